@@ -0,0 +1,780 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	com "github.com/dbhubio/common"
+	"github.com/jackc/pgx"
+)
+
+// Displays the admin dashboard, with overall statistics
+func adminDashboardPage(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin dashboard"
+
+	var pageData struct {
+		Meta             metaInfo
+		Users            int
+		Databases        int
+		Versions         int
+		Storage          int64
+		CorruptDownloads uint64
+		Verify           objectVerification
+		Backfill         metaBackfillStatus
+	}
+	pageData.Meta.Title = "Admin"
+	pageData.Meta.LoggedInUser = adminUser
+	pageData.CorruptDownloads = atomic.LoadUint64(&corruptObjects)
+	pageData.Verify = getVerifyStatus()
+
+	err := db.QueryRow(`
+		SELECT (SELECT count(*) FROM users),
+			(SELECT count(*) FROM sqlite_databases),
+			(SELECT count(*) FROM database_versions),
+			(SELECT coalesce(sum(size), 0) FROM database_versions)`).Scan(&pageData.Users,
+		&pageData.Databases, &pageData.Versions, &pageData.Storage)
+	if err != nil {
+		log.Printf("%s: Error retrieving statistics: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.Backfill, err = getMetaBackfillStatus()
+	if err != nil {
+		log.Printf("%s: Error retrieving metadata backfill status: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Render the page
+	renderTemplate(w, "adminPage", pageData)
+}
+
+// Displays a searchable list of databases, with the actions for handling abuse
+func adminDatabasesPage(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin databases page"
+
+	type dbRow struct {
+		Owner        string
+		Database     string
+		Version      int
+		Size         int
+		Public       bool
+		LastModified time.Time
+	}
+	var pageData struct {
+		Meta      metaInfo
+		Search    string
+		Databases []dbRow
+	}
+	pageData.Meta.Title = "Admin - Databases"
+	pageData.Meta.LoggedInUser = adminUser
+	pageData.Search = r.FormValue("q")
+
+	rows, err := db.Query(`
+		SELECT DISTINCT ON (db.idnum) db.username, db.dbname, ver.version, ver.size, ver.public, db.last_modified
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.idnum = ver.db
+			AND (db.username ILIKE '%' || $1 || '%' OR db.dbname ILIKE '%' || $1 || '%')
+		ORDER BY db.idnum DESC, ver.version DESC
+		LIMIT 100`, pageData.Search)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow dbRow
+		err = rows.Scan(&oneRow.Owner, &oneRow.Database, &oneRow.Version, &oneRow.Size, &oneRow.Public,
+			&oneRow.LastModified)
+		if err != nil {
+			log.Printf("%s: Error retrieving database list: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		pageData.Databases = append(pageData.Databases, oneRow)
+	}
+
+	// Render the page
+	renderTemplate(w, "adminDatabasesPage", pageData)
+}
+
+// Queues a background job recording the details of the database versions uploaded before they were recorded at
+// upload time.  The number of versions read at once and the pause between them can be given, to keep the load down
+// while the site is busy
+func adminBackfillMeta(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin metadata backfill"
+
+	var p metaBackfillJob
+	var err error
+	p.Concurrency, err = strconv.Atoi(r.PostFormValue("concurrency"))
+	if err != nil || p.Concurrency < 1 || p.Concurrency > backfillMaxConcurrency {
+		errorPage(w, r, http.StatusBadRequest,
+			fmt.Sprintf("The number of versions read at once needs to be between 1 and %d", backfillMaxConcurrency))
+		return
+	}
+	p.Delay, err = strconv.Atoi(r.PostFormValue("delay"))
+	if err != nil || p.Delay < 0 || p.Delay > 60000 {
+		errorPage(w, r, http.StatusBadRequest, "The pause between versions needs to be between 0 and 60000 ms")
+		return
+	}
+
+	// Only one backfill runs at a time
+	var pending int
+	err = db.QueryRow(`
+		SELECT count(*)
+		FROM jobs
+		WHERE job_type = $1
+			AND status IN ('queued', 'running')`, jobMetaBackfill).Scan(&pending)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if pending > 0 {
+		errorPage(w, r, http.StatusConflict, "A metadata backfill is already running")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	err = auditLog(tx, r, adminUser, "backfill metadata", auditTargetSite, "",
+		map[string]interface{}{"concurrency": p.Concurrency, "delay": p.Delay})
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing audit entry: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	_, err = enqueueJob(jobMetaBackfill, adminUser, p)
+	if err != nil {
+		log.Printf("%s: Error queueing job: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "The job couldn't be started")
+		return
+	}
+	log.Printf("%s: Admin '%s' started a metadata backfill\n", pageName, adminUser)
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// Deletes a database, including all of its versions and stored objects
+func adminDeleteDatabase(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin delete database"
+
+	owner := r.PostFormValue("owner")
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateUserDB(owner, dbName)
+	if err != nil {
+		log.Printf("%s: Validation failed for user or database name: %s", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid user or database name")
+		return
+	}
+
+	// Retrieve the Minio details for each version, so the objects can be removed once the database rows are gone
+	var bucket string
+	var minioIds []string
+	rows, err := db.Query(`
+		SELECT db.minio_bucket, ver.minioid
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.idnum = ver.db
+			AND db.username = $1
+			AND db.dbname = $2`, owner, dbName)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	for rows.Next() {
+		var minioId string
+		err = rows.Scan(&bucket, &minioId)
+		if err != nil {
+			rows.Close()
+			log.Printf("%s: Error retrieving version list: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		minioIds = append(minioIds, minioId)
+	}
+	rows.Close()
+
+	// Remove the database from PostgreSQL
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	deleteQueries := []string{
+		`DELETE FROM database_stars
+			WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)`,
+		`DELETE FROM database_versions
+			WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)`,
+		`DELETE FROM user_db_state
+			WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)`,
+		`DELETE FROM discussion_comments
+			WHERE discussion IN (SELECT id FROM discussions
+				WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2))`,
+		`DELETE FROM discussions
+			WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)`,
+
+		// Merge requests from the database are removed too, so the open ones come off the counts of where
+		// they were proposed to
+		`UPDATE sqlite_databases AS up
+			SET pull_requests = up.pull_requests - mr.open
+			FROM (SELECT db, count(*) AS open FROM merge_requests
+				WHERE state = 'open'
+					AND source_db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)
+				GROUP BY db) AS mr
+			WHERE up.idnum = mr.db`,
+		`DELETE FROM merge_requests
+			WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)
+				OR source_db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)`,
+		`DELETE FROM table_filters
+			WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)`,
+		`DELETE FROM database_stats
+			WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)`,
+		`DELETE FROM abuse_reports
+			WHERE db = (SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2)`,
+		`DELETE FROM sqlite_databases WHERE username = $1 AND dbname = $2`,
+	}
+	for _, dbQuery := range deleteQueries {
+		_, err = tx.Exec(dbQuery, owner, dbName)
+		if err != nil {
+			log.Printf("%s: Deleting database '%s/%s' failed: %v\n", pageName, owner, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
+	err = auditLog(tx, r, adminUser, "delete database", auditTargetDatabase, owner+"/"+dbName, nil)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing deletion of '%s/%s': %v\n", pageName, owner, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Remove the stored objects
+	for _, id := range minioIds {
+		err = minioClient.RemoveObject(bucket, id)
+		if err != nil {
+			log.Printf("%s: Error removing Minio object '%s/%s': %v\n", pageName, bucket, id, err)
+		}
+	}
+	log.Printf("%s: Admin '%s' deleted database '%s/%s'\n", pageName, adminUser, owner, dbName)
+
+	http.Redirect(w, r, "/admin/databases", http.StatusSeeOther)
+}
+
+// Dismisses a single abuse report, leaving any other reports for the same database in the queue
+func adminDismissReport(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin dismiss report"
+
+	reportId, err := strconv.Atoi(r.PostFormValue("reportid"))
+	if err != nil {
+		log.Printf("%s: Invalid report id: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid report id")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	commandTag, err := tx.Exec(`
+		UPDATE abuse_reports
+		SET status = 'dismissed'
+		WHERE report_id = $1
+			AND status = 'open'`, reportId)
+	if err != nil {
+		log.Printf("%s: Dismissing report %d failed: %v\n", pageName, reportId, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("%s: Wrong number of rows affected: %v, report: %v\n", pageName, numRows, reportId)
+		errorPage(w, r, http.StatusNotFound, "Unknown report")
+		return
+	}
+	err = auditLog(tx, r, adminUser, "dismiss report", auditTargetReport, strconv.Itoa(reportId), nil)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing dismissal of report %d: %v\n", pageName, reportId, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
+
+// Makes every version of a database private
+func adminForcePrivate(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin force private"
+
+	owner := r.PostFormValue("owner")
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateUserDB(owner, dbName)
+	if err != nil {
+		log.Printf("%s: Validation failed for user or database name: %s", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid user or database name")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	err = forceDatabasePrivate(tx, owner, dbName)
+	if err != nil {
+		log.Printf("%s: Making database '%s/%s' private failed: %v\n", pageName, owner, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = auditLog(tx, r, adminUser, "force private", auditTargetDatabase, owner+"/"+dbName, nil)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing change for '%s/%s': %v\n", pageName, owner, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	log.Printf("%s: Admin '%s' made database '%s/%s' private\n", pageName, adminUser, owner, dbName)
+
+	http.Redirect(w, r, "/admin/databases", http.StatusSeeOther)
+}
+
+// Entry point for the admin section.  Anyone other than an admin receives a 404, so the section isn't advertised
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure the user is logged in and is an admin
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" || !isAdmin(loggedInUser) {
+		auditLog(nil, r, loggedInUser, "admin access denied", auditTargetSite, r.URL.Path, nil)
+		errorPage(w, r, http.StatusNotFound, "Page not found")
+		return
+	}
+
+	// Actions which change things need to be POSTed
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if strings.HasPrefix(path, "/admin/x/") && r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Admin actions need to be submitted from the admin pages")
+		return
+	}
+
+	switch path {
+	case "/admin":
+		adminDashboardPage(w, r, loggedInUser)
+	case "/admin/audit":
+		adminAuditPage(w, r, loggedInUser)
+	case "/admin/databases":
+		adminDatabasesPage(w, r, loggedInUser)
+	case "/admin/reports":
+		adminReportsPage(w, r, loggedInUser)
+	case "/admin/requests":
+		adminRequestsPage(w, r, loggedInUser)
+	case "/admin/users":
+		adminUsersPage(w, r, loggedInUser)
+	case "/admin/x/backfillmeta":
+		adminBackfillMeta(w, r, loggedInUser)
+	case "/admin/x/deletedb":
+		adminDeleteDatabase(w, r, loggedInUser)
+	case "/admin/x/dismissreport":
+		adminDismissReport(w, r, loggedInUser)
+	case "/admin/x/flushcache":
+		adminFlushCache(w, r, loggedInUser)
+	case "/admin/x/forceprivate":
+		adminForcePrivate(w, r, loggedInUser)
+	case "/admin/x/reconcilestars":
+		adminReconcileStars(w, r, loggedInUser)
+	case "/admin/x/resolvereports":
+		adminResolveReports(w, r, loggedInUser)
+	case "/admin/x/userstatus":
+		adminUserStatus(w, r, loggedInUser)
+	case "/admin/x/verifyobjects":
+		adminVerifyObjects(w, r, loggedInUser)
+	default:
+		errorPage(w, r, http.StatusNotFound, "Page not found")
+	}
+}
+
+// Empties the cache, for emergencies such as bad data having been cached
+func adminFlushCache(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin flush cache"
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	err = auditLog(tx, r, adminUser, "flush cache", auditTargetSite, "", nil)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing audit entry: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	err = flushCache()
+	if err != nil {
+		log.Printf("%s: Error flushing the cache: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "The cache couldn't be flushed")
+		return
+	}
+	log.Printf("%s: Admin '%s' flushed the cache\n", pageName, adminUser)
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// Recounts the stars of every database, fixing any stored counts which have drifted from the star rows
+func adminReconcileStars(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin reconcile stars"
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	err = auditLog(tx, r, adminUser, "reconcile stars", auditTargetSite, "", nil)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing audit entry: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	fixed, err := reconcileStarCounts()
+	if err != nil {
+		log.Printf("%s: Error recounting stars: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	log.Printf("%s: Admin '%s' recounted the stars, fixing %d databases\n", pageName, adminUser, fixed)
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// Displays the moderation queue of open abuse reports.  Reports for the same database are grouped into one entry
+func adminReportsPage(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin reports page"
+
+	type report struct {
+		ID          int
+		Reason      string
+		Details     string
+		Reporter    string
+		ReporterIP  string
+		DateCreated time.Time
+	}
+	type queueEntry struct {
+		Owner    string
+		Database string
+		Count    int
+		Reports  []report
+	}
+	var pageData struct {
+		Meta    metaInfo
+		Entries []queueEntry
+	}
+	pageData.Meta.Title = "Admin - Reports"
+	pageData.Meta.LoggedInUser = adminUser
+
+	rows, err := db.Query(`
+		SELECT db.idnum, db.username, db.dbname, rep.report_id, rep.reason, rep.details, rep.reporter,
+			rep.reporter_ip, rep.date_created
+		FROM abuse_reports AS rep, sqlite_databases AS db
+		WHERE rep.db = db.idnum
+			AND rep.status = 'open'
+		ORDER BY db.idnum, rep.date_created`)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer rows.Close()
+	lastDB := -1
+	for rows.Next() {
+		var dbId int
+		var owner, dbName string
+		var oneRow report
+		var details, reporter pgx.NullString
+		err = rows.Scan(&dbId, &owner, &dbName, &oneRow.ID, &oneRow.Reason, &details, &reporter,
+			&oneRow.ReporterIP, &oneRow.DateCreated)
+		if err != nil {
+			log.Printf("%s: Error retrieving report list: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		oneRow.Details = details.String
+		oneRow.Reporter = reporter.String
+
+		// Start a new queue entry whenever the database changes
+		if dbId != lastDB {
+			pageData.Entries = append(pageData.Entries, queueEntry{Owner: owner, Database: dbName})
+			lastDB = dbId
+		}
+		entry := &pageData.Entries[len(pageData.Entries)-1]
+		entry.Reports = append(entry.Reports, oneRow)
+		entry.Count++
+	}
+
+	// Render the page
+	renderTemplate(w, "adminReportsPage", pageData)
+}
+
+// Closes all open abuse reports for a database.  When requested, the database is made private at the same time
+func adminResolveReports(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin resolve reports"
+
+	owner := r.PostFormValue("owner")
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateUserDB(owner, dbName)
+	if err != nil {
+		log.Printf("%s: Validation failed for user or database name: %s", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid user or database name")
+		return
+	}
+	hide := r.PostFormValue("hide") == "true"
+	action := "resolve reports"
+	if hide {
+		action = "hide reported database"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	if hide {
+		err = forceDatabasePrivate(tx, owner, dbName)
+		if err != nil {
+			log.Printf("%s: Making database '%s/%s' private failed: %v\n", pageName, owner, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
+	_, err = tx.Exec(`
+		UPDATE abuse_reports
+		SET status = 'resolved'
+		WHERE status = 'open'
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND dbname = $2)`, owner, dbName)
+	if err != nil {
+		log.Printf("%s: Resolving reports for '%s/%s' failed: %v\n", pageName, owner, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = auditLog(tx, r, adminUser, action, auditTargetDatabase, owner+"/"+dbName, nil)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing report resolution for '%s/%s': %v\n", pageName, owner, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	log.Printf("%s: Admin '%s' performed '%s' on '%s/%s'\n", pageName, adminUser, action, owner, dbName)
+
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
+
+// Disables or enables a user account
+func adminUserStatus(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin user status"
+
+	userName := r.PostFormValue("username")
+	err := com.ValidateUser(userName)
+	if err != nil {
+		log.Printf("%s: Validation failed for username: %s", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid username")
+		return
+	}
+	disable := r.PostFormValue("disable") == "true"
+	action := "enable user"
+	if disable {
+		action = "disable user"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	commandTag, err := tx.Exec(`
+		UPDATE users
+		SET disabled = $2
+		WHERE username = $1`, userName, disable)
+	if err != nil {
+		log.Printf("%s: Updating status of user '%s' failed: %v\n", pageName, userName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("%s: Wrong number of rows affected: %v, username: %v\n", pageName, numRows, userName)
+		errorPage(w, r, http.StatusNotFound, "Unknown user")
+		return
+	}
+	err = auditLog(tx, r, adminUser, action, auditTargetUser, userName, nil)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing status change for user '%s': %v\n", pageName, userName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	log.Printf("%s: Admin '%s' performed '%s' on '%s'\n", pageName, adminUser, action, userName)
+
+	// The user's sessions are checked against the cached status, so a disabled user is logged out on their next
+	// request
+	cacheUserDisabled(userName, disable)
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// Displays a searchable list of users
+func adminUsersPage(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin users page"
+
+	type userRow struct {
+		Username  string
+		Email     string
+		Databases int
+		Disabled  bool
+		Admin     bool
+	}
+	var pageData struct {
+		Meta   metaInfo
+		Search string
+		Users  []userRow
+	}
+	pageData.Meta.Title = "Admin - Users"
+	pageData.Meta.LoggedInUser = adminUser
+	pageData.Search = r.FormValue("q")
+
+	rows, err := db.Query(`
+		SELECT u.username, u.email, u.disabled, u.is_admin,
+			(SELECT count(*) FROM sqlite_databases AS db WHERE db.username = u.username)
+		FROM users AS u
+		WHERE u.username ILIKE '%' || $1 || '%'
+			OR u.email ILIKE '%' || $1 || '%'
+		ORDER BY u.username
+		LIMIT 100`, pageData.Search)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow userRow
+		err = rows.Scan(&oneRow.Username, &oneRow.Email, &oneRow.Disabled, &oneRow.Admin, &oneRow.Databases)
+		if err != nil {
+			log.Printf("%s: Error retrieving user list: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		pageData.Users = append(pageData.Users, oneRow)
+	}
+
+	// Render the page
+	renderTemplate(w, "adminUsersPage", pageData)
+}
+
+// Starts a background job verifying the checksum of every stored database object
+func adminVerifyObjects(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin verify objects"
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	err = auditLog(tx, r, adminUser, "verify objects", auditTargetSite, "", nil)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing audit entry: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	if !startObjectVerification() {
+		errorPage(w, r, http.StatusConflict, "A verification job is already running")
+		return
+	}
+	log.Printf("%s: Admin '%s' started verification of all objects\n", pageName, adminUser)
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// Makes every version of a database private, as part of a larger admin transaction
+func forceDatabasePrivate(tx *pgx.Tx, owner string, dbName string) error {
+	_, err := tx.Exec(`
+		UPDATE database_versions
+		SET public = false
+		WHERE db = (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+				AND dbname = $2)`, owner, dbName)
+	return err
+}
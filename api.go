@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	com "github.com/dbhubio/common"
+)
+
+// The URL prefix of the versioned JSON API
+const apiPrefix = "/api/v1/"
+
+// A handler for an API route.  The named path parameters of the route are passed in, already validated
+type apiHandlerFunc func(w http.ResponseWriter, r *http.Request, params map[string]string)
+
+// An API route.  The pattern is relative to apiPrefix, with path parameters given in braces, eg "table/{owner}/{db}"
+type apiRoute struct {
+	Method  string
+	Pattern string
+	Auth    bool // Whether the route needs a logged in user.  Only sessions count, as no API tokens are issued
+	Handler apiHandlerFunc
+}
+
+// The routes of the JSON API
+var apiRoutes = []apiRoute{
+	{Method: "GET", Pattern: "capabilities", Handler: apiCapabilitiesHandler},
+	{Method: "GET", Pattern: "clone/{owner}/{db}", Handler: apiCloneHandler},
+	{Method: "PUT", Pattern: "clone/{owner}/{db}", Auth: true, Handler: apiClonePushHandler},
+	{Method: "GET", Pattern: "clone/{owner}/{db}/file", Handler: apiCloneFileHandler},
+	{Method: "GET", Pattern: "meta/{owner}/{db}", Handler: apiMetaHandler},
+	{Method: "PUT", Pattern: "star/{owner}/{db}", Auth: true, Handler: apiStarHandler},
+	{Method: "DELETE", Pattern: "star/{owner}/{db}", Auth: true, Handler: apiStarHandler},
+	{Method: "GET", Pattern: "table/{owner}/{db}", Handler: apiTableHandler},
+	{Method: "GET", Pattern: "visdata/{owner}/{db}", Handler: apiVisDataHandler},
+}
+
+// Dispatches requests under apiPrefix to the matching API route.  Everything returned from here is JSON, including
+// the errors
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	// The API can be used from other sites, though only with their own credentials
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(apiMethods(r.URL.Path), ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Look for the route matching the request
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	var route *apiRoute
+	var params map[string]string
+	methodMismatch := false
+	for i := range apiRoutes {
+		p, ok := matchAPIRoute(apiRoutes[i].Pattern, path)
+		if !ok {
+			continue
+		}
+		if apiRoutes[i].Method != r.Method && !(apiRoutes[i].Method == "GET" && r.Method == "HEAD") {
+			methodMismatch = true
+			continue
+		}
+		route, params = &apiRoutes[i], p
+		break
+	}
+	if route == nil {
+		if methodMismatch {
+			w.Header().Set("Allow", strings.Join(apiMethods(r.URL.Path), ", "))
+			jsonError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		jsonError(w, http.StatusNotFound, "Unknown API endpoint")
+		return
+	}
+
+	// Validate the owner and database names, when the route has them
+	if params["owner"] != "" || params["db"] != "" {
+		err := com.ValidateUserDB(params["owner"], params["db"])
+		if err != nil {
+			log.Printf("Validation failed for user or database name: %s", err)
+			jsonError(w, http.StatusBadRequest, "Invalid user or database name")
+			return
+		}
+		params["owner"], err = canonicalUsername(params["owner"])
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+	if route.Auth && loggedInUser == "" {
+		jsonError(w, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Limit how quickly each client can make requests
+	if !allowRequest(w, r, limitAPI) {
+		return
+	}
+
+	route.Handler(w, r, params)
+}
+
+// Returns the methods the routes matching a request path allow, for the Allow headers
+func apiMethods(urlPath string) []string {
+	path := strings.TrimPrefix(urlPath, apiPrefix)
+	methods := []string{"OPTIONS"}
+	for _, j := range apiRoutes {
+		if _, ok := matchAPIRoute(j.Pattern, path); ok {
+			methods = append(methods, j.Method)
+		}
+	}
+	return methods
+}
+
+// Matches a request path against a route pattern, returning the path parameters when they match.  A trailing slash
+// on the request path is ignored
+func matchAPIRoute(pattern string, path string) (map[string]string, bool) {
+	patternParts := strings.Split(pattern, "/")
+	pathParts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, j := range patternParts {
+		if strings.HasPrefix(j, "{") && strings.HasSuffix(j, "}") {
+			if pathParts[i] == "" {
+				return nil, false
+			}
+			params[strings.Trim(j, "{}")] = pathParts[i]
+			continue
+		}
+		if j != pathParts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Returns a window of rows from a database table
+func apiTableHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	requestedTable, err := getTable(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tableData(w, r, params["owner"], params["db"], requestedTable)
+}
+
+// Returns the data for a visualisation
+func apiVisDataHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	requestedTable, err := getTable(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visDataResponse(w, r, params["owner"], params["db"], requestedTable)
+}
+
+// Stars a database for the logged in user with PUT, or unstars it with DELETE.  Unlike the toggle used by the
+// database pages, asking for the state the star is already in changes nothing, so clients can safely retry.  The
+// star count and whether the database is now starred are returned either way
+func apiStarHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	pageName := "Star API"
+	owner, dbName := params["owner"], params["db"]
+	change := starAdd
+	if r.Method == "DELETE" {
+		change = starRemove
+	}
+	changeDBStar(w, pageName, currentUser(r), owner, dbName, change)
+}
+
+// Reports whether a request was made through the JSON API, so errors can be returned as JSON instead of a page
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix)
+}
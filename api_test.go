@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Sends a request to the API as the given user, or anonymously when userName is empty
+func apiRequest(method string, path string, body io.Reader, userName string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	logReq(apiHandler)(w, testRequest(method, apiPrefix+path, body, userName))
+	return w
+}
+
+// Returns the message of a JSON error response, failing the test if the response isn't one
+func apiErrorMessage(t *testing.T, w *httptest.ResponseRecorder) string {
+	if ct := w.Header().Get("Content-Type"); ct != contentTypeJSON {
+		t.Errorf("Expected a JSON error, got Content-Type '%s'", ct)
+		return ""
+	}
+	var resp struct{ Error string }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error == "" {
+		t.Errorf("Expected a JSON error, got '%s'", w.Body.String())
+	}
+	return resp.Error
+}
+
+func TestMatchAPIRoute(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		params  map[string]string
+		ok      bool
+	}{
+		{"capabilities", "capabilities", map[string]string{}, true},
+		{"capabilities", "capabilities/", map[string]string{}, true},
+		{"table/{owner}/{db}", "table/someone/a.sqlite", map[string]string{"owner": "someone", "db": "a.sqlite"}, true},
+		{"table/{owner}/{db}", "table/someone/a.sqlite/", map[string]string{"owner": "someone", "db": "a.sqlite"},
+			true},
+		{"table/{owner}/{db}", "table/someone", nil, false},
+		{"table/{owner}/{db}", "table//a.sqlite", nil, false},
+		{"table/{owner}/{db}", "visdata/someone/a.sqlite", nil, false},
+		{"clone/{owner}/{db}", "clone/someone/a.sqlite/file", nil, false},
+		{"clone/{owner}/{db}/file", "clone/someone/a.sqlite/file", map[string]string{"owner": "someone",
+			"db": "a.sqlite"}, true},
+	}
+	for _, tt := range tests {
+		params, ok := matchAPIRoute(tt.pattern, tt.path)
+		if ok != tt.ok || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%s against %s: expected %v %v, got %v %v", tt.path, tt.pattern, tt.params, tt.ok, params, ok)
+		}
+	}
+}
+
+func TestAPIRouting(t *testing.T) {
+	// Unknown endpoints and methods get JSON errors
+	w := apiRequest(http.MethodGet, "nothing/here", nil, "")
+	if w.Code != http.StatusNotFound || apiErrorMessage(t, w) != "Unknown API endpoint" {
+		t.Errorf("Unexpected response for an unknown endpoint: %d %s", w.Code, w.Body.String())
+	}
+	w = apiRequest(http.MethodPost, "table/someone/a.sqlite", nil, "")
+	if w.Code != http.StatusMethodNotAllowed || apiErrorMessage(t, w) != "Method not allowed" {
+		t.Errorf("Unexpected response for the wrong method: %d %s", w.Code, w.Body.String())
+	}
+	if allow := w.Header().Get("Allow"); allow != "OPTIONS, GET" {
+		t.Errorf("Unexpected Allow header: %s", allow)
+	}
+
+	// Preflight requests are answered with the methods of every route matching the path
+	w = apiRequest(http.MethodOptions, "star/someone/a.sqlite", nil, "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d for a preflight request, got %d", http.StatusNoContent, w.Code)
+	}
+	if methods := w.Header().Get("Access-Control-Allow-Methods"); methods != "OPTIONS, PUT, DELETE" {
+		t.Errorf("Unexpected Access-Control-Allow-Methods header: %s", methods)
+	}
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin header: %s", origin)
+	}
+
+	// Names are checked before any handler sees them
+	w = apiRequest(http.MethodGet, "table/some%3Cone%3E/a.sqlite", nil, "")
+	if w.Code != http.StatusBadRequest || apiErrorMessage(t, w) != "Invalid user or database name" {
+		t.Errorf("Unexpected response for an invalid name: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAPICapabilities(t *testing.T) {
+	w := apiRequest(http.MethodGet, "capabilities", nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentTypeJSON {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	var caps cloneCapabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil {
+		t.Fatal(err)
+	}
+	if caps.APIVersion != cloneAPIVersion || !reflect.DeepEqual(caps.Features, cloneFeatures) {
+		t.Errorf("Unexpected capabilities: %+v", caps)
+	}
+}
+
+func TestAPIRoutes(t *testing.T) {
+	requireBackends(t)
+	rateLimits := conf.RateLimit.Disabled
+	conf.RateLimit.Disabled = true
+	defer func() {
+		conf.RateLimit.Disabled = rateLimits
+	}()
+
+	owner := testUserName("apiowner")
+	viewer := testUserName("apiviewer")
+	addTestUser(t, owner)
+	addTestUser(t, viewer)
+	stmts := []string{"CREATE TABLE t (a INTEGER, b TEXT)", "INSERT INTO t VALUES (1, 'x')", "CREATE TABLE e (a INTEGER)"}
+	addTestDatabase(t, owner, "pub.sqlite", true, stmts...)
+	addTestDatabase(t, owner, "priv.sqlite", false, stmts...)
+	pub, priv := owner+"/pub.sqlite", owner+"/priv.sqlite"
+	pushed := readTestSQLite(t, "pushed.sqlite", stmts...)
+
+	// Each route is tried with a request which works, and with ones it refuses.  Refusals are JSON errors, with
+	// private databases looking the same as missing ones to other people
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   []byte
+		user   string
+		status int
+	}{
+		{"clone", "GET", "clone/" + pub, nil, "", http.StatusOK},
+		{"clone private", "GET", "clone/" + priv, nil, "", http.StatusNotFound},
+		{"clone own private", "GET", "clone/" + priv, nil, owner, http.StatusOK},
+		{"clone missing version", "GET", "clone/" + pub + "?version=99", nil, "", http.StatusNotFound},
+		{"clone branch", "GET", "clone/" + pub + "?branch=main", nil, "", http.StatusBadRequest},
+		{"clone file", "GET", "clone/" + pub + "/file", nil, "", http.StatusOK},
+		{"clone file private", "GET", "clone/" + priv + "/file", nil, viewer, http.StatusNotFound},
+		{"push anonymous", "PUT", "clone/" + owner + "/new.sqlite?base=0", pushed, "", http.StatusUnauthorized},
+		{"push someone else's", "PUT", "clone/" + owner + "/new.sqlite?base=0", pushed, viewer,
+			http.StatusForbidden},
+		{"push stale", "PUT", "clone/" + pub + "?base=0", pushed, owner, http.StatusConflict},
+		{"push not SQLite", "PUT", "clone/" + owner + "/new.sqlite?base=0", []byte("a,b\n1,2\n"), owner,
+			http.StatusBadRequest},
+		{"push", "PUT", "clone/" + owner + "/new.sqlite?base=0", pushed, owner, http.StatusCreated},
+		{"meta", "GET", "meta/" + pub, nil, "", http.StatusOK},
+		{"meta private", "GET", "meta/" + priv, nil, viewer, http.StatusNotFound},
+		{"meta own private", "GET", "meta/" + priv, nil, owner, http.StatusOK},
+		{"star anonymous", "PUT", "star/" + pub, nil, "", http.StatusUnauthorized},
+		{"star", "PUT", "star/" + pub, nil, viewer, http.StatusOK},
+		{"star private", "PUT", "star/" + priv, nil, viewer, http.StatusNotFound},
+		{"unstar anonymous", "DELETE", "star/" + pub, nil, "", http.StatusUnauthorized},
+		{"unstar", "DELETE", "star/" + pub, nil, viewer, http.StatusOK},
+		{"table", "GET", "table/" + pub + "?table=t", nil, "", http.StatusOK},
+		{"table private", "GET", "table/" + priv + "?table=t", nil, viewer, http.StatusNotFound},
+		{"table missing", "GET", "table/" + owner + "/missing.sqlite?table=t", nil, "", http.StatusNotFound},
+		{"table bad rows", "GET", "table/" + pub + "?table=t&rows=many", nil, "", http.StatusBadRequest},
+		{"table missing table", "GET", "table/" + pub + "?table=nothere", nil, "", http.StatusNotFound},
+		{"visdata", "GET", "visdata/" + pub + "?table=t&xcol=a&ycol=a", nil, "", http.StatusOK},
+		{"visdata private", "GET", "visdata/" + priv + "?table=t&xcol=a&ycol=a", nil, "", http.StatusNotFound},
+		{"visdata bad sampling", "GET", "visdata/" + pub + "?table=t&sampling=some", nil, "",
+			http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var body io.Reader
+		if tt.body != nil {
+			body = bytes.NewReader(tt.body)
+		}
+		w := apiRequest(tt.method, tt.path, body, tt.user)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.status, w.Code, w.Body.String())
+			continue
+		}
+		if w.Code >= http.StatusBadRequest {
+			apiErrorMessage(t, w)
+		}
+	}
+
+	// An empty table gives an empty JSON object rather than nothing at all
+	w := apiRequest("GET", "table/"+pub+"?table=e", nil, "")
+	var empty map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &empty); w.Code != http.StatusOK || err != nil || len(empty) != 0 {
+		t.Errorf("Unexpected response for an empty table, status %d: %s", w.Code, w.Body.String())
+	}
+
+	// PUT and DELETE leave the star the way they ask for, however many times they're sent
+	for _, method := range []string{"PUT", "PUT", "DELETE", "DELETE"} {
+		w := apiRequest(method, "star/"+pub, nil, viewer)
+		var resp struct {
+			Stars   int
+			Starred bool
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Unexpected star response: %s", w.Body.String())
+		}
+		want := method == "PUT"
+		wantStars := 0
+		if want {
+			wantStars = 1
+		}
+		if resp.Starred != want || resp.Stars != wantStars {
+			t.Errorf("%s: unexpected star state %+v", method, resp)
+		}
+	}
+}
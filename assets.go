@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The static files the server sends out, relative to the directory it runs from
+var staticAssets = []string{"favicon.ico", "images/auth0.svg", "images/rackspace.svg", "images/sqlitebrowser.svg"}
+
+// The URL prefix for static files addressed by the hash of their contents.  As the URL changes whenever the file
+// does, these can be cached by browsers forever
+const assetPrefix = "/static/"
+
+// Cache times for static files, in seconds.  Files asked for by their plain path, such as the favicon, can change
+// without their URL changing, so are only cached briefly
+const (
+	assetCacheHashed = 365 * 24 * 60 * 60
+	assetCachePlain  = 60 * 60
+)
+
+// The hash of each static file's contents, keyed by its path
+var assetHashes = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// Works out the hashes of the static files.  In development mode this is done again whenever the templates are
+// reloaded, so changed files get new URLs
+func loadAssetHashes() error {
+	m := make(map[string]string)
+	for _, name := range staticAssets {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("Error reading static file '%s': %v", name, err)
+		}
+		sum := sha256.Sum256(data)
+		m[name] = hex.EncodeToString(sum[:6])
+	}
+	assetHashes.Lock()
+	assetHashes.m = m
+	assetHashes.Unlock()
+	return nil
+}
+
+// Returns the URL for a static file which includes the hash of its contents, eg
+// /static/3fa4c21b09de/images/auth0.svg.  Files which aren't known are given their plain path
+func assetURL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	assetHashes.RLock()
+	hash, ok := assetHashes.m[name]
+	assetHashes.RUnlock()
+	if !ok {
+		log.Printf("Unknown static file '%s' used in a template\n", name)
+		return "/" + name
+	}
+	return assetPrefix + hash + "/" + name
+}
+
+// Serves a static file, either by its plain path or by the URL from assetURL().  A URL with an out of date hash,
+// such as from a page cached before a deploy, still gets the current file but only cached briefly
+func assetHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	hashed := false
+	var hash string
+	if strings.HasPrefix(r.URL.Path, assetPrefix) {
+		s := strings.SplitN(strings.TrimPrefix(r.URL.Path, assetPrefix), "/", 2)
+		if len(s) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		hash, name = s[0], s[1]
+		hashed = true
+	}
+
+	// Only the files in the list are served, so nothing else from the server's directory can be asked for
+	assetHashes.RLock()
+	current, ok := assetHashes.m[name]
+	assetHashes.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if hashed && hash == current {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", assetCacheHashed))
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", assetCachePlain))
+	}
+	http.ServeFile(w, r, name)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// The kinds of things an audit event can be about
+const (
+	auditTargetDatabase = "database"
+	auditTargetReport   = "report"
+	auditTargetSite     = "site"
+	auditTargetUser     = "user"
+)
+
+// The number of audit events shown at a time on the admin audit page
+const auditPageSize = 100
+
+// The most audit events written to a single CSV export
+const auditExportMaxRows = 100000
+
+// An entry in the audit log
+type auditEvent struct {
+	ID         int64
+	Timestamp  time.Time
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Metadata   string // JSON
+	IP         string
+}
+
+// The filters for browsing the audit log.  Empty ones match everything
+type auditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Before int64 // Only events with a lower ID, for paging back through older events
+}
+
+// Records a destructive or security relevant action in the audit log.  Actions done in a transaction pass it in, so
+// the entry is only kept if the action itself succeeds.  Everything else, such as failed attempts, passes a nil tx.
+// The metadata is stored as JSON, so needs to leave out secrets such as passwords
+func auditLog(tx *pgx.Tx, r *http.Request, actor string, action string, targetType string, targetID string,
+	metadata map[string]interface{}) error {
+	meta := "{}"
+	if len(metadata) > 0 {
+		b, err := json.Marshal(metadata)
+		if err != nil {
+			log.Printf("Error encoding audit metadata. Action: '%s', Target: '%s', Error: %v\n", action, targetID,
+				err)
+			return err
+		}
+		meta = string(b)
+	}
+	dbQuery := `
+		INSERT INTO audit_events (actor, action, target_type, target_id, metadata, ip)
+		VALUES ($1, $2, $3, $4, $5::jsonb, $6)`
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(dbQuery, actor, action, targetType, targetID, meta, clientIP(r))
+	} else {
+		_, err = db.Exec(dbQuery, actor, action, targetType, targetID, meta, clientIP(r))
+	}
+	if err != nil {
+		log.Printf("Error writing audit entry. Actor: '%s', Action: '%s', Target: '%s %s', Error: %v\n", actor,
+			action, targetType, targetID, err)
+	}
+	return err
+}
+
+// Returns the audit events matching a filter, newest first
+func getAuditEvents(filter auditFilter, limit int) ([]auditEvent, error) {
+	rows, err := db.Query(`
+		SELECT id, event_time, actor, action, target_type, target_id, metadata::text, ip
+		FROM audit_events
+		WHERE ($1 = '' OR actor = $1)
+			AND ($2 = '' OR action = $2)
+			AND ($3 = '' OR target_id ILIKE '%' || $3 || '%')
+			AND ($4 = 0 OR id < $4)
+		ORDER BY id DESC
+		LIMIT $5`, filter.Actor, filter.Action, filter.Target, filter.Before, limit)
+	if err != nil {
+		log.Printf("Error retrieving audit events: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var events []auditEvent
+	for rows.Next() {
+		var ev auditEvent
+		err = rows.Scan(&ev.ID, &ev.Timestamp, &ev.Actor, &ev.Action, &ev.TargetType, &ev.TargetID, &ev.Metadata,
+			&ev.IP)
+		if err != nil {
+			log.Printf("Error retrieving audit events: %v\n", err)
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// Displays the audit log, filtered by actor, action or target.  With format=csv, the matching events are downloaded
+// instead
+func adminAuditPage(w http.ResponseWriter, r *http.Request, adminUser string) {
+	pageName := "Admin audit page"
+
+	var pageData struct {
+		Meta    metaInfo
+		Filter  auditFilter
+		Events  []auditEvent
+		Actions []string
+		Older   int64 // The ID to page back from for older events, or 0 when there aren't any
+	}
+	pageData.Meta.Title = "Admin - Audit log"
+	pageData.Meta.LoggedInUser = adminUser
+	pageData.Filter = auditFilter{Actor: r.FormValue("actor"), Action: r.FormValue("action"),
+		Target: r.FormValue("target")}
+	if v := r.FormValue("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before < 0 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid audit event ID")
+			return
+		}
+		pageData.Filter.Before = before
+	}
+
+	if r.FormValue("format") == "csv" {
+		adminAuditExport(w, r, adminUser, pageData.Filter)
+		return
+	}
+
+	var err error
+	pageData.Events, err = getAuditEvents(pageData.Filter, auditPageSize+1)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if len(pageData.Events) > auditPageSize {
+		pageData.Events = pageData.Events[:auditPageSize]
+		pageData.Older = pageData.Events[auditPageSize-1].ID
+	}
+
+	// The actions recorded so far, for choosing between them
+	rows, err := db.Query(`SELECT DISTINCT action FROM audit_events ORDER BY action`)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var action string
+		err = rows.Scan(&action)
+		if err != nil {
+			log.Printf("%s: Error retrieving audit actions: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		pageData.Actions = append(pageData.Actions, action)
+	}
+
+	// Render the page
+	renderTemplate(w, "adminAuditPage", pageData)
+}
+
+// Sends the audit events matching a filter as a CSV file.  Exports are audited too, as the log includes IP addresses
+func adminAuditExport(w http.ResponseWriter, r *http.Request, adminUser string, filter auditFilter) {
+	pageName := "Admin audit export"
+
+	events, err := getAuditEvents(filter, auditExportMaxRows)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = auditLog(nil, r, adminUser, "export audit log", auditTargetSite, "",
+		map[string]interface{}{"actor": filter.Actor, "action": filter.Action, "target": filter.Target})
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename=audit-"+time.Now().UTC().Format("20060102")+".csv")
+	w.Header().Set("Content-Type", contentTypeCSV)
+	csvFile := csv.NewWriter(w)
+	err = csvFile.Write([]string{"id", "time", "actor", "action", "target_type", "target_id", "metadata", "ip"})
+	for _, ev := range events {
+		if err != nil {
+			break
+		}
+		err = csvFile.Write([]string{strconv.FormatInt(ev.ID, 10), ev.Timestamp.UTC().Format(time.RFC3339),
+			ev.Actor, ev.Action, ev.TargetType, ev.TargetID, ev.Metadata, ev.IP})
+	}
+	csvFile.Flush()
+	if err == nil {
+		err = csvFile.Error()
+	}
+	if err != nil {
+		log.Printf("%s: Error writing audit export: %v\n", pageName, err)
+	}
+}
+
+// Removes audit events older than the retention period, checking once a day.  A retention period of 0 keeps
+// everything
+func expireAuditEvents() {
+	for {
+		if conf.Web.AuditRetention > 0 {
+			commandTag, err := db.Exec(`
+				DELETE FROM audit_events
+				WHERE event_time < now() - $1 * interval '1 day'`, conf.Web.AuditRetention)
+			if err != nil {
+				log.Printf("Error removing expired audit events: %v\n", err)
+			} else if n := commandTag.RowsAffected(); n > 0 {
+				log.Printf("Removed %d expired audit events\n", n)
+			}
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
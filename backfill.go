@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// The number of versions looked up at a time by the metadata backfill
+const backfillBatchSize = 100
+
+// The most recent failures kept in the progress of a metadata backfill
+const backfillMaxFailures = 20
+
+// The most versions a metadata backfill reads at once
+const backfillMaxConcurrency = 8
+
+// Payload for the job recording the details of versions uploaded before they were recorded at upload time
+type metaBackfillJob struct {
+	Concurrency int // How many versions are read at once
+	Delay       int // Milliseconds each reader waits between versions, to leave room for serving pages
+}
+
+// The progress of a metadata backfill, kept as the job's result so the admin dashboard can show it
+type metaBackfillProgress struct {
+	Total    int // The versions without details when the job started
+	Done     int
+	Failed   int
+	Failures []string // The most recent failures
+}
+
+// A database version without recorded details
+type backfillVersion struct {
+	DBID    int64
+	Owner   string
+	DBName  string
+	Version int
+	Bucket  string
+	MinioId string
+}
+
+// Records the details of every database version which doesn't have them yet.  Versions which already have them are
+// skipped, so a job interrupted by a restart carries on where it left off.  Versions which can't be read are listed
+// in the progress and left for a later run
+func runMetaBackfillJob(ctx context.Context, j job) (string, error) {
+	var p metaBackfillJob
+	err := json.Unmarshal(j.Payload, &p)
+	if err != nil {
+		return "", err
+	}
+	if p.Concurrency < 1 {
+		p.Concurrency = 1
+	}
+	if p.Concurrency > backfillMaxConcurrency {
+		p.Concurrency = backfillMaxConcurrency
+	}
+	delay := time.Duration(p.Delay) * time.Millisecond
+
+	var progress metaBackfillProgress
+	err = db.QueryRow(`SELECT count(*) FROM database_versions WHERE table_meta IS NULL`).Scan(&progress.Total)
+	if err != nil {
+		return "", err
+	}
+
+	// Work through the versions in order, so ones which failed aren't tried again by this run
+	var lastDB int64
+	var lastVersion int
+	var mu sync.Mutex
+	for {
+		batch, err := backfillBatch(lastDB, lastVersion)
+		if err != nil {
+			return "", err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		lastDB, lastVersion = batch[len(batch)-1].DBID, batch[len(batch)-1].Version
+
+		work := make(chan backfillVersion)
+		var wg sync.WaitGroup
+		for i := 0; i < p.Concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for v := range work {
+					err := backfillVersionMeta(ctx, v)
+					mu.Lock()
+					if err != nil && ctx.Err() == nil {
+						progress.Failed++
+						progress.Failures = append(progress.Failures,
+							fmt.Sprintf("%s/%s version %d: %v", v.Owner, v.DBName, v.Version, err))
+						if len(progress.Failures) > backfillMaxFailures {
+							progress.Failures = progress.Failures[1:]
+						}
+					} else if err == nil {
+						progress.Done++
+					}
+					mu.Unlock()
+					select {
+					case <-ctx.Done():
+					case <-time.After(delay):
+					}
+				}
+			}()
+		}
+		for _, v := range batch {
+			if ctx.Err() != nil {
+				break
+			}
+			work <- v
+		}
+		close(work)
+		wg.Wait()
+
+		// Jobs interrupted by shutdown are queued again, and skip the versions done so far when they next run
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		saveBackfillProgress(j.ID, progress)
+	}
+
+	result, err := json.Marshal(progress)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Metadata backfill finished. Versions done: %d, failed: %d\n", progress.Done, progress.Failed)
+	return string(result), nil
+}
+
+// Returns the next versions without recorded details, after the given one
+func backfillBatch(lastDB int64, lastVersion int) ([]backfillVersion, error) {
+	rows, err := db.Query(`
+		SELECT ver.db, db.username, db.dbname, ver.version, db.minio_bucket, ver.minioid
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE db.idnum = ver.db
+			AND ver.table_meta IS NULL
+			AND (ver.db, ver.version) > ($1, $2)
+		ORDER BY ver.db, ver.version
+		LIMIT $3`, lastDB, lastVersion, backfillBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batch []backfillVersion
+	for rows.Next() {
+		var v backfillVersion
+		err = rows.Scan(&v.DBID, &v.Owner, &v.DBName, &v.Version, &v.Bucket, &v.MinioId)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, v)
+	}
+	return batch, rows.Err()
+}
+
+// Reads the details of one database version from Minio and records them.  The open database counts towards the
+// limit on open databases like any other, so when the site is busy this waits its turn rather than turning visitors
+// away
+func backfillVersionMeta(ctx context.Context, v backfillVersion) error {
+	sdb, err := openMinioObjectCtx(ctx, v.Bucket, v.MinioId)
+	for err == errTooManyOpenDBs && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		sdb, err = openMinioObjectCtx(ctx, v.Bucket, v.MinioId)
+	}
+	if err != nil {
+		return err
+	}
+	defer closeMinioObject(sdb)
+
+	// Counting the rows of a big table can take a while, so it's interrupted if the server is shutting down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sdb.Interrupt()
+		case <-done:
+		}
+	}()
+	meta, err := summariseVersion(sdb)
+	if err != nil {
+		return err
+	}
+	return saveVersionMeta(v.Owner, v.DBName, v.Version, meta)
+}
+
+// Stores the progress of a metadata backfill in its job, for the admin dashboard
+func saveBackfillProgress(jobID int64, progress metaBackfillProgress) {
+	result, err := json.Marshal(progress)
+	if err != nil {
+		log.Printf("Error encoding metadata backfill progress: %v\n", err)
+		return
+	}
+	_, err = db.Exec(`
+		UPDATE jobs
+		SET result = $2, date_updated = now()
+		WHERE id = $1`, jobID, string(result))
+	if err != nil {
+		log.Printf("Error saving metadata backfill progress: %v\n", err)
+	}
+}
+
+// The state of the most recent metadata backfill, for the admin dashboard
+type metaBackfillStatus struct {
+	Status   string // Empty when there hasn't been one
+	Updated  time.Time
+	Error    string
+	Progress metaBackfillProgress
+	Missing  int // The versions which don't have their details recorded yet
+}
+
+// Returns the state of the most recent metadata backfill
+func getMetaBackfillStatus() (status metaBackfillStatus, err error) {
+	err = db.QueryRow(`SELECT count(*) FROM database_versions WHERE table_meta IS NULL`).Scan(&status.Missing)
+	if err != nil {
+		return
+	}
+	var result, jobErr pgx.NullString
+	err = db.QueryRow(`
+		SELECT status, date_updated, result, error
+		FROM jobs
+		WHERE job_type = $1
+		ORDER BY id DESC
+		LIMIT 1`, jobMetaBackfill).Scan(&status.Status, &status.Updated, &result, &jobErr)
+	if err == pgx.ErrNoRows {
+		return status, nil
+	}
+	if err != nil {
+		return
+	}
+	status.Error = jobErr.String
+	if result.Valid && result.String != "" {
+		err = json.Unmarshal([]byte(result.String), &status.Progress)
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Request bodies are limited to the size of a form, apart from the routes below which need to take more.  Most of
+// those have a tighter limit of their own as well.  Paths ending in "/" cover everything under them
+var uploadBodyRoutes = []string{
+	apiPrefix + "clone/",
+	"/x/commitedits/",
+	"/x/upload/chunk",
+	"/x/uploadavatar/",
+	"/x/uploaddata/",
+}
+
+// Returns true if a request is for one of the routes taking uploads
+func isUploadRoute(r *http.Request) bool {
+	for _, j := range uploadBodyRoutes {
+		if r.URL.Path == j || (strings.HasSuffix(j, "/") && strings.HasPrefix(r.URL.Path, j)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the most data, in bytes, accepted in the body of a request
+func requestBodyLimit(r *http.Request) int64 {
+	if isUploadRoute(r) {
+		return conf.Limits.Upload << 20
+	}
+	return conf.Limits.Form << 20
+}
+
+// Returns the message telling people their request was larger than a limit
+func tooLargeMessage(limit int64) string {
+	return fmt.Sprintf("The request is too large.  The limit is %s", formatSize(int(limit)))
+}
+
+// Answers a request whose body was larger than a limit with a 413
+func requestTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	if strings.HasPrefix(r.URL.Path, "/x/upload/") {
+		// The chunked upload routes are used from scripts, so always give JSON
+		jsonError(w, http.StatusRequestEntityTooLarge, tooLargeMessage(limit))
+		return
+	}
+	errorPage(w, r, http.StatusRequestEntityTooLarge, tooLargeMessage(limit))
+}
+
+// Returns true if reading a request's body failed because it went past the limit set by http.MaxBytesReader()
+func bodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// Limits the size of a request's body.  Requests which say up front they're larger than the limit are turned away
+// with a 413 straight away, returning false.  Form bodies are small, so they're read here, which means ones sent
+// without their length are turned away the same way.  Upload routes stream their bodies, so the handlers check for
+// reads going past the limit with bodyTooLarge()
+func limitRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	limit := requestBodyLimit(r)
+	if r.ContentLength > limit {
+		requestTooLarge(w, r, limit)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if isUploadRoute(r) {
+		return true
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if bodyTooLarge(err) {
+		requestTooLarge(w, r, limit)
+		return false
+	}
+	if err != nil {
+		log.Printf("Error reading the body of a request for '%s': %v\n", r.URL.Path, err)
+		errorPage(w, r, http.StatusBadRequest, "The request couldn't be read")
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return true
+}
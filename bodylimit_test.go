@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestBodyLimit(t *testing.T) {
+	tests := []struct {
+		path  string
+		limit int64
+	}{
+		{"/pref", conf.Limits.Form << 20},
+		{"/x/star/someone/db.sqlite", conf.Limits.Form << 20},
+		{"/x/upload/init", conf.Limits.Form << 20},
+		{"/x/upload/chunk", conf.Limits.Upload << 20},
+		{"/x/uploaddata/", conf.Limits.Upload << 20},
+		{"/x/uploadavatar/", conf.Limits.Upload << 20},
+		{apiPrefix + "clone/someone/db.sqlite", conf.Limits.Upload << 20},
+		{apiPrefix + "star/someone/db.sqlite", conf.Limits.Form << 20},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		if limit := requestBodyLimit(r); limit != tt.limit {
+			t.Errorf("%s: expected a limit of %d, got %d", tt.path, tt.limit, limit)
+		}
+	}
+}
+
+// Posts a body of the given size through logReq() to a handler which reads all of it.  When chunked is set the
+// body is sent without a Content-Length.  Returns the response, and how much of the body the handler read or -1 if
+// it wasn't run
+func postBody(path string, size int, chunked bool) (*httptest.ResponseRecorder, int) {
+	var body io.Reader = bytes.NewReader(make([]byte, size))
+	if chunked {
+		// Hide the type of the reader, so the length isn't known
+		body = io.MultiReader(body)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, body)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if chunked {
+		r.ContentLength = -1
+		r.TransferEncoding = []string{"chunked"}
+	}
+	read := -1
+	w := httptest.NewRecorder()
+	logReq(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			requestTooLarge(w, r, requestBodyLimit(r))
+		}
+		read = len(data)
+	})(w, r)
+	return w, read
+}
+
+func TestFormBodyLimit(t *testing.T) {
+	limit := int(conf.Limits.Form << 20)
+	for _, chunked := range []bool{false, true} {
+		// Up to the limit is fine
+		w, read := postBody("/pref", limit, chunked)
+		if w.Code != http.StatusOK || read != limit {
+			t.Errorf("Chunked %v: a body at the limit gave status %d, with %d bytes read", chunked, w.Code, read)
+		}
+
+		// One byte more is turned away before the handler sees it, with a page naming the limit
+		w, read = postBody("/pref", limit+1, chunked)
+		if w.Code != http.StatusRequestEntityTooLarge || read != -1 {
+			t.Errorf("Chunked %v: an oversized body gave status %d, and the handler ran: %v", chunked, w.Code,
+				read != -1)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != contentTypeHTML {
+			t.Errorf("Chunked %v: expected an error page, got Content-Type '%s'", chunked, ct)
+		}
+		if !strings.Contains(w.Body.String(), tooLargeMessage(int64(limit))) {
+			t.Errorf("Chunked %v: error page doesn't give the limit", chunked)
+		}
+	}
+}
+
+func TestUploadBodyLimit(t *testing.T) {
+	// Much smaller than usual, so the test doesn't need gigabytes
+	upload := conf.Limits.Upload
+	conf.Limits.Upload = 3
+	defer func() {
+		conf.Limits.Upload = upload
+	}()
+	formLimit, uploadLimit := int(conf.Limits.Form<<20), int(conf.Limits.Upload<<20)
+
+	for _, chunked := range []bool{false, true} {
+		// Uploads larger than a form are fine
+		w, read := postBody("/x/uploaddata/", formLimit*2, chunked)
+		if w.Code != http.StatusOK || read != formLimit*2 {
+			t.Errorf("Chunked %v: an upload over the form limit gave status %d, with %d bytes read", chunked, w.Code,
+				read)
+		}
+
+		// Past their own limit, the upload is refused.  When the size is known that happens before the handler is
+		// run, otherwise the handler finds out as it reads
+		w, read = postBody("/x/uploaddata/", uploadLimit+1, chunked)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Chunked %v: an oversized upload gave status %d", chunked, w.Code)
+		}
+		if !chunked && read != -1 {
+			t.Errorf("The handler ran for an upload known to be too large")
+		}
+		if chunked && read != uploadLimit {
+			t.Errorf("Expected the handler to read %d bytes before stopping, got %d", uploadLimit, read)
+		}
+		if !strings.Contains(w.Body.String(), "The limit is 3.0 MB") {
+			t.Errorf("Chunked %v: error doesn't give the limit: %s", chunked, w.Body.String())
+		}
+	}
+
+	// The chunked upload is used by scripts, so its errors are JSON
+	w, _ := postBody("/x/upload/chunk", uploadLimit+1, false)
+	if w.Code != http.StatusRequestEntityTooLarge || w.Header().Get("Content-Type") != contentTypeJSON {
+		t.Errorf("Expected a JSON 413 for the chunked upload, got status %d with '%s'", w.Code,
+			w.Header().Get("Content-Type"))
+	}
+}
@@ -4,12 +4,51 @@ import (
 	"bytes"
 	"encoding/gob"
 	"io"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
+// Number of consecutive Memcached failures before caching is switched off
+const cacheFailureThreshold = 3
+
+// Added to the front of every key cached by cacheData().  Bump this whenever the layout of something cached changes,
+// so entries written by the previous release are ignored instead of being decoded into the wrong shape
+const cacheKeyPrefix = "v1-"
+
+// Circuit breaker for Memcached.  When the cache stops responding, caching is switched off for a while rather than
+// every request failing against it.  The wait before trying again doubles each time, up to maxRetryInterval
+var cacheBreaker struct {
+	sync.Mutex
+	failures  int
+	open      bool
+	retryAt   time.Time
+	retryWait time.Duration
+}
+
+// Returns true if Memcached should be used.  Once the wait has passed, one request is allowed through to see if the
+// cache has come back
+func cacheAvailable() bool {
+	cacheBreaker.Lock()
+	defer cacheBreaker.Unlock()
+	if !cacheBreaker.open {
+		return true
+	}
+	if time.Now().Before(cacheBreaker.retryAt) {
+		return false
+	}
+	cacheBreaker.retryAt = time.Now().Add(cacheBreaker.retryWait)
+	return true
+}
+
 // Caches data in Memcached
 func cacheData(cacheKey string, cacheData interface{}, cacheSeconds int32) error {
+	if !cacheAvailable() {
+		return nil
+	}
+
 	// Encode the data
 	var encodedData bytes.Buffer
 	enc := gob.NewEncoder(&encodedData)
@@ -19,18 +58,55 @@ func cacheData(cacheKey string, cacheData interface{}, cacheSeconds int32) error
 	}
 
 	// Send the data to memcached
-	cachedData := memcache.Item{Key: cacheKey, Value: encodedData.Bytes(), Expiration: cacheSeconds}
+	cachedData := memcache.Item{Key: cacheKeyPrefix + cacheKey, Value: encodedData.Bytes(), Expiration: cacheSeconds}
 	err = memCache.Set(&cachedData)
 	if err != nil {
+		cacheResult(err)
 		return err
 	}
+	cacheResult(nil)
 
 	return nil
 }
 
+// Records the outcome of a Memcached operation for the circuit breaker
+func cacheResult(err error) {
+	cacheBreaker.Lock()
+	defer cacheBreaker.Unlock()
+	if err == nil || err == memcache.ErrCacheMiss || err == memcache.ErrNotStored {
+		if cacheBreaker.open {
+			log.Printf("Memcached is responding again, caching re-enabled\n")
+		}
+		cacheBreaker.failures = 0
+		cacheBreaker.open = false
+		cacheBreaker.retryWait = 0
+		return
+	}
+	cacheBreaker.failures++
+	if cacheBreaker.open {
+		// The retry failed, so wait longer next time
+		cacheBreaker.retryWait *= 2
+		if cacheBreaker.retryWait > maxRetryInterval {
+			cacheBreaker.retryWait = maxRetryInterval
+		}
+		cacheBreaker.retryAt = time.Now().Add(cacheBreaker.retryWait)
+		return
+	}
+	if cacheBreaker.failures >= cacheFailureThreshold {
+		cacheBreaker.open = true
+		cacheBreaker.retryWait = time.Second
+		cacheBreaker.retryAt = time.Now().Add(cacheBreaker.retryWait)
+		log.Printf("Memcached isn't responding, caching disabled until it recovers: %v\n", err)
+	}
+}
+
 // Retrieves cached data from Memcached
 func getCachedData(cacheKey string, cacheData interface{}) (bool, error) {
-	cacheItem, err := memCache.Get(cacheKey)
+	if !cacheAvailable() {
+		return false, nil
+	}
+	cacheItem, err := memCache.Get(cacheKeyPrefix + cacheKey)
+	cacheResult(err)
 	if err != nil {
 		if err == memcache.ErrCacheMiss {
 			return false, nil
@@ -40,13 +116,31 @@ func getCachedData(cacheKey string, cacheData interface{}) (bool, error) {
 
 	// If a value was retrieved, return it
 	if cacheItem != nil {
-		// Decode the serialised data
+		// Decode the serialised data.  Entries which can't be decoded are removed and treated as a miss, so they're
+		// replaced with a good copy rather than failing every time until they expire
 		var decBuf bytes.Buffer
 		io.Copy(&decBuf, bytes.NewReader(cacheItem.Value))
 		dec := gob.NewDecoder(&decBuf)
-		dec.Decode(cacheData)
+		err = dec.Decode(cacheData)
+		if err != nil {
+			log.Printf("Removing cache entry '%s' which couldn't be decoded: %v\n", cacheKey, err)
+			err = memCache.Delete(cacheKeyPrefix + cacheKey)
+			if err != nil && err != memcache.ErrCacheMiss {
+				cacheResult(err)
+				log.Printf("Error removing cache entry '%s': %v\n", cacheKey, err)
+			}
+			return false, nil
+		}
 		return true, nil
 	}
 
 	return false, nil
 }
+
+// Removes everything from Memcached, for when bad data has been cached.  This includes the rate limit buckets and
+// report counts, so those start again from nothing
+func flushCache() error {
+	err := memCache.FlushAll()
+	cacheResult(err)
+	return err
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	sqlite "github.com/gwenn/gosqlite"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// The most text a table response can hold when full values are asked for, rather than ones cut short
+	maxFullValuesSize = 16 << 20
+
+	// How much of the start of a blob is looked at to work out what it holds
+	blobSniffLen = 512
+
+	// The largest thumbnail /x/blob/ will make, in pixels along its longest side
+	maxThumbnailSize = 256
+
+	// Images bigger than these aren't made into thumbnails, so a small blob can't decode into a huge image
+	maxThumbnailSourceSize   = 16 << 20
+	maxThumbnailSourcePixels = 25000000
+)
+
+// The image types shown as thumbnails, as named by http.DetectContentType()
+var thumbnailTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// Returns a text value for showing in a table.  Values longer than limit bytes are cut short, on a character
+// boundary, and marked as such along with their full length.  A limit of 0 leaves values as they are
+func displayText(name string, val string, limit int) dataValue {
+	v := dataValue{Name: name, Type: Text, Value: val}
+	if limit <= 0 || len(val) <= limit {
+		return v
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(val[cut]) {
+		cut--
+	}
+	v.Value = val[:cut]
+	v.Truncated = true
+	v.Length = len(val)
+	return v
+}
+
+// Cuts short the long text values of a record set, as displayText() does
+func truncateRecords(rs *sqliteRecordSet, limit int) {
+	for _, row := range rs.Records {
+		for j, val := range row {
+			if val.Type == Text {
+				row[j] = displayText(val.Name, val.Value, limit)
+			}
+		}
+	}
+}
+
+// Returns the total length of the values in a record set
+func recordsSize(rs sqliteRecordSet) int {
+	size := 0
+	for _, row := range rs.Records {
+		for _, val := range row {
+			size += len(val.Value)
+		}
+	}
+	return size
+}
+
+// Returns true if a table's rows are identified by their rowid, so a value in it can be retrieved with /x/cell/
+func tableHasRowid(db *sqlite.Conn, dbTable string) bool {
+	keys, err := tableKeyColumns(db, dbTable)
+	return err == nil && len(keys) == 1 && keys[0] == "rowid"
+}
+
+// Returns a blob value for showing in a table.  Images are flagged so they can be shown as thumbnails, UTF-8 text is
+// shown like any other text, and anything else only has its size given.  Only the start of the blob is looked at
+func blobValue(name string, data []byte, limit int) dataValue {
+	v := dataValue{Name: name, Type: Binary, Length: len(data)}
+	head := data
+	if len(head) > blobSniffLen {
+		head = head[:blobSniffLen]
+	}
+	kind := http.DetectContentType(head)
+	if thumbnailTypes[kind] {
+		v.Image = true
+		return v
+	}
+	if !strings.HasSuffix(kind, "charset=utf-8") || limit <= 0 {
+		return v
+	}
+
+	// Text blobs are cut short the same way as text values.  Only the part shown needs to be valid UTF-8
+	text := data
+	if len(text) > limit {
+		text = text[:limit+1]
+	}
+	t := displayText(name, string(text), limit)
+	if !utf8.ValidString(t.Value) {
+		return v
+	}
+	v.Value = t.Value
+	v.Truncated = t.Truncated
+	return v
+}
+
+// The location of a single table cell, as given to /x/cell/ and /x/blob/
+type cellRef struct {
+	Owner    string
+	Database string
+	Table    string
+	Version  int64
+	Rowid    int64
+	Col      string
+}
+
+// Checks a request for a single table cell, then reads its value.  Blobs and text are returned as they are stored,
+// other types as text.  If anything goes wrong the error has already been sent and ok is false
+func readCell(w http.ResponseWriter, r *http.Request, pageName string) (ref cellRef, obj versionObject,
+	valType sqlite.Type, val []byte, ok bool) {
+	// Retrieve user, database, and table name
+	var err error
+	ref.Owner, ref.Database, ref.Table, err = getUDT(2, r) // 2 = Ignore "/x/cell/" or "/x/blob/" at the start
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if ref.Table == "" {
+		jsonError(w, http.StatusBadRequest, "No table name given")
+		return
+	}
+	ref.Version, err = getVersion(r)
+	if err != nil || ref.Version == 0 {
+		jsonError(w, http.StatusBadRequest, "Invalid database version")
+		return
+	}
+	ref.Rowid, err = strconv.ParseInt(r.FormValue("rowid"), 10, 64)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, "Invalid rowid")
+		return
+	}
+	ref.Col = r.FormValue("col")
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+
+	// Private databases can only be read by their owner
+	ctx := r.Context()
+	obj, err = getVersionObject(ctx, loggedInUser, ref.Owner, ref.Database, ref.Version)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// Rows hidden by the owner's default filter can't be read by other people one cell at a time either, unless they
+	// asked for every row
+	filters, _, err := viewerTableFilters(r, loggedInUser, ref.Owner, ref.Database)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sdb, err := openMinioObjectCtx(ctx, obj.Bucket, obj.MinioId)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err == errTooManyOpenDBs {
+		serverBusy(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving database '%s/%s': %v\n", pageName, ref.Owner, ref.Database, err)
+		jsonError(w, http.StatusInternalServerError, "Error opening database")
+		return
+	}
+	defer closeMinioObject(sdb)
+	if !tableHasRowid(sdb, ref.Table) {
+		jsonError(w, http.StatusBadRequest, "The table doesn't have rowids")
+		return
+	}
+	if !tableHasColumn(sdb, ref.Table, ref.Col) {
+		jsonError(w, http.StatusBadRequest, fmt.Sprintf("Column '%s' isn't in the table", ref.Col))
+		return
+	}
+
+	// A hidden row is reported as not existing, the same as for a rowid which isn't there
+	dbQuery := "SELECT " + quoteIdentifier(ref.Col) + " FROM " + quoteIdentifier(ref.Table) + " WHERE rowid = ?"
+	conds, args := whereConditions(filters.Clauses(sdb, ref.Table))
+	for _, c := range conds {
+		dbQuery += " AND " + c
+	}
+
+	sctx, cancel := sqliteContext(ctx)
+	defer cancel()
+	stop := interruptWhenDone(sctx, sdb)
+	stmt, err := sdb.Prepare(dbQuery, append([]interface{}{ref.Rowid}, args...)...)
+	var found bool
+	if err == nil {
+		found, err = stmt.Next()
+		if err == nil && found {
+			valType = stmt.ColumnType(0)
+			switch valType {
+			case sqlite.Blob:
+				val, _ = stmt.ScanBlob(0)
+			default:
+				var text string
+				text, _ = stmt.ScanText(0)
+				val = []byte(text)
+			}
+		}
+		stmt.Finalize()
+	}
+	stop()
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if sctx.Err() != nil {
+		jsonError(w, http.StatusGatewayTimeout, errQueryTooLong.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error reading cell of '%s/%s' table '%s': %v\n", pageName, ref.Owner, ref.Database,
+			ref.Table, err)
+		jsonError(w, http.StatusInternalServerError, "Error reading the value")
+		return
+	}
+	if !found {
+		jsonError(w, http.StatusNotFound, "The row doesn't exist")
+		return
+	}
+	ok = true
+	return
+}
+
+// Returns the full value of a table cell which was cut short for display.  The cell is given by the version, table,
+// rowid, and column
+func cellHandler(w http.ResponseWriter, r *http.Request) {
+	ref, _, valType, val, ok := readCell(w, r, "Cell value handler")
+	if !ok {
+		return
+	}
+	w.Header().Set("X-DBHub-Version", strconv.FormatInt(ref.Version, 10))
+
+	// Only text values, and blobs holding text, are ever cut short, so nothing else is returned
+	switch {
+	case valType == sqlite.Text:
+		writeJSON(w, http.StatusOK, dataValue{Name: ref.Col, Type: Text, Value: string(val)})
+	case valType == sqlite.Blob && utf8.Valid(val):
+		writeJSON(w, http.StatusOK, dataValue{Name: ref.Col, Type: Binary, Value: string(val), Length: len(val)})
+	default:
+		jsonError(w, http.StatusBadRequest, "Only text values can be retrieved")
+	}
+}
+
+// Returns the contents of a blob in a table cell, given the same way as for /x/cell/.  Images can be asked for as a
+// thumbnail with the size parameter, giving the longest side in pixels.  Thumbnails are cached, as the versions of a
+// database never change
+func blobHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Blob handler"
+
+	// Check the thumbnail size before doing any work
+	var size int
+	if r.FormValue("size") != "" {
+		var err error
+		size, err = strconv.Atoi(r.FormValue("size"))
+		if err != nil || size < 1 || size > maxThumbnailSize {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("The size needs to be between 1 and %d",
+				maxThumbnailSize))
+			return
+		}
+	}
+
+	ref, obj, valType, val, ok := readCell(w, r, pageName)
+	if !ok {
+		return
+	}
+	if valType != sqlite.Blob {
+		jsonError(w, http.StatusBadRequest, "The value isn't a blob")
+		return
+	}
+	head := val
+	if len(head) > blobSniffLen {
+		head = head[:blobSniffLen]
+	}
+	kind := http.DetectContentType(head)
+
+	// Without a size the blob is returned as it is.  Only images are shown in the browser, anything else is a
+	// download, so a blob can't be used to serve pages from our site
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if size == 0 {
+		if !thumbnailTypes[kind] {
+			kind = "application/octet-stream"
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		w.Header().Set("Content-Type", kind)
+		w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+		w.Write(val)
+		return
+	}
+	if !thumbnailTypes[kind] {
+		jsonError(w, http.StatusBadRequest, "The blob isn't an image")
+		return
+	}
+
+	// Use a cached thumbnail if there is one.  The key is for the database file actually read, so it's the same
+	// whoever asks
+	tempArr := md5.Sum([]byte(fmt.Sprintf("%s/%s/%s/%d/%s/%d", obj.Bucket, obj.MinioId, ref.Table, ref.Rowid,
+		ref.Col, size)))
+	cacheKey := "thumb-" + hex.EncodeToString(tempArr[:])
+	var thumb []byte
+	ok, err := getCachedData(cacheKey, &thumb)
+	if err != nil {
+		log.Printf("%s: Error retrieving thumbnail from cache: %v\n", pageName, err)
+	}
+	if !ok {
+		thumb, err = makeThumbnail(val, size)
+		if err != nil {
+			log.Printf("%s: Error making thumbnail for '%s/%s' table '%s' rowid %d: %v\n", pageName, ref.Owner,
+				ref.Database, ref.Table, ref.Rowid, err)
+			jsonError(w, http.StatusBadRequest, "The image couldn't be made into a thumbnail")
+			return
+		}
+		err = cacheData(cacheKey, thumb, cacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching thumbnail: %v\n", pageName, err)
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(thumb)))
+	w.Write(thumb)
+}
+
+// Scales an image down so its longest side is at most size pixels, returning it as a PNG.  Images are checked
+// before being decoded, so ones too large to handle are refused rather than using lots of memory
+func makeThumbnail(data []byte, size int) ([]byte, error) {
+	if len(data) > maxThumbnailSourceSize {
+		return nil, fmt.Errorf("image is %d bytes, more than the %d allowed", len(data), maxThumbnailSourceSize)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("image is %dx%d pixels, too large to make a thumbnail of", cfg.Width, cfg.Height)
+	}
+	srcImg, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the aspect ratio.  Images already small enough are left at their size
+	b := srcImg.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dstImg := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dstImg, dstImg.Bounds(), srcImg, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, dstImg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// Desktop clients such as DB Browser for SQLite open hosted databases using dbhub://{owner}/{db} URLs.  They ask
+// apiPrefix+"capabilities" what the server supports, then resolve the URL with GET apiPrefix+"clone/{owner}/{db}",
+// which describes the latest version (or the one given with ?version=) including its size and sha256.  The file
+// itself comes from the download_url in that description, which supports Range requests so interrupted downloads
+// can be resumed.  A new version is pushed with PUT apiPrefix+"clone/{owner}/{db}", sending the database as the
+// request body.  Databases too large for one request go through the chunked upload instead.
+//
+// The request and response shapes are versioned with cloneAPIVersion.  Fields can be added without changing it,
+// but anything which would break an existing client needs it bumped
+const (
+	cloneAPIVersion = 1
+	cloneURLScheme  = "dbhub"
+
+	// The largest database which can be pushed in a single request
+	maxClonePushSize = 512 << 20
+)
+
+// The features listed by the capability probe.  Clients should only use the ones listed, as servers running older
+// code won't have them all
+var cloneFeatures = []string{"clone", "resume", "push", "chunked_upload", "meta"}
+
+// The answer to the capability probe
+type cloneCapabilities struct {
+	APIVersion  int               `json:"api_version"`
+	Server      string            `json:"server"`
+	URLScheme   string            `json:"url_scheme"`
+	Auth        string            `json:"auth"` // How clients log in.  Only the web session cookie for now
+	Features    []string          `json:"features"`
+	MaxPushSize int64             `json:"max_push_size"`
+	Endpoints   map[string]string `json:"endpoints"`
+}
+
+// The description of a database version a client can clone
+type cloneInfo struct {
+	APIVersion    int       `json:"api_version"`
+	Owner         string    `json:"owner"`
+	Database      string    `json:"database"`
+	Version       int       `json:"version"`
+	LatestVersion int       `json:"latest_version"`
+	Size          int       `json:"size"`
+	SHA256        string    `json:"sha256"`
+	LastModified  time.Time `json:"last_modified"`
+	Public        bool      `json:"public"`
+	CloneURL      string    `json:"clone_url"`
+	DownloadURL   string    `json:"download_url"`
+	WebURL        string    `json:"web_url"`
+}
+
+// Returns the dbhub:// URL clients use for a database
+func cloneURL(owner string, dbName string) string {
+	return cloneURLScheme + "://" + url.PathEscape(owner) + "/" + url.PathEscape(dbName)
+}
+
+// Tells clients which API version and features this server supports
+func apiCapabilitiesHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	writeJSON(w, http.StatusOK, cloneCapabilities{
+		APIVersion:  cloneAPIVersion,
+		Server:      conf.Web.Server,
+		URLScheme:   cloneURLScheme,
+		Auth:        "session",
+		Features:    cloneFeatures,
+		MaxPushSize: maxClonePushSize,
+		Endpoints: map[string]string{
+			"resolve":        siteURL(apiPrefix + "clone/{owner}/{db}"),
+			"download":       siteURL(apiPrefix + "clone/{owner}/{db}/file"),
+			"push":           siteURL(apiPrefix + "clone/{owner}/{db}"),
+			"chunked_upload": siteURL("/x/upload/init"),
+			"meta":           siteURL(apiPrefix + "meta/{owner}/{db}"),
+		},
+	})
+}
+
+// Finds the version of a database a clone request is for, checking the user can see it.  If something's wrong the
+// error has already been sent and ok is false
+func cloneTarget(w http.ResponseWriter, r *http.Request, pageName string, owner string,
+	dbName string) (dbInfo sqliteDBinfo, ok bool) {
+	if r.FormValue("branch") != "" {
+		jsonError(w, http.StatusBadRequest, "This server doesn't support branches")
+		return
+	}
+	version := int64(latestVersion)
+	if r.FormValue("version") != "" {
+		var err error
+		version, err = getVersion(r)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	ctx := r.Context()
+	err := checkUserDBVersionAccessCtx(ctx, &dbInfo, currentUser(r), owner, dbName, version)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		jsonError(w, versionErrorStatus(err), err.Error())
+		return
+	}
+	return dbInfo, true
+}
+
+// Describes a database version for cloning
+func describeClone(owner string, dbName string, dbInfo sqliteDBinfo) cloneInfo {
+	return cloneInfo{APIVersion: cloneAPIVersion, Owner: owner, Database: dbName, Version: dbInfo.Info.Version,
+		LatestVersion: dbInfo.Info.Latest, Size: dbInfo.Info.Size, SHA256: dbInfo.Info.SHA256,
+		LastModified: dbInfo.Info.VersionDate, Public: dbInfo.Info.Public, CloneURL: cloneURL(owner, dbName),
+		DownloadURL: siteURL(fmt.Sprintf("%sclone/%s/%s/file?version=%d", apiPrefix, url.PathEscape(owner),
+			url.PathEscape(dbName), dbInfo.Info.Version)),
+		WebURL: siteURL("/" + url.PathEscape(owner) + "/" + url.PathEscape(dbName))}
+}
+
+// Resolves a dbhub:// URL to the version of the database to download
+func apiCloneHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	pageName := "Clone API"
+	owner, dbName := params["owner"], params["db"]
+
+	dbInfo, ok := cloneTarget(w, r, pageName, owner, dbName)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	writeJSON(w, http.StatusOK, describeClone(owner, dbName, dbInfo))
+}
+
+// Sends the file of a database version.  Range requests are supported, so clients can resume an interrupted
+// download, and the ETag is the version's sha256 so If-Range makes sure the pieces come from the same file
+func apiCloneFileHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	pageName := "Clone download API"
+	owner, dbName := params["owner"], params["db"]
+
+	dbInfo, ok := cloneTarget(w, r, pageName, owner, dbName)
+	if !ok {
+		return
+	}
+	userDB, err := minioClient.GetObject(dbInfo.MinioBkt, dbInfo.MinioId)
+	if err != nil {
+		log.Printf("%s: Error retrieving DB from Minio: %v\n", pageName, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer func() {
+		err := userDB.Close()
+		if err != nil {
+			log.Printf("%s: Error closing object handle: %v\n", pageName, err)
+		}
+	}()
+
+	// Only requests for the start of the file are counted as downloads, so resuming one doesn't count it again
+	if rng := r.Header.Get("Range"); rng == "" || strings.HasPrefix(rng, "bytes=0-") {
+		recordStat(r, owner, dbName, statDownload, currentUser(r))
+	}
+	w.Header().Set("X-DBHub-Version", strconv.Itoa(dbInfo.Info.Version))
+	w.Header().Set("X-DBHub-SHA256", dbInfo.Info.SHA256)
+	w.Header().Set("ETag", `"`+dbInfo.Info.SHA256+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment",
+		downloadFileName(dbName, dbInfo.Info.Version, "", "")))
+	w.Header().Set("Content-Type", contentTypeSQLite)
+	http.ServeContent(w, r, "", dbInfo.Info.VersionDate, userDB)
+}
+
+// Stores the request body as a new version of one of the user's databases, creating the database if it's new.
+// Clients pass the version their copy was based on as ?base=, or 0 for a new database, and the push is refused if
+// someone else added a version since.  An optional ?sha256= is checked against what arrived, and ?message= becomes
+// the commit message.  New versions have the same visibility as the latest one unless ?public= is given, and new
+// databases are private unless it says otherwise
+func apiClonePushHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	pageName := "Clone push API"
+	owner, dbName := params["owner"], params["db"]
+	loggedInUser := currentUser(r)
+
+	// The options are only read from the query string, as the body is the database
+	query := r.URL.Query()
+	if loggedInUser != owner {
+		jsonError(w, http.StatusForbidden, "Versions can only be pushed to your own databases")
+		return
+	}
+	var base int
+	if v := query.Get("base"); v != "" {
+		var err error
+		base, err = strconv.Atoi(v)
+		if err != nil || base < 0 {
+			jsonError(w, http.StatusBadRequest, "Invalid base version")
+			return
+		}
+	}
+	message := strings.TrimSpace(query.Get("message"))
+	if len([]rune(message)) > maxCommentLength {
+		jsonError(w, http.StatusBadRequest, fmt.Sprintf("Commit messages can't be longer than %d characters",
+			maxCommentLength))
+		return
+	}
+	if r.ContentLength > maxClonePushSize {
+		jsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Databases larger than %d MB need to be sent "+
+			"with the chunked upload", maxClonePushSize>>20))
+		return
+	}
+
+	// Check the push is based on the latest version, so it doesn't quietly undo someone else's changes
+	var latest int
+	var public bool
+	err := db.QueryRow(`
+		SELECT ver.version, ver.public
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND db.idnum = ver.db
+		ORDER BY ver.version DESC
+		LIMIT 1`, owner, dbName).Scan(&latest, &public)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("%s: Error looking up latest version of '%s/%s': %v\n", pageName, owner, dbName, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if base != latest {
+		writeJSON(w, http.StatusConflict, struct {
+			APIVersion    int    `json:"api_version"`
+			Error         string `json:"error"`
+			LatestVersion int    `json:"latest_version"`
+		}{cloneAPIVersion, fmt.Sprintf("The push needs to be based on the latest version, which is %d", latest),
+			latest})
+		return
+	}
+	if v := query.Get("public"); v != "" {
+		public, err = strconv.ParseBool(v)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "Invalid value for public")
+			return
+		}
+	}
+
+	// Read and check the database
+	dbData, err := ioutil.ReadAll(io.LimitReader(r.Body, maxClonePushSize+1))
+	if bodyTooLarge(err) {
+		requestTooLarge(w, r, requestBodyLimit(r))
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error reading pushed database: %v\n", pageName, err)
+		jsonError(w, http.StatusBadRequest, "Error reading the database")
+		return
+	}
+	if len(dbData) > maxClonePushSize {
+		jsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Databases larger than %d MB need to be sent "+
+			"with the chunked upload", maxClonePushSize>>20))
+		return
+	}
+	if len(dbData) == 0 {
+		jsonError(w, http.StatusBadRequest, "The database is empty")
+		return
+	}
+	shaSum := sha256.Sum256(dbData)
+	if want := query.Get("sha256"); want != "" && !strings.EqualFold(want, hex.EncodeToString(shaSum[:])) {
+		jsonError(w, http.StatusBadRequest, "The database doesn't match the sha256 it was sent with")
+		return
+	}
+	meta, err := sanityCheckSQLiteData(dbData)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	newVersion, dbSize, minioId, err := addDatabaseVersion(owner, dbName, "/", public, dbData, message,
+		loggedInUser)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if meta.Tables != nil {
+		saveVersionMeta(owner, dbName, newVersion, meta)
+	}
+	log.Printf("%s: Username: %v, database '%v' version %d pushed as '%v', bytes: %v\n", pageName, owner, dbName,
+		newVersion, minioId, dbSize)
+
+	var dbInfo sqliteDBinfo
+	err = checkUserDBVersionAccessCtx(r.Context(), &dbInfo, loggedInUser, owner, dbName, int64(newVersion))
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, describeClone(owner, dbName, dbInfo))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCloneURL(t *testing.T) {
+	tests := []struct {
+		owner  string
+		dbName string
+		want   string
+	}{
+		{"someone", "plain.sqlite", "dbhub://someone/plain.sqlite"},
+		{"someone", "my data.sqlite", "dbhub://someone/my%20data.sqlite"},
+		{"someone", "a#b?.sqlite", "dbhub://someone/a%23b%3F.sqlite"},
+	}
+	for _, tt := range tests {
+		if got := cloneURL(tt.owner, tt.dbName); got != tt.want {
+			t.Errorf("Expected '%s', got '%s'", tt.want, got)
+		}
+	}
+}
+
+// Decodes the description of a database version from a clone response
+func decodeCloneInfo(t *testing.T, w *httptest.ResponseRecorder) cloneInfo {
+	var info cloneInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Unexpected clone response: %s", w.Body.String())
+	}
+	if info.APIVersion != cloneAPIVersion {
+		t.Errorf("Expected API version %d, got %d", cloneAPIVersion, info.APIVersion)
+	}
+	return info
+}
+
+// Fetches a database through the download URL of a clone description, with the given extra request headers
+func fetchClone(t *testing.T, info cloneInfo, userName string, header map[string]string) *httptest.ResponseRecorder {
+	u, err := url.Parse(info.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testRequest(http.MethodGet, u.RequestURI(), nil, userName)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	logReq(apiHandler)(w, r)
+	return w
+}
+
+func TestCloneRoundTrip(t *testing.T) {
+	requireBackends(t)
+	rateLimits := conf.RateLimit.Disabled
+	conf.RateLimit.Disabled = true
+	defer func() {
+		conf.RateLimit.Disabled = rateLimits
+	}()
+	owner := testUserName("cloner")
+	addTestUser(t, owner)
+	first := readTestSQLite(t, "clone1.sqlite", numberedRowsFixture(100)...)
+	path := "clone/" + owner + "/clone.sqlite"
+
+	// The capability probe lists what the client can use
+	w := apiRequest(http.MethodGet, "capabilities", nil, "")
+	var caps cloneCapabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil || caps.URLScheme != cloneURLScheme {
+		t.Fatalf("Unexpected capabilities: %s", w.Body.String())
+	}
+	if !strings.HasSuffix(caps.Endpoints["push"], apiPrefix+"clone/{owner}/{db}") {
+		t.Errorf("Unexpected push endpoint: %s", caps.Endpoints["push"])
+	}
+
+	// Push a new database from the client, checked against its sha256
+	sum := sha256.Sum256(first)
+	firstSHA := hex.EncodeToString(sum[:])
+	w = apiRequest(http.MethodPut, path+"?base=0&public=true&message=First&sha256="+firstSHA,
+		bytes.NewReader(first), owner)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Push failed with status %d: %s", w.Code, w.Body.String())
+	}
+	info := decodeCloneInfo(t, w)
+	if info.Version != 1 || info.LatestVersion != 1 || info.SHA256 != firstSHA || info.Size != len(first) ||
+		!info.Public || info.CloneURL != cloneURL(owner, "clone.sqlite") {
+		t.Errorf("Unexpected description of the pushed database: %+v", info)
+	}
+
+	// Resolving the dbhub:// URL gives the same version, and anyone can fetch it
+	w = apiRequest(http.MethodGet, path, nil, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Resolving failed with status %d: %s", w.Code, w.Body.String())
+	}
+	info = decodeCloneInfo(t, w)
+	w = fetchClone(t, info, "", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), first) {
+		t.Fatalf("Fetching failed with status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("ETag") != `"`+firstSHA+`"` || w.Header().Get("X-DBHub-SHA256") != firstSHA {
+		t.Errorf("Unexpected validators: ETag %s, X-DBHub-SHA256 %s", w.Header().Get("ETag"),
+			w.Header().Get("X-DBHub-SHA256"))
+	}
+
+	// An interrupted download can be resumed from where it stopped, as long as the file is the same one
+	w = fetchClone(t, info, "", map[string]string{"Range": "bytes=1000-", "If-Range": `"` + firstSHA + `"`})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), first[1000:]) {
+		t.Errorf("Resuming failed with status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	w = fetchClone(t, info, "", map[string]string{"Range": "bytes=1000-", "If-Range": `"different"`})
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), first) {
+		t.Errorf("Resuming a different file should send all of it, got status %d, %d bytes", w.Code, w.Body.Len())
+	}
+
+	// Pushes need to be based on the latest version, and match the sha256 they were sent with
+	second := readTestSQLite(t, "clone2.sqlite", numberedRowsFixture(200)...)
+	w = apiRequest(http.MethodPut, path+"?base=0", bytes.NewReader(second), owner)
+	var conflict struct {
+		LatestVersion int `json:"latest_version"`
+	}
+	if w.Code != http.StatusConflict || json.Unmarshal(w.Body.Bytes(), &conflict) != nil || conflict.LatestVersion != 1 {
+		t.Errorf("Expected a conflict naming version 1, got status %d: %s", w.Code, w.Body.String())
+	}
+	w = apiRequest(http.MethodPut, path+"?base=1&sha256="+firstSHA, bytes.NewReader(second), owner)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a push with the wrong sha256 to be refused, got status %d", w.Code)
+	}
+	w = apiRequest(http.MethodPut, path+"?base=1&public=false", bytes.NewReader(second), owner)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Second push failed with status %d: %s", w.Code, w.Body.String())
+	}
+	if info = decodeCloneInfo(t, w); info.Version != 2 || info.Public {
+		t.Errorf("Unexpected description of the second version: %+v", info)
+	}
+
+	// Other people still get the public first version, while the owner gets the latest
+	for _, tt := range []struct {
+		user    string
+		version int
+		data    []byte
+	}{{"", 1, first}, {owner, 2, second}} {
+		w = apiRequest(http.MethodGet, path, nil, tt.user)
+		info = decodeCloneInfo(t, w)
+		if info.Version != tt.version || info.LatestVersion != tt.version {
+			t.Errorf("'%s': expected version %d, got %+v", tt.user, tt.version, info)
+			continue
+		}
+		w = fetchClone(t, info, tt.user, nil)
+		if !bytes.Equal(w.Body.Bytes(), tt.data) || w.Header().Get("X-DBHub-Version") != fmt.Sprint(tt.version) {
+			t.Errorf("'%s': fetched the wrong file, status %d", tt.user, w.Code)
+		}
+	}
+
+	// The database page shows the dbhub:// URL for copying
+	w = httptest.NewRecorder()
+	logReq(mainHandler)(w, testRequest(http.MethodGet, "/"+owner+"/clone.sqlite", nil, ""))
+	if !strings.Contains(w.Body.String(), cloneURL(owner, "clone.sqlite")) {
+		t.Errorf("The database page doesn't show the dbhub:// URL")
+	}
+}
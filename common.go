@@ -1,53 +1,259 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	sqlite "github.com/gwenn/gosqlite"
 	"github.com/jackc/pgx"
 	com "github.com/dbhubio/common"
 )
 
+// Stores a database file as a new version of a user's database, creating the database if it doesn't exist yet.
+// Returns the new version number, along with the size and Minio ID of the stored file.  The file is always stored
+// as a SQLite database, whatever type the uploader said it was, as it's been checked to be one.  The version is
+// credited to uploadedBy, which is the owner unless the version came from someone else, such as through a merge
+// request
+func addDatabaseVersion(userName string, dbName string, folder string, public bool, dbData []byte,
+	commitMsg string, uploadedBy string) (newVersion int, dbSize int64, minioId string, err error) {
+	shaSum := sha256.Sum256(dbData)
+	return storeDatabaseVersion(userName, dbName, folder, public, bytes.NewReader(dbData),
+		hex.EncodeToString(shaSum[:]), commitMsg, uploadedBy)
+}
+
+// Like addDatabaseVersion(), but for a database file on disk, which is streamed to Minio rather than read into
+// memory.  The file has to match the given sha256, so a file changed or damaged since it was checked isn't stored
+func addDatabaseVersionFile(userName string, dbName string, folder string, public bool, path string,
+	shaSum string, commitMsg string, uploadedBy string) (newVersion int, dbSize int64, minioId string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Error opening database file '%s': %v\n", path, err)
+		return 0, 0, "", errors.New("Error reading the database file")
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("Error reading database file '%s': %v\n", path, err)
+		return 0, 0, "", errors.New("Error reading the database file")
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != shaSum {
+		log.Printf("Database file '%s' has changed.  Expected sha256 %s, got %s\n", path, shaSum, sum)
+		return 0, 0, "", errors.New("The database file has changed since it was checked")
+	}
+	return storeDatabaseVersion(userName, dbName, folder, public, f, shaSum, commitMsg, uploadedBy)
+}
+
+// Does the work of addDatabaseVersion() and addDatabaseVersionFile(), storing the database read from dbData
+func storeDatabaseVersion(userName string, dbName string, folder string, public bool, dbData io.Reader,
+	shaSum string, commitMsg string, uploadedBy string) (newVersion int, dbSize int64, minioId string, err error) {
+	// Check if the database already exists
+	var highestVersion int
+	err = db.QueryRow(`
+		SELECT version
+		FROM database_versions
+		WHERE db = (SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+			AND dbname = $2)
+		ORDER BY version DESC
+		LIMIT 1`, userName, dbName).Scan(&highestVersion)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error when querying database: %v\n", err)
+		return 0, 0, "", errors.New("Database query failure")
+	}
+	if highestVersion > 0 {
+		// The database already exists
+		newVersion = highestVersion + 1
+	} else {
+		newVersion = 1
+	}
+
+	// Retrieve the Minio bucket to store the database in
+	var minioBucket string
+	err = db.QueryRow(`
+		SELECT minio_bucket
+		FROM users
+		WHERE username = $1`, userName).Scan(&minioBucket)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error when querying database: %v\n", err)
+		return 0, 0, "", errors.New("Database query failure")
+	}
+
+	// Generate random filename to store the database as
+	minioId = randomString(8) + ".db"
+
+	// TODO: We should probably check if the randomly generated filename is already used for the user, just in case
+
+	// Store the database file in Minio
+	dbSize, err = minioClient.PutObject(minioBucket, minioId, dbData, contentTypeSQLite)
+	if err != nil {
+		log.Printf("Storing file in Minio failed: %v\n", err)
+		return 0, 0, "", errors.New("Storing in object store failed")
+	}
+
+	// TODO: Put these queries inside a single transaction
+
+	// Add the new database details to the PG database
+	var dbQuery string
+	if newVersion == 1 {
+		dbQuery = `
+			INSERT INTO sqlite_databases (username, folder, dbname, minio_bucket)
+			VALUES ($1, $2, $3, $4)`
+		commandTag, err := db.Exec(dbQuery, userName, folder, dbName, minioBucket)
+		if err != nil {
+			log.Printf("Adding database to PostgreSQL failed: %v\n", err)
+			return 0, 0, "", errors.New("Database query failed")
+		}
+		if numRows := commandTag.RowsAffected(); numRows != 1 {
+			log.Printf("Wrong number of rows affected: %v, user: %s, database: %v\n", numRows, userName, dbName)
+			return 0, 0, "", errors.New("Database query failed")
+		}
+	}
+
+	// Add the database to database_versions.  Versions created by uploads don't have a commit message
+	msg := pgx.NullString{String: commitMsg, Valid: commitMsg != ""}
+	dbQuery = `
+		WITH databaseid AS (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+				AND dbname = $2)
+		INSERT INTO database_versions (db, size, version, sha256, public, minioid, commit_message, uploaded_by)
+		SELECT idnum, $3, $4, $5, $6, $7, $8, $9 FROM databaseid`
+	_, err = db.Exec(dbQuery, userName, dbName, dbSize, newVersion, shaSum, public, minioId, msg, uploadedBy)
+	if err != nil {
+		log.Printf("Adding version info to PostgreSQL failed: %v\n", err)
+		return 0, 0, "", errors.New("Database query failed")
+	}
+
+	// Update the last_modified date and contributor count for the database in sqlite_databases.  Versions from
+	// before uploaders were recorded were all uploaded by the owner
+	dbQuery = `
+		UPDATE sqlite_databases
+		SET last_modified = (
+			SELECT last_modified
+			FROM database_versions
+			WHERE db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND dbname = $2)
+				AND version = $3),
+			contributors = (
+			SELECT count(DISTINCT coalesce(uploaded_by, $1))
+			FROM database_versions
+			WHERE db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND dbname = $2))
+		WHERE username = $1
+			AND dbname = $2`
+	commandTag, err := db.Exec(dbQuery, userName, dbName, newVersion)
+	if err != nil {
+		log.Printf("Updating last_modified date in PostgreSQL failed: %v\n", err)
+		return 0, 0, "", errors.New("Database query failed")
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected: %v, user: %s, database: %v\n", numRows, userName, dbName)
+		return 0, 0, "", errors.New("Database query failed")
+	}
+	return newVersion, dbSize, minioId, nil
+}
+
+// Returns the URL of the avatar image for a user.  A locally uploaded avatar takes priority, otherwise Gravatar is
+// used (which itself falls back to a generated identicon for email addresses it doesn't know)
+func avatarURL(userName string, email string, localAvatar bool) string {
+	if localAvatar {
+		return "/avatar/" + userName
+	}
+	return gravatarURL(email)
+}
+
 // Check if the user has access to the requested database
 func checkUserDBAccess(DB *sqliteDBinfo, loggedInUser string, dbUser string, dbName string) error {
+	return checkUserDBAccessCtx(context.Background(), DB, loggedInUser, dbUser, dbName)
+}
+
+// Check if the user has access to the requested database.  The database query is abandoned if the context is
+// cancelled, or takes longer than the configured query timeout
+func checkUserDBAccessCtx(ctx context.Context, DB *sqliteDBinfo, loggedInUser string, dbUser string,
+	dbName string) error {
+	return checkUserDBVersionAccessCtx(ctx, DB, loggedInUser, dbUser, dbName, latestVersion)
+}
+
+// Like checkUserDBAccessCtx(), but for a given version of the database rather than the latest one.  The latest
+// version the user can see is filled in too, so pages can tell when they're showing an older one
+func checkUserDBVersionAccessCtx(ctx context.Context, DB *sqliteDBinfo, loggedInUser string, dbUser string,
+	dbName string, version int64) error {
 	var queryCacheKey, dbQuery string
 	if loggedInUser != dbUser {
 		// * The request is for another users database, so it needs to be a public one *
 		dbQuery = `
 			SELECT ver.minioid, db.date_created, db.last_modified, ver.size, ver.version, db.watchers,
 				db.stars, db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
-				db.releases, db.contributors, db.description, db.readme, db.minio_bucket
-			FROM sqlite_databases AS db, database_versions AS ver
+				db.releases, db.contributors, db.description, db.readme, db.minio_bucket, ver.public,
+				NULL AS source_url, ver.sha256, ver.last_modified, ver.original_filename,
+				(SELECT max(latest.version)
+				FROM database_versions AS latest
+				WHERE latest.db = db.idnum
+					AND latest.public = true)
+			FROM sqlite_databases AS db, database_versions AS ver, users AS u
 			WHERE db.username = $1
 				AND db.dbname = $2
 				AND db.idnum = ver.db
+				AND db.username = u.username
+				AND u.disabled = false
 				AND ver.public = true
+				AND ($3 = 0 OR ver.version = $3)
 			ORDER BY version DESC
 			LIMIT 1`
-		tempArr := md5.Sum([]byte(fmt.Sprintf(dbQuery, dbUser, dbName)))
+		tempArr := md5.Sum([]byte(fmt.Sprintf(dbQuery, dbUser, dbName, version)))
 		queryCacheKey = "pub/" + hex.EncodeToString(tempArr[:])
 	} else {
 		dbQuery = `
 			SELECT ver.minioid, db.date_created, db.last_modified, ver.size, ver.version, db.watchers,
 				db.stars, db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
-				db.releases, db.contributors, db.description, db.readme, db.minio_bucket
-			FROM sqlite_databases AS db, database_versions AS ver
+				db.releases, db.contributors, db.description, db.readme, db.minio_bucket, ver.public,
+				db.source_url, ver.sha256, ver.last_modified, ver.original_filename,
+				(SELECT max(latest.version)
+				FROM database_versions AS latest
+				WHERE latest.db = db.idnum)
+			FROM sqlite_databases AS db, database_versions AS ver, users AS u
 			WHERE db.username = $1
 				AND db.dbname = $2
 				AND db.idnum = ver.db
+				AND db.username = u.username
+				AND u.disabled = false
+				AND ($3 = 0 OR ver.version = $3)
 			ORDER BY version DESC
 			LIMIT 1`
-		tempArr := md5.Sum([]byte(fmt.Sprintf(dbQuery, dbUser, dbName)))
+		tempArr := md5.Sum([]byte(fmt.Sprintf(dbQuery, dbUser, dbName, version)))
 		queryCacheKey = loggedInUser + "/" + hex.EncodeToString(tempArr[:])
 	}
 
@@ -56,28 +262,38 @@ func checkUserDBAccess(DB *sqliteDBinfo, loggedInUser string, dbUser string, dbN
 	if err != nil {
 		log.Printf("Error retrieving data from cache: %v\n", err)
 	}
+	if ok && loggedInUser != dbUser {
+		ok = ownerEnabled(dbUser)
+	}
 	if !ok {
 		// Retrieve the requested database details
-		var Desc, Readme pgx.NullString
-		err := db.QueryRow(dbQuery, dbUser, dbName).Scan(&DB.MinioId, &DB.Info.DateCreated,
-			&DB.Info.LastModified, &DB.Info.Size, &DB.Info.Version, &DB.Info.Watchers,
+		var Desc, Readme, SourceURL, OriginalName pgx.NullString
+		qctx, cancel := queryContext(ctx)
+		defer cancel()
+		err := db.QueryRowEx(qctx, dbQuery, nil, dbUser, dbName, version).Scan(&DB.MinioId,
+			&DB.Info.DateCreated, &DB.Info.LastModified, &DB.Info.Size, &DB.Info.Version, &DB.Info.Watchers,
 			&DB.Info.Stars, &DB.Info.Forks, &DB.Info.Discussions, &DB.Info.MRs,
 			&DB.Info.Updates, &DB.Info.Branches, &DB.Info.Releases, &DB.Info.Contributors,
-			&Desc, &Readme, &DB.MinioBkt)
-		if err != nil {
-			log.Printf("Requested database '%s/%s' not found or not available for user\n", dbUser, dbName)
-			return errors.New("The requested database doesn't exist")
+			&Desc, &Readme, &DB.MinioBkt, &DB.Info.Public, &SourceURL, &DB.Info.SHA256, &DB.Info.VersionDate,
+			&OriginalName, &DB.Info.Latest)
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		if !Desc.Valid {
-			DB.Info.Description = "No description"
-		} else {
-			DB.Info.Description = Desc.String
+		if err == pgx.ErrNoRows {
+			return versionLookupError(ctx, loggedInUser, dbUser, dbName, version)
+		}
+		if err != nil {
+			log.Printf("Error retrieving details of database '%s/%s': %v\n", dbUser, dbName, err)
+			return errors.New("Database query failed")
 		}
+		DB.Info.Description = Desc.String
 		if !Readme.Valid {
 			DB.Info.Readme = "No readme"
 		} else {
 			DB.Info.Readme = Readme.String
 		}
+		DB.Info.SourceURL = SourceURL.String
+		DB.Info.OriginalName = OriginalName.String
 
 		// Cache the database details
 		err = cacheData(queryCacheKey, DB, 120)
@@ -89,6 +305,383 @@ func checkUserDBAccess(DB *sqliteDBinfo, loggedInUser string, dbUser string, dbN
 	return nil
 }
 
+// The reasons a version of a database can't be given to a user.  Databases the user can't see at all are reported
+// as not existing, so private databases can't be found by guessing their names
+var (
+	errDatabaseNotFound = errors.New("The requested database doesn't exist")
+	errVersionNotFound  = errors.New("The requested version of the database doesn't exist")
+	errVersionDenied    = errors.New("You don't have access to the requested version of the database")
+)
+
+// Works out why a version of a database wasn't found for a user, returning one of the errors above.  A version is
+// only denied when the user can see other versions of the database, as otherwise saying so would give away that the
+// database exists
+func versionLookupError(ctx context.Context, loggedInUser string, dbUser string, dbName string,
+	version int64) error {
+	var visible, exists bool
+	qctx, cancel := queryContext(ctx)
+	defer cancel()
+	err := db.QueryRowEx(qctx, `
+		SELECT db.username = $3 OR coalesce(bool_or(ver.public), false),
+			coalesce(bool_or(ver.version = $4), false)
+		FROM sqlite_databases AS db
+			JOIN users AS u ON u.username = db.username
+			LEFT JOIN database_versions AS ver ON ver.db = db.idnum
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND u.disabled = false
+		GROUP BY db.idnum, db.username`, nil, dbUser, dbName, loggedInUser, version).Scan(&visible, &exists)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error looking up why '%s/%s' version %d wasn't found: %v\n", dbUser, dbName, version, err)
+		return errors.New("Database query failed")
+	}
+	switch {
+	case !visible:
+		log.Printf("Requested database '%s/%s' not found or not available for user\n", dbUser, dbName)
+		return errDatabaseNotFound
+	case version == latestVersion || !exists:
+		log.Printf("Version %d of database '%s/%s' not found\n", version, dbUser, dbName)
+		return errVersionNotFound
+	}
+	log.Printf("Version %d of database '%s/%s' not available for user '%s'\n", version, dbUser, dbName,
+		loggedInUser)
+	return errVersionDenied
+}
+
+// Returns the HTTP status code for an error from looking up a database version
+func versionErrorStatus(err error) int {
+	switch err {
+	case errDatabaseNotFound, errVersionNotFound:
+		return http.StatusNotFound
+	case errVersionDenied:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// Checks if a given username is already in use
+func checkUserExists(userName string) (bool, error) {
+	return checkUserExistsCtx(context.Background(), userName)
+}
+
+// Context aware version of checkUserExists()
+func checkUserExistsCtx(ctx context.Context, userName string) (bool, error) {
+	var userCount int
+	err := db.QueryRowEx(ctx, `
+		SELECT count(username)
+		FROM users
+		WHERE username = $1`, nil, userName).Scan(&userCount)
+	if err != nil {
+		log.Printf("Error checking if user '%s' exists: %v\n", userName, err)
+		return false, errors.New("Database query failed")
+	}
+	return userCount > 0, nil
+}
+
+// Returns true (and logs it) if the client for a request has gone away, so the handler can stop working on it
+func clientGone(ctx context.Context, pageName string) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	log.Printf("%s: Client went away: %v\n", pageName, ctx.Err())
+	return true
+}
+
+// Returns the IP address a request came from.  When it came through one of our trusted proxies, the address the
+// proxy says it was forwarded for is used instead.  X-Forwarded-For is read from the right, as anything to the left of
+// the addresses our own proxies added could have been made up by the client
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			// Something went wrong with the header, so go with the last address we know is real
+			break
+		}
+		ip = addr
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// Returns true if the given user has starred a database.  Nobody who isn't logged in has starred anything
+func checkDBStarred(loggedInUser string, owner string, dbName string) (bool, error) {
+	if loggedInUser == "" {
+		return false, nil
+	}
+	var starred bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM database_stars AS stars, sqlite_databases AS db
+			WHERE stars.db = db.idnum
+				AND db.username = $1
+				AND db.dbname = $2
+				AND stars.username = $3)`, owner, dbName, loggedInUser).Scan(&starred)
+	return starred, err
+}
+
+// The ways a user's star on a database can be changed
+type starChange int
+
+const (
+	starToggle starChange = iota // Star the database if it isn't starred, otherwise unstar it
+	starAdd                      // Star the database, doing nothing if it's already starred
+	starRemove                   // Unstar the database, doing nothing if it isn't starred
+)
+
+// Stars or unstars a database for a user, returning whether it's now starred and its star count.  The star and the
+// count are changed in one transaction, with the database row locked, so changes at the same time can't leave the
+// count wrong or return a stale one
+func setDBStar(dbId int, loggedInUser string, change starChange) (starred bool, stars int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the database row, so other changes for it wait for this one to finish
+	_, err = tx.Exec(`SELECT idnum FROM sqlite_databases WHERE idnum = $1 FOR UPDATE`, dbId)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Work out whether the database should end up starred, and only touch the star row when that's different
+	var wasStarred bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM database_stars
+			WHERE db = $1
+				AND username = $2)`, dbId, loggedInUser).Scan(&wasStarred)
+	if err != nil {
+		return false, 0, err
+	}
+	switch change {
+	case starAdd:
+		starred = true
+	case starRemove:
+		starred = false
+	default:
+		starred = !wasStarred
+	}
+	if starred && !wasStarred {
+		_, err = tx.Exec(`INSERT INTO database_stars (db, username) VALUES ($1, $2)`, dbId, loggedInUser)
+	} else if !starred && wasStarred {
+		_, err = tx.Exec(`DELETE FROM database_stars WHERE db = $1 AND username = $2`, dbId, loggedInUser)
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Count the stars again rather than adjusting the stored count, so it can't drift from the star rows
+	err = tx.QueryRow(`
+		UPDATE sqlite_databases
+		SET stars = (
+			SELECT count(db)
+			FROM database_stars
+			WHERE db = $1
+		) WHERE idnum = $1
+		RETURNING stars`, dbId).Scan(&stars)
+	if err != nil {
+		return false, 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	return starred, stars, nil
+}
+
+// Returns the id of a database, for the tables which refer to databases by it
+func getDatabaseID(owner string, dbName string) (dbId int, err error) {
+	err = db.QueryRow(`SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2`, owner,
+		dbName).Scan(&dbId)
+	return
+}
+
+// Recounts the stars of every database from the star rows, fixing any stored counts which have drifted.  Returns
+// the number of databases fixed
+func reconcileStarCounts() (int64, error) {
+	commandTag, err := db.Exec(`
+		UPDATE sqlite_databases AS db
+		SET stars = counts.stars
+		FROM (
+			SELECT dbs.idnum, count(stars.db) AS stars
+			FROM sqlite_databases AS dbs
+				LEFT JOIN database_stars AS stars ON stars.db = dbs.idnum
+			GROUP BY dbs.idnum
+		) AS counts
+		WHERE db.idnum = counts.idnum
+			AND db.stars != counts.stars`)
+	if err != nil {
+		return 0, err
+	}
+	return commandTag.RowsAffected(), nil
+}
+
+// Builds a Content-Disposition header value for the given file name, as per RFC 6266.  The filename parameter holds
+// a plain ASCII approximation for older clients, and filename* holds the real UTF-8 name
+func contentDisposition(disposition string, fileName string) string {
+	var fallback, encoded bytes.Buffer
+	for _, r := range fileName {
+		switch {
+		case r == '"' || r == '\\' || r < 0x20 || r == 0x7f:
+			fallback.WriteByte('_')
+		case r < 0x80:
+			fallback.WriteRune(r)
+		default:
+			fallback.WriteByte('_')
+		}
+	}
+	for _, b := range []byte(fileName) {
+		// The characters which don't need escaping in RFC 5987 values
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(),
+		encoded.String())
+}
+
+// Creates a Minio bucket if it doesn't already exist
+func createBucketIfMissing(bucket string) error {
+	found, err := minioClient.BucketExists(bucket)
+	if err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+	err = minioClient.MakeBucket(bucket, "us-east-1")
+	if err != nil {
+		return err
+	}
+	log.Printf("Minio bucket created: %s\n", bucket)
+	return nil
+}
+
+// Returns the file name to use when downloading a version of a database, so several downloaded versions can sit
+// side by side.  eg "mydata.db" version 3 is "mydata_v3.db".  When a table name is given, it's added to the end and
+// the extension replaced with the given one, giving "mydata_v3_tablename.csv"
+func downloadFileName(dbName string, version int, dbTable string, ext string) string {
+	base := strings.TrimSuffix(dbName, path.Ext(dbName))
+	if dbTable == "" {
+		return fmt.Sprintf("%s_v%d%s", base, version, path.Ext(dbName))
+	}
+	return fmt.Sprintf("%s_v%d_%s.%s", base, version, dbTable, ext)
+}
+
+// Formats a timestamp for display, with the date format and timezone in the page's meta info.  The name of the zone
+// is always shown, so visitors who aren't logged in see an explicit "UTC"
+func formatTime(t time.Time, meta metaInfo) string {
+	if meta.DateFormat == relativeDateFormat {
+		return relativeTime(t, time.Now())
+	}
+	format := meta.DateFormat
+	if !isValidDateFormat(format) {
+		format = defaultDateFormat
+	}
+	loc := time.UTC
+	if meta.TimeZone != "" {
+		if l, err := time.LoadLocation(meta.TimeZone); err == nil {
+			loc = l
+		}
+	}
+	return t.In(loc).Format(format + " MST")
+}
+
+// Describes how long before now a timestamp was, eg "3 days ago".  Timestamps in the future, such as when something
+// expires, are described the other way around, eg "in 3 days"
+func relativeTime(t time.Time, now time.Time) string {
+	d, format := now.Sub(t), "%s ago"
+	if d < 0 {
+		d, format = -d, "in %s"
+	}
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf(format, "1 "+unit)
+		}
+		return fmt.Sprintf(format, fmt.Sprintf("%d %ss", n, unit))
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	case d < 30*24*time.Hour:
+		return plural(int(d/(24*time.Hour)), "day")
+	case d < 365*24*time.Hour:
+		return plural(int(d/(30*24*time.Hour)), "month")
+	}
+	return plural(int(d/(365*24*time.Hour)), "year")
+}
+
+// Returns true if the given name is a timezone which time.LoadLocation() knows.  An empty name means UTC.  "Local"
+// isn't accepted, as it's the timezone of the server rather than of the user
+func isValidTimeZone(name string) bool {
+	if name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// The number of entries shown on each page of the user and database listings
+const listPageSize = 25
+
+// Works out which page of a listing with the given number of entries was requested in the given form field.  The
+// page number is clamped to the pages which exist, and the links to the pages either side keep the rest of the
+// request's query string
+func getListPage(r *http.Request, field string, total int) (pageInfo, error) {
+	p := pageInfo{Page: 1, Total: total}
+	if v := r.FormValue(field); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return p, errors.New("Invalid page number")
+		}
+		p.Page = page
+	}
+	p.TotalPages = (total + listPageSize - 1) / listPageSize
+	if p.TotalPages < 1 {
+		p.TotalPages = 1
+	}
+	if p.Page > p.TotalPages {
+		p.Page = p.TotalPages
+	}
+	p.Offset = (p.Page - 1) * listPageSize
+
+	link := func(page int) string {
+		q := r.URL.Query()
+		q.Set(field, strconv.Itoa(page))
+		return "?" + q.Encode()
+	}
+	if p.Page > 1 {
+		p.PrevLink = link(p.Page - 1)
+	}
+	if p.Page < p.TotalPages {
+		p.NextLink = link(p.Page + 1)
+	}
+	return p, nil
+}
+
 // Returns the number of rows in a SQLite table
 func getSQLiteRowCount(db *sqlite.Conn, dbTable string) (int, error) {
 	dbQuery := "SELECT count(*) FROM " + dbTable
@@ -101,6 +694,100 @@ func getSQLiteRowCount(db *sqlite.Conn, dbTable string) (int, error) {
 	return rowCount, nil
 }
 
+// The ways the database listings can be ordered, and the column each is ordered by
+var dbListSorts = map[string]string{
+	"modified": "last_modified",
+	"name":     "dbname",
+	"size":     "size",
+	"stars":    "stars",
+}
+
+// Reads the ordering and filter for the database listings from the "sort", "dir" and "q" parameters of a request.
+// Anything unrecognised falls back to the default of the most recently modified first
+func parseDBListOptions(r *http.Request) dbListOptions {
+	opts := dbListOptions{Sort: r.FormValue("sort"), Dir: sortDirection(r.FormValue("dir")),
+		Filter: strings.TrimSpace(r.FormValue("q"))}
+	if _, ok := dbListSorts[opts.Sort]; !ok {
+		opts.Sort = "modified"
+	}
+	if opts.Dir == "" {
+		// Names read best alphabetically, everything else biggest or newest first
+		opts.Dir = "DESC"
+		if opts.Sort == "name" {
+			opts.Dir = "ASC"
+		}
+	}
+	if len([]rune(opts.Filter)) > maxSearchLength {
+		opts.Filter = string([]rune(opts.Filter)[:maxSearchLength])
+	}
+	return opts
+}
+
+// Returns the ILIKE pattern for the filter of a database listing, or an empty string when there's no filter
+func (o dbListOptions) pattern() string {
+	if o.Filter == "" {
+		return ""
+	}
+	return "%" + escapeLike(o.Filter) + "%"
+}
+
+// Counts the databases of a user which match the listing filter.  When publicOnly is set, only those with a public
+// version are counted
+func countUserDBSection(ctx context.Context, userName string, publicOnly bool, opts dbListOptions) (int, error) {
+	var total int
+	err := db.QueryRowEx(ctx, `
+		SELECT count(DISTINCT db.idnum)
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.idnum = ver.db
+			AND db.username = $1
+			AND ($2 = false OR ver.public = true)
+			AND ($3 = '' OR db.dbname ILIKE $3 OR db.description ILIKE $3)`, nil, userName, publicOnly,
+		opts.pattern()).Scan(&total)
+	return total, err
+}
+
+// Retrieves a page of a user's databases, in the order and with the filter given.  Each database is given with its
+// latest version, or its latest public version when publicOnly is set, in which case databases without a public
+// version are left out.  Each database says whether the viewer has starred it
+func getUserDBSection(ctx context.Context, userName string, publicOnly bool, opts dbListOptions, offset int,
+	viewer string) ([]dbInfo, error) {
+	dbQuery := `
+		WITH section_dbs AS (
+			SELECT DISTINCT ON (db.idnum) db.username, db.dbname, db.last_modified, ver.size, ver.version,
+				ver.public, db.watchers, db.stars, db.forks, db.discussions, db.pull_requests, db.updates,
+				db.branches, db.releases, db.contributors, db.description, my_star.db IS NOT NULL AS starred
+			FROM sqlite_databases AS db
+				JOIN database_versions AS ver ON ver.db = db.idnum
+				LEFT JOIN database_stars AS my_star ON my_star.db = db.idnum AND my_star.username = $5
+			WHERE db.username = $1
+				AND ($2 = false OR ver.public = true)
+				AND ($6 = '' OR db.dbname ILIKE $6 OR db.description ILIKE $6)
+			ORDER BY db.idnum, ver.version DESC
+		)
+		SELECT * FROM section_dbs ORDER BY ` + dbListSorts[opts.Sort] + ` ` + sortDirection(opts.Dir) + `, dbname
+		LIMIT $3 OFFSET $4`
+	rows, err := db.QueryEx(ctx, dbQuery, nil, userName, publicOnly, listPageSize, offset, viewer,
+		opts.pattern())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []dbInfo
+	for rows.Next() {
+		var desc pgx.NullString
+		var oneRow dbInfo
+		err = rows.Scan(&oneRow.Owner, &oneRow.Database, &oneRow.LastModified, &oneRow.Size, &oneRow.Version,
+			&oneRow.Public, &oneRow.Watchers, &oneRow.Stars, &oneRow.Forks, &oneRow.Discussions, &oneRow.MRs,
+			&oneRow.Updates, &oneRow.Branches, &oneRow.Releases, &oneRow.Contributors, &desc, &oneRow.Starred)
+		if err != nil {
+			return nil, err
+		}
+		oneRow.Description = desc.String
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
 // Extracts and returns the requested table name (if any)
 func getTable(r *http.Request) (string, error) {
 	var requestedTable string
@@ -140,6 +827,12 @@ func getUD(ignore_leading int, r *http.Request) (string, string, error) {
 		return "", "", errors.New("Invalid user or database name")
 	}
 
+	// Usernames match apart from case, so handlers (and their cache keys) always see the registered name
+	userName, err = canonicalUsername(userName)
+	if err != nil {
+		return "", "", err
+	}
+
 	// Everything seems ok
 	return userName, dbName, nil
 }
@@ -162,7 +855,8 @@ func getUDT(ignore_leading int, r *http.Request) (string, string, string, error)
 	return userName, dbName, requestedTable, nil
 }
 
-// Extracts and returns the requested username, database, table name, and version number
+// Extracts and returns the requested username, database, table name, and version number.  The table and version
+// can also be given as extra path components, as in /owner/db/table/version
 func getUDTV(ignore_leading int, r *http.Request) (string, string, string, int64, error) {
 	// Grab user and database name
 	userName, dbName, err := getUD(ignore_leading, r)
@@ -175,9 +869,23 @@ func getUDTV(ignore_leading int, r *http.Request) (string, string, string, int64
 	if err != nil {
 		return "", "", "", 0, err
 	}
+	pathStrings := strings.Split(r.URL.Path, "/")
+	if len(pathStrings) > 3+ignore_leading && pathStrings[3+ignore_leading] != "" {
+		requestedTable = pathStrings[3+ignore_leading]
+		err = com.ValidatePGTable(requestedTable)
+		if err != nil {
+			log.Printf("Validation failed for table name: %s", err)
+			return "", "", "", 0, errors.New("Invalid table name")
+		}
+	}
 
 	// Extract the version number
-	dbVersion, err := getVersion(r)
+	var dbVersion int64
+	if len(pathStrings) > 4+ignore_leading && pathStrings[4+ignore_leading] != "" {
+		dbVersion, err = parseVersion(pathStrings[4+ignore_leading])
+	} else {
+		dbVersion, err = getVersion(r)
+	}
 	if err != nil {
 		return "", "", "", 0, err
 	}
@@ -186,7 +894,8 @@ func getUDTV(ignore_leading int, r *http.Request) (string, string, string, int64
 	return userName, dbName, requestedTable, dbVersion, nil
 }
 
-// Extracts and returns the requested username, database, and database version
+// Extracts and returns the requested username, database, and database version.  The version can also be given as
+// an extra path component, as in /owner/db/version
 func getUDV(ignore_leading int, r *http.Request) (string, string, int64, error) {
 	// Grab user and database name
 	userName, dbName, err := getUD(ignore_leading, r)
@@ -195,7 +904,13 @@ func getUDV(ignore_leading int, r *http.Request) (string, string, int64, error)
 	}
 
 	// Extract the version number
-	dbVersion, err := getVersion(r)
+	var dbVersion int64
+	pathStrings := strings.Split(r.URL.Path, "/")
+	if len(pathStrings) > 3+ignore_leading && pathStrings[3+ignore_leading] != "" {
+		dbVersion, err = parseVersion(pathStrings[3+ignore_leading])
+	} else {
+		dbVersion, err = getVersion(r)
+	}
 	if err != nil {
 		return "", "", 0, err
 	}
@@ -204,95 +919,771 @@ func getUDV(ignore_leading int, r *http.Request) (string, string, int64, error)
 	return userName, dbName, dbVersion, nil
 }
 
-// Retrieve the user's preference for maximum number of SQLite rows to display
-func getUserMaxRowsPref(loggedInUser string) int {
-	// Retrieve the user preference data
-	dbQuery := `
-		SELECT pref_max_rows
+// Returns the avatar URL for a given user
+func getUserAvatar(userName string) string {
+	var email string
+	var avatarId pgx.NullString
+	err := db.QueryRow(`
+		SELECT email, avatar_minioid
 		FROM users
-		WHERE username = $1`
-	var maxRows int
-	err := db.QueryRow(dbQuery, loggedInUser).Scan(&maxRows)
+		WHERE username = $1`, userName).Scan(&email, &avatarId)
 	if err != nil {
-		log.Printf("Error retrieving user '%s' preference data: %v\n", loggedInUser, err)
-		return 10 // Use the default value
+		log.Printf("Error retrieving avatar details for user '%s': %v\n", userName, err)
+		return gravatarURL("")
 	}
-
-	return maxRows
+	return avatarURL(userName, email, avatarId.Valid)
 }
 
-// Extract and return the requested version number
-func getVersion(r *http.Request) (int64, error) {
-	dbVersion, err := strconv.ParseInt(r.FormValue("version"), 10, 0) // This also validates the version input
+// Returns the new name of a recently renamed user, or an empty string if the name hasn't been redirected
+func getUsernameRedirect(userName string) (string, error) {
+	var newName string
+	err := db.QueryRow(`
+		SELECT new_name
+		FROM username_redirects
+		WHERE old_name = $1
+			AND expires > now()`, userName).Scan(&newName)
 	if err != nil {
-		log.Printf("Invalid database version number: %v\n", err)
-		return 0, errors.New("Invalid database version number")
+		if err == pgx.ErrNoRows {
+			return "", nil
+		}
+		log.Printf("Error looking up redirect for username '%s': %v\n", userName, err)
+		return "", errors.New("Database query failed")
 	}
-	return dbVersion, nil
+	return newName, nil
 }
 
-// Retrieves a SQLite database from Minio, then opens it
-func openMinioObject(bucket string, id string) (*sqlite.Conn, error) {
-	// Get a handle from Minio for the database object
-	userDB, err := minioClient.GetObject(bucket, id)
+// Returns the given username in the case it was registered with.  Names match apart from case, unless several users
+// have the name in different cases, when only an exact match counts.  Names which don't belong to anyone are
+// returned unchanged, for the caller to deal with as an unknown user.  This runs for every request naming a user, so
+// the case insensitive match relies on an index:
+//
+//	CREATE INDEX users_lower_username_idx ON users (lower(username));
+func canonicalUsername(userName string) (string, error) {
+	var name string
+	err := db.QueryRow(`
+		SELECT coalesce(
+			(SELECT username
+			FROM users
+			WHERE username = $1),
+			(SELECT min(username)
+			FROM users
+			WHERE lower(username) = lower($1)
+			HAVING count(*) = 1),
+			$1)`, userName).Scan(&name)
 	if err != nil {
-		log.Printf("Error retrieving DB from Minio: %v\n", err)
-		return nil, errors.New("Internal retrieving database from object store")
+		log.Printf("Error looking up username '%s': %v\n", userName, err)
+		return "", errors.New("Database query failed")
 	}
+	return name, nil
+}
 
-	// Close the object handle when this function finishes
-	defer func() {
-		err := userDB.Close()
-		if err != nil {
-			log.Printf("Error closing object handle: %v\n", err)
-		}
-	}()
+// The date format used for users who haven't chosen one, as a Go time layout.  The timezone is added by formatTime()
+const defaultDateFormat = "2 January 2006 15:04"
 
-	// Save the database locally to a temporary file
-	tempfileHandle, err := ioutil.TempFile("", "databaseViewHandler-")
+// The date format which shows how long ago something was, instead of the date itself
+const relativeDateFormat = "relative"
+
+// The date formats users can choose between
+var dateFormats = []dateFormatInfo{
+	{defaultDateFormat, "5 March 2017 14:30"},
+	{"2006-01-02 15:04", "2017-03-05 14:30"},
+	{"02/01/2006 15:04", "05/03/2017 14:30"},
+	{"01/02/2006 3:04 PM", "03/05/2017 2:30 PM"},
+	{relativeDateFormat, "3 days ago"},
+}
+
+// The licences a database can be given.  The ID is the SPDX identifier, where there is one
+var dbLicences = []licenceInfo{
+	{"", "Not specified"},
+	{"CC0-1.0", "Creative Commons Zero (public domain)"},
+	{"CC-BY-4.0", "Creative Commons Attribution 4.0"},
+	{"CC-BY-SA-4.0", "Creative Commons Attribution-ShareAlike 4.0"},
+	{"ODbL-1.0", "Open Database License 1.0"},
+	{"other", "Other"},
+}
+
+// Retrieve the user's preference for maximum number of SQLite rows to display
+func getUserMaxRowsPref(loggedInUser string) int {
+	prefs, err := getUserPreferences(loggedInUser)
 	if err != nil {
-		log.Printf("Error creating tempfile: %v\n", err)
-		return nil, errors.New("Internal server error")
+		return conf.Web.DefaultRows
+	}
+	return prefs.MaxRows
+}
+
+// Retrieves all of a user's preferences.  Preferences which haven't been set are returned with their default values
+func getUserPreferences(userName string) (userPreferences, error) {
+	acct, found, err := getUserAccount(context.Background(), userName)
+	if err == nil && !found {
+		err = errors.New("Error retrieving preference data")
+	}
+	return acct.Prefs, err
+}
+
+// Retrieves a user's preferences, along with the account details shown with them.  found is false if the user
+// doesn't exist, such as when their account was removed while they were still logged in.  Preferences which haven't
+// been set are returned with their default values, including when there's an error
+func getUserAccount(ctx context.Context, userName string) (acct userAccount, found bool, err error) {
+	acct.Prefs = userPreferences{MaxRows: conf.Web.DefaultRows, DateFormat: defaultDateFormat}
+	dbQuery := `
+		SELECT pref_max_rows, coalesce(pref_default_public, false), coalesce(pref_default_licence, ''),
+			coalesce(pref_date_format, ''), coalesce(pref_timezone, ''), email, avatar_minioid
+		FROM users
+		WHERE username = $1`
+	var prefs userPreferences
+	var avatarId pgx.NullString
+	qctx, cancel := queryContext(ctx)
+	defer cancel()
+	err = db.QueryRowEx(qctx, dbQuery, nil, userName).Scan(&prefs.MaxRows, &prefs.DefaultPublic,
+		&prefs.DefaultLicence, &prefs.DateFormat, &prefs.TimeZone, &acct.Email, &avatarId)
+	if err == pgx.ErrNoRows {
+		return acct, false, nil
 	}
-	tempfile := tempfileHandle.Name()
-	bytesWritten, err := io.Copy(tempfileHandle, userDB)
 	if err != nil {
-		log.Printf("Error writing database to temporary file: %v\n", err)
-		return nil, errors.New("Internal server error")
+		log.Printf("Error retrieving user '%s' preference data: %v\n", userName, err)
+		return acct, false, errors.New("Error retrieving preference data")
 	}
-	if bytesWritten == 0 {
-		log.Printf("0 bytes written to the SQLite temporary file. Minio object: %s/%s\n", bucket, id)
-		return nil, errors.New("Internal server error")
+	if !isValidDateFormat(prefs.DateFormat) {
+		prefs.DateFormat = defaultDateFormat
 	}
-	tempfileHandle.Close()
-	defer os.Remove(tempfile) // Delete the temporary file when this function finishes
+	acct.Prefs = prefs
+	acct.LocalAvatar = avatarId.Valid
+	return acct, true, nil
+}
 
-	// Open database
-	db, err := sqlite.Open(tempfile, sqlite.OpenReadOnly)
-	if err != nil {
-		log.Printf("Couldn't open database: %s", err)
-		return nil, errors.New("Internal server error")
+// Turns the file name a browser sent for an upload into a database name.  Some browsers send the full path of the
+// file, or percent-encode it, so only the last path component is kept, and control characters are removed.  The
+// result still needs checking with ValidateDB()
+func sanitiseDBName(fileName string) string {
+	if unescaped, err := url.PathUnescape(fileName); err == nil {
+		fileName = unescaped
+	}
+	fileName = path.Base(strings.Replace(fileName, "\\", "/", -1))
+	if fileName == "." || fileName == "/" {
+		return ""
 	}
+	return strings.TrimSpace(stripControlChars(fileName))
+}
 
-	return db, nil
+// Removes any control characters from a string
+func stripControlChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
 }
 
-// Reads up to maxRows number of rows from a given SQLite database table.  If maxRows < 0 (eg -1), then read all rows.
-func readSQLiteDB(db *sqlite.Conn, dbTable string, maxRows int) (sqliteRecordSet, error) {
-	return readSQLiteDBCols(db, dbTable, false, false, maxRows, nil, "*")
+// Records the name of the file a version of a database was uploaded from, when it differs from the database name
+func setOriginalFilename(userName string, dbName string, version int, fileName string) error {
+	_, err := db.Exec(`
+		UPDATE database_versions
+		SET original_filename = $4
+		WHERE db = (SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+				AND dbname = $2)
+			AND version = $3`, userName, dbName, version, fileName)
+	if err != nil {
+		log.Printf("Error saving the original file name of '%s/%s' version %d: %v\n", userName, dbName, version,
+			err)
+		return errors.New("Database query failed")
+	}
+	return nil
 }
 
-// Reads up to maxRows # of rows from a SQLite database.  Only returns the requested columns
-func readSQLiteDBCols(db *sqlite.Conn, dbTable string, ignoreBinary bool, ignoreNull bool, maxRows int,
-	filters []whereClause, cols ...string) (sqliteRecordSet, error) {
-	// Ugh, have to use string smashing for this, even though the SQL spec doesn't seem to say table names
-	// shouldn't be parameterised.  Limitation from SQLite's implementation? :(
-	var dataRows sqliteRecordSet
-	var err error
-	var stmt *sqlite.Stmt
+// Sets the licence of a database.  An empty licence means none was chosen
+func setDatabaseLicence(userName string, dbName string, licence string) error {
+	_, err := db.Exec(`
+		UPDATE sqlite_databases
+		SET licence = $3
+		WHERE username = $1
+			AND dbname = $2`, userName, dbName, pgx.NullString{String: licence, Valid: licence != ""})
+	if err != nil {
+		log.Printf("Error setting the licence of '%s/%s': %v\n", userName, dbName, err)
+		return errors.New("Database query failed")
+	}
+	return nil
+}
+
+// Updates the preferences of a user.  Preferences which aren't Valid in the update are left as they are
+func setUserPreferences(userName string, prefs userPreferenceUpdate) error {
+	dbQuery := `
+		UPDATE users
+		SET pref_max_rows = coalesce($2, pref_max_rows),
+			pref_default_public = coalesce($3, pref_default_public),
+			pref_default_licence = coalesce($4, pref_default_licence),
+			pref_date_format = coalesce($5, pref_date_format),
+			pref_timezone = coalesce($6, pref_timezone)
+		WHERE username = $1`
+	commandTag, err := db.Exec(dbQuery, userName, prefs.MaxRows, prefs.DefaultPublic, prefs.DefaultLicence,
+		prefs.DateFormat, prefs.TimeZone)
+	if err != nil {
+		log.Printf("Updating preferences for user '%s' failed: %v\n", userName, err)
+		return errors.New("Error when updating preferences")
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected when updating user preferences: %v, username: %v\n", numRows,
+			userName)
+		return errors.New("Error when updating preferences")
+	}
+	return nil
+}
+
+// Fills in the date format and timezone of the logged in user, which formatTime() displays timestamps with.
+// Visitors who aren't logged in get the default format, in UTC
+func setUserTimePrefs(meta *metaInfo, loggedInUser string) {
+	meta.DateFormat = defaultDateFormat
+	meta.TimeZone = ""
+	if loggedInUser == "" {
+		return
+	}
+	prefs, _ := getUserPreferences(loggedInUser)
+	meta.DateFormat = prefs.DateFormat
+	meta.TimeZone = prefs.TimeZone
+}
+
+// Extract and return the requested version number.  "latest" is returned as latestVersion
+func getVersion(r *http.Request) (int64, error) {
+	return parseVersion(r.FormValue("version"))
+}
+
+// Returns the Gravatar URL for an email address
+func gravatarURL(email string) string {
+	emailHash := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return fmt.Sprintf("https://www.gravatar.com/avatar/%s?d=identicon&s=%d", hex.EncodeToString(emailHash[:]),
+		avatarSize)
+}
+
+// Checks if a user is a site administrator
+func isAdmin(userName string) bool {
+	var admin bool
+	err := db.QueryRow(`
+		SELECT is_admin
+		FROM users
+		WHERE username = $1`, userName).Scan(&admin)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("Error checking admin status of user '%s': %v\n", userName, err)
+		}
+		return false
+	}
+	return admin
+}
+
+// Returns true if the given format is one of the date formats users can choose
+func isValidDateFormat(format string) bool {
+	for _, f := range dateFormats {
+		if f.Format == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the given ID is one of the licences a database can have.  An empty ID means no licence was chosen
+func isValidLicence(id string) bool {
+	for _, l := range dbLicences {
+		if l.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieves a SQLite database from Minio, then opens it
+func openMinioObject(bucket string, id string) (*sqlite.Conn, error) {
+	return openMinioObjectCtx(context.Background(), bucket, id)
+}
+
+// Wraps a reader, so reading stops once the context is cancelled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Retrieves a database object from Minio, abandoning the transfer if the context is cancelled or the configured
+// Minio timeout is reached
+func openMinioObjectCtx(ctx context.Context, bucket string, id string) (*sqlite.Conn, error) {
+	mctx, cancel := context.WithTimeout(ctx, time.Duration(conf.Timeouts.Minio)*time.Second)
+	defer cancel()
 
-	// Set the table name
+	// Use the local disk cache when it's enabled
+	if minioCache != nil {
+		entry, err := minioCache.fetch(mctx, bucket, id)
+		if err != nil {
+			return nil, err
+		}
+		db, err := openImmutableSQLite(minioCache.path(entry))
+		if err != nil {
+			minioCache.release(entry)
+			log.Printf("Couldn't open database: %s", err)
+			if err == errWALDatabase {
+				return nil, err
+			}
+			return nil, errors.New("Internal server error")
+		}
+		openEntriesMu.Lock()
+		openEntries[db] = entry
+		openEntriesMu.Unlock()
+		return db, nil
+	}
+
+	// Wait for a slot to open the database in, so a burst of requests can't fill the disk with temporary files.  The
+	// slot is held until the database is closed
+	err := acquireTempDBSlot(mctx)
+	if err != nil {
+		return nil, err
+	}
+	opened := false
+	defer func() {
+		if !opened {
+			releaseTempDBSlot()
+		}
+	}()
+
+	// Get a handle from Minio for the database object
+	userDB, err := minioClient.GetObject(bucket, id)
+	if err != nil {
+		log.Printf("Error retrieving DB from Minio: %v\n", err)
+		return nil, errors.New("Internal retrieving database from object store")
+	}
+	defer func() {
+		err := userDB.Close()
+		if err != nil {
+			log.Printf("Error closing object handle: %v\n", err)
+		}
+	}()
+
+	// Save the database locally to a temporary file
+	tempfileHandle, err := ioutil.TempFile(tempDir(), "dbhub-minio-")
+	if err != nil {
+		log.Printf("Error creating tempfile: %v\n", err)
+		return nil, errors.New("Internal server error")
+	}
+	tempfile := tempfileHandle.Name()
+	defer os.Remove(tempfile) // Delete the temporary file when this function finishes
+	bytesWritten, err := io.Copy(tempfileHandle, ctxReader{ctx: mctx, r: userDB})
+	tempfileHandle.Close()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		log.Printf("Error writing database to temporary file: %v\n", err)
+		return nil, errors.New("Internal server error")
+	}
+	if bytesWritten == 0 {
+		log.Printf("0 bytes written to the SQLite temporary file. Minio object: %s/%s\n", bucket, id)
+		return nil, errors.New("Internal server error")
+	}
+
+	// Open database
+	db, err := openImmutableSQLite(tempfile)
+	if err != nil {
+		log.Printf("Couldn't open database: %s", err)
+		if err == errWALDatabase {
+			return nil, err
+		}
+		return nil, errors.New("Internal server error")
+	}
+	tempDBsMu.Lock()
+	tempDBs[db] = true
+	tempDBsMu.Unlock()
+	opened = true
+
+	return db, nil
+}
+
+// Returned when a database can't be read because it was saved in WAL mode, with some of its data still in the -wal
+// file which wasn't uploaded along with it
+var errWALDatabase = errors.New("This database was saved in WAL mode, and can't be read without its -wal file.  " +
+	"Please checkpoint it, or switch it back to the rollback journal, then upload it again")
+
+// Opens a SQLite database file which nothing will be writing to, such as one retrieved from Minio.  Opening it as
+// immutable means SQLite doesn't look for -wal or -shm files or take any locks, and there's no point waiting when
+// it's busy as nothing else can be using it
+func openImmutableSQLite(path string) (*sqlite.Conn, error) {
+	uri := url.URL{Scheme: "file", Path: path, RawQuery: "immutable=1"}
+	db, err := sqlite.Open(uri.String(), sqlite.OpenReadOnly, sqlite.OpenURI)
+	if err != nil {
+		return nil, err
+	}
+	err = db.BusyTimeout(0)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Read the schema straight away, so a database which can't be read from its main file alone fails here rather
+	// than part way through a page.  A WAL mode database with an empty schema had everything in its -wal file
+	var n int
+	err = db.OneValue("SELECT count(*) FROM sqlite_master", &n)
+	if err != nil || (n == 0 && isWALDatabase(path)) {
+		db.Close()
+		if isWALDatabase(path) {
+			return nil, errWALDatabase
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// Returns true if the header of a database file says it's in WAL mode
+func isWALDatabase(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	// The file format read and write versions are 2 for WAL mode, and 1 for the rollback journal
+	header := make([]byte, 20)
+	_, err = io.ReadFull(f, header)
+	return err == nil && header[18] == 2 && header[19] == 2
+}
+
+// Parses an IP address or CIDR range, as given for the trusted proxies.  Returns nil if it's neither
+func parseIPRange(s string) *net.IPNet {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil
+		}
+		return ipNet
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// Version number used to ask for the newest version of a database which the requesting user can see
+const latestVersion = 0
+
+// Parses a requested database version number, which can also be the word "latest"
+func parseVersion(v string) (int64, error) {
+	if v == "latest" {
+		return latestVersion, nil
+	}
+	dbVersion, err := strconv.ParseInt(v, 10, 0) // This also validates the version input
+	if err != nil || dbVersion < 1 {
+		log.Printf("Invalid database version number: %v\n", v)
+		return 0, errors.New("Invalid database version number")
+	}
+	return dbVersion, nil
+}
+
+// Returns a context for a PostgreSQL query, limited to the configured query timeout
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(conf.Timeouts.Query)*time.Second)
+}
+
+// Returned when reading from a SQLite database takes longer than a request is allowed, which handlers send as a 504
+var errQueryTooLong = errors.New("Reading from the database took too long, so it was stopped")
+
+// Returns a context which limits the time a request spends reading from SQLite databases
+func sqliteContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(conf.Timeouts.SQLite)*time.Second)
+}
+
+// Returns the error for a SQLite read stopped by its context, which is errQueryTooLong when the time ran out
+func sqliteCtxErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errQueryTooLong
+	}
+	return ctx.Err()
+}
+
+// Interrupts whatever a SQLite connection is running once the context is done.  The returned function stops
+// watching the context, and needs calling when the reads are finished
+func interruptWhenDone(ctx context.Context, db *sqlite.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.Interrupt()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// The templates the page handlers render.  Any missing from the parsed set stop the server from starting
+var pageTemplates = []string{"adminAuditPage", "adminDatabasesPage", "adminPage", "adminReportsPage",
+	"adminRequestsPage", "adminUsersPage", "contributorsPage", "databasePage", "diffPage", "discussionPage",
+	"discussionsPage", "errorPage", "jobPage", "loginPage", "mergeNewPage", "mergeRequestPage", "mergeRequestsPage",
+	"prefPage", "profilePage", "registerPage", "reportPage", "rootPage", "schemaPage", "starsPage", "statsPage",
+	"uploadConfirmPage", "uploadPage", "uploadSucceededPage", "userPage", "visualisePage"}
+
+// Checks all of the page templates are present in a parsed set of templates
+func checkTemplates(t *template.Template) error {
+	var missing []string
+	for _, name := range pageTemplates {
+		if t.Lookup(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing templates: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// The content types of the responses the server generates itself
+const (
+	contentTypeCSV       = "text/csv; charset=utf-8"
+	contentTypeHTML      = "text/html; charset=utf-8"
+	contentTypeJSON      = "application/json; charset=utf-8"
+	contentTypeJSONLines = "application/x-ndjson; charset=utf-8"
+)
+
+// The content type of stored and downloaded databases
+const contentTypeSQLite = "application/x-sqlite3"
+
+// Sends an already encoded JSON response
+func jsonOK(w http.ResponseWriter, jsonResponse []byte) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(jsonResponse)
+}
+
+// Encodes a value as JSON and sends it with the given status code.  The encoding is done before anything is
+// written, so a failure can still be reported with a proper status
+func writeJSON(w http.ResponseWriter, httpcode int, v interface{}) {
+	jsonResponse, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding JSON response: %v\n", err)
+		jsonError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(httpcode)
+	w.Write(jsonResponse)
+}
+
+// Sends an error message as JSON, for requests made by the front end rather than for a page
+func jsonError(w http.ResponseWriter, httpcode int, msg string) {
+	jsonResponse, _ := json.Marshal(struct{ Error string }{msg})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(httpcode)
+	w.Write(jsonResponse)
+}
+
+// Renders a page template.  If the template is missing, which can happen when templates are reloaded in development
+// mode, a plain text error is returned rather than the request panicking
+func renderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	renderTemplateStatus(w, http.StatusOK, name, data)
+}
+
+// Renders a page template with the given HTTP status code.  The page is rendered into a buffer first, and only sent
+// once that worked, so a failure partway through gives a plain error instead of half a page
+func renderTemplateStatus(w http.ResponseWriter, httpcode int, name string, data interface{}) {
+	t := tmpl.Lookup(name)
+	if t == nil {
+		log.Printf("Template '%s' not found\n", name)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	err := t.Execute(&buf, data)
+	if err != nil {
+		log.Printf("Error rendering template '%s': %v\n", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeHTML)
+	w.WriteHeader(httpcode)
+	buf.WriteTo(w)
+}
+
+// Generates a random string of lower case letters and digits, of the requested length
+func randomString(length int) string {
+	mathrand.Seed(time.Now().UnixNano())
+	const alphaNum = "abcdefghijklmnopqrstuvwxyz0123456789"
+	randomString := make([]byte, length)
+	for i := range randomString {
+		randomString[i] = alphaNum[mathrand.Intn(len(alphaNum))]
+	}
+	return string(randomString)
+}
+
+// Returned when a sum or average is asked for on a column which doesn't hold only numbers
+var errNonNumericColumn = errors.New("The Y column needs to be numeric for sum and avg")
+
+// Groups the rows of a SQLite table by a column, returning an aggregate of each Y column for each group.  The
+// count aggregate doesn't need a Y column.  Up to maxRows groups are returned
+func readSQLiteAggregate(ctx context.Context, db *sqlite.Conn, dbTable string, aggregate string, groupCol string,
+	yCols []string, filters []whereClause, maxRows int) (sqliteRecordSet, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.Interrupt()
+		case <-done:
+		}
+	}()
+
+	// Construct the WHERE clause
+	var conditions []string
+	var args []interface{}
+	for _, f := range filters {
+		conditions = append(conditions, fmt.Sprintf("%s %s ?", quoteIdentifier(f.Column), f.Type))
+		args = append(args, f.Value)
+	}
+	var where string
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	// Sums and averages only make sense for numbers
+	if aggregate == "sum" || aggregate == "avg" {
+		var typeChecks []string
+		for _, c := range yCols {
+			typeChecks = append(typeChecks, "typeof("+quoteIdentifier(c)+") NOT IN ('integer', 'real', 'null')")
+		}
+		typeCheck := "(" + strings.Join(typeChecks, " OR ") + ")"
+		if where == "" {
+			typeCheck = " WHERE " + typeCheck
+		} else {
+			typeCheck = where + " AND " + typeCheck
+		}
+		var nonNumeric int
+		err := db.OneValue("SELECT count(*) FROM "+quoteIdentifier(dbTable)+typeCheck, &nonNumeric, args...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return sqliteRecordSet{}, sqliteCtxErr(ctx)
+			}
+			log.Printf("Error checking column type for aggregation: %v\n", err)
+			return sqliteRecordSet{}, errors.New("Error when reading data from the SQLite database")
+		}
+		if nonNumeric > 0 {
+			return sqliteRecordSet{}, errNonNumericColumn
+		}
+	}
+
+	// Build and run the aggregate query
+	aggCols := []string{"count(*) AS count"}
+	if len(yCols) > 0 {
+		aggCols = nil
+		for _, c := range yCols {
+			aggCols = append(aggCols, fmt.Sprintf("%s(%s) AS %s", aggregate, quoteIdentifier(c),
+				quoteIdentifier(aggregate+"_"+c)))
+		}
+	}
+	dbQuery := fmt.Sprintf("SELECT %[1]s, %[2]s FROM %[3]s%[4]s GROUP BY %[1]s ORDER BY %[1]s LIMIT ?",
+		quoteIdentifier(groupCol), strings.Join(aggCols, ", "), quoteIdentifier(dbTable), where)
+	args = append(args, maxRows)
+	dataRows, err := readSQLiteRows(db, dbQuery, args, true, false, 1)
 	dataRows.Tablename = dbTable
+	if ctx.Err() != nil {
+		return dataRows, sqliteCtxErr(ctx)
+	}
+	return dataRows, err
+}
+
+// Reads up to maxRows number of rows from a given SQLite database table.  If maxRows < 0 (eg -1), then read all rows.
+func readSQLiteDB(db *sqlite.Conn, dbTable string, maxRows int) (sqliteRecordSet, error) {
+	return readSQLiteDBCols(db, dbTable, false, false, maxRows, nil, "*")
+}
+
+// Reads the rows of a SQLite table, converting the values into strings suitable for CSV.  Each row is passed to
+// the given function, so callers can choose whether to buffer or stream the output.  If columns are given only
+// those are read, and if maxRows is above zero no more than that many rows are read
+func readSQLiteTableCSV(db *sqlite.Conn, dbTable string, cols []string, filter rowFilter, maxRows int,
+	fn func(row []string) error) error {
+	// Retrieve the data from the selected database table
+	dbQuery, args, err := tableExportQuery(db, dbTable, cols, filter, maxRows)
+	if err != nil {
+		return err
+	}
+	stmt, err := db.Prepare(dbQuery, args...)
+	if err != nil {
+		log.Printf("Error when preparing statement for database: %s\v", err)
+		return err
+	}
+	defer stmt.Finalize()
+
+	// Process each row
+	fieldCount := -1
+	return stmt.Select(func(s *sqlite.Stmt) error {
+		// Get the number of fields in the result
+		if fieldCount == -1 {
+			fieldCount = stmt.DataCount()
+		}
+
+		// Retrieve the data for each row
+		var row []string
+		for i := 0; i < fieldCount; i++ {
+			// Retrieve the data type for the field
+			fieldType := stmt.ColumnType(i)
+
+			isNull := false
+			switch fieldType {
+			case sqlite.Integer:
+				var val int
+				val, isNull, err = s.ScanInt(i)
+				if err != nil {
+					log.Printf("Something went wrong with ScanInt(): %v\n", err)
+					break
+				}
+				if !isNull {
+					row = append(row, fmt.Sprintf("%d", val))
+				}
+			case sqlite.Float:
+				var val float64
+				val, isNull, err = s.ScanDouble(i)
+				if err != nil {
+					log.Printf("Something went wrong with ScanDouble(): %v\n", err)
+					break
+				}
+				if !isNull {
+					row = append(row, strconv.FormatFloat(val, 'f', 4, 64))
+				}
+			case sqlite.Text:
+				var val string
+				val, isNull = s.ScanText(i)
+				if !isNull {
+					row = append(row, val)
+				}
+			case sqlite.Blob:
+				var val []byte
+				val, isNull = s.ScanBlob(i)
+				if !isNull {
+					// Base64 encode the value
+					row = append(row, base64.StdEncoding.EncodeToString(val))
+				}
+			case sqlite.Null:
+				isNull = true
+			}
+			if isNull {
+				row = append(row, "NULL")
+			}
+		}
+		return fn(row)
+	})
+}
+
+// Reads up to maxRows # of rows from a SQLite database.  Only returns the requested columns
+func readSQLiteDBCols(db *sqlite.Conn, dbTable string, ignoreBinary bool, ignoreNull bool, maxRows int,
+	filters []whereClause, cols ...string) (sqliteRecordSet, error) {
+	// Ugh, have to use string smashing for this, even though the SQL spec doesn't seem to say table names
+	// shouldn't be parameterised.  Limitation from SQLite's implementation? :(
 
 	// Construct the main SQL query
 	var colString string
@@ -305,34 +1696,106 @@ func readSQLiteDBCols(db *sqlite.Conn, dbTable string, ignoreBinary bool, ignore
 	dbQuery := fmt.Sprintf("SELECT %s FROM %s", colString, dbTable)
 
 	// If filters were given, add them
-	var filterVals []interface{}
-	if filters != nil {
-		for i, d := range filters {
-			if i != 0 {
-				dbQuery += " AND "
-			}
-			dbQuery = fmt.Sprintf("%s WHERE %s %s ?", dbQuery, d.Column, d.Type)
-			filterVals = append(filterVals, d.Value)
-		}
+	conds, filterVals := whereConditions(filters)
+	if len(conds) > 0 {
+		dbQuery += " WHERE " + strings.Join(conds, " AND ")
 	}
 
 	// If a row limit was given, add it
 	if maxRows >= 0 {
+		dbQuery += " LIMIT ?"
+		filterVals = append(filterVals, maxRows)
+	}
+
+	dataRows, err := readSQLiteRows(db, dbQuery, filterVals, ignoreBinary, ignoreNull, 1)
+	dataRows.Tablename = dbTable
+	return dataRows, err
+}
 
-		dbQuery = fmt.Sprintf("%s LIMIT %d", dbQuery, maxRows)
+// Context aware version of readSQLiteDBCols().  If the context is cancelled, the SQLite query is interrupted
+func readSQLiteDBColsCtx(ctx context.Context, db *sqlite.Conn, dbTable string, ignoreBinary bool, ignoreNull bool,
+	maxRows int, filters []whereClause, cols ...string) (sqliteRecordSet, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.Interrupt()
+		case <-done:
+		}
+	}()
+	dataRows, err := readSQLiteDBCols(db, dbTable, ignoreBinary, ignoreNull, maxRows, filters, cols...)
+	if ctx.Err() != nil {
+		return dataRows, sqliteCtxErr(ctx)
 	}
+	return dataRows, err
+}
 
-	// Use parameter binding for the WHERE clause values
-	if filters != nil {
-		// Use parameter binding for the user supplied WHERE expression (safety!)
-		stmt, err = db.Prepare(dbQuery, filterVals...)
-	} else {
-		stmt, err = db.Prepare(dbQuery)
+// Context aware version of readSQLiteDB()
+func readSQLiteDBCtx(ctx context.Context, db *sqlite.Conn, dbTable string, maxRows int) (sqliteRecordSet, error) {
+	return readSQLiteDBColsCtx(ctx, db, dbTable, false, false, maxRows, nil, "*")
+}
+
+// Like readSQLiteDBCtx(), but reads the window of up to maxRows rows starting at the given offset, optionally
+// ordered by a column.  If columns are given only those are read, and if where clauses are given only the rows
+// matching them.  The columns need to have been checked with tableHasColumn() first, and sortDir needs to be one
+// returned by sortDirection()
+func readSQLiteDBWindowCtx(ctx context.Context, db *sqlite.Conn, dbTable string, maxRows int, offset int,
+	sortCol string, sortDir string, cols []string, where []whereClause) (sqliteRecordSet, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.Interrupt()
+		case <-done:
+		}
+	}()
+	dbQuery := "SELECT " + selectColumns(cols) + " FROM " + quoteIdentifier(dbTable)
+	conds, args := whereConditions(where)
+	if len(conds) > 0 {
+		dbQuery += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if sortCol != "" {
+		dbQuery += " ORDER BY " + quoteIdentifier(sortCol) + " " + sortDir
+	}
+	dbQuery += " LIMIT ? OFFSET ?"
+	dataRows, err := readSQLiteRows(db, dbQuery, append(args, maxRows, offset), false, false, 1)
+	dataRows.Tablename = dbTable
+	dataRows.SortCol = sortCol
+	dataRows.SortDir = sortDir
+	dataRows.Offset = offset
+	if ctx.Err() != nil {
+		return dataRows, sqliteCtxErr(ctx)
+	}
+	return dataRows, err
+}
+
+// Returns the quoted column list for a SELECT, or "*" when no columns are given
+func selectColumns(cols []string) string {
+	if len(cols) == 0 {
+		return "*"
+	}
+	var quoted []string
+	for _, c := range cols {
+		quoted = append(quoted, quoteIdentifier(c))
 	}
+	return strings.Join(quoted, ", ")
+}
+
+// Runs a query against a SQLite database, returning the results as a record set.  Only every step'th row is
+// kept, which is used for downsampling.  The args are bound to the query's placeholders when it's run, so values
+// such as the LIMIT and OFFSET should be passed that way rather than pasted into the query
+func readSQLiteRows(db *sqlite.Conn, dbQuery string, args []interface{}, ignoreBinary bool, ignoreNull bool,
+	step int) (sqliteRecordSet, error) {
+	var dataRows sqliteRecordSet
+
+	stmt, err := db.Prepare(dbQuery)
 	if err != nil {
 		log.Printf("Error when preparing statement for database: %s\v", err)
 		return dataRows, errors.New("Error when reading data from the SQLite database")
 	}
+	defer stmt.Finalize()
 
 	// Retrieve the field names
 	dataRows.ColNames = stmt.ColumnNames()
@@ -340,7 +1803,12 @@ func readSQLiteDBCols(db *sqlite.Conn, dbTable string, ignoreBinary bool, ignore
 
 	// Process each row
 	fieldCount := -1
+	rowNum := -1
 	err = stmt.Select(func(s *sqlite.Stmt) error {
+		rowNum++
+		if step > 1 && rowNum%step != 0 {
+			return nil
+		}
 
 		// Get the number of fields in the result
 		if fieldCount == -1 {
@@ -390,10 +1858,10 @@ func readSQLiteDBCols(db *sqlite.Conn, dbTable string, ignoreBinary bool, ignore
 			case sqlite.Blob:
 				// BLOBs can be ignored (via flag to this function) for situations like the vis data
 				if !ignoreBinary {
-					_, isNull = s.ScanBlob(i)
+					var val []byte
+					val, isNull = s.ScanRawBytes(i)
 					if !isNull {
-						row = append(row, dataValue{Name: dataRows.ColNames[i], Type: Binary,
-							Value: "<i>BINARY DATA</i>"})
+						row = append(row, blobValue(dataRows.ColNames[i], val, conf.Web.CellLength))
 					}
 				} else {
 					addRow = false
@@ -403,8 +1871,7 @@ func readSQLiteDBCols(db *sqlite.Conn, dbTable string, ignoreBinary bool, ignore
 			}
 			if isNull && !ignoreNull {
 				// NULLS can be ignored (via flag to this function) for situations like the vis data
-				row = append(row, dataValue{Name: dataRows.ColNames[i], Type: Null,
-					Value: "<i>NULL</i>"})
+				row = append(row, dataValue{Name: dataRows.ColNames[i], Type: Null})
 			}
 			if isNull && ignoreNull {
 				addRow = false
@@ -416,12 +1883,288 @@ func readSQLiteDBCols(db *sqlite.Conn, dbTable string, ignoreBinary bool, ignore
 		}
 
 		return nil
-	})
+	}, args...)
 	if err != nil {
 		log.Printf("Error when retrieving select data from database: %s\v", err)
 		return dataRows, errors.New("Error when reading data from the SQLite database")
 	}
-	defer stmt.Finalize()
 
 	return dataRows, nil
 }
+
+// Moves the key columns read at the start of each row of a record set into its RowKeys, leaving just the table's
+// own columns in the rows
+func splitRowKeys(dataRows *sqliteRecordSet, keyCols []string) {
+	n := len(keyCols)
+	if n == 0 || len(dataRows.ColNames) < n {
+		return
+	}
+	dataRows.KeyCols = keyCols
+	dataRows.ColNames = dataRows.ColNames[n:]
+	dataRows.ColCount = len(dataRows.ColNames)
+	for i, row := range dataRows.Records {
+		key := make(map[string]string)
+		for j, k := range keyCols {
+			key[k] = row[j].Value
+		}
+		dataRows.RowKeys = append(dataRows.RowKeys, key)
+		dataRows.Records[i] = row[n:]
+	}
+}
+
+// The first 16 bytes of every unencrypted SQLite 3 database file
+const sqliteHeader = "SQLite format 3\x00"
+
+// Recognisable file signatures, used to tell people what they uploaded when it's not a SQLite database
+var fileSignatures = []struct {
+	prefix string
+	kind   string
+}{
+	{"PK\x03\x04", "a zip archive (possibly a spreadsheet or document)"},
+	{"\x1f\x8b", "a gzip compressed file"},
+	{"BZh", "a bzip2 compressed file"},
+	{"\xfd7zXZ\x00", "an xz compressed file"},
+	{"7z\xbc\xaf\x27\x1c", "a 7-Zip archive"},
+	{"Rar!\x1a\x07", "a RAR archive"},
+	{"%PDF-", "a PDF document"},
+	{"\x89PNG\r\n\x1a\n", "a PNG image"},
+	{"\xff\xd8\xff", "a JPEG image"},
+	{"GIF8", "a GIF image"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "an older Microsoft Office document"},
+	{"\x00\x01\x00\x00Standard Jet DB", "a Microsoft Access database"},
+	{"\x00\x01\x00\x00Standard ACE DB", "a Microsoft Access database"},
+	{"** This file contains an SQLite", "a SQLite 2 database, which isn't supported"},
+}
+
+// Works out what kind of file the given leading bytes come from.  Returns an empty string for SQLite 3 databases,
+// otherwise a short description suitable for an error message.  A description of "encrypted" means the data looks
+// like an encrypted database (SEE, SQLCipher and friends encrypt the header too), though it could also be any
+// other binary file
+func detectFileType(header []byte) string {
+	if bytes.HasPrefix(header, []byte(sqliteHeader)) {
+		return ""
+	}
+	for _, sig := range fileSignatures {
+		if bytes.HasPrefix(header, []byte(sig.prefix)) {
+			return sig.kind
+		}
+	}
+	if len(header) == 0 {
+		return "an empty file"
+	}
+
+	// Look at the mix of bytes to tell text from binary
+	printable := 0
+	for _, b := range header {
+		if b == '\t' || b == '\n' || b == '\r' || (b >= 0x20 && b < 0x7f) || b >= 0x80 {
+			printable++
+		}
+	}
+	if printable == len(header) {
+		trimmed := bytes.TrimLeft(header, " \t\r\n\xef\xbb\xbf")
+		switch {
+		case bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")):
+			return "a JSON file"
+		case bytes.HasPrefix(trimmed, []byte("<")):
+			return "an HTML or XML file"
+		case bytes.HasPrefix(bytes.ToUpper(trimmed), []byte("CREATE ")) ||
+			bytes.HasPrefix(bytes.ToUpper(trimmed), []byte("BEGIN TRANSACTION")) ||
+			bytes.HasPrefix(bytes.ToUpper(trimmed), []byte("PRAGMA ")):
+			return "a SQL text file"
+		case bytes.ContainsAny(trimmed, ",;\t"):
+			return "a CSV or other text file"
+		}
+		return "a text file"
+	}
+	return "encrypted"
+}
+
+// Reads the header of a file, and returns an error describing the file when it isn't a SQLite 3 database
+func checkSQLiteHeader(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Couldn't open file when checking its header: %s", err)
+		return errors.New("Internal error")
+	}
+	defer f.Close()
+	header := make([]byte, 64)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		log.Printf("Couldn't read file header: %s", err)
+		return errors.New("Internal error")
+	}
+	switch kind := detectFileType(header[:n]); kind {
+	case "":
+		return nil
+	case "encrypted":
+		return errors.New("This doesn't look like a SQLite database.  If it's an encrypted database, please " +
+			"upload an unencrypted copy")
+	default:
+		return fmt.Errorf("This isn't a SQLite database, it looks like %s", kind)
+	}
+}
+
+// Performs a read on a database file, as a basic sanity check to ensure it's really a SQLite database with at least
+// one table.  The returned errors are suitable for showing to the user
+func sanityCheckSQLite(path string) error {
+	// Check the file header first, so obviously wrong files get a useful message without involving SQLite
+	err := checkSQLiteHeader(path)
+	if err != nil {
+		log.Printf("Sanity check of '%s' failed: %s", path, err)
+		return err
+	}
+
+	// The file is opened as immutable, so SQLite doesn't leave -wal and -shm files beside it for a WAL mode database
+	uri := url.URL{Scheme: "file", Path: path, RawQuery: "immutable=1"}
+	sqliteDB, err := sqlite.Open(uri.String(), sqlite.OpenReadOnly, sqlite.OpenURI)
+	if err != nil {
+		log.Printf("Couldn't open database when sanity checking: %s", err)
+		return errors.New("The database couldn't be opened.  It may be corrupt")
+	}
+	defer sqliteDB.Close()
+	tables, err := sqliteDB.Tables("")
+	if err != nil {
+		log.Printf("Error retrieving table names when sanity checking: %s", err)
+		if cerr, ok := err.(sqlite.ConnError); ok && cerr.Code() == sqlite.ErrNotDB {
+			// The header is fine but the rest isn't readable, which is what an encrypted database with a plain
+			// text header looks like
+			return errors.New("The database appears to be encrypted.  Please upload an unencrypted copy")
+		}
+		return errors.New("The database appears to be corrupt.  Its list of tables couldn't be read")
+	}
+	if len(tables) == 0 {
+		// No table names were returned, so abort.  For a database in WAL mode that means they're all in the -wal
+		// file, which wasn't uploaded along with it
+		log.Printf("Sanity check of '%s' failed, as it doesn't seem to have any tables.", path)
+		if isWALDatabase(path) {
+			return errWALDatabase
+		}
+		return errors.New("Database has no tables?")
+	}
+
+	// Make sure the rest of the file is intact too
+	var result string
+	err = sqliteDB.OneValue("PRAGMA integrity_check(1)", &result)
+	if err != nil || result != "ok" {
+		log.Printf("Integrity check of '%s' failed. Result: '%s', error: %v", path, result, err)
+		if result == "" {
+			return errors.New("The database appears to be corrupt, as its integrity check couldn't be run")
+		}
+		return fmt.Errorf("The database appears to be corrupt.  Its integrity check failed with: %s", result)
+	}
+	return nil
+}
+
+// Returns the columns of a table, in the order SELECT * returns them.  PRAGMA table_info leaves out generated
+// columns, so PRAGMA table_xinfo is used where the SQLite version has it.  The hidden columns of virtual tables
+// aren't returned by SELECT *, so they're skipped
+func tableColumns(db *sqlite.Conn, dbTable string) ([]columnInfo, error) {
+	stmt, err := db.Prepare("PRAGMA table_xinfo(" + quoteIdentifier(dbTable) + ")")
+	if err != nil {
+		// Older SQLite, which doesn't know about generated columns either
+		tableCols, err := db.Columns("", dbTable)
+		if err != nil {
+			return nil, err
+		}
+		var cols []columnInfo
+		for _, c := range tableCols {
+			cols = append(cols, columnInfo{Name: c.Name, DataType: c.DataType, NotNull: c.NotNull, Pk: c.Pk})
+		}
+		return cols, nil
+	}
+	defer stmt.Finalize()
+	var cols []columnInfo
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		var c columnInfo
+		var notNull, hidden int
+		c.Name, _ = s.ScanText(1)
+		c.DataType, _ = s.ScanText(2)
+		notNull, _, err := s.ScanInt(3)
+		if err != nil {
+			return err
+		}
+		c.Pk, _, err = s.ScanInt(5)
+		if err != nil {
+			return err
+		}
+		hidden, _, err = s.ScanInt(6)
+		if err != nil {
+			return err
+		}
+		c.NotNull = notNull != 0
+		c.Generated = hidden == 2 || hidden == 3
+		if hidden != 1 {
+			cols = append(cols, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("No such table: %s", dbTable)
+	}
+	return cols, nil
+}
+
+// Returns the table whose name matches the given one apart from case.  Nothing is returned if there's no such table,
+// or if more than one match, as picking between them would be a guess
+func matchTableName(tables []string, name string) (string, bool) {
+	var match string
+	found := 0
+	for _, tbl := range tables {
+		if strings.EqualFold(tbl, name) {
+			match = tbl
+			found++
+		}
+	}
+	if found != 1 {
+		return "", false
+	}
+	return match, true
+}
+
+// Returns true if the given table in a SQLite database has a column with the given name
+func tableHasColumn(db *sqlite.Conn, dbTable string, colName string) bool {
+	cols, err := tableColumns(db, dbTable)
+	if err != nil {
+		log.Printf("Error retrieving columns of table '%s': %v\n", dbTable, err)
+		return false
+	}
+	for _, c := range cols {
+		if c.Name == colName {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds the query for exporting the rows of a table, with the row filter applied.  If columns are given only those
+// are selected, and if maxRows is above zero no more than that many rows are returned
+func tableExportQuery(db *sqlite.Conn, dbTable string, cols []string, filter rowFilter, maxRows int) (string,
+	[]interface{}, error) {
+	colString := selectColumns(cols)
+	clauses, args, err := rowFilterClauses(db, dbTable, filter)
+	if err != nil {
+		return "", nil, err
+	}
+	dbQuery := "SELECT " + colString + " FROM " + quoteIdentifier(dbTable) + clauses
+	if maxRows > 0 {
+		dbQuery += " LIMIT " + strconv.Itoa(maxRows)
+	}
+	return dbQuery, args, nil
+}
+
+// Returns true if the given IP address is one of our trusted proxies
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, j := range conf.Web.TrustedProxies {
+		if ipNet := parseIPRange(j); ipNet != nil && ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// A view which never returns, so reads from it only stop when they're interrupted
+const slowViewSQL = `CREATE VIEW slow AS
+	WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n)
+	SELECT x FROM n WHERE x < 0`
+
+// Runs fn, failing the test if it hasn't returned within a few seconds
+func finishesSoon(t *testing.T, what string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s didn't stop", what)
+	}
+}
+
+func TestReadSQLiteStopsWhenCancelled(t *testing.T) {
+	sdb := openTestSQLite(t, "cancel.sqlite", slowViewSQL)
+	defer sdb.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	var err error
+	finishesSoon(t, "Reading from SQLite", func() {
+		_, err = readSQLiteDBColsCtx(ctx, sdb, "slow", false, false, -1, nil, "*")
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestReadSQLiteStopsAtTimeout(t *testing.T) {
+	sdb := openTestSQLite(t, "timeout.sqlite", slowViewSQL)
+	defer sdb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var err error
+	finishesSoon(t, "Reading from SQLite", func() {
+		_, err = readSQLiteDBWindowCtx(ctx, sdb, "slow", 10, 0, "", "", nil, nil)
+	})
+	if err != errQueryTooLong {
+		t.Errorf("Expected %v, got %v", errQueryTooLong, err)
+	}
+}
+
+func TestOpenMinioObjectStopsWhenCancelled(t *testing.T) {
+	// With every slot taken, opening a database has to wait, which the cancelled context cuts short before Minio
+	// is asked for anything
+	for i := 0; i < cap(tempDBSlots); i++ {
+		tempDBSlots <- struct{}{}
+	}
+	defer func() {
+		for len(tempDBSlots) > 0 {
+			releaseTempDBSlot()
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var err error
+	finishesSoon(t, "Opening a database", func() {
+		_, err = openMinioObjectCtx(ctx, "bucket", "id")
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestCheckUserDBAccessStopsWhenCancelled(t *testing.T) {
+	requireBackends(t)
+	owner := testUserName("ctxowner")
+	addTestUser(t, owner)
+	addTestDatabase(t, owner, "cancel.sqlite", true, "CREATE TABLE t (a INTEGER)")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var DB sqliteDBinfo
+	err := checkUserDBAccessCtx(ctx, &DB, "", owner, "cancel.sqlite")
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+
+	// The same lookup works when the client is still there
+	err = checkUserDBAccessCtx(context.Background(), &DB, "", owner, "cancel.sqlite")
+	if err != nil {
+		t.Errorf("Access check failed: %v", err)
+	}
+}
+
+func TestDetectFileType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		kind   string
+	}{
+		{"SQLite 3", "SQLite format 3\x00\x10\x00\x01\x01", ""},
+		{"SQLite 2", "** This file contains an SQLite 2.1 database **", "a SQLite 2 database, which isn't supported"},
+		{"Zip", "PK\x03\x04\x14\x00\x06\x00", "a zip archive (possibly a spreadsheet or document)"},
+		{"Gzip", "\x1f\x8b\x08\x00", "a gzip compressed file"},
+		{"PDF", "%PDF-1.4\n", "a PDF document"},
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00", "a PNG image"},
+		{"Access", "\x00\x01\x00\x00Standard Jet DB\x00", "a Microsoft Access database"},
+		{"CSV", "id,name,value\n1,foo,2\n", "a CSV or other text file"},
+		{"CSV with BOM", "\xef\xbb\xbfid;name\n", "a CSV or other text file"},
+		{"JSON", "  {\"a\": 1}", "a JSON file"},
+		{"HTML", "<!DOCTYPE html>", "an HTML or XML file"},
+		{"SQL dump", "BEGIN TRANSACTION;\nCREATE TABLE", "a SQL text file"},
+		{"SQL schema", "create table foo (a)", "a SQL text file"},
+		{"Plain text", "hello world", "a text file"},
+		{"Empty", "", "an empty file"},
+		{"Encrypted", "\x8a\x03\x00\x91\x1c\x05\xee\x00\x12", "encrypted"},
+	}
+	for _, tt := range tests {
+		if kind := detectFileType([]byte(tt.header)); kind != tt.kind {
+			t.Errorf("%s: expected '%s', got '%s'", tt.name, tt.kind, kind)
+		}
+	}
+}
+
+// Writes a file for a sanity check test into the test directory, returning its path
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(testDir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Error writing test file '%s': %v", name, err)
+	}
+	return path
+}
+
+func TestSanityCheckSQLite(t *testing.T) {
+	good := newTestSQLite(t, "good.sqlite", "CREATE TABLE t (a INTEGER, b TEXT)", "INSERT INTO t VALUES (1, 'x')")
+	if err := sanityCheckSQLite(good); err != nil {
+		t.Errorf("Valid database failed its sanity check: %v", err)
+	}
+
+	empty := newTestSQLite(t, "notables.sqlite", "PRAGMA user_version = 1")
+	if err := sanityCheckSQLite(empty); err == nil || !strings.Contains(err.Error(), "no tables") {
+		t.Errorf("Expected an error about there being no tables, got %v", err)
+	}
+
+	csv := writeTestFile(t, "data.csv", []byte("id,name\n1,foo\n"))
+	err := sanityCheckSQLite(csv)
+	if err == nil || err.Error() != "This isn't a SQLite database, it looks like a CSV or other text file" {
+		t.Errorf("Unexpected error for a CSV file: %v", err)
+	}
+
+	encrypted := writeTestFile(t, "encrypted.sqlite", []byte("\x8a\x03\x00\x91\x1c\x05\xee\x00\x12\x7f"))
+	err = sanityCheckSQLite(encrypted)
+	if err == nil || !strings.Contains(err.Error(), "encrypted database") {
+		t.Errorf("Expected an error about encryption, got %v", err)
+	}
+
+	// Scribble over the pages holding the table, leaving the header and schema on the first page intact
+	var stmts []string
+	stmts = append(stmts, "CREATE TABLE t (a INTEGER, b TEXT)")
+	for i := 0; i < 200; i++ {
+		stmts = append(stmts, "INSERT INTO t VALUES (1, '"+strings.Repeat("x", 100)+"')")
+	}
+	data, err := ioutil.ReadFile(newTestSQLite(t, "corrupt.sqlite", stmts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 4096; i < len(data); i++ {
+		data[i] = 0xa5
+	}
+	corrupt := writeTestFile(t, "corrupt.sqlite", data)
+	err = sanityCheckSQLite(corrupt)
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Expected an error about corruption, got %v", err)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		fileName string
+		header   string
+	}{
+		{"plain.db", `attachment; filename="plain.db"; filename*=UTF-8''plain.db`},
+		{"my database.db", `attachment; filename="my database.db"; filename*=UTF-8''my%20database.db`},
+		{`say "hi".db`, `attachment; filename="say _hi_.db"; filename*=UTF-8''say%20%22hi%22.db`},
+		{`back\slash.db`, `attachment; filename="back_slash.db"; filename*=UTF-8''back%5Cslash.db`},
+		{"a,b;c.csv", `attachment; filename="a,b;c.csv"; filename*=UTF-8''a%2Cb%3Bc.csv`},
+		{"données.db", `attachment; filename="donn_es.db"; filename*=UTF-8''donn%C3%A9es.db`},
+		{"数据.sqlite", `attachment; filename="__.sqlite"; filename*=UTF-8''%E6%95%B0%E6%8D%AE.sqlite`},
+		{"Ελληνικά.csv", `attachment; filename="________.csv"; ` +
+			`filename*=UTF-8''%CE%95%CE%BB%CE%BB%CE%B7%CE%BD%CE%B9%CE%BA%CE%AC.csv`},
+		{"new\nline.db", `attachment; filename="new_line.db"; filename*=UTF-8''new%0Aline.db`},
+	}
+	for _, tt := range tests {
+		if header := contentDisposition("attachment", tt.fileName); header != tt.header {
+			t.Errorf("For '%s' expected\n\t%s\ngot\n\t%s", tt.fileName, tt.header, header)
+		}
+	}
+
+	// Inline use only changes the disposition
+	header := contentDisposition("inline", "chart.svg")
+	if header != `inline; filename="chart.svg"; filename*=UTF-8''chart.svg` {
+		t.Errorf("Unexpected inline header: %s", header)
+	}
+}
+
+// Creates a database in WAL mode, returning the path of a copy of just its main file, the way it would be uploaded.
+// When checkpoint is false the copy is made while everything is still in the -wal file
+func newWALTestSQLite(t *testing.T, name string, checkpoint bool, stmts ...string) string {
+	sdb, err := sqlite.Open(filepath.Join(testDir, "wal-"+name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+	var mode string
+	if err = sdb.OneValue("PRAGMA journal_mode = WAL", &mode); err != nil || mode != "wal" {
+		t.Fatalf("Couldn't switch to WAL mode: %s %v", mode, err)
+	}
+	var n int
+	if err = sdb.OneValue("PRAGMA wal_autocheckpoint = 0", &n); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stmts {
+		if err = sdb.Exec(s); err != nil {
+			t.Fatalf("Error running '%s': %v", s, err)
+		}
+	}
+	if checkpoint {
+		if err = sdb.OneValue("PRAGMA wal_checkpoint(TRUNCATE)", &n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(testDir, "wal-"+name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, name, data)
+}
+
+func TestOpenWALDatabase(t *testing.T) {
+	stmts := []string{"CREATE TABLE t (a INTEGER, b TEXT)", "INSERT INTO t VALUES (1, 'x')"}
+
+	// Once checkpointed the main file has everything, and reads the same as any other database even though its
+	// header still says WAL mode
+	path := newWALTestSQLite(t, "checkpointed.sqlite", true, stmts...)
+	if !isWALDatabase(path) {
+		t.Fatal("Database isn't in WAL mode")
+	}
+	if err := sanityCheckSQLite(path); err != nil {
+		t.Errorf("Checkpointed database failed its sanity check: %v", err)
+	}
+	sdb, err := openImmutableSQLite(path)
+	if err != nil {
+		t.Fatalf("Checkpointed database couldn't be opened: %v", err)
+	}
+	var b string
+	err = sdb.OneValue("SELECT b FROM t WHERE a = 1", &b)
+	sdb.Close()
+	if err != nil || b != "x" {
+		t.Errorf("Expected to read 'x', got '%s' (%v)", b, err)
+	}
+
+	// Without its -wal file the main file has nothing in it, which is refused with a message saying why rather than
+	// being shown as a database without tables
+	path = newWALTestSQLite(t, "uncheckpointed.sqlite", false, stmts...)
+	if err = sanityCheckSQLite(path); err != errWALDatabase {
+		t.Errorf("Expected the sanity check to give %v, got %v", errWALDatabase, err)
+	}
+	if sdb, err = openImmutableSQLite(path); err != errWALDatabase {
+		if err == nil {
+			sdb.Close()
+		}
+		t.Errorf("Expected opening the database to give %v, got %v", errWALDatabase, err)
+	}
+
+	// Neither leaves -wal or -shm files behind
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if _, err = os.Stat(path + suffix); !os.IsNotExist(err) {
+			t.Errorf("Found a %s file after reading the database", suffix)
+		}
+	}
+}
+
+func TestUserDBSectionVisibility(t *testing.T) {
+	requireBackends(t)
+	stmts := []string{"CREATE TABLE t (a INTEGER)"}
+	privateOnly := testUserName("privonly")
+	publicOnly := testUserName("pubonly")
+	mixed := testUserName("mixed")
+	for _, u := range []string{privateOnly, publicOnly, mixed} {
+		addTestUser(t, u)
+	}
+	addTestDatabase(t, privateOnly, "a.sqlite", false, stmts...)
+	addTestDatabase(t, privateOnly, "b.sqlite", false, stmts...)
+	addTestDatabase(t, publicOnly, "a.sqlite", true, stmts...)
+	addTestDatabase(t, publicOnly, "b.sqlite", true, stmts...)
+	addTestDatabase(t, mixed, "a.sqlite", true, stmts...)
+	addTestDatabase(t, mixed, "b.sqlite", false, stmts...)
+
+	// A database whose latest version is private is listed publicly with its latest public version
+	addTestDatabase(t, mixed, "c.sqlite", true, stmts...)
+	addTestDatabase(t, mixed, "c.sqlite", false, append(stmts, "CREATE TABLE u (b TEXT)")...)
+
+	tests := []struct {
+		user       string
+		publicOnly bool
+		dbs        []string // The databases listed, as name:version
+	}{
+		{privateOnly, true, nil},
+		{privateOnly, false, []string{"a.sqlite:1", "b.sqlite:1"}},
+		{publicOnly, true, []string{"a.sqlite:1", "b.sqlite:1"}},
+		{publicOnly, false, []string{"a.sqlite:1", "b.sqlite:1"}},
+		{mixed, true, []string{"a.sqlite:1", "c.sqlite:1"}},
+		{mixed, false, []string{"a.sqlite:1", "b.sqlite:1", "c.sqlite:2"}},
+	}
+	opts := dbListOptions{Sort: "name", Dir: "ASC"}
+	ctx := context.Background()
+	for _, tt := range tests {
+		list, err := getUserDBSection(ctx, tt.user, tt.publicOnly, opts, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dbs []string
+		for _, d := range list {
+			dbs = append(dbs, fmt.Sprintf("%s:%d", d.Database, d.Version))
+		}
+		if !reflect.DeepEqual(dbs, tt.dbs) {
+			t.Errorf("%s (public only %v): expected %v, got %v", tt.user, tt.publicOnly, tt.dbs, dbs)
+		}
+		total, err := countUserDBSection(ctx, tt.user, tt.publicOnly, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != len(tt.dbs) {
+			t.Errorf("%s (public only %v): expected a count of %d, got %d", tt.user, tt.publicOnly, len(tt.dbs),
+				total)
+		}
+	}
+}
+
+// Returns the statements for a table of n rows, numbered from 1
+func numberedRowsFixture(n int) []string {
+	stmts := []string{"CREATE TABLE t (n INTEGER, s TEXT)"}
+	for i := 1; i <= n; i++ {
+		stmts = append(stmts, fmt.Sprintf("INSERT INTO t VALUES (%d, 'row %d')", i, i))
+	}
+	return stmts
+}
+
+func TestReadSQLiteRowLimit(t *testing.T) {
+	sdb := openTestSQLite(t, "hundred.sqlite", numberedRowsFixture(100)...)
+	defer sdb.Close()
+
+	tests := []struct {
+		maxRows int
+		offset  int
+		first   string
+		count   int
+	}{
+		{10, 0, "1", 10},
+		{10, 20, "21", 10},
+		{10, 95, "96", 5},
+		{200, 0, "1", 100},
+		{10, 100, "", 0},
+	}
+	for _, tt := range tests {
+		data, err := readSQLiteDBWindowCtx(context.Background(), sdb, "t", tt.maxRows, tt.offset, "n", "ASC", nil,
+			nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Records) != tt.count || data.RowCount != tt.count {
+			t.Errorf("%d rows from %d: expected %d rows, got %d (RowCount %d)", tt.maxRows, tt.offset, tt.count,
+				len(data.Records), data.RowCount)
+			continue
+		}
+		if tt.count > 0 && data.Records[0][0].Value != tt.first {
+			t.Errorf("%d rows from %d: expected the first row to be %s, got %s", tt.maxRows, tt.offset, tt.first,
+				data.Records[0][0].Value)
+		}
+	}
+
+	// The database page reads the rowid along with the rows, with the limit bound the same way
+	data, err := readSQLiteRows(sdb, `SELECT rowid, * FROM "t" LIMIT ? OFFSET ?`, []interface{}{10, 0}, false,
+		false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	splitRowKeys(&data, []string{"rowid"})
+	if len(data.Records) != 10 || len(data.RowKeys) != 10 {
+		t.Fatalf("Expected 10 rows, got %d with %d keys", len(data.Records), len(data.RowKeys))
+	}
+	if !reflect.DeepEqual(data.ColNames, []string{"n", "s"}) || data.RowKeys[9]["rowid"] != "10" {
+		t.Errorf("Unexpected columns %v or keys %v", data.ColNames, data.RowKeys)
+	}
+}
+
+func TestCanonicalUsername(t *testing.T) {
+	requireBackends(t)
+	single := strings.ToLower(testUserName("single"))
+	double := strings.ToLower(testUserName("double"))
+	addTestUser(t, single)
+	addTestUser(t, double)
+	addTestUser(t, strings.ToUpper(double))
+
+	// Case only matters when several users have the same name in different cases
+	tests := []struct {
+		name string
+		want string
+	}{
+		{single, single},
+		{strings.ToUpper(single), single},
+		{double, double},
+		{strings.ToUpper(double), strings.ToUpper(double)},
+		{strings.Title(double), strings.Title(double)},
+		{"nobody" + single, "nobody" + single},
+	}
+	for _, tt := range tests {
+		got, err := canonicalUsername(tt.name)
+		if err != nil {
+			t.Fatalf("Error looking up '%s': %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("'%s': expected '%s', got '%s'", tt.name, tt.want, got)
+		}
+	}
+}
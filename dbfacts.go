@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Facts about how a database file was made, for people who want to know what they're getting before downloading
+// it.  Anything which couldn't be read is left as nil, which the API gives as null and pages show as a dash
+type dbFacts struct {
+	PageSize      *int    `json:"page_size"`
+	Encoding      *string `json:"encoding"`
+	UserVersion   *int    `json:"user_version"`
+	ApplicationID *int    `json:"application_id"`
+	ForeignKeys   *bool   `json:"foreign_keys"`       // Whether any table declares a foreign key
+	MinSQLite     *string `json:"min_sqlite_version"` // The oldest SQLite library which understands the schema
+}
+
+// A fact ready for showing on a page
+type dbFactRow struct {
+	Name  string
+	Value string
+}
+
+// Returns the facts as name and value pairs, in the order they're shown
+func (f dbFacts) Rows() []dbFactRow {
+	unknown := "—"
+	str := func(s *string) string {
+		if s == nil || *s == "" {
+			return unknown
+		}
+		return *s
+	}
+	num := func(n *int) string {
+		if n == nil {
+			return unknown
+		}
+		return strconv.Itoa(*n)
+	}
+	fks := unknown
+	if f.ForeignKeys != nil {
+		fks = "No"
+		if *f.ForeignKeys {
+			fks = "Yes"
+		}
+	}
+	appID := num(f.ApplicationID)
+	if f.ApplicationID != nil && *f.ApplicationID != 0 {
+		// Application IDs are usually picked to spell something out in hex
+		appID = fmt.Sprintf("%d (0x%08x)", *f.ApplicationID, uint32(*f.ApplicationID))
+	}
+	return []dbFactRow{
+		{"Page size", num(f.PageSize)},
+		{"Encoding", str(f.Encoding)},
+		{"User version", num(f.UserVersion)},
+		{"Application ID", appID},
+		{"Foreign keys", fks},
+		{"Needs SQLite", str(f.MinSQLite)},
+	}
+}
+
+// Databases using none of the features below can be read by any SQLite 3 release
+const baseSQLiteVersion = "3.0.0"
+
+// Match schema features added in later SQLite releases.  Table options come after the end of the column list
+var (
+	partialIndexRE = regexp.MustCompile(`(?is)\)\s*WHERE\b`)
+	strictTableRE  = regexp.MustCompile(`(?is)\)[^)]*\bSTRICT\b[^)]*$`)
+	withoutRowidRE = regexp.MustCompile(`(?is)\)[^)]*\bWITHOUT\s+ROWID\b[^)]*$`)
+)
+
+// The SQLite releases which added virtual table modules
+var sqliteModuleVersions = map[string]string{
+	"fts4":    "3.7.4",
+	"fts5":    "3.9.0",
+	"geopoly": "3.24.0",
+}
+
+// Returns whichever of two SQLite version numbers is later
+func laterSQLiteVersion(a string, b string) string {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			if x > y {
+				return a
+			}
+			return b
+		}
+	}
+	if len(as) >= len(bs) {
+		return a
+	}
+	return b
+}
+
+// Reads the facts about an open database.  Each one is read separately, so one failing doesn't lose the others
+func readDBFacts(sdb *sqlite.Conn) (f dbFacts) {
+	var pageSize, userVersion, appID int
+	var encoding string
+	if err := sdb.OneValue("PRAGMA page_size", &pageSize); err == nil {
+		f.PageSize = &pageSize
+	}
+	if err := sdb.OneValue("PRAGMA encoding", &encoding); err == nil {
+		f.Encoding = &encoding
+	}
+	if err := sdb.OneValue("PRAGMA user_version", &userVersion); err == nil {
+		f.UserVersion = &userVersion
+	}
+	if err := sdb.OneValue("PRAGMA application_id", &appID); err == nil {
+		f.ApplicationID = &appID
+	}
+	tables, err := sdb.Tables("")
+	if err != nil {
+		log.Printf("Error retrieving table names when reading database facts: %v\n", err)
+		return
+	}
+	if fks, err := hasForeignKeys(sdb, tables); err == nil {
+		f.ForeignKeys = &fks
+	}
+	if v, err := minSQLiteVersion(sdb, tables); err == nil {
+		f.MinSQLite = &v
+	}
+	return
+}
+
+// Returns true if any of the tables declares a foreign key
+func hasForeignKeys(sdb *sqlite.Conn, tables []string) (bool, error) {
+	found := false
+	for _, t := range tables {
+		stmt, err := sdb.Prepare("PRAGMA foreign_key_list(" + quoteIdentifier(t) + ")")
+		if err != nil {
+			return false, err
+		}
+		err = stmt.Select(func(s *sqlite.Stmt) error {
+			found = true
+			return nil
+		})
+		stmt.Finalize()
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Works out the oldest SQLite release which understands a database's schema, from the features it uses
+func minSQLiteVersion(sdb *sqlite.Conn, tables []string) (string, error) {
+	need := baseSQLiteVersion
+	stmt, err := sdb.Prepare("SELECT type, coalesce(sql, '') FROM sqlite_master")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Finalize()
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		objType, _ := s.ScanText(0)
+		def, _ := s.ScanText(1)
+		switch {
+		case objType == "index" && partialIndexRE.MatchString(def):
+			need = laterSQLiteVersion(need, "3.8.0")
+		case objType == "table" && strictTableRE.MatchString(def):
+			need = laterSQLiteVersion(need, "3.37.0")
+		case objType == "table" && withoutRowidRE.MatchString(def):
+			need = laterSQLiteVersion(need, "3.8.2")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, module := range readVirtualTables(sdb).Modules {
+		if v, ok := sqliteModuleVersions[module]; ok {
+			need = laterSQLiteVersion(need, v)
+		}
+	}
+	for _, t := range tables {
+		cols, err := tableColumns(sdb, t)
+		if err != nil {
+			continue
+		}
+		for _, c := range cols {
+			if c.Generated {
+				need = laterSQLiteVersion(need, "3.31.0")
+			}
+		}
+	}
+	return need, nil
+}
+
+// Returns the facts about a database version.  They're recorded when the version is uploaded, so for versions from
+// before then they're read from the database the first time someone looks, then kept with the version's other
+// details if it has them, or in the cache if it doesn't.  When they can't be read at all, nothing is known and every
+// fact is shown as a dash rather than failing the page
+func getVersionFacts(ctx context.Context, owner string, dbName string, dbInfo sqliteDBinfo) dbFacts {
+	meta, hasMeta := getVersionMeta(owner, dbName, dbInfo.Info.Version)
+	if hasMeta && meta.Facts != nil {
+		return *meta.Facts
+	}
+	tempArr := md5.Sum([]byte(fmt.Sprintf("%s/%s/%d", owner, dbName, dbInfo.Info.Version)))
+	cacheKey := "dbfacts-" + hex.EncodeToString(tempArr[:])
+	var facts dbFacts
+	ok, err := getCachedData(cacheKey, &facts)
+	if err != nil {
+		log.Printf("Error retrieving database facts from cache: %v\n", err)
+	}
+	if ok {
+		return facts
+	}
+
+	sdb, err := openMinioObjectCtx(ctx, dbInfo.MinioBkt, dbInfo.MinioId)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Error opening '%s/%s' version %d to read its facts: %v\n", owner, dbName,
+				dbInfo.Info.Version, err)
+		}
+		return dbFacts{}
+	}
+	defer closeMinioObject(sdb)
+	facts = readDBFacts(sdb)
+	if hasMeta {
+		meta.Facts = &facts
+		saveVersionMeta(owner, dbName, dbInfo.Info.Version, meta)
+		return facts
+	}
+	err = cacheData(cacheKey, facts, rowCountCacheTime)
+	if err != nil {
+		log.Printf("Error when caching database facts: %v\n", err)
+	}
+	return facts
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	com "github.com/dbhubio/common"
+	"github.com/jackc/pgx"
+)
+
+// Returns the table the owner of a database chose to have shown first, or an empty string if they haven't chosen
+// one.  The table may not be in every version of the database, so callers fall back to landingTable()'s usual
+// choice when it's missing
+func getDefaultTable(owner string, dbName string) string {
+	var defaultTable pgx.NullString
+	err := db.QueryRow(`
+		SELECT default_table
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2`, owner, dbName).Scan(&defaultTable)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error retrieving the default table of '%s/%s': %v\n", owner, dbName, err)
+	}
+	return defaultTable.String
+}
+
+// Sets the table shown first for a database.  An empty table name goes back to the usual choice
+func setDefaultTable(owner string, dbName string, table string) error {
+	_, err := db.Exec(`
+		UPDATE sqlite_databases
+		SET default_table = $3
+		WHERE username = $1
+			AND dbname = $2`, owner, dbName, pgx.NullString{String: table, Valid: table != ""})
+	if err != nil {
+		log.Printf("Error setting the default table of '%s/%s': %v\n", owner, dbName, err)
+		return errors.New("Database query failed")
+	}
+	return nil
+}
+
+// Returns the table to show when none was asked for.  That's the database's default table when it's in this
+// version, otherwise the first table which isn't internal to a virtual table, as the order SQLite gives the tables
+// in often puts a lookup table first
+func landingTable(tables []string, vt vtableInfo, defaultTable string) string {
+	for _, t := range tables {
+		if t == defaultTable {
+			return t
+		}
+	}
+	if visible := vt.VisibleTables(tables); len(visible) > 0 {
+		return visible[0]
+	}
+	return tables[0]
+}
+
+// Sets the table visitors see first when they open a database without asking for one.  Only the owner can change
+// it, and only to a table in the latest version.  An empty table name clears it
+func defaultTableHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Default table handler"
+
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "The default table needs to be sent with POST")
+		return
+	}
+	loggedInUser := currentUser(r)
+
+	// Retrieve user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/defaulttable/" at the start of the URL
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if loggedInUser != userName {
+		jsonError(w, http.StatusForbidden, "Only the owner of a database can change its default table")
+		return
+	}
+	table := r.PostFormValue("table")
+	if table != "" {
+		err = com.ValidatePGTable(table)
+		if err != nil {
+			log.Printf("%s: Validation failed for table name: %s", pageName, err)
+			jsonError(w, http.StatusBadRequest, "Invalid table name")
+			return
+		}
+	}
+
+	// Check the table is in the latest version.  The table names are recorded with the version, so the database
+	// only needs opening for versions from before then
+	var dbInfo sqliteDBinfo
+	err = checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+	if err != nil {
+		jsonError(w, versionErrorStatus(err), err.Error())
+		return
+	}
+	if table != "" {
+		var tables []string
+		if meta, ok := getVersionMeta(userName, dbName, dbInfo.Info.Version); ok {
+			for _, t := range meta.Tables {
+				tables = append(tables, t.Name)
+			}
+		} else {
+			sdb, err := openMinioObject(dbInfo.MinioBkt, dbInfo.MinioId)
+			if err == errTooManyOpenDBs {
+				serverBusy(w, r)
+				return
+			}
+			if err != nil {
+				jsonError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			tables, err = sdb.Tables("")
+			closeMinioObject(sdb)
+			if err != nil {
+				log.Printf("%s: Error retrieving table names of '%s/%s': %v\n", pageName, userName, dbName, err)
+				jsonError(w, http.StatusInternalServerError, "Error reading from the database")
+				return
+			}
+		}
+		found := false
+		for _, t := range tables {
+			if t == table {
+				found = true
+			}
+		}
+		if !found {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("The latest version doesn't have a table called '%s'",
+				table))
+			return
+		}
+	}
+
+	err = setDefaultTable(userName, dbName, table)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		DefaultTable string
+	}{table})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// How long row counting may take for each version being compared, before the remaining counts are marked unknown
+const diffCountTimeout = 10 * time.Second
+
+// The differences in structure and row counts between two versions of a database.  The versions are normally of
+// the same database, but merge requests compare a version of a fork with its upstream database
+type dbDiff struct {
+	From          int64
+	To            int64
+	FromName      string // The owner and name of each database, only filled in when they're different databases
+	ToName        string
+	TablesAdded   []string
+	TablesRemoved []string
+	Tables        []tableDiff
+	Incomplete    bool // True when some row counts couldn't be done in time
+}
+
+// The differences for a single table present in both versions
+type tableDiff struct {
+	Name        string
+	ColsAdded   []string
+	ColsRemoved []string
+	ColsChanged []colChange
+	From        rowCountInfo
+	To          rowCountInfo
+}
+
+// A column whose definition changed between versions
+type colChange struct {
+	Name string
+	From string
+	To   string
+}
+
+// The row count of a table in one version
+type rowCountInfo struct {
+	Rows    int
+	Approx  bool
+	Unknown bool
+}
+
+// The Minio details of a single database version, along with the database it belongs to
+type versionObject struct {
+	Owner    string
+	Database string
+	Bucket   string
+	MinioId  string
+}
+
+// Describes a column's definition, for comparing between versions
+func columnDefinition(c sqlite.Column) string {
+	def := c.DataType
+	if def == "" {
+		def = "(no type)"
+	}
+	if c.Pk > 0 {
+		def += " PRIMARY KEY"
+	}
+	if c.NotNull {
+		def += " NOT NULL"
+	}
+	if c.DfltValue != "" {
+		def += " DEFAULT " + c.DfltValue
+	}
+	return def
+}
+
+// Compares the structure and row counts of two database versions
+func diffDatabases(ctx context.Context, from int64, to int64, fromObj versionObject,
+	toObj versionObject) (diff dbDiff, err error) {
+	diff.From = from
+	diff.To = to
+	if fromObj.Owner != toObj.Owner || fromObj.Database != toObj.Database {
+		diff.FromName = fromObj.Owner + "/" + fromObj.Database
+		diff.ToName = toObj.Owner + "/" + toObj.Database
+	}
+
+	fromDB, err := openMinioObjectCtx(ctx, fromObj.Bucket, fromObj.MinioId)
+	if err != nil {
+		return diff, err
+	}
+	defer closeMinioObject(fromDB)
+	toDB, err := openMinioObjectCtx(ctx, toObj.Bucket, toObj.MinioId)
+	if err != nil {
+		return diff, err
+	}
+	defer closeMinioObject(toDB)
+
+	fromTables, err := fromDB.Tables("")
+	if err != nil {
+		return diff, fmt.Errorf("Error reading the tables of version %d", from)
+	}
+	toTables, err := toDB.Tables("")
+	if err != nil {
+		return diff, fmt.Errorf("Error reading the tables of version %d", to)
+	}
+	inFrom := make(map[string]bool)
+	for _, t := range fromTables {
+		inFrom[t] = true
+	}
+	inTo := make(map[string]bool)
+	for _, t := range toTables {
+		inTo[t] = true
+		if !inFrom[t] {
+			diff.TablesAdded = append(diff.TablesAdded, t)
+		}
+	}
+	for _, t := range fromTables {
+		if !inTo[t] {
+			diff.TablesRemoved = append(diff.TablesRemoved, t)
+			continue
+		}
+
+		// The table is in both versions, so compare its columns
+		tbl := tableDiff{Name: t}
+		fromCols, err := fromDB.Columns("", t)
+		if err != nil {
+			return diff, fmt.Errorf("Error reading the columns of '%s' in version %d", t, from)
+		}
+		toCols, err := toDB.Columns("", t)
+		if err != nil {
+			return diff, fmt.Errorf("Error reading the columns of '%s' in version %d", t, to)
+		}
+		fromDefs := make(map[string]string)
+		for _, c := range fromCols {
+			fromDefs[c.Name] = columnDefinition(c)
+		}
+		toDefs := make(map[string]bool)
+		for _, c := range toCols {
+			toDefs[c.Name] = true
+			fromDef, ok := fromDefs[c.Name]
+			if !ok {
+				tbl.ColsAdded = append(tbl.ColsAdded, c.Name)
+			} else if toDef := columnDefinition(c); fromDef != toDef {
+				tbl.ColsChanged = append(tbl.ColsChanged, colChange{Name: c.Name, From: fromDef, To: toDef})
+			}
+		}
+		for _, c := range fromCols {
+			if !toDefs[c.Name] {
+				tbl.ColsRemoved = append(tbl.ColsRemoved, c.Name)
+			}
+		}
+		diff.Tables = append(diff.Tables, tbl)
+	}
+	sort.Strings(diff.TablesAdded)
+	sort.Strings(diff.TablesRemoved)
+	sort.Slice(diff.Tables, func(i, j int) bool {
+		return diff.Tables[i].Name < diff.Tables[j].Name
+	})
+
+	// Count the rows of the tables in each version.  Large databases could take a long time, so each version gets
+	// a time limit, after which the remaining counts are marked unknown
+	countRows := func(sdb *sqlite.Conn, version int64, obj versionObject, info func(i int) *rowCountInfo) {
+		cctx, cancel := context.WithTimeout(ctx, diffCountTimeout)
+		defer cancel()
+		for i := range diff.Tables {
+			c := info(i)
+			if cctx.Err() != nil {
+				c.Unknown = true
+				diff.Incomplete = true
+				continue
+			}
+			var countErr error
+			c.Rows, c.Approx, countErr = getTableRowCount(cctx, sdb, obj.Owner, obj.Database, int(version),
+				diff.Tables[i].Name, obj.Bucket, obj.MinioId)
+			if countErr != nil {
+				c.Unknown = true
+				diff.Incomplete = true
+			}
+			if cctx.Err() != nil {
+				// The count ran out of time, so only an approximate one was given
+				diff.Incomplete = true
+			}
+		}
+	}
+	countRows(fromDB, from, fromObj, func(i int) *rowCountInfo { return &diff.Tables[i].From })
+	countRows(toDB, to, toObj, func(i int) *rowCountInfo { return &diff.Tables[i].To })
+	if ctx.Err() != nil {
+		return diff, ctx.Err()
+	}
+	return diff, nil
+}
+
+// Returns the Minio details for a version of a database, if the user is allowed to see it
+func getVersionObject(ctx context.Context, loggedInUser string, owner string, dbName string,
+	version int64) (obj versionObject, err error) {
+	obj.Owner = owner
+	obj.Database = dbName
+	dbQuery := `
+		SELECT db.minio_bucket, ver.minioid
+		FROM database_versions AS ver, sqlite_databases AS db, users AS u
+		WHERE ver.db = db.idnum
+			AND db.username = u.username
+			AND u.disabled = false
+			AND db.username = $1
+			AND db.dbname = $2
+			AND ver.version = $3`
+	if loggedInUser != owner {
+		// * The request is for another users database, so the version needs to be a public one *
+		dbQuery += `
+			AND ver.public = true`
+	}
+	qctx, cancel := queryContext(ctx)
+	defer cancel()
+	err = db.QueryRowEx(qctx, dbQuery, nil, owner, dbName, version).Scan(&obj.Bucket, &obj.MinioId)
+	if ctx.Err() != nil {
+		return obj, ctx.Err()
+	}
+	if err != nil {
+		log.Printf("Version %d of '%s/%s' not found or not available for user '%s'\n", version, owner, dbName,
+			loggedInUser)
+		return obj, fmt.Errorf("Version %d of the database doesn't exist", version)
+	}
+	return obj, nil
+}
+
+// Returns the label of the version being compared from, for table headings
+func (d dbDiff) FromLabel() string {
+	return versionLabel(d.FromName, d.From)
+}
+
+// Returns the label of the version being compared to, for table headings
+func (d dbDiff) ToLabel() string {
+	return versionLabel(d.ToName, d.To)
+}
+
+// Labels a database version, including the database when the comparison is between two of them
+func versionLabel(name string, version int64) string {
+	if name == "" {
+		return fmt.Sprintf("v%d", version)
+	}
+	return fmt.Sprintf("%s v%d", name, version)
+}
+
+// Returns a short summary of how the row count of a table changed
+func (t tableDiff) RowChange() string {
+	if t.From.Unknown || t.To.Unknown {
+		return "unknown"
+	}
+	delta := t.To.Rows - t.From.Rows
+	var change string
+	switch {
+	case delta > 0:
+		change = fmt.Sprintf("+%d", delta)
+	case delta < 0:
+		change = fmt.Sprintf("%d", delta)
+	default:
+		change = "no change"
+	}
+	if t.From.Approx || t.To.Approx {
+		change = "approx. " + change
+	}
+	return change
+}
+
+// Returns true when the columns of the table changed
+func (t tableDiff) SchemaChanged() bool {
+	return len(t.ColsAdded) > 0 || len(t.ColsRemoved) > 0 || len(t.ColsChanged) > 0
+}
+
+// Returns a row count for display
+func (c rowCountInfo) String() string {
+	if c.Unknown {
+		return "unknown"
+	}
+	if c.Approx {
+		return fmt.Sprintf("approx. %d", c.Rows)
+	}
+	return fmt.Sprintf("%d", c.Rows)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// The longest discussion title and comment accepted, in characters
+const (
+	maxDiscussionTitle = 200
+	maxCommentLength   = 5000
+)
+
+// A discussion thread on a database
+type discussionThread struct {
+	ID           int64
+	Title        string
+	Author       string
+	Created      time.Time
+	LastActivity time.Time
+	Comments     int
+}
+
+// A comment in a discussion thread.  The first comment of a thread is the text it was started with
+type discussionComment struct {
+	ID      int64
+	Author  string
+	Body    string
+	Created time.Time
+}
+
+// Returns the URL of a database's discussions, or of one thread in them when an id is given
+func discussionURL(owner string, dbName string, id int64) string {
+	u := "/discuss/" + url.PathEscape(owner) + "/" + url.PathEscape(dbName)
+	if id != 0 {
+		u += "?id=" + strconv.FormatInt(id, 10)
+	}
+	return u
+}
+
+// Shows the discussion threads of a database, or one thread with its comments when asked for by id.  They're only
+// shown to people who can see the database
+func discussionsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Discussions page"
+
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/discuss/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	loggedInUser := currentUser(r)
+
+	var pageData struct {
+		Meta      metaInfo
+		Threads   []discussionThread
+		Thread    discussionThread
+		Comments  []discussionComment
+		CanDelete bool // Whether the person looking can remove threads and comments
+	}
+	pageData.Meta.Title = "Discussions - " + userName + "/" + dbName
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+	pageData.Meta.LoggedInUser = loggedInUser
+	setUserTimePrefs(&pageData.Meta, loggedInUser)
+	pageData.CanDelete = loggedInUser != "" && (loggedInUser == userName || isAdmin(loggedInUser))
+
+	var dbInfo sqliteDBinfo
+	err = checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+	if !dbInfo.Info.Public {
+		noIndex(w)
+	}
+	dbId, err := getDatabaseID(userName, dbName)
+	if err != nil {
+		log.Printf("%s: Error looking up database id of '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+
+	// A single thread
+	if r.FormValue("id") != "" {
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid discussion id")
+			return
+		}
+		err = db.QueryRowEx(ctx, `
+			SELECT id, title, author, date_created, last_activity
+			FROM discussions
+			WHERE id = $1
+				AND db = $2`, nil, id, dbId).Scan(&pageData.Thread.ID, &pageData.Thread.Title,
+			&pageData.Thread.Author, &pageData.Thread.Created, &pageData.Thread.LastActivity)
+		if err == pgx.ErrNoRows {
+			errorPage(w, r, http.StatusNotFound, "That discussion doesn't exist")
+			return
+		}
+		if err != nil {
+			log.Printf("%s: Error retrieving discussion %d of '%s/%s': %v\n", pageName, id, userName, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		rows, err := db.QueryEx(ctx, `
+			SELECT id, author, body, date_created
+			FROM discussion_comments
+			WHERE discussion = $1
+			ORDER BY date_created, id`, nil, id)
+		if err != nil {
+			log.Printf("%s: Error retrieving comments of discussion %d: %v\n", pageName, id, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c discussionComment
+			err = rows.Scan(&c.ID, &c.Author, &c.Body, &c.Created)
+			if err != nil {
+				log.Printf("%s: Error retrieving comments of discussion %d: %v\n", pageName, id, err)
+				errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+				return
+			}
+			pageData.Comments = append(pageData.Comments, c)
+		}
+		pageData.Meta.Title = pageData.Thread.Title + " - " + userName + "/" + dbName
+		renderTemplate(w, "discussionPage", pageData)
+		return
+	}
+
+	// The list of threads, most recently active first
+	rows, err := db.QueryEx(ctx, `
+		SELECT d.id, d.title, d.author, d.date_created, d.last_activity, (
+			SELECT count(*)
+			FROM discussion_comments AS c
+			WHERE c.discussion = d.id)
+		FROM discussions AS d
+		WHERE d.db = $1
+		ORDER BY d.last_activity DESC, d.id DESC`, nil, dbId)
+	if err != nil {
+		log.Printf("%s: Error retrieving discussions of '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t discussionThread
+		err = rows.Scan(&t.ID, &t.Title, &t.Author, &t.Created, &t.LastActivity, &t.Comments)
+		if err != nil {
+			log.Printf("%s: Error retrieving discussions of '%s/%s': %v\n", pageName, userName, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		pageData.Threads = append(pageData.Threads, t)
+	}
+	renderTemplate(w, "discussionsPage", pageData)
+}
+
+// Checks a request to change the discussions of a database, returning the database's owner, name and id.  If
+// something's wrong the error has already been sent and ok is false
+func discussionTarget(w http.ResponseWriter, r *http.Request, pageName string) (userName string, dbName string,
+	dbId int, ok bool) {
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Discussions need to be changed with POST")
+		return
+	}
+	var err error
+	userName, dbName, err = getUD(2, r) // 2 = Ignore "/x/discuss.../" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// People can only take part in the discussions of databases they can see
+	var dbInfo sqliteDBinfo
+	err = checkUserDBAccess(&dbInfo, currentUser(r), userName, dbName)
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+	dbId, err = getDatabaseID(userName, dbName)
+	if err != nil {
+		log.Printf("%s: Error looking up database id of '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	ok = true
+	return
+}
+
+// Returns the comment text submitted with a request, or an error message saying what's wrong with it
+func commentText(r *http.Request) (string, string) {
+	text := strings.TrimSpace(r.PostFormValue("text"))
+	if text == "" {
+		return "", "The comment is empty"
+	}
+	if len([]rune(text)) > maxCommentLength {
+		return "", fmt.Sprintf("Comments can't be longer than %d characters", maxCommentLength)
+	}
+	return text, ""
+}
+
+// Recounts the discussion threads of a database from the thread rows, as part of a transaction changing them
+func recountDiscussions(tx *pgx.Tx, dbId int) error {
+	_, err := tx.Exec(`
+		UPDATE sqlite_databases
+		SET discussions = (
+			SELECT count(*)
+			FROM discussions
+			WHERE db = $1
+		) WHERE idnum = $1`, dbId)
+	return err
+}
+
+// Starts a new discussion thread on a database, with its title and first comment
+func discussionNewHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "New discussion handler"
+
+	userName, dbName, dbId, ok := discussionTarget(w, r, pageName)
+	if !ok {
+		return
+	}
+	loggedInUser := currentUser(r)
+	title := strings.TrimSpace(r.PostFormValue("title"))
+	if title == "" {
+		errorPage(w, r, http.StatusBadRequest, "The discussion needs a title")
+		return
+	}
+	if len([]rune(title)) > maxDiscussionTitle {
+		errorPage(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Discussion titles can't be longer than %d characters", maxDiscussionTitle))
+		return
+	}
+	text, problem := commentText(r)
+	if problem != "" {
+		errorPage(w, r, http.StatusBadRequest, problem)
+		return
+	}
+
+	// The thread, its first comment, and the thread count are changed together
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	var id int64
+	err = tx.QueryRow(`
+		INSERT INTO discussions (db, title, author)
+		VALUES ($1, $2, $3)
+		RETURNING id`, dbId, title, loggedInUser).Scan(&id)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO discussion_comments (discussion, author, body)
+			VALUES ($1, $2, $3)`, id, loggedInUser, text)
+	}
+	if err == nil {
+		err = recountDiscussions(tx, dbId)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("%s: Error starting discussion on '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	http.Redirect(w, r, discussionURL(userName, dbName, id), http.StatusSeeOther)
+}
+
+// Adds a comment to a discussion thread
+func discussionCommentHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Discussion comment handler"
+
+	userName, dbName, dbId, ok := discussionTarget(w, r, pageName)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid discussion id")
+		return
+	}
+	text, problem := commentText(r)
+	if problem != "" {
+		errorPage(w, r, http.StatusBadRequest, problem)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	commandTag, err := tx.Exec(`
+		UPDATE discussions
+		SET last_activity = now()
+		WHERE id = $1
+			AND db = $2`, id, dbId)
+	if err == nil && commandTag.RowsAffected() == 0 {
+		errorPage(w, r, http.StatusNotFound, "That discussion doesn't exist")
+		return
+	}
+	var commentId int64
+	if err == nil {
+		err = tx.QueryRow(`
+			INSERT INTO discussion_comments (discussion, author, body)
+			VALUES ($1, $2, $3)
+			RETURNING id`, id, currentUser(r), text).Scan(&commentId)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("%s: Error adding comment to discussion %d of '%s/%s': %v\n", pageName, id, userName, dbName,
+			err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	http.Redirect(w, r, discussionURL(userName, dbName, id)+"#comment-"+strconv.FormatInt(commentId, 10),
+		http.StatusSeeOther)
+}
+
+// Removes a discussion thread, or a single comment from one when a comment id is given.  Only the owner of the
+// database and site admins can do this
+func discussionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Discussion delete handler"
+
+	userName, dbName, dbId, ok := discussionTarget(w, r, pageName)
+	if !ok {
+		return
+	}
+	loggedInUser := currentUser(r)
+	if loggedInUser != userName && !isAdmin(loggedInUser) {
+		errorPage(w, r, http.StatusForbidden, "Only the owner of the database can remove discussions")
+		return
+	}
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid discussion id")
+		return
+	}
+	var commentId int64
+	if v := r.PostFormValue("comment"); v != "" {
+		commentId, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid comment id")
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	var title string
+	err = tx.QueryRow(`
+		SELECT title
+		FROM discussions
+		WHERE id = $1
+			AND db = $2
+		FOR UPDATE`, id, dbId).Scan(&title)
+	if err == pgx.ErrNoRows {
+		errorPage(w, r, http.StatusNotFound, "That discussion doesn't exist")
+		return
+	}
+	action := "delete discussion"
+	metadata := map[string]interface{}{"discussion": id, "title": title}
+	redirectURL := discussionURL(userName, dbName, 0)
+	if err == nil && commentId != 0 {
+		var commandTag pgx.CommandTag
+		commandTag, err = tx.Exec(`DELETE FROM discussion_comments WHERE id = $1 AND discussion = $2`, commentId,
+			id)
+		if err == nil && commandTag.RowsAffected() == 0 {
+			errorPage(w, r, http.StatusNotFound, "That comment doesn't exist")
+			return
+		}
+		action = "delete comment"
+		metadata["comment"] = commentId
+		redirectURL = discussionURL(userName, dbName, id)
+	} else if err == nil {
+		_, err = tx.Exec(`DELETE FROM discussion_comments WHERE discussion = $1`, id)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM discussions WHERE id = $1`, id)
+		}
+		if err == nil {
+			err = recountDiscussions(tx, dbId)
+		}
+	}
+	if err == nil {
+		err = auditLog(tx, r, loggedInUser, action, auditTargetDatabase, userName+"/"+dbName, metadata)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("%s: Error removing from discussion %d of '%s/%s': %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	log.Printf("%s: '%s' did '%s' on discussion %d of '%s/%s'\n", pageName, loggedInUser, action, id, userName,
+		dbName)
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
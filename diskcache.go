@@ -0,0 +1,322 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// A database file held in the local disk cache
+type diskCacheEntry struct {
+	name     string
+	size     int64
+	refs     int
+	verified bool
+	elem     *list.Element
+}
+
+// Size bounded, least recently used cache of database files retrieved from Minio
+type diskCache struct {
+	hits   uint64 // Updated atomically, so kept first for 64 bit alignment
+	misses uint64
+	sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	entries map[string]*diskCacheEntry
+	lru     *list.List // Most recently used at the front
+}
+
+var (
+	// The local disk cache.  This is nil when no cache directory has been configured
+	minioCache *diskCache
+
+	// Cache entries in use by open SQLite connections, released by closeMinioObject()
+	openEntries   = make(map[*sqlite.Conn]*diskCacheEntry)
+	openEntriesMu sync.Mutex
+)
+
+// Compares the sha256 of a database file against the value recorded when it was uploaded.  Object ids are only
+// unique within a bucket, so the bucket has to match as well
+func checkMinioSha256(ctx context.Context, bucket string, id string, sum string) error {
+	qctx, cancel := queryContext(ctx)
+	defer cancel()
+	var stored string
+	err := db.QueryRowEx(qctx, `
+		SELECT ver.sha256
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.minio_bucket = $1
+			AND ver.minioid = $2`, nil, bucket, id).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	if stored != sum {
+		return sha256MismatchError{stored: stored, calculated: sum}
+	}
+	return nil
+}
+
+// Returned by checkMinioSha256() when a file doesn't match the sha256 recorded for it, as opposed to the check
+// itself failing
+type sha256MismatchError struct {
+	stored     string
+	calculated string
+}
+
+func (e sha256MismatchError) Error() string {
+	return "sha256 mismatch.  Stored: " + e.stored + ", calculated: " + e.calculated
+}
+
+// Closes a SQLite database retrieved with openMinioObject(), allowing its cache entry to be evicted again, or freeing
+// its slot when it was retrieved into a temporary file
+func closeMinioObject(db *sqlite.Conn) {
+	err := db.Close()
+	if err != nil {
+		log.Printf("Error closing SQLite database: %v\n", err)
+	}
+	openEntriesMu.Lock()
+	entry, ok := openEntries[db]
+	delete(openEntries, db)
+	openEntriesMu.Unlock()
+	if ok {
+		minioCache.release(entry)
+	}
+	tempDBsMu.Lock()
+	temp := tempDBs[db]
+	delete(tempDBs, db)
+	tempDBsMu.Unlock()
+	if temp {
+		releaseTempDBSlot()
+	}
+}
+
+// Returns the number of disk cache hits and misses since startup
+func diskCacheStats() (hits uint64, misses uint64) {
+	if minioCache == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&minioCache.hits), atomic.LoadUint64(&minioCache.misses)
+}
+
+// Calculates the sha256 of a file
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Opens the disk cache, adding any files already present from a previous run
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: dir, maxSize: maxSize, entries: make(map[string]*diskCacheEntry), lru: list.New()}
+
+	// Files which were used most recently go to the front of the list
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".db" {
+			// Skip anything which isn't a cached database, such as a partial download from a crash
+			if !f.IsDir() {
+				os.Remove(filepath.Join(dir, f.Name()))
+			}
+			continue
+		}
+		entry := &diskCacheEntry{name: f.Name(), size: f.Size()}
+		entry.elem = c.lru.PushBack(entry)
+		c.entries[entry.name] = entry
+		c.size += entry.size
+	}
+	c.Lock()
+	c.evict()
+	c.Unlock()
+	log.Printf("Disk cache opened: %s. %d files, %d bytes\n", dir, len(c.entries), c.size)
+	return c, nil
+}
+
+// Removes least recently used files which aren't in use, until the cache is within its size limit.  The cache
+// needs to be locked when calling this
+func (c *diskCache) evict() {
+	for e := c.lru.Back(); e != nil && c.size > c.maxSize; {
+		entry := e.Value.(*diskCacheEntry)
+		prev := e.Prev()
+		if entry.refs == 0 {
+			c.remove(entry)
+		}
+		e = prev
+	}
+}
+
+// Returns the path to a local copy of the given Minio object, downloading it if needed.  The returned entry is
+// referenced, so must be released when no longer needed
+func (c *diskCache) fetch(ctx context.Context, bucket string, id string) (*diskCacheEntry, error) {
+	tempArr := md5.Sum([]byte(bucket + "/" + id))
+	name := hex.EncodeToString(tempArr[:]) + ".db"
+
+	// Use the cached copy if it's present
+	c.Lock()
+	entry, ok := c.entries[name]
+	if ok {
+		entry.refs++
+		c.lru.MoveToFront(entry.elem)
+		verified := entry.verified
+		c.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		now := time.Now()
+		os.Chtimes(c.path(entry), now, now)
+
+		// Files found at startup are checked the first time they're used
+		if !verified {
+			sum, err := fileSha256(c.path(entry))
+			if err == nil {
+				err = checkMinioSha256(ctx, bucket, id, sum)
+			}
+			if err != nil {
+				// Only a file which really doesn't match is thrown away.  When the check couldn't be done, such as
+				// from a cancelled request or a database error, the file is left to be checked again next time
+				_, mismatch := err.(sha256MismatchError)
+				if !mismatch {
+					c.release(entry)
+					if ctx.Err() != nil {
+						return nil, ctx.Err()
+					}
+					log.Printf("Error verifying disk cache file for '%s/%s': %v\n", bucket, id, err)
+					return nil, errors.New("Internal server error")
+				}
+
+				// The file can only be removed once nobody else is using it.  Until then they're refused as well,
+				// as they'll reach the same result when checking it
+				log.Printf("Disk cache file for '%s/%s' failed verification: %v\n", bucket, id, err)
+				c.Lock()
+				entry.refs--
+				inUse := entry.refs > 0
+				if !inUse {
+					c.remove(entry)
+				}
+				c.Unlock()
+				if inUse {
+					return nil, errors.New("Internal server error")
+				}
+				return c.fetch(ctx, bucket, id)
+			}
+			c.Lock()
+			entry.verified = true
+			c.Unlock()
+		}
+		return entry, nil
+	}
+	c.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	// Download the object into a temporary file in the cache directory, calculating its checksum on the way
+	userDB, err := minioClient.GetObject(bucket, id)
+	if err != nil {
+		log.Printf("Error retrieving DB from Minio: %v\n", err)
+		return nil, errors.New("Internal retrieving database from object store")
+	}
+	defer userDB.Close()
+	tempfileHandle, err := ioutil.TempFile(c.dir, "download-")
+	if err != nil {
+		log.Printf("Error creating tempfile: %v\n", err)
+		return nil, errors.New("Internal server error")
+	}
+	tempfile := tempfileHandle.Name()
+	hasher := sha256.New()
+	bytesWritten, err := io.Copy(io.MultiWriter(tempfileHandle, hasher), ctxReader{ctx: ctx, r: userDB})
+	tempfileHandle.Close()
+	if err != nil || bytesWritten == 0 {
+		os.Remove(tempfile)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Printf("Error writing database to disk cache. Minio object: %s/%s, bytes: %d, error: %v\n", bucket,
+			id, bytesWritten, err)
+		return nil, errors.New("Internal server error")
+	}
+	err = checkMinioSha256(ctx, bucket, id, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		os.Remove(tempfile)
+		log.Printf("Database retrieved from Minio failed verification. Object: %s/%s, error: %v\n", bucket, id,
+			err)
+		return nil, errors.New("Internal server error")
+	}
+
+	// Add the file to the cache.  If another request added it in the meantime, use theirs instead
+	c.Lock()
+	defer c.Unlock()
+	if entry, ok = c.entries[name]; ok {
+		os.Remove(tempfile)
+		entry.refs++
+		c.lru.MoveToFront(entry.elem)
+		return entry, nil
+	}
+	err = os.Rename(tempfile, filepath.Join(c.dir, name))
+	if err != nil {
+		os.Remove(tempfile)
+		log.Printf("Error adding file to disk cache: %v\n", err)
+		return nil, errors.New("Internal server error")
+	}
+	entry = &diskCacheEntry{name: name, size: bytesWritten, refs: 1, verified: true}
+	entry.elem = c.lru.PushFront(entry)
+	c.entries[name] = entry
+	c.size += entry.size
+	c.evict()
+	return entry, nil
+}
+
+// Returns the full path to a cached file
+func (c *diskCache) path(entry *diskCacheEntry) string {
+	return filepath.Join(c.dir, entry.name)
+}
+
+// Releases a reference to a cache entry
+func (c *diskCache) release(entry *diskCacheEntry) {
+	c.Lock()
+	entry.refs--
+	c.evict()
+	c.Unlock()
+}
+
+// Removes a file from the cache.  The cache needs to be locked when calling this
+func (c *diskCache) remove(entry *diskCacheEntry) {
+	if _, ok := c.entries[entry.name]; !ok {
+		return
+	}
+	err := os.Remove(c.path(entry))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing file from disk cache: %v\n", err)
+	}
+	c.lru.Remove(entry.elem)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+}
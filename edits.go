@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	com "github.com/dbhubio/common"
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+const (
+	// The most changes accepted in a single commit of edits
+	maxEditsPerCommit = 1000
+
+	// The largest request body accepted for a commit of edits
+	maxEditRequestSize = 4 << 20
+)
+
+// A change to a single cell.  Rows are identified by their key, which is either their rowid or, for tables created
+// WITHOUT ROWID, their primary key columns.  A nil Value means NULL
+type cellEdit struct {
+	Key    map[string]string
+	Column string
+	Value  *string
+}
+
+// A new row to add.  Columns not given get their default value
+type rowInsert struct {
+	Values map[string]*string
+}
+
+// The changes made to a table in the web editor
+type editRequest struct {
+	Table   string
+	Version int // The version the edits were made against
+	Edits   []cellEdit
+	Inserts []rowInsert
+	Deletes []map[string]string
+}
+
+// A problem with one of the requested changes, reported back so the editor can show it against the right cell
+type editError struct {
+	Kind    string // "edit", "insert", or "delete"
+	Index   int    // Position of the change in its list
+	Column  string `json:",omitempty"`
+	Message string
+}
+
+// Applies a set of edits to a table in an open (writable) SQLite database, inside a transaction.  If any of them
+// fail, nothing is changed and the problems are returned
+func applyTableEdits(sdb *sqlite.Conn, req editRequest) ([]editError, error) {
+	tableCols, err := tableColumns(sdb, req.Table)
+	if err != nil {
+		return nil, err
+	}
+	colTypes := make(map[string]string)
+	generated := make(map[string]bool)
+	for _, c := range tableCols {
+		colTypes[c.Name] = c.DataType
+		generated[c.Name] = c.Generated
+	}
+	keyCols, err := tableKeyColumns(sdb, req.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	// Builds the WHERE clause identifying a row from its key
+	whereKey := func(key map[string]string) (string, []interface{}, error) {
+		if len(key) != len(keyCols) {
+			return "", nil, errors.New("Row key doesn't match the table")
+		}
+		var conditions []string
+		var args []interface{}
+		for _, k := range keyCols {
+			val, ok := key[k]
+			if !ok {
+				return "", nil, errors.New("Row key doesn't match the table")
+			}
+			conditions = append(conditions, quoteIdentifier(k)+" = ?")
+			args = append(args, val)
+		}
+		return strings.Join(conditions, " AND "), args, nil
+	}
+
+	err = sdb.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var problems []editError
+
+	// Deletes go first, so any edits to deleted rows show up as problems
+	for i, key := range req.Deletes {
+		where, args, err := whereKey(key)
+		if err == nil {
+			err = sdb.Exec("DELETE FROM "+quoteIdentifier(req.Table)+" WHERE "+where, args...)
+		}
+		if err == nil && sdb.Changes() != 1 {
+			err = errors.New("The row no longer exists")
+		}
+		if err != nil {
+			problems = append(problems, editError{Kind: "delete", Index: i, Message: editErrorMessage(err)})
+		}
+	}
+
+	for i, e := range req.Edits {
+		declType, ok := colTypes[e.Column]
+		if !ok {
+			problems = append(problems, editError{Kind: "edit", Index: i, Column: e.Column,
+				Message: "Unknown column"})
+			continue
+		}
+		if generated[e.Column] {
+			problems = append(problems, editError{Kind: "edit", Index: i, Column: e.Column,
+				Message: "Generated columns can't be changed"})
+			continue
+		}
+		val, err := convertCellValue(declType, e.Value)
+		var where string
+		var args []interface{}
+		if err == nil {
+			where, args, err = whereKey(e.Key)
+		}
+		if err == nil {
+			args = append([]interface{}{val}, args...)
+			err = sdb.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s", quoteIdentifier(req.Table),
+				quoteIdentifier(e.Column), where), args...)
+		}
+		if err == nil && sdb.Changes() != 1 {
+			err = errors.New("The row no longer exists")
+		}
+		if err != nil {
+			problems = append(problems, editError{Kind: "edit", Index: i, Column: e.Column,
+				Message: editErrorMessage(err)})
+		}
+	}
+
+	for i, ins := range req.Inserts {
+		var cols, placeholders []string
+		var args []interface{}
+		var insErr *editError
+		for col, v := range ins.Values {
+			declType, ok := colTypes[col]
+			if !ok {
+				insErr = &editError{Kind: "insert", Index: i, Column: col, Message: "Unknown column"}
+				break
+			}
+			if generated[col] {
+				// The editor sends every column of a new row, so generated ones are only a problem if filled in
+				if v == nil || *v == "" {
+					continue
+				}
+				insErr = &editError{Kind: "insert", Index: i, Column: col,
+					Message: "Generated columns can't be set"}
+				break
+			}
+			val, err := convertCellValue(declType, v)
+			if err != nil {
+				insErr = &editError{Kind: "insert", Index: i, Column: col, Message: err.Error()}
+				break
+			}
+			cols = append(cols, quoteIdentifier(col))
+			placeholders = append(placeholders, "?")
+			args = append(args, val)
+		}
+		if insErr != nil {
+			problems = append(problems, *insErr)
+			continue
+		}
+		dbQuery := "INSERT INTO " + quoteIdentifier(req.Table) + " DEFAULT VALUES"
+		if len(cols) > 0 {
+			dbQuery = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdentifier(req.Table),
+				strings.Join(cols, ", "), strings.Join(placeholders, ", "))
+		}
+		err = sdb.Exec(dbQuery, args...)
+		if err != nil {
+			problems = append(problems, editError{Kind: "insert", Index: i, Message: editErrorMessage(err)})
+		}
+	}
+
+	if len(problems) > 0 {
+		err = sdb.Rollback()
+		if err != nil {
+			log.Printf("Error rolling back edits: %v\n", err)
+		}
+		return problems, nil
+	}
+	return nil, sdb.Commit()
+}
+
+// Handles the edits made to a table in the web editor.  They're applied to a copy of the latest version of the
+// database, which is then stored as a new version
+func commitEditsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Commit edits handler"
+
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Edits need to be sent with POST")
+		return
+	}
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Retrieve user and database name.  Only the owner of a database can edit it
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/commitedits/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if userName != loggedInUser {
+		errorPage(w, r, http.StatusForbidden, "Only the owner of a database can edit it")
+		return
+	}
+
+	// Decode and validate the requested changes
+	var req editRequest
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEditRequestSize)).Decode(&req)
+	if bodyTooLarge(err) {
+		requestTooLarge(w, r, maxEditRequestSize)
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error decoding edits: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid edit request")
+		return
+	}
+	numChanges := len(req.Edits) + len(req.Inserts) + len(req.Deletes)
+	if numChanges == 0 {
+		errorPage(w, r, http.StatusBadRequest, "No changes were given")
+		return
+	}
+	if numChanges > maxEditsPerCommit {
+		errorPage(w, r, http.StatusBadRequest,
+			fmt.Sprintf("No more than %d changes can be committed at once", maxEditsPerCommit))
+		return
+	}
+	names := []string{req.Table}
+	for _, e := range req.Edits {
+		names = append(names, e.Column)
+	}
+	for _, ins := range req.Inserts {
+		for col := range ins.Values {
+			names = append(names, col)
+		}
+	}
+	for _, name := range names {
+		err = com.ValidatePGTable(name)
+		if err != nil {
+			log.Printf("%s: Validation failed for table or column name: %s", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Invalid table or column name")
+			return
+		}
+	}
+
+	// The edits need to be against the latest version, otherwise they could undo someone else's changes
+	ctx := r.Context()
+	var minioBucket, minioId string
+	var latestVersion int
+	var public bool
+	qctx, cancel := queryContext(ctx)
+	err = db.QueryRowEx(qctx, `
+		SELECT db.minio_bucket, ver.minioid, ver.version, ver.public
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND db.idnum = ver.db
+		ORDER BY ver.version DESC
+		LIMIT 1`, nil, userName, dbName).Scan(&minioBucket, &minioId, &latestVersion, &public)
+	cancel()
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error looking up latest version of '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusBadRequest, "The requested database doesn't exist")
+		return
+	}
+	if req.Version != latestVersion {
+		errorPage(w, r, http.StatusConflict, fmt.Sprintf("The database has changed since editing started.  "+
+			"Version %d is now the latest, please reload the page", latestVersion))
+		return
+	}
+
+	// Copy the database to a temporary file which can be written to
+	tempFile, err := copyMinioObjectToTemp(ctx, minioBucket, minioId)
+	if clientGone(ctx, pageName) {
+		if tempFile != "" {
+			os.Remove(tempFile)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error copying '%s/%s' for editing: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error retrieving the database")
+		return
+	}
+	defer os.Remove(tempFile)
+
+	// Apply the edits
+	sdb, err := sqlite.Open(tempFile, sqlite.OpenReadWrite)
+	if err != nil {
+		log.Printf("%s: Couldn't open database for editing: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	problems, err := applyTableEdits(sdb, req)
+	closeErr := sdb.Close()
+	if err != nil {
+		log.Printf("%s: Error applying edits to '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error applying the edits")
+		return
+	}
+	if closeErr != nil {
+		log.Printf("%s: Error closing edited database: %v\n", pageName, closeErr)
+		errorPage(w, r, http.StatusInternalServerError, "Error applying the edits")
+		return
+	}
+
+	// Send back any problems with individual changes, so they can be shown against the right cells
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, struct{ Errors []editError }{problems})
+		return
+	}
+
+	// Check the result the same way as an upload, then store it as a new version
+	err = sanityCheckSQLite(tempFile)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	dbData, err := ioutil.ReadFile(tempFile)
+	if err != nil {
+		log.Printf("%s: Error reading edited database: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	newVersion, dbSize, newMinioId, err := addDatabaseVersion(loggedInUser, dbName, "/", public, dbData,
+		editCommitMessage(req), loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recordVersionMeta(tempFile, loggedInUser, dbName, newVersion)
+	log.Printf("%s: Username: %v, database '%v' edited as version %d stored as '%v', bytes: %v\n", pageName,
+		loggedInUser, dbName, newVersion, newMinioId, dbSize)
+	writeJSON(w, http.StatusOK, struct{ Version int }{newVersion})
+}
+
+// Converts a value given in the editor to suit the column's type.  SQLite would quietly store text in a numeric
+// column, so values which don't fit integer or floating point columns are refused here instead
+func convertCellValue(declType string, val *string) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	// These follow SQLite's rules for working out a column's type affinity from its declared type
+	t := strings.ToUpper(declType)
+	switch {
+	case strings.Contains(t, "INT"):
+		i, err := strconv.ParseInt(strings.TrimSpace(*val), 10, 64)
+		if err != nil {
+			return nil, errors.New("This column needs a whole number")
+		}
+		return i, nil
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return *val, nil
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		f, err := strconv.ParseFloat(strings.TrimSpace(*val), 64)
+		if err != nil {
+			return nil, errors.New("This column needs a number")
+		}
+		return f, nil
+	}
+
+	// Columns with NUMERIC affinity (including dates and booleans) and those without a type take anything
+	return *val, nil
+}
+
+// Copies a database object from Minio to a new temporary file, returning its path.  The caller needs to remove
+// the file when done
+func copyMinioObjectToTemp(ctx context.Context, bucket string, id string) (string, error) {
+	obj, err := minioClient.GetObject(bucket, id)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	tempFile, err := ioutil.TempFile(tempDir(), "dbhub-edit-")
+	if err != nil {
+		return "", err
+	}
+	mctx, cancel := context.WithTimeout(ctx, time.Duration(conf.Timeouts.Minio)*time.Second)
+	defer cancel()
+	_, err = io.Copy(tempFile, ctxReader{ctx: mctx, r: obj})
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
+
+// Generates a commit message describing a set of edits
+func editCommitMessage(req editRequest) string {
+	plural := func(n int, word string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", word)
+		}
+		return fmt.Sprintf("%d %ss", n, word)
+	}
+	var parts []string
+	if len(req.Edits) > 0 {
+		parts = append(parts, plural(len(req.Edits), "cell")+" changed")
+	}
+	if len(req.Inserts) > 0 {
+		parts = append(parts, plural(len(req.Inserts), "row")+" added")
+	}
+	if len(req.Deletes) > 0 {
+		parts = append(parts, plural(len(req.Deletes), "row")+" deleted")
+	}
+	return fmt.Sprintf("Edited table '%s' on the website: %s", req.Table, strings.Join(parts, ", "))
+}
+
+// Turns a SQLite error into a message suitable for showing next to a cell
+func editErrorMessage(err error) string {
+	msg := err.Error()
+	if i := strings.Index(msg, "constraint failed"); i >= 0 {
+		return "Not allowed by the table's constraints: " + strings.TrimSpace(msg[i:])
+	}
+	return msg
+}
+
+// Reads rows from a table along with the key identifying each of them, for the web editor and for retrieving values
+// cut short for display.  Keys are returned separately from the row values, in RowKeys.  If columns are given only
+// those are read, apart from the keys
+func readSQLiteDBEditable(ctx context.Context, sdb *sqlite.Conn, dbTable string, maxRows int, offset int,
+	sortCol string, sortDir string, cols []string, where []whereClause) (sqliteRecordSet, error) {
+	keyCols, err := tableKeyColumns(sdb, dbTable)
+	if err != nil {
+		return sqliteRecordSet{}, err
+	}
+	var selectKeys []string
+	for _, k := range keyCols {
+		selectKeys = append(selectKeys, quoteIdentifier(k))
+	}
+	dbQuery := "SELECT " + strings.Join(selectKeys, ", ") + ", " + selectColumns(cols) + " FROM " +
+		quoteIdentifier(dbTable)
+	conds, args := whereConditions(where)
+	if len(conds) > 0 {
+		dbQuery += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if sortCol != "" {
+		dbQuery += " ORDER BY " + quoteIdentifier(sortCol) + " " + sortDir
+	}
+	dbQuery += " LIMIT ? OFFSET ?"
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sdb.Interrupt()
+		case <-done:
+		}
+	}()
+	dataRows, err := readSQLiteRows(sdb, dbQuery, append(args, maxRows, offset), false, false, 1)
+	if ctx.Err() != nil {
+		return dataRows, sqliteCtxErr(ctx)
+	}
+	if err != nil {
+		return dataRows, err
+	}
+
+	dataRows.Tablename = dbTable
+	dataRows.SortCol = sortCol
+	dataRows.SortDir = sortDir
+	dataRows.Offset = offset
+	splitRowKeys(&dataRows, keyCols)
+	return dataRows, nil
+}
+
+// Returns the columns which identify a row in a table.  That's the rowid, except for tables created WITHOUT ROWID,
+// where it's the primary key.  A table with its own column called "rowid" hides the real one, so its primary key is
+// used instead too
+func tableKeyColumns(sdb *sqlite.Conn, dbTable string) ([]string, error) {
+	cols, err := tableColumns(sdb, dbTable)
+	if err != nil {
+		return nil, err
+	}
+	hasRowidCol := false
+	for _, c := range cols {
+		if strings.EqualFold(c.Name, "rowid") {
+			hasRowidCol = true
+		}
+	}
+	if !hasRowidCol {
+		stmt, err := sdb.Prepare("SELECT rowid FROM " + quoteIdentifier(dbTable) + " LIMIT 0")
+		if err == nil {
+			stmt.Finalize()
+			return []string{"rowid"}, nil
+		}
+	}
+
+	// The primary key columns, in the order they're declared in the key
+	var pkCols []columnInfo
+	for _, c := range cols {
+		if c.Pk > 0 {
+			pkCols = append(pkCols, c)
+		}
+	}
+	sort.Slice(pkCols, func(i, j int) bool {
+		return pkCols[i].Pk < pkCols[j].Pk
+	})
+	var keyCols []string
+	for _, c := range pkCols {
+		keyCols = append(keyCols, c.Name)
+	}
+	if len(keyCols) == 0 {
+		return nil, errors.New("The table doesn't have a way to identify its rows")
+	}
+	return keyCols, nil
+}
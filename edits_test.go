@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Fixture tables for the two kinds of table which don't look like the usual rowid table with plain columns.  The
+// WITHOUT ROWID table declares its key columns in the opposite order to the key, so using the column order instead
+// of the key order shows up
+var (
+	withoutRowidFixture = []string{
+		"CREATE TABLE pairs (b TEXT, a INTEGER, v TEXT, PRIMARY KEY (a, b)) WITHOUT ROWID",
+		"INSERT INTO pairs VALUES ('x', 1, 'first')",
+		"INSERT INTO pairs VALUES ('y', 1, 'second')",
+		"INSERT INTO pairs VALUES ('x', 2, 'third')",
+	}
+	generatedFixture = []string{
+		"CREATE TABLE prices (net INTEGER, tax INTEGER, " +
+			"gross INTEGER GENERATED ALWAYS AS (net + tax) VIRTUAL, " +
+			"label TEXT GENERATED ALWAYS AS ('total ' || (net + tax)) STORED)",
+		"INSERT INTO prices (net, tax) VALUES (100, 20)",
+	}
+)
+
+// Skips a test when the SQLite library is too old to know about generated columns
+func requireGeneratedColumns(t *testing.T) {
+	sdb, err := sqlite.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+	if sdb.Exec("CREATE TABLE g (a INTEGER, b INTEGER GENERATED ALWAYS AS (a + 1))") != nil {
+		t.Skip("the SQLite library is too old for generated columns")
+	}
+}
+
+// Opens a fixture database for writing, the way edits are applied to a copy of a database
+func openWritableFixture(t *testing.T, name string, stmts []string) *sqlite.Conn {
+	sdb, err := sqlite.Open(newTestSQLite(t, name, stmts...))
+	if err != nil {
+		t.Fatalf("Error opening fixture database '%s': %v", name, err)
+	}
+	return sdb
+}
+
+// Returns a pointer to a string, for the values of edits
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestTableColumnsGenerated(t *testing.T) {
+	requireGeneratedColumns(t)
+	sdb := openTestSQLite(t, "generated.sqlite", generatedFixture...)
+	defer sdb.Close()
+
+	cols, err := tableColumns(sdb, "prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var generated []bool
+	for _, c := range cols {
+		names = append(names, c.Name)
+		generated = append(generated, c.Generated)
+	}
+	if !reflect.DeepEqual(names, []string{"net", "tax", "gross", "label"}) {
+		t.Errorf("Unexpected columns: %v", names)
+	}
+	if !reflect.DeepEqual(generated, []bool{false, false, true, true}) {
+		t.Errorf("Unexpected generated flags: %v", generated)
+	}
+
+	// Generated columns are shown along with the others
+	data, err := readSQLiteDBWindowCtx(context.Background(), sdb, "prices", 10, 0, "", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data.ColNames, names) {
+		t.Errorf("Unexpected columns read: %v", data.ColNames)
+	}
+	if len(data.Records) != 1 || data.Records[0][2].Value != "120" || data.Records[0][3].Value != "total 120" {
+		t.Errorf("Unexpected rows read: %v", data.Records)
+	}
+}
+
+func TestTableKeyColumns(t *testing.T) {
+	sdb := openTestSQLite(t, "keys.sqlite", append([]string{
+		"CREATE TABLE plain (a TEXT)",
+		"CREATE TABLE ownrowid (id INTEGER PRIMARY KEY, rowid TEXT)",
+	}, withoutRowidFixture...)...)
+	defer sdb.Close()
+
+	tests := []struct {
+		table string
+		keys  []string
+	}{
+		{"plain", []string{"rowid"}},
+		{"ownrowid", []string{"id"}},
+		{"pairs", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		keys, err := tableKeyColumns(sdb, tt.table)
+		if err != nil {
+			t.Errorf("%s: %v", tt.table, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("%s: expected keys %v, got %v", tt.table, tt.keys, keys)
+		}
+	}
+}
+
+func TestReadEditableWithoutRowid(t *testing.T) {
+	sdb := openTestSQLite(t, "withoutrowid.sqlite", withoutRowidFixture...)
+	defer sdb.Close()
+
+	data, err := readSQLiteDBEditable(context.Background(), sdb, "pairs", 10, 0, "", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data.ColNames, []string{"b", "a", "v"}) {
+		t.Errorf("Unexpected columns: %v", data.ColNames)
+	}
+	want := []map[string]string{{"a": "1", "b": "x"}, {"a": "1", "b": "y"}, {"a": "2", "b": "x"}}
+	if !reflect.DeepEqual(data.RowKeys, want) {
+		t.Errorf("Expected row keys %v, got %v", want, data.RowKeys)
+	}
+}
+
+func TestApplyEditsWithoutRowid(t *testing.T) {
+	sdb := openWritableFixture(t, "editwithoutrowid.sqlite", withoutRowidFixture)
+	defer sdb.Close()
+
+	problems, err := applyTableEdits(sdb, editRequest{
+		Table:   "pairs",
+		Edits:   []cellEdit{{Key: map[string]string{"a": "1", "b": "y"}, Column: "v", Value: strPtr("changed")}},
+		Inserts: []rowInsert{{Values: map[string]*string{"a": strPtr("3"), "b": strPtr("z"), "v": strPtr("new")}}},
+		Deletes: []map[string]string{{"a": "2", "b": "x"}},
+	})
+	if err != nil || problems != nil {
+		t.Fatalf("Edits failed: %v %v", problems, err)
+	}
+	var rows []string
+	err = sdb.Select("SELECT a || b || v FROM pairs", func(s *sqlite.Stmt) error {
+		v, _ := s.ScanText(0)
+		rows = append(rows, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, []string{"1xfirst", "1ychanged", "3znew"}) {
+		t.Errorf("Unexpected table contents: %v", rows)
+	}
+
+	// Rows are only found by their whole key
+	problems, err = applyTableEdits(sdb, editRequest{
+		Table: "pairs",
+		Edits: []cellEdit{{Key: map[string]string{"a": "1"}, Column: "v", Value: strPtr("x")}},
+	})
+	if err != nil || len(problems) != 1 || problems[0].Message != "Row key doesn't match the table" {
+		t.Errorf("Expected a row key problem, got %v %v", problems, err)
+	}
+}
+
+func TestApplyEditsGenerated(t *testing.T) {
+	requireGeneratedColumns(t)
+	sdb := openWritableFixture(t, "editgenerated.sqlite", generatedFixture)
+	defer sdb.Close()
+
+	// New rows come with every column, and the generated ones are left for SQLite to fill in
+	problems, err := applyTableEdits(sdb, editRequest{
+		Table: "prices",
+		Inserts: []rowInsert{{Values: map[string]*string{"net": strPtr("5"), "tax": strPtr("1"),
+			"gross": strPtr(""), "label": nil}}},
+	})
+	if err != nil || problems != nil {
+		t.Fatalf("Insert failed: %v %v", problems, err)
+	}
+	var gross int
+	err = sdb.OneValue("SELECT gross FROM prices WHERE net = 5", &gross)
+	if err != nil || gross != 6 {
+		t.Errorf("Expected a generated value of 6, got %d (%v)", gross, err)
+	}
+
+	// Generated columns can't be changed or set
+	problems, err = applyTableEdits(sdb, editRequest{
+		Table:   "prices",
+		Edits:   []cellEdit{{Key: map[string]string{"rowid": "1"}, Column: "gross", Value: strPtr("1")}},
+		Inserts: []rowInsert{{Values: map[string]*string{"net": strPtr("1"), "label": strPtr("free")}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []editError{
+		{Kind: "edit", Index: 0, Column: "gross", Message: "Generated columns can't be changed"},
+		{Kind: "insert", Index: 0, Column: "label", Message: "Generated columns can't be set"},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("Expected problems %v, got %v", want, problems)
+	}
+}
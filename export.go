@@ -0,0 +1,551 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// Minio bucket holding finished data export archives
+const exportBucket = "exports"
+
+// How long a finished data export remains available for download
+const exportLifetime = 48 * time.Hour
+
+// Status information for a user's most recent data export
+type dataExport struct {
+	Status   string
+	Progress int
+	Expires  time.Time
+}
+
+// Assembles a zip archive of everything we hold for a user, then stores it in Minio.  This runs in the background,
+// with progress recorded in the data_exports table so the preferences page can display it
+func buildDataExport(exportId int64, userName string) {
+	pageName := "Data export"
+
+	// Record the export failure if anything goes wrong
+	failed := func(err error) {
+		log.Printf("%s: Export %d for user '%s' failed: %v\n", pageName, exportId, userName, err)
+		_, err = db.Exec(`UPDATE data_exports SET status = 'failed' WHERE id = $1`, exportId)
+		if err != nil {
+			log.Printf("%s: Error updating status of export %d: %v\n", pageName, exportId, err)
+		}
+	}
+	_, err := db.Exec(`UPDATE data_exports SET status = 'running' WHERE id = $1`, exportId)
+	if err != nil {
+		failed(err)
+		return
+	}
+
+	// Gather the account details and preferences.  An uploaded avatar is included in the archive as avatar.png
+	var account struct {
+		Username    string
+		Email       string
+		Preferences userPreferences
+		Avatar      string
+	}
+	var avatarId pgx.NullString
+	prefs := &account.Preferences
+	err = db.QueryRow(`
+		SELECT username, email, pref_max_rows, coalesce(pref_default_public, false),
+			coalesce(pref_default_licence, ''), coalesce(pref_date_format, ''), coalesce(pref_timezone, ''),
+			avatar_minioid
+		FROM users
+		WHERE username = $1`, userName).Scan(&account.Username, &account.Email, &prefs.MaxRows,
+		&prefs.DefaultPublic, &prefs.DefaultLicence, &prefs.DateFormat, &prefs.TimeZone, &avatarId)
+	if err != nil {
+		failed(err)
+		return
+	}
+	if avatarId.Valid {
+		account.Avatar = "avatar.png"
+	}
+
+	// Gather the details of each database version
+	type versionInfo struct {
+		Database     string
+		Folder       string
+		Description  string
+		Version      int
+		Size         int
+		Sha256       string
+		Public       bool
+		LastModified time.Time
+		minioBucket  string
+		minioId      string
+	}
+	var versions []versionInfo
+	rows, err := db.Query(`
+		SELECT db.dbname, db.folder, db.description, ver.version, ver.size, ver.sha256, ver.public,
+			ver.last_modified, db.minio_bucket, ver.minioid
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.idnum = ver.db
+			AND db.username = $1
+		ORDER BY db.dbname, ver.version`, userName)
+	if err != nil {
+		failed(err)
+		return
+	}
+	for rows.Next() {
+		var oneRow versionInfo
+		var desc pgx.NullString
+		err = rows.Scan(&oneRow.Database, &oneRow.Folder, &desc, &oneRow.Version, &oneRow.Size, &oneRow.Sha256,
+			&oneRow.Public, &oneRow.LastModified, &oneRow.minioBucket, &oneRow.minioId)
+		if err != nil {
+			rows.Close()
+			failed(err)
+			return
+		}
+		oneRow.Description = desc.String
+		versions = append(versions, oneRow)
+	}
+	rows.Close()
+
+	// Gather the databases starred by the user
+	type starInfo struct {
+		Owner       string
+		Database    string
+		DateStarred time.Time
+	}
+	stars, err := exportRows(`
+		SELECT dbs.username, dbs.dbname, stars.date_starred
+		FROM database_stars AS stars, sqlite_databases AS dbs
+		WHERE dbs.idnum = stars.db
+			AND stars.username = $1
+		ORDER BY stars.date_starred`, userName, func(rows *pgx.Rows) (interface{}, error) {
+		var oneRow starInfo
+		err := rows.Scan(&oneRow.Owner, &oneRow.Database, &oneRow.DateStarred)
+		return oneRow, err
+	})
+	if err != nil {
+		failed(err)
+		return
+	}
+
+	// Gather the discussion threads the user started, and the comments they wrote in any thread
+	type discussionInfo struct {
+		Owner        string
+		Database     string
+		ID           int64
+		Title        string
+		Created      time.Time
+		LastActivity time.Time
+	}
+	discussions, err := exportRows(`
+		SELECT db.username, db.dbname, d.id, d.title, d.date_created, d.last_activity
+		FROM discussions AS d, sqlite_databases AS db
+		WHERE d.db = db.idnum
+			AND d.author = $1
+		ORDER BY d.date_created`, userName, func(rows *pgx.Rows) (interface{}, error) {
+		var oneRow discussionInfo
+		err := rows.Scan(&oneRow.Owner, &oneRow.Database, &oneRow.ID, &oneRow.Title, &oneRow.Created,
+			&oneRow.LastActivity)
+		return oneRow, err
+	})
+	if err != nil {
+		failed(err)
+		return
+	}
+	type commentInfo struct {
+		Owner      string
+		Database   string
+		Discussion int64
+		ID         int64
+		Body       string
+		Created    time.Time
+	}
+	comments, err := exportRows(`
+		SELECT db.username, db.dbname, c.discussion, c.id, c.body, c.date_created
+		FROM discussion_comments AS c, discussions AS d, sqlite_databases AS db
+		WHERE c.discussion = d.id
+			AND d.db = db.idnum
+			AND c.author = $1
+		ORDER BY c.date_created`, userName, func(rows *pgx.Rows) (interface{}, error) {
+		var oneRow commentInfo
+		err := rows.Scan(&oneRow.Owner, &oneRow.Database, &oneRow.Discussion, &oneRow.ID, &oneRow.Body,
+			&oneRow.Created)
+		return oneRow, err
+	})
+	if err != nil {
+		failed(err)
+		return
+	}
+
+	// Gather the merge requests the user opened
+	type mergeRequestInfo struct {
+		Owner    string
+		Database string
+		mergeRequest
+	}
+	mergeRequests, err := exportRows(`
+		SELECT db.username, db.dbname, `+mergeRequestColumns+`
+		FROM merge_requests AS mr, sqlite_databases AS src, sqlite_databases AS db
+		WHERE mr.source_db = src.idnum
+			AND mr.db = db.idnum
+			AND mr.author = $1
+		ORDER BY mr.date_created`, userName, func(rows *pgx.Rows) (interface{}, error) {
+		var oneRow mergeRequestInfo
+		mr := &oneRow.mergeRequest
+		err := rows.Scan(&oneRow.Owner, &oneRow.Database, &mr.ID, &mr.Title, &mr.Description, &mr.Author,
+			&mr.SourceOwner, &mr.SourceDatabase, &mr.SourceVersion, &mr.State, &mr.Created, &mr.Closed, &mr.ClosedBy,
+			&mr.CloseComment, &mr.MergedVersion)
+		return oneRow, err
+	})
+	if err != nil {
+		failed(err)
+		return
+	}
+
+	// Gather the abuse reports the user filed
+	type reportInfo struct {
+		Owner    string
+		Database string
+		Reason   string
+		Details  string
+		IP       string
+		Status   string
+		Created  time.Time
+	}
+	reports, err := exportRows(`
+		SELECT db.username, db.dbname, rep.reason, coalesce(rep.details, ''), rep.reporter_ip, rep.status,
+			rep.date_created
+		FROM abuse_reports AS rep, sqlite_databases AS db
+		WHERE rep.db = db.idnum
+			AND rep.reporter = $1
+		ORDER BY rep.date_created`, userName, func(rows *pgx.Rows) (interface{}, error) {
+		var oneRow reportInfo
+		err := rows.Scan(&oneRow.Owner, &oneRow.Database, &oneRow.Reason, &oneRow.Details, &oneRow.IP,
+			&oneRow.Status, &oneRow.Created)
+		return oneRow, err
+	})
+	if err != nil {
+		failed(err)
+		return
+	}
+
+	// Gather the table, sorting and visualisation settings saved for the user on each database
+	type stateInfo struct {
+		Owner    string
+		Database string
+		State    dbState
+		LastUsed time.Time
+	}
+	states, err := exportRows(`
+		SELECT db.username, db.dbname, st.state::text, st.last_used
+		FROM user_db_state AS st, sqlite_databases AS db
+		WHERE st.db = db.idnum
+			AND st.username = $1
+		ORDER BY st.last_used`, userName, func(rows *pgx.Rows) (interface{}, error) {
+		var oneRow stateInfo
+		var stateJSON string
+		err := rows.Scan(&oneRow.Owner, &oneRow.Database, &stateJSON, &oneRow.LastUsed)
+		if err == nil {
+			err = json.Unmarshal([]byte(stateJSON), &oneRow.State)
+		}
+		return oneRow, err
+	})
+	if err != nil {
+		failed(err)
+		return
+	}
+
+	// The archive can be large, so it's assembled in a temporary file rather than in memory
+	tempFile, err := ioutil.TempFile(tempDir(), "dbhub-export-")
+	if err != nil {
+		failed(err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	zipFile := zip.NewWriter(tempFile)
+
+	// Add the JSON documents
+	jsonDocs := []struct {
+		name string
+		data interface{}
+	}{
+		{"account.json", account},
+		{"databases.json", versions},
+		{"stars.json", stars},
+		{"discussions.json", discussions},
+		{"comments.json", comments},
+		{"merge_requests.json", mergeRequests},
+		{"reports.json", reports},
+		{"saved_state.json", states},
+	}
+	for _, doc := range jsonDocs {
+		var f io.Writer
+		f, err = zipFile.Create(doc.name)
+		if err != nil {
+			failed(err)
+			return
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", " ")
+		err = enc.Encode(doc.data)
+		if err != nil {
+			failed(err)
+			return
+		}
+	}
+
+	// Add the avatar image
+	if avatarId.Valid {
+		var avatar io.ReadCloser
+		avatar, err = minioClient.GetObject(avatarBucket, avatarId.String)
+		if err != nil {
+			failed(err)
+			return
+		}
+		var f io.Writer
+		f, err = zipFile.Create(account.Avatar)
+		if err == nil {
+			_, err = io.Copy(f, avatar)
+		}
+		avatar.Close()
+		if err != nil {
+			failed(err)
+			return
+		}
+	}
+
+	// Add each stored database file, updating the progress as we go
+	for i, ver := range versions {
+		var obj io.ReadCloser
+		obj, err = minioClient.GetObject(ver.minioBucket, ver.minioId)
+		if err != nil {
+			failed(err)
+			return
+		}
+		var f io.Writer
+		f, err = zipFile.Create(fmt.Sprintf("databases/%s/v%d.db", ver.Database, ver.Version))
+		if err == nil {
+			_, err = io.Copy(f, obj)
+		}
+		obj.Close()
+		if err != nil {
+			failed(err)
+			return
+		}
+		_, err = db.Exec(`UPDATE data_exports SET progress = $2 WHERE id = $1`, exportId,
+			(i+1)*100/(len(versions)+1))
+		if err != nil {
+			log.Printf("%s: Error updating progress of export %d: %v\n", pageName, exportId, err)
+		}
+	}
+	err = zipFile.Close()
+	if err != nil {
+		failed(err)
+		return
+	}
+
+	// Store the finished archive in Minio
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		failed(err)
+		return
+	}
+	minioId := randomString(32) + ".zip"
+	_, err = minioClient.PutObject(exportBucket, minioId, tempFile, "application/zip")
+	if err != nil {
+		failed(err)
+		return
+	}
+	_, err = db.Exec(`
+		UPDATE data_exports
+		SET status = 'complete', progress = 100, minioid = $2, expires = $3
+		WHERE id = $1`, exportId, minioId, time.Now().Add(exportLifetime))
+	if err != nil {
+		failed(err)
+		return
+	}
+	log.Printf("%s: Export %d for user '%s' complete\n", pageName, exportId, userName)
+}
+
+// Runs a query for the data export, returning one entry per row as built by scanRow.  The query is given the user
+// name as its only argument
+func exportRows(dbQuery string, userName string, scanRow func(rows *pgx.Rows) (interface{}, error)) (
+	[]interface{}, error) {
+	rows, err := db.Query(dbQuery, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []interface{}{}
+	for rows.Next() {
+		oneRow, err := scanRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, rows.Err()
+}
+
+// Starts a data export for the logged in user
+func exportDataHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Data export handler"
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Data exports need to be requested from the preferences page")
+		return
+	}
+
+	// Only one export per user can be in progress at a time.  The insert only happens when that's the case
+	var exportId int64
+	err := db.QueryRow(`
+		INSERT INTO data_exports (username, status, progress)
+		SELECT $1, 'queued', 0
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM data_exports
+			WHERE username = $1
+				AND status IN ('queued', 'running'))
+		RETURNING id`, loggedInUser).Scan(&exportId)
+	if err == pgx.ErrNoRows {
+		errorPage(w, r, http.StatusConflict, "A data export is already in progress")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error queueing data export for user '%s': %v\n", pageName, loggedInUser, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Build the export in the background
+	go buildDataExport(exportId, loggedInUser)
+
+	// Bounce back to the preferences page, which displays the export progress
+	http.Redirect(w, r, "/pref", http.StatusSeeOther)
+}
+
+// Sends the logged in user their most recently completed data export
+func exportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Data export download handler"
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Find the most recent export which hasn't yet expired
+	var minioId string
+	var created time.Time
+	err := db.QueryRow(`
+		SELECT minioid, date_created
+		FROM data_exports
+		WHERE username = $1
+			AND status = 'complete'
+			AND expires > now()
+		ORDER BY date_created DESC
+		LIMIT 1`, loggedInUser).Scan(&minioId, &created)
+	if err == pgx.ErrNoRows {
+		errorPage(w, r, http.StatusNotFound, "No data export is available.  It may have expired.")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error looking up data export for user '%s': %v\n", pageName, loggedInUser, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Get a handle from Minio for the archive
+	archive, err := minioClient.GetObject(exportBucket, minioId)
+	if err != nil {
+		log.Printf("%s: Error retrieving export from Minio: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Retrieving the data export failed")
+		return
+	}
+	defer archive.Close()
+
+	// Send the archive to the user
+	w.Header().Set("Content-Disposition", contentDisposition("attachment",
+		"dbhub-"+loggedInUser+"-"+created.Format("2006-01-02")+".zip"))
+	w.Header().Set("Content-Type", "application/zip")
+	_, err = io.Copy(w, archive)
+	if err != nil {
+		log.Printf("%s: Error returning data export: %v\n", pageName, err)
+	}
+}
+
+// Periodically removes expired data export archives from Minio
+func expireDataExports() {
+	// Exports which were in progress when the server last stopped will never finish, so mark them as failed
+	_, err := db.Exec(`UPDATE data_exports SET status = 'failed' WHERE status IN ('queued', 'running')`)
+	if err != nil {
+		log.Printf("Error marking interrupted data exports as failed: %v\n", err)
+	}
+
+	for {
+		rows, err := db.Query(`
+			SELECT id, minioid
+			FROM data_exports
+			WHERE expires < now()`)
+		if err != nil {
+			log.Printf("Error looking up expired data exports: %v\n", err)
+		} else {
+			var expired []int64
+			for rows.Next() {
+				var id int64
+				var minioId string
+				err = rows.Scan(&id, &minioId)
+				if err != nil {
+					log.Printf("Error retrieving expired data export: %v\n", err)
+					break
+				}
+				err = minioClient.RemoveObject(exportBucket, minioId)
+				if err != nil {
+					log.Printf("Error removing expired data export '%s': %v\n", minioId, err)
+					continue
+				}
+				expired = append(expired, id)
+			}
+			rows.Close()
+			for _, id := range expired {
+				_, err = db.Exec(`DELETE FROM data_exports WHERE id = $1`, id)
+				if err != nil {
+					log.Printf("Error removing expired data export %d: %v\n", id, err)
+				}
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// Returns the status of the most recent data export for a user, if any
+func getDataExport(userName string) (exp dataExport, found bool, err error) {
+	var expires pgx.NullTime
+	err = db.QueryRow(`
+		SELECT status, progress, expires
+		FROM data_exports
+		WHERE username = $1
+		ORDER BY date_created DESC
+		LIMIT 1`, userName).Scan(&exp.Status, &exp.Progress, &expires)
+	if err == pgx.ErrNoRows {
+		return exp, false, nil
+	}
+	if err != nil {
+		log.Printf("Error retrieving data export status for user '%s': %v\n", userName, err)
+		return exp, false, err
+	}
+	exp.Expires = expires.Time
+	return exp, true, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	com "github.com/dbhubio/common"
+	"github.com/jackc/pgx"
+)
+
+const (
+	// The largest database which can be fetched from a remote URL
+	maxFetchSize = 512 << 20
+
+	// The most redirects followed when fetching a database
+	maxFetchRedirects = 5
+)
+
+// Address ranges which fetches aren't allowed to connect to, so the server can't be used to reach internal
+// services.  Loopback, link local, and multicast addresses are checked separately
+var blockedFetchNets = func() (nets []*net.IPNet) {
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"fc00::/7",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}()
+
+// The HTTP client used for fetching databases.  The address is checked when connecting rather than when the URL
+// is given, so it applies to redirects too and the host name can't resolve differently in between
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network string, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !fetchAllowedIP(ip) {
+					return fmt.Errorf("Connecting to %s isn't allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxFetchRedirects {
+			return errors.New("Too many redirects")
+		}
+		if req.URL.Scheme != "https" {
+			return errors.New("Redirected to a URL which isn't https")
+		}
+		return nil
+	},
+}
+
+// Returns true if fetches are allowed to connect to the given address
+func fetchAllowedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range blockedFetchNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Downloads a database from a remote URL.  The returned errors are suitable for showing to the user, as they say
+// what went wrong with the request
+func fetchDatabase(ctx context.Context, rawURL string) (data []byte, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("That doesn't look like a valid URL")
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("Only https URLs can be fetched")
+	}
+
+	fctx, cancel := context.WithTimeout(ctx, time.Duration(conf.Timeouts.Fetch)*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.New("That doesn't look like a valid URL")
+	}
+	resp, err := fetchClient.Do(req.WithContext(fctx))
+	if err != nil {
+		return nil, fmt.Errorf("Fetching the URL failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching the URL failed, the server returned HTTP status '%s'", resp.Status)
+	}
+	if resp.ContentLength > maxFetchSize {
+		return nil, fmt.Errorf("The database is larger than the %d MB limit", maxFetchSize>>20)
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxFetchSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Fetching the URL failed: %v", err)
+	}
+	if len(data) > maxFetchSize {
+		return nil, fmt.Errorf("The database is larger than the %d MB limit", maxFetchSize>>20)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("The URL returned an empty file")
+	}
+	return data, nil
+}
+
+// Adds a new database from a remote URL, remembering the URL so the database can be re-fetched later
+func fetchDataHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Fetch DB handler"
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Fetches need to be requested with POST")
+		return
+	}
+
+	// Grab and validate the supplied "public" form field
+	public, err := strconv.ParseBool(r.PostFormValue("public"))
+	if err != nil {
+		log.Printf("%s: Error when converting public value to boolean: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Public value incorrect")
+		return
+	}
+
+	// The licence only applies to new databases.  Existing ones keep theirs
+	licence := r.PostFormValue("licence")
+	if !isValidLicence(licence) {
+		log.Printf("%s: Unknown licence '%s'\n", pageName, licence)
+		errorPage(w, r, http.StatusBadRequest, "Unknown licence")
+		return
+	}
+
+	// The database is named after the file in the URL, unless a name was given
+	sourceURL := r.PostFormValue("url")
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "That doesn't look like a valid URL")
+		return
+	}
+	dbName := r.PostFormValue("name")
+	if dbName == "" {
+		dbName = path.Base(u.Path)
+	}
+	err = com.ValidateDB(dbName)
+	if err != nil {
+		log.Printf("%s: Validation failed for database name: %s", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name.  Please give a name for it")
+		return
+	}
+
+	// Download and check the database
+	ctx := r.Context()
+	dbData, err := fetchDatabase(ctx, sourceURL)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Fetching '%s' for user '%s' failed: %v\n", pageName, sourceURL, loggedInUser, err)
+		errorPage(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	meta, err := sanityCheckSQLiteData(dbData)
+	if err != nil {
+		log.Printf("%s: The database fetched from '%s' failed the sanity check\n", pageName, sourceURL)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Store it as a new version, and remember where it came from
+	newVersion, dbSize, minioId, err := addDatabaseVersion(loggedInUser, dbName, "/", public, dbData,
+		"Fetched from "+sourceURL, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if meta.Tables != nil {
+		saveVersionMeta(loggedInUser, dbName, newVersion, meta)
+	}
+	if newVersion == 1 && licence != "" {
+		// The database is stored already, so a failure here isn't worth failing the fetch over
+		setDatabaseLicence(loggedInUser, dbName, licence)
+	}
+	_, err = db.Exec(`
+		UPDATE sqlite_databases
+		SET source_url = $3
+		WHERE username = $1
+			AND dbname = $2`, loggedInUser, dbName, sourceURL)
+	if err != nil {
+		log.Printf("%s: Error saving the source URL of '%s/%s': %v\n", pageName, loggedInUser, dbName, err)
+	}
+	log.Printf("%s: Username: %v, database '%v' fetched from '%v' as '%v', bytes: %v\n", pageName, loggedInUser,
+		dbName, sourceURL, minioId, dbSize)
+
+	// Bounce back to the new database
+	http.Redirect(w, r, "/"+loggedInUser+"/"+dbName, http.StatusSeeOther)
+}
+
+// Fetches a database from the URL it was originally added from.  A new version is only created when the remote
+// file has changed
+func refetchHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Re-fetch DB handler"
+
+	// Errors are returned as JSON, for showing on the database page
+	fail := func(status int, msg string) {
+		jsonError(w, status, msg)
+	}
+
+	if r.Method != http.MethodPost {
+		fail(http.StatusMethodNotAllowed, "Re-fetches need to be requested with POST")
+		return
+	}
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		fail(http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Only the owner of a database can re-fetch it
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/refetch/" at the start of the URL
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	if userName != loggedInUser {
+		fail(http.StatusForbidden, "Only the owner of a database can re-fetch it")
+		return
+	}
+
+	// Retrieve the source URL, and the details of the latest version to compare against
+	ctx := r.Context()
+	var sourceURL pgx.NullString
+	var latestSHA string
+	var latestVersion int
+	var public bool
+	qctx, cancel := queryContext(ctx)
+	err = db.QueryRowEx(qctx, `
+		SELECT db.source_url, ver.sha256, ver.version, ver.public
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND db.idnum = ver.db
+		ORDER BY ver.version DESC
+		LIMIT 1`, nil, userName, dbName).Scan(&sourceURL, &latestSHA, &latestVersion, &public)
+	cancel()
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error looking up '%s/%s': %v\n", pageName, userName, dbName, err)
+		fail(http.StatusBadRequest, "The requested database doesn't exist")
+		return
+	}
+	if !sourceURL.Valid || sourceURL.String == "" {
+		fail(http.StatusBadRequest, "The database wasn't added from a URL")
+		return
+	}
+
+	// Download the database again, and see if it's changed
+	dbData, err := fetchDatabase(ctx, sourceURL.String)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Re-fetching '%s' for '%s/%s' failed: %v\n", pageName, sourceURL.String, userName, dbName,
+			err)
+		fail(http.StatusBadGateway, err.Error())
+		return
+	}
+	shaSum := sha256.Sum256(dbData)
+	if hex.EncodeToString(shaSum[:]) == latestSHA {
+		writeJSON(w, http.StatusOK, struct {
+			Changed bool
+			Version int
+		}{false, latestVersion})
+		return
+	}
+	meta, err := sanityCheckSQLiteData(dbData)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	newVersion, dbSize, minioId, err := addDatabaseVersion(userName, dbName, "/", public, dbData,
+		"Re-fetched from "+sourceURL.String, userName)
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if meta.Tables != nil {
+		saveVersionMeta(userName, dbName, newVersion, meta)
+	}
+	log.Printf("%s: Database '%s/%s' re-fetched as version %d stored as '%v', bytes: %v\n", pageName, userName,
+		dbName, newVersion, minioId, dbSize)
+	writeJSON(w, http.StatusOK, struct {
+		Changed bool
+		Version int
+	}{true, newVersion})
+}
+
+// Like sanityCheckSQLite(), but for a database held in memory.  The details to record with the new version are read
+// while the database is in a file anyway.  If they can't be read, which doesn't stop the database being stored, the
+// returned details have no tables
+func sanityCheckSQLiteData(dbData []byte) (versionMeta, error) {
+	tempDB, err := ioutil.TempFile(tempDir(), "dbhub-fetch-")
+	if err != nil {
+		log.Printf("Error creating temporary file: %v\n", err)
+		return versionMeta{}, errors.New("Internal error")
+	}
+	defer os.Remove(tempDB.Name())
+	_, err = tempDB.Write(dbData)
+	closeErr := tempDB.Close()
+	if err != nil || closeErr != nil {
+		log.Printf("Error writing temporary file: %v, %v\n", err, closeErr)
+		return versionMeta{}, errors.New("Internal error")
+	}
+	err = sanityCheckSQLite(tempDB.Name())
+	if err != nil {
+		return versionMeta{}, err
+	}
+	meta, err := readVersionMeta(tempDB.Name())
+	if err != nil {
+		log.Printf("Error reading details of fetched database: %v\n", err)
+		return versionMeta{}, nil
+	}
+	return meta, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strconv"
+)
+
+// A GeoJSON point, with coordinates in longitude, latitude order
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONPoint      `json:"geometry"`
+	Properties map[string]string `json:"properties"`
+}
+
+// A GeoJSON feature collection.  The fields after Features are extra members, describing how the points were
+// selected
+type geoJSONCollection struct {
+	Type         string           `json:"type"`
+	Features     []geoJSONFeature `json:"features"`
+	Downsampled  bool             `json:"downsampled"`
+	SampleMethod string           `json:"sample_method,omitempty"`
+	TotalRows    int              `json:"total_rows"`
+	SkippedRows  int              `json:"skipped_rows"`
+	Version      int              `json:"version"`
+}
+
+// Converts a record set of latitude, longitude, and (optional) label columns into GeoJSON points.  Rows with a
+// missing or out of range position are skipped, and counted in SkippedRows
+func recordsToGeoJSON(data sqliteRecordSet) geoJSONCollection {
+	geo := geoJSONCollection{
+		Type:         "FeatureCollection",
+		Features:     []geoJSONFeature{},
+		Downsampled:  data.Downsampled,
+		SampleMethod: data.SampleMethod,
+		TotalRows:    data.TotalRows,
+		SkippedRows:  data.SkippedRows,
+		Version:      data.Version,
+	}
+	for _, row := range data.Records {
+		if len(row) < 2 || row[0].Type == Null || row[1].Type == Null {
+			geo.SkippedRows++
+			continue
+		}
+		lat, err := strconv.ParseFloat(row[0].Value, 64)
+		if err != nil || lat < -90 || lat > 90 {
+			geo.SkippedRows++
+			continue
+		}
+		lon, err := strconv.ParseFloat(row[1].Value, 64)
+		if err != nil || lon < -180 || lon > 180 {
+			geo.SkippedRows++
+			continue
+		}
+		feature := geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONPoint{Type: "Point", Coordinates: [2]float64{lon, lat}},
+			Properties: map[string]string{},
+		}
+		if len(row) > 2 && row[2].Type != Null {
+			feature.Properties[row[2].Name] = row[2].Value
+		}
+		geo.Features = append(geo.Features, feature)
+	}
+	return geo
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The longest wait between connection attempts
+const maxRetryInterval = time.Minute
+
+// Reports whether the server's dependencies are usable, for load balancers and orchestration systems.  Anyone can
+// call this, so the details of any failure are only logged
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := map[string]string{
+		"cache":      "ok",
+		"minio":      "ok",
+		"postgresql": "ok",
+	}
+	ready := true
+
+	// PostgreSQL
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	var one int
+	err := db.QueryRowEx(ctx, "SELECT 1", nil).Scan(&one)
+	if err != nil {
+		log.Printf("Readiness check: PostgreSQL error: %v\n", err)
+		status["postgresql"] = "error"
+		ready = false
+	}
+
+	// Minio
+	_, err = minioClient.BucketExists(avatarBucket)
+	if err != nil {
+		log.Printf("Readiness check: Minio error: %v\n", err)
+		status["minio"] = "error"
+		ready = false
+	}
+
+	// Memcached isn't required for serving pages, so a dead cache is reported without failing the check
+	if !cacheAvailable() {
+		status["cache"] = "error"
+	}
+
+	httpcode := http.StatusOK
+	if !ready {
+		httpcode = http.StatusServiceUnavailable
+	}
+	writeJSON(w, httpcode, status)
+}
+
+// Calls the given function until it succeeds, waiting longer between each attempt.  This lets the server start
+// before the services it depends on are ready
+func withRetries(what string, fn func() error) error {
+	interval := time.Duration(conf.Retry.Interval) * time.Second
+	var err error
+	for attempt := 1; attempt <= conf.Retry.Attempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if attempt == conf.Retry.Attempts {
+			break
+		}
+		log.Printf("%s not available (attempt %d of %d), retrying in %v: %v\n", what, attempt,
+			conf.Retry.Attempts, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+	return fmt.Errorf("%s not available after %d attempts: %v", what, conf.Retry.Attempts, err)
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// The types of background job
+const (
+	jobCSVExport    = "csvexport"
+	jobMetaBackfill = "metabackfill"
+)
+
+// Tables with more rows than this are exported to CSV in the background, rather than during the request
+const csvBackgroundRows = 100000
+
+// How often idle workers check for new jobs
+const jobPollInterval = 2 * time.Second
+
+// How many times a job is attempted before it's marked as failed
+const jobMaxAttempts = 5
+
+// A job claimed by a worker
+type job struct {
+	ID       int64
+	Type     string
+	Username string
+	Payload  []byte
+	Attempts int
+}
+
+// The status of a job, as returned to the browser
+type jobStatus struct {
+	Status string
+	Result string
+	Error  string
+}
+
+// Payload for the CSV export job
+type csvExportJob struct {
+	Owner    string
+	Database string
+	Version  int64
+	Table    string
+	Bucket   string
+	MinioId  string
+	Cols     []string  // Columns to export, or all of them when empty
+	Filter   rowFilter // The ordering, search and default filter from the table view, if any
+	MaxRows  int       // Row limit, or no limit when zero
+}
+
+// Runs a job of a particular type, returning a result string for the job status.  A returned error means the job
+// will be retried later, unless it's run out of attempts
+type jobHandler func(ctx context.Context, j job) (string, error)
+
+// The handler for each type of job
+var jobHandlers = map[string]jobHandler{
+	jobCSVExport:    runCSVExportJob,
+	jobMetaBackfill: runMetaBackfillJob,
+}
+
+// Claims the oldest job which is ready to run, if there is one
+func claimJob() (j job, found bool, err error) {
+	err = db.QueryRow(`
+		UPDATE jobs
+		SET status = 'running', attempts = attempts + 1, date_updated = now()
+		WHERE id = (
+			SELECT id
+			FROM jobs
+			WHERE status = 'queued'
+				AND run_after <= now()
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, job_type, username, payload, attempts`).Scan(&j.ID, &j.Type, &j.Username, &j.Payload,
+		&j.Attempts)
+	if err == pgx.ErrNoRows {
+		return j, false, nil
+	}
+	if err != nil {
+		return j, false, err
+	}
+	return j, true, nil
+}
+
+// Adds a job to the queue, returning the token used to check on it
+func enqueueJob(jobType string, userName string, payload interface{}) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	// The token is all that's needed to check on a job and fetch its result, so it has to be hard to guess
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	_, err = db.Exec(`
+		INSERT INTO jobs (token, job_type, username, payload, status, attempts, run_after)
+		VALUES ($1, $2, $3, $4, 'queued', 0, now())`, token, jobType, userName, string(data))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Removes finished jobs older than the export lifetime, along with any file they produced
+func expireJobs() {
+	rows, err := db.Query(`
+		SELECT id, job_type, result
+		FROM jobs
+		WHERE status IN ('complete', 'failed')
+			AND date_updated < now() - $1::interval`, fmt.Sprintf("%d seconds", int(exportLifetime.Seconds())))
+	if err != nil {
+		log.Printf("Error looking up expired jobs: %v\n", err)
+		return
+	}
+	var expired []int64
+	for rows.Next() {
+		var id int64
+		var jobType string
+		var result pgx.NullString
+		err = rows.Scan(&id, &jobType, &result)
+		if err != nil {
+			log.Printf("Error retrieving expired job: %v\n", err)
+			break
+		}
+		if jobType == jobCSVExport && result.Valid && result.String != "" {
+			err = minioClient.RemoveObject(exportBucket, result.String)
+			if err != nil {
+				log.Printf("Error removing result of expired job %d: %v\n", id, err)
+				continue
+			}
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	for _, id := range expired {
+		_, err = db.Exec(`DELETE FROM jobs WHERE id = $1`, id)
+		if err != nil {
+			log.Printf("Error removing expired job %d: %v\n", id, err)
+		}
+	}
+}
+
+// Looks up a job by its token.  Jobs started by a logged in user can only be seen by that user
+func getJob(r *http.Request, token string) (status jobStatus, jobType string, err error) {
+	loggedInUser := currentUser(r)
+
+	var owner string
+	var result, jobErr pgx.NullString
+	err = db.QueryRow(`
+		SELECT job_type, username, status, result, error
+		FROM jobs
+		WHERE token = $1`, token).Scan(&jobType, &owner, &status.Status, &result, &jobErr)
+	if err != nil {
+		return
+	}
+	if owner != "" && owner != loggedInUser {
+		return status, jobType, pgx.ErrNoRows
+	}
+	status.Result = result.String
+	status.Error = jobErr.String
+	return
+}
+
+// Displays the progress of a background job, with a link to the result once it's finished
+func jobPage(w http.ResponseWriter, r *http.Request) {
+	pageName := "Job page"
+
+	token := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	status, _, err := getJob(r, token)
+	if err == pgx.ErrNoRows {
+		errorPage(w, r, http.StatusNotFound, "Unknown job")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving job '%s': %v\n", pageName, token, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	var pageData struct {
+		Meta   metaInfo
+		Token  string
+		Status jobStatus
+	}
+	pageData.Meta.Title = "Background job"
+	pageData.Meta.LoggedInUser = currentUser(r)
+	pageData.Token = token
+	pageData.Status = status
+
+	// Render the page
+	renderTemplate(w, "jobPage", pageData)
+}
+
+// Sends the file produced by a finished job
+func jobResultHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Job result handler"
+
+	token := strings.TrimPrefix(r.URL.Path, "/x/jobresult/")
+	status, jobType, err := getJob(r, token)
+	if err == pgx.ErrNoRows || (err == nil && (status.Status != "complete" || jobType != jobCSVExport)) {
+		errorPage(w, r, http.StatusNotFound, "No result is available for this job.  It may have expired.")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving job '%s': %v\n", pageName, token, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Get a handle from Minio for the file
+	result, err := minioClient.GetObject(exportBucket, status.Result)
+	if err != nil {
+		log.Printf("%s: Error retrieving job result from Minio: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Retrieving the file failed")
+		return
+	}
+	defer result.Close()
+
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", status.Result))
+	w.Header().Set("Content-Type", contentTypeCSV)
+	_, err = io.Copy(w, result)
+	if err != nil {
+		log.Printf("%s: Error returning job result: %v\n", pageName, err)
+	}
+}
+
+// Returns the status of a background job as JSON, so pages can poll for completion
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Job status handler"
+
+	token := strings.TrimPrefix(r.URL.Path, "/x/jobstatus/")
+	status, _, err := getJob(r, token)
+	if err == pgx.ErrNoRows {
+		jsonError(w, http.StatusNotFound, "Unknown job")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving job '%s': %v\n", pageName, token, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// Runs a claimed job, recording the outcome.  Failed jobs are retried with an increasing delay
+func runJob(ctx context.Context, j job) {
+	handler, ok := jobHandlers[j.Type]
+	var result string
+	err := errors.New("unknown job type: " + j.Type)
+	if ok {
+		result, err = handler(ctx, j)
+	}
+	if err == nil {
+		_, err = db.Exec(`
+			UPDATE jobs
+			SET status = 'complete', result = $2, error = NULL, date_updated = now()
+			WHERE id = $1`, j.ID, result)
+		if err != nil {
+			log.Printf("Error recording completion of job %d: %v\n", j.ID, err)
+		}
+		return
+	}
+	log.Printf("Job %d (%s) failed on attempt %d: %v\n", j.ID, j.Type, j.Attempts, err)
+
+	// Jobs interrupted by shutdown go straight back on the queue, without using up an attempt
+	if ctx.Err() != nil {
+		_, err = db.Exec(`
+			UPDATE jobs
+			SET status = 'queued', attempts = attempts - 1, date_updated = now()
+			WHERE id = $1`, j.ID)
+	} else if j.Attempts >= jobMaxAttempts || !ok {
+		_, err = db.Exec(`
+			UPDATE jobs
+			SET status = 'failed', error = $2, date_updated = now()
+			WHERE id = $1`, j.ID, err.Error())
+	} else {
+		backoff := time.Duration(1<<uint(j.Attempts)) * 30 * time.Second
+		_, err = db.Exec(`
+			UPDATE jobs
+			SET status = 'queued', error = $2, run_after = $3, date_updated = now()
+			WHERE id = $1`, j.ID, err.Error(), time.Now().Add(backoff))
+	}
+	if err != nil {
+		log.Printf("Error recording failure of job %d: %v\n", j.ID, err)
+	}
+}
+
+// Exports a table to a CSV file in Minio
+func runCSVExportJob(ctx context.Context, j job) (string, error) {
+	var p csvExportJob
+	err := json.Unmarshal(j.Payload, &p)
+	if err != nil {
+		return "", err
+	}
+
+	sdb, err := openMinioObjectCtx(ctx, p.Bucket, p.MinioId)
+	if err != nil {
+		return "", err
+	}
+	defer closeMinioObject(sdb)
+
+	// Write the CSV to a temporary file first, as it may be too big to hold in memory
+	tempFile, err := ioutil.TempFile(tempDir(), "dbhub-csv-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	csvFile := csv.NewWriter(tempFile)
+	err = readSQLiteTableCSV(sdb, p.Table, p.Cols, p.Filter, p.MaxRows, func(row []string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return csvFile.Write(row)
+	})
+	if err != nil {
+		return "", err
+	}
+	csvFile.Flush()
+	if err = csvFile.Error(); err != nil {
+		return "", err
+	}
+
+	// Store the finished file
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	table := p.Table
+	if p.Filter.String() != "" {
+		table += "-filtered"
+	}
+	name := fmt.Sprintf("%s-%s-v%d-%s-%s.csv", p.Owner, p.Database, p.Version, table, randomString(8))
+	_, err = minioClient.PutObject(exportBucket, name, tempFile, "text/csv")
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Starts the pool of background job workers.  Cancelling the context stops them once their current job is done,
+// with the returned WaitGroup finishing when they all have
+func startJobWorkers(ctx context.Context, numWorkers int) *sync.WaitGroup {
+	// Jobs left running when the server last stopped won't finish by themselves
+	_, err := db.Exec(`UPDATE jobs SET status = 'queued' WHERE status = 'running'`)
+	if err != nil {
+		log.Printf("Error requeueing interrupted jobs: %v\n", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				j, found, err := claimJob()
+				if err != nil {
+					log.Printf("Error claiming job: %v\n", err)
+				}
+				if found {
+					runJob(ctx, j)
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(jobPollInterval):
+				}
+			}
+		}()
+	}
+
+	// Clean up old jobs once an hour
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			expireJobs()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return &wg
+}
@@ -1,36 +1,44 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"log"
-	mathrand "math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/bradfitz/gomemcache/memcache"
 	com "github.com/dbhubio/common"
-	sqlite "github.com/gwenn/gosqlite"
 	"github.com/icza/session"
 	"github.com/jackc/pgx"
 	"github.com/minio/go-homedir"
 	"github.com/minio/minio-go"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/image/draw"
 )
 
 type ValType int
@@ -44,15 +52,30 @@ const (
 	Float
 )
 
+// The address the server listens on in development mode
+const devServer = "localhost:8080"
+
 // Stored cached data in memcache for 1/2 hour by default
 const cacheTime = 1800
 
+// Minio bucket holding locally uploaded user avatars
+const avatarBucket = "avatars"
+
+// Width and height (in pixels) of avatar images
+const avatarSize = 256
+
+// Largest avatar image accepted, in bytes
+const maxAvatarUpload = 5 << 20
+
+// Maximum number of Y columns which can be plotted on one visualisation
+const maxYCols = 5
+
 var (
 	// Our configuration info
 	conf tomlConfig
 
 	// Connection handles
-	db          *pgx.Conn
+	db          *pgx.ConnPool
 	memCache    *memcache.Client
 	minioClient *minio.Client
 
@@ -66,6 +89,191 @@ var (
 	tmpl *template.Template
 )
 
+// Returns the avatar image for a user.  Locally uploaded avatars are served from Minio, everyone else is redirected
+// to Gravatar
+func avatarHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Avatar handler"
+
+	// Extract and validate the username
+	userName := strings.TrimPrefix(r.URL.Path, "/avatar/")
+	err := com.ValidateUser(userName)
+	if err != nil {
+		log.Printf("%s: Validation failed for username: %s", pageName, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// Retrieve the avatar details for the user
+	var email string
+	var avatarId pgx.NullString
+	err = db.QueryRow(`
+		SELECT email, avatar_minioid
+		FROM users
+		WHERE username = $1`, userName).Scan(&email, &avatarId)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("%s: Error retrieving avatar details for user '%s': %v\n", pageName, userName, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	// If the user hasn't uploaded their own avatar, use Gravatar (or its identicon fallback)
+	if !avatarId.Valid {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		http.Redirect(w, r, gravatarURL(email), http.StatusFound)
+		return
+	}
+
+	// The Minio id changes with each upload, so it works well as an ETag
+	etag := `"` + avatarId.String + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Get a handle from Minio for the avatar image
+	avatar, err := minioClient.GetObject(avatarBucket, avatarId.String)
+	if err != nil {
+		log.Printf("%s: Error retrieving avatar from Minio: %v\n", pageName, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer avatar.Close()
+
+	// Send the image to the user
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", etag)
+	_, err = io.Copy(w, avatar)
+	if err != nil {
+		log.Printf("%s: Error returning avatar for user '%s': %v\n", pageName, userName, err)
+	}
+}
+
+func contributorsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/contributors/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the contributors page
+	contributorsPage(w, r, userName, dbName)
+}
+
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/diff/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the diff page
+	diffPage(w, r, userName, dbName)
+}
+
+// Streams a zip archive containing the latest version of each of the logged in user's databases
+func downloadAllHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Download all handler"
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Retrieve the Minio details for the latest version of each database
+	type dbObject struct {
+		Name    string
+		Version int
+		Bucket  string
+		Id      string
+	}
+	var dbList []dbObject
+	rows, err := db.Query(`
+		SELECT DISTINCT ON (db.dbname) db.dbname, ver.version, db.minio_bucket, ver.minioid
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.idnum = ver.db
+			AND db.username = $1
+		ORDER BY db.dbname, ver.version DESC`, loggedInUser)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow dbObject
+		err = rows.Scan(&oneRow.Name, &oneRow.Version, &oneRow.Bucket, &oneRow.Id)
+		if err != nil {
+			log.Printf("%s: Error retrieving database list for user '%s': %v\n", pageName, loggedInUser, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		dbList = append(dbList, oneRow)
+	}
+
+	// Stream the archive directly to the user, so nothing is buffered
+	w.Header().Set("Content-Disposition", contentDisposition("attachment",
+		loggedInUser+"-databases-"+time.Now().Format("2006-01-02")+".zip"))
+	w.Header().Set("Content-Type", "application/zip")
+	zipFile := zip.NewWriter(w)
+	var failures []string
+	for _, d := range dbList {
+		userDB, err := minioClient.GetObject(d.Bucket, d.Id)
+		if err == nil {
+			// Minio objects are retrieved lazily, so check the object is reachable before starting its entry
+			_, err = userDB.Stat()
+		}
+		if err != nil {
+			log.Printf("%s: Error retrieving '%s/%s' from Minio: %v\n", pageName, loggedInUser, d.Name, err)
+			failures = append(failures, fmt.Sprintf("%s (version %d): could not be retrieved", d.Name, d.Version))
+			if userDB != nil {
+				userDB.Close()
+			}
+			continue
+		}
+		f, err := zipFile.Create(fmt.Sprintf("%s-v%d.db", d.Name, d.Version))
+		if err != nil {
+			// Writing to the client failed, so there's no point continuing
+			log.Printf("%s: Error creating zip entry: %v\n", pageName, err)
+			userDB.Close()
+			return
+		}
+		_, err = io.Copy(f, userDB)
+		userDB.Close()
+		if err != nil {
+			log.Printf("%s: Error copying '%s/%s' into zip: %v\n", pageName, loggedInUser, d.Name, err)
+			failures = append(failures, fmt.Sprintf("%s (version %d): incomplete, transfer failed part way",
+				d.Name, d.Version))
+		}
+	}
+
+	// Note any failures in a manifest at the end of the archive
+	if len(failures) > 0 {
+		f, err := zipFile.Create("MANIFEST.txt")
+		if err == nil {
+			fmt.Fprintf(f, "The following databases could not be included in this archive:\n\n")
+			for _, msg := range failures {
+				fmt.Fprintf(f, "  %s\n", msg)
+			}
+		}
+	}
+	err = zipFile.Close()
+	if err != nil {
+		log.Printf("%s: Error finishing zip archive: %v\n", pageName, err)
+		return
+	}
+
+	// Log the bulk download
+	log.Printf("%s: '%s' downloaded %d databases, %d failures", pageName, loggedInUser,
+		len(dbList)-len(failures), len(failures))
+}
+
 func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
 	pageName := "Download CSV"
 
@@ -83,11 +291,54 @@ func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	// The table can also be given as Markdown or HTML, for pasting into documents
+	format := r.FormValue("format")
+	switch format {
+	case "", "csv", "xlsx", tableFormatMarkdown, tableFormatHTML:
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown export format")
+		return
+	}
+
+	// Check the optional column selection and row limit
+	cols := r.Form["col"]
+	for _, c := range cols {
+		err = com.ValidatePGTable(c)
+		if err != nil {
+			log.Printf("%s: Validation failed for column name: %s", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Invalid column name")
+			return
+		}
+	}
+	var maxRows int
+	if limit := r.FormValue("limit"); limit != "" {
+		maxRows, err = strconv.Atoi(limit)
+		if err != nil || maxRows < 1 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid row limit")
+			return
+		}
+	}
+
+	// The ordering and search from the table view are applied, so the download has the rows being looked at.  The
+	// whole table can still be asked for with full=true
+	filter, err := parseRowFilter(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.FormValue("full") == "true" {
+		filter = rowFilter{}
+	}
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+
+	// Other people only get the rows the owner's default filter leaves, even with full=true, unless they asked for
+	// every row
+	filters, _, err := viewerTableFilters(r, loggedInUser, userName, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
 	}
 
 	// Verify the given database exists and is ok to be downloaded (and get the Minio details while at it)
@@ -95,165 +346,208 @@ func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
 	if loggedInUser != userName {
 		// * The request is for another users database, so it needs to be a public one *
 		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
+			SELECT db.minio_bucket, ver.minioid, ver.version
+			FROM database_versions AS ver, sqlite_databases AS db, users AS u
 			WHERE ver.db = db.idnum
+				AND db.username = u.username
+				AND u.disabled = false
 				AND db.username = $1
 				AND db.dbname = $2
-				AND ver.version = $3
-				AND ver.public = true`
+				AND ($3 = 0 OR ver.version = $3)
+				AND ver.public = true
+			ORDER BY ver.version DESC
+			LIMIT 1`
 	} else {
 		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
+			SELECT db.minio_bucket, ver.minioid, ver.version
+			FROM database_versions AS ver, sqlite_databases AS db, users AS u
 			WHERE ver.db = db.idnum
+				AND db.username = u.username
+				AND u.disabled = false
 				AND db.username = $1
 				AND db.dbname = $2
-				AND ver.version = $3`
+				AND ($3 = 0 OR ver.version = $3)
+			ORDER BY ver.version DESC
+			LIMIT 1`
 	}
 	var minioBucket, minioId string
-	err = db.QueryRow(dbQuery, userName, dbName, dbVersion).Scan(&minioBucket, &minioId)
+	var servedVersion int
+	err = db.QueryRow(dbQuery, userName, dbName, dbVersion).Scan(&minioBucket, &minioId, &servedVersion)
+	if err == pgx.ErrNoRows {
+		err = versionLookupError(r.Context(), loggedInUser, userName, dbName, dbVersion)
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
 	if err != nil {
 		log.Printf("%s: Error retrieving MinioID: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "The requested database doesn't exist")
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
+	w.Header().Set("X-DBHub-Version", strconv.Itoa(servedVersion))
 
-	// Get a handle from Minio for the database object
-	userDB, err := minioClient.GetObject(minioBucket, minioId)
+	// Retrieve the database from Minio and open it
+	ctx := r.Context()
+	db, err := openMinioObjectCtx(ctx, minioBucket, minioId)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err == errTooManyOpenDBs {
+		serverBusy(w, r)
+		return
+	}
 	if err != nil {
-		log.Printf("%s: Error retrieving DB from Minio: %v\n", pageName, err)
+		log.Printf("%s: Error retrieving database '%s/%s': %v\n", pageName, userName, dbName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
+	defer closeMinioObject(db)
 
-	// Close the object handle when this function finishes
-	defer func() {
-		err := userDB.Close()
-		if err != nil {
-			log.Printf("%s: Error closing object handle: %v\n", pageName, err)
+	// Make sure the selected columns are in the table
+	for _, c := range cols {
+		if !tableHasColumn(db, dbTable, c) {
+			errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("Column '%s' isn't in the table", c))
+			return
 		}
-	}()
+	}
 
-	// Save the database locally to a temporary file
-	tempfileHandle, err := ioutil.TempFile("", "databaseViewHandler-")
-	if err != nil {
-		log.Printf("%s: Error creating tempfile: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+	filter.Where = filters.Clauses(db, dbTable)
+	if err = checkRowFilter(db, dbTable, filter); err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Filtered downloads say so, both in a header and in the file name, so they're not mistaken for the whole table
+	fileTable := dbTable
+	if filter.String() != "" {
+		w.Header().Set("X-DBHub-Filter", filter.String())
+		fileTable += "-filtered"
+	}
+
+	// Stop reading the table if it takes too long.  Excel files are the exception, as they're streamed to the client
+	// so how long they take depends on the client as much as the database
+	sctx, cancel := sqliteContext(ctx)
+	defer cancel()
+
+	// Large tables are exported in the background, with the user given a link to the finished file
+	rowCount, err := filteredRowCount(sctx, db, dbTable, filter)
+	if err == errQueryTooLong {
+		errorPage(w, r, http.StatusGatewayTimeout, err.Error())
 		return
 	}
-	tempfile := tempfileHandle.Name()
-	bytesWritten, err := io.Copy(tempfileHandle, userDB)
 	if err != nil {
-		log.Printf("%s: Error writing database to temporary file: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+		log.Printf("%s: Error counting rows in '%s/%s' table '%s': %v\n", pageName, userName, dbName, dbTable,
+			err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	if bytesWritten == 0 {
-		log.Printf("%s: 0 bytes written to the temporary file: %v\n", pageName, dbName)
-		errorPage(w, r, http.StatusInternalServerError, "Internal server error")
+	if maxRows > 0 && maxRows < rowCount {
+		rowCount = maxRows
+	}
+	if (format == tableFormatMarkdown || format == tableFormatHTML) && rowCount > tableFormatMaxRows {
+		errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("Markdown and HTML exports are limited to %d rows. "+
+			"Please choose a row limit, or download as CSV instead", tableFormatMaxRows))
 		return
 	}
-	tempfileHandle.Close()
-	defer os.Remove(tempfile) // Delete the temporary file when this function finishes
 
-	// Open database
-	db, err := sqlite.Open(tempfile, sqlite.OpenReadOnly)
-	if err != nil {
-		log.Printf("Couldn't open database: %s", err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+	// Excel files are streamed straight to the user, so even large tables don't need to be held in memory
+	if format == "xlsx" {
+		if rowCount > xlsxMaxRows-1 {
+			errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("Excel can't handle more than %d rows in a sheet, "+
+				"and this table has %d.  Please choose a row limit, or download as CSV instead", xlsxMaxRows-1,
+				rowCount))
+			return
+		}
+		w.Header().Set("Content-Disposition", contentDisposition("attachment",
+			downloadFileName(dbName, servedVersion, fileTable, "xlsx")))
+		w.Header().Set("Content-Type", xlsxContentType)
+		err = writeSQLiteTableXLSX(w, db, dbTable, cols, filter, maxRows)
+		if err != nil {
+			// The headers have already gone out by now, so there's no way to give the user an error page
+			log.Printf("%s: Error when generating Excel file: %v\n", pageName, err)
+			return
+		}
+		recordStat(r, userName, dbName, statCSVDownload, loggedInUser)
 		return
 	}
-	defer db.Close()
 
-	// Retrieve all of the data from the selected database table
-	stmt, err := db.Prepare("SELECT * FROM " + dbTable)
-	if err != nil {
-		log.Printf("Error when preparing statement for database: %s\v", err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+	if rowCount > csvBackgroundRows {
+		token, err := enqueueJob(jobCSVExport, loggedInUser, csvExportJob{Owner: userName, Database: dbName,
+			Version: int64(servedVersion), Table: dbTable, Bucket: minioBucket, MinioId: minioId, Cols: cols,
+			Filter: filter, MaxRows: maxRows})
+		if err != nil {
+			log.Printf("%s: Error queueing CSV export: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Couldn't start the CSV export")
+			return
+		}
+		recordStat(r, userName, dbName, statCSVDownload, loggedInUser)
+		http.Redirect(w, r, "/jobs/"+token, http.StatusSeeOther)
 		return
 	}
 
-	// Process each row
-	fieldCount := -1
+	// Retrieve the data from the selected database table
 	var resultSet [][]string
-	err = stmt.Select(func(s *sqlite.Stmt) error {
-
-		// Get the number of fields in the result
-		if fieldCount == -1 {
-			fieldCount = stmt.DataCount()
-		}
-
-		// Retrieve the data for each row
-		var row []string
-		for i := 0; i < fieldCount; i++ {
-			// Retrieve the data type for the field
-			fieldType := stmt.ColumnType(i)
-
-			isNull := false
-			switch fieldType {
-			case sqlite.Integer:
-				var val int
-				val, isNull, err = s.ScanInt(i)
-				if err != nil {
-					log.Printf("Something went wrong with ScanInt(): %v\n", err)
-					break
-				}
-				if !isNull {
-					row = append(row, fmt.Sprintf("%d", val))
-				}
-			case sqlite.Float:
-				var val float64
-				val, isNull, err = s.ScanDouble(i)
-				if err != nil {
-					log.Printf("Something went wrong with ScanDouble(): %v\n", err)
-					break
-				}
-				if !isNull {
-					row = append(row, strconv.FormatFloat(val, 'f', 4, 64))
-				}
-			case sqlite.Text:
-				var val string
-				val, isNull = s.ScanText(i)
-				if !isNull {
-					row = append(row, val)
-				}
-			case sqlite.Blob:
-				var val []byte
-				val, isNull = s.ScanBlob(i)
-				if !isNull {
-					// Base64 encode the value
-					row = append(row, base64.StdEncoding.EncodeToString(val))
-				}
-			case sqlite.Null:
-				isNull = true
-			}
-			if isNull {
-				row = append(row, "NULL")
-			}
-		}
+	stop := interruptWhenDone(sctx, db)
+	err = readSQLiteTableCSV(db, dbTable, cols, filter, maxRows, func(row []string) error {
 		resultSet = append(resultSet, row)
-
 		return nil
 	})
+	stop()
+	if sctx.Err() == context.DeadlineExceeded {
+		errorPage(w, r, http.StatusGatewayTimeout, errQueryTooLong.Error())
+		return
+	}
 	if err != nil {
 		log.Printf("Error when reading data from database: %s\v", err)
 		errorPage(w, r, http.StatusInternalServerError,
 			fmt.Sprintf("Error reading data from '%s'.  Possibly malformed?", dbName))
 		return
 	}
-	defer stmt.Finalize()
+
+	// Markdown and HTML are shown in the browser rather than downloaded, so they can be previewed and copied
+	if format == tableFormatMarkdown || format == tableFormatHTML {
+		colNames := cols
+		if len(colNames) == 0 {
+			tableCols, err := tableColumns(db, dbTable)
+			if err != nil {
+				log.Printf("%s: Error retrieving columns of table '%s': %v\n", pageName, dbTable, err)
+				errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+				return
+			}
+			for _, c := range tableCols {
+				colNames = append(colNames, c.Name)
+			}
+		}
+		if format == tableFormatMarkdown {
+			w.Header().Set("Content-Disposition", contentDisposition("inline",
+				downloadFileName(dbName, servedVersion, fileTable, "md")))
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+			err = writeMarkdownTable(w, colNames, resultSet, filter.String())
+		} else {
+			w.Header().Set("Content-Disposition", contentDisposition("inline",
+				downloadFileName(dbName, servedVersion, fileTable, "html")))
+			w.Header().Set("Content-Type", contentTypeHTML)
+			err = writeHTMLTable(w, dbTable, colNames, resultSet, filter.String())
+		}
+		if err != nil {
+			log.Printf("%s: Error when writing %s table: %v\n", pageName, format, err)
+			return
+		}
+		recordStat(r, userName, dbName, statCSVDownload, loggedInUser)
+		return
+	}
 
 	// Convert resultSet into CSV and send to the user
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", url.QueryEscape(dbTable)))
-	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment",
+		downloadFileName(dbName, servedVersion, fileTable, "csv")))
+	w.Header().Set("Content-Type", contentTypeCSV)
 	csvFile := csv.NewWriter(w)
 	err = csvFile.WriteAll(resultSet)
 	if err != nil {
+		// Some of the CSV has probably been sent already, so it's too late for an error page
 		log.Printf("%s: Error when generating CSV: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Error when generating CSV")
 		return
 	}
+	recordStat(r, userName, dbName, statCSVDownload, loggedInUser)
 }
 
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
@@ -265,39 +559,69 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
-	}
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
 
 	// Verify the given database exists and is ok to be downloaded (and get the Minio details while at it)
 	var dbQuery string
 	if loggedInUser != userName {
 		// * The request is for another users database, so it needs to be a public one *
 		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
+			SELECT db.minio_bucket, ver.minioid, ver.sha256, ver.version
+			FROM database_versions AS ver, sqlite_databases AS db, users AS u
 			WHERE ver.db = db.idnum
+				AND db.username = u.username
+				AND u.disabled = false
 				AND db.username = $1
 				AND db.dbname = $2
-				AND ver.version = $3
-				AND ver.public = true`
+				AND ($3 = 0 OR ver.version = $3)
+				AND ver.public = true
+			ORDER BY ver.version DESC
+			LIMIT 1`
 	} else {
 		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
+			SELECT db.minio_bucket, ver.minioid, ver.sha256, ver.version
+			FROM database_versions AS ver, sqlite_databases AS db, users AS u
 			WHERE ver.db = db.idnum
+				AND db.username = u.username
+				AND u.disabled = false
 				AND db.username = $1
 				AND db.dbname = $2
-				AND ver.version = $3`
+				AND ($3 = 0 OR ver.version = $3)
+			ORDER BY ver.version DESC
+			LIMIT 1`
+	}
+	var minioBucket, minioId, storedSha string
+	var servedVersion int
+	err = db.QueryRow(dbQuery, userName, dbName, dbVersion).Scan(&minioBucket, &minioId, &storedSha,
+		&servedVersion)
+	if err == pgx.ErrNoRows {
+		err = versionLookupError(r.Context(), loggedInUser, userName, dbName, dbVersion)
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
 	}
-	var minioBucket, minioId string
-	err = db.QueryRow(dbQuery, userName, dbName, dbVersion).Scan(&minioBucket, &minioId)
 	if err != nil {
 		log.Printf("%s: Error retrieving MinioID: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "The requested database doesn't exist")
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	w.Header().Set("X-DBHub-Version", strconv.Itoa(servedVersion))
+	fileName := downloadFileName(dbName, servedVersion, "", "")
+
+	// When Minio can be reached directly, send the user there rather than passing the file through this server.
+	// The download is counted now, as there's no telling whether it finishes
+	if conf.Minio.PresignDownloads {
+		downloadURL, err := presignedDownloadURL(minioBucket, minioId, fileName, contentTypeSQLite)
+		if err != nil {
+			log.Printf("%s: Error creating download URL for '%s/%s': %v\n", pageName, userName, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.Redirect(w, r, downloadURL, http.StatusFound)
+		log.Printf("%s: '%s/%s' version %d download redirected to Minio", pageName, userName, dbName,
+			servedVersion)
+		recordStat(r, userName, dbName, statDownload, loggedInUser)
 		return
 	}
 
@@ -318,17 +642,44 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// Send the database to the user
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(dbName)))
-	w.Header().Set("Content-Type", "application/x-sqlite3")
-	bytesWritten, err := io.Copy(w, userDB)
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fileName))
+	w.Header().Set("Content-Type", contentTypeSQLite)
+	hasher := sha256.New()
+	bytesWritten, err := io.Copy(io.MultiWriter(w, hasher), userDB)
 	if err != nil {
+		// The file is partly sent by now, so writing an error message would only add it to the end of the file
 		log.Printf("%s: Error returning DB file: %v\n", pageName, err)
-		fmt.Fprintf(w, "%s: Error returning DB file: %v\n", pageName, err)
 		return
 	}
 
+	// Make sure what we sent matches what was uploaded.  The headers have already gone out by this point, so on a
+	// mismatch the connection is aborted.  That way the user sees a failed transfer instead of a quietly bad file
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != storedSha {
+		log.Printf("%s: CORRUPTION DETECTED in '%s/%s' version %d.  Minio object: %s/%s, stored sha256: %s, "+
+			"calculated sha256: %s\n", pageName, userName, dbName, servedVersion, minioBucket, minioId, storedSha, sum)
+		atomic.AddUint64(&corruptObjects, 1)
+		panic(http.ErrAbortHandler)
+	}
+
 	// Log the number of bytes written
 	log.Printf("%s: '%s/%s' downloaded. %d bytes", pageName, userName, dbName, bytesWritten)
+	recordStat(r, userName, dbName, statDownload, loggedInUser)
+}
+
+// Returns a presigned Minio URL for downloading an object, which stops working after the configured expiry.  The
+// file name and content type are signed into the URL, so Minio sends them as the response headers.  A new URL is
+// made for each request, and the redirect to it mustn't be cached, so a link to a private database passed on to
+// someone else is only good until it expires
+func presignedDownloadURL(bucket string, id string, fileName string, contentType string) (string, error) {
+	reqParams := url.Values{}
+	reqParams.Set("response-content-disposition", contentDisposition("attachment", fileName))
+	reqParams.Set("response-content-type", contentType)
+	u, err := minioClient.PresignedGetObject(bucket, id, time.Duration(conf.Minio.PresignExpiry)*time.Second,
+		reqParams)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -370,24 +721,15 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate the source referrer (if present)
-	var bounceURL string
-	if sourceRef != "" {
-		ref, err := url.Parse(sourceRef)
-		if err != nil {
-			log.Printf("Error when parsing referrer URL for login form: %s\n", err)
-		} else {
-			// Only use the referrer path if no hostname is set (eg check if someone is screwing around)
-			if ref.Host == "" {
-				bounceURL = ref.Path
-			}
-		}
-	}
+	// Validate the source referrer (if present).  Only pages on this site are used, keeping their query string so
+	// deep links work
+	bounceURL := localBounceURL(sourceRef)
 
 	// Retrieve the password hash for the user, if they exist in the database
-	row := db.QueryRow("SELECT password_hash FROM public.users WHERE username = $1", userName)
+	row := db.QueryRow("SELECT password_hash, disabled FROM public.users WHERE username = $1", userName)
 	var passHash []byte
-	err = row.Scan(&passHash)
+	var disabled bool
+	err = row.Scan(&passHash, &disabled)
 	if err != nil {
 		log.Printf("%s: Error looking up password hash for login. User: '%s' Error: %v\n", pageName, userName,
 			err)
@@ -403,11 +745,15 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Disabled accounts can't log in
+	if disabled {
+		log.Printf("%s: Login attempt for disabled account. User: '%s'\n", pageName, userName)
+		errorPage(w, r, http.StatusForbidden, "This account has been disabled")
+		return
+	}
+
 	// Create session cookie
-	sess := session.NewSessionOptions(&session.SessOptions{
-		CAttrs: map[string]interface{}{"UserName": userName},
-	})
-	session.Add(sess, w)
+	session.Add(newSession(userName, time.Now()), w)
 
 	if bounceURL == "" || bounceURL == "/register" || bounceURL == "/login" {
 		// Bounce to the user's own page
@@ -436,47 +782,104 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 // Wrapper function to log incoming https requests
 func logReq(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check if user is logged in
-		var loggedInUser string
-		sess := session.Get(r)
-		if sess == nil {
+		// Sessions which have run out, or belong to accounts disabled since they logged in, are removed before
+		// anything else happens
+		if !checkSessionExpiry(w, r) || !checkSessionAccount(w, r) {
+			return
+		}
+
+		// Check if user is logged in.  This is only done once per request, with handlers using currentUser()
+		r = withSessionUser(r)
+		loggedInUser := currentUser(r)
+		if loggedInUser == "" {
 			loggedInUser = "-"
-		} else {
-			loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+		}
+
+		// In development mode, pick up any changes to the templates
+		if conf.Web.Dev {
+			reloadTemplates()
 		}
 
 		// Write request details to the request log
-		fmt.Fprintf(reqLog, "%v - %s [%s] \"%s %s %s\" \"-\" \"-\" \"%s\" \"%s\"\n", r.RemoteAddr,
-			loggedInUser, time.Now().Format(time.RFC3339Nano), r.Method, r.URL, r.Proto,
-			r.Referer(), r.Header.Get("User-Agent"))
+		startTime := time.Now()
+		if reqLogToFile() {
+			fmt.Fprintf(reqLog, "%v - %s [%s] \"%s %s %s\" \"-\" \"-\" \"%s\" \"%s\"\n", r.RemoteAddr,
+				loggedInUser, startTime.Format(time.RFC3339Nano), r.Method, r.URL, r.Proto,
+				r.Referer(), r.Header.Get("User-Agent"))
+		}
 
 		// Call the original function
-		fn(w, r)
+		rec := &statusRecorder{ResponseWriter: w}
+		if limitRequestBody(rec, r) {
+			fn(rec, r)
+		}
+
+		// Handlers should only set the status once, so note any which didn't
+		if len(rec.extraStatus) > 0 {
+			log.Printf("Response status for '%s' was set again after %d was sent: %v\n", r.URL.Path, rec.status,
+				rec.extraStatus)
+		}
+		if !reqLogToPostgres() {
+			return
+		}
+
+		// Queue the request details for the PostgreSQL request log, dropping them if the queue is full
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		select {
+		case reqLogQueue <- requestRecord{Timestamp: startTime, User: loggedInUser, Method: r.Method,
+			Path: r.URL.String(), Status: rec.status, Duration: time.Since(startTime), Bytes: rec.bytes,
+			UserAgent: r.UserAgent()}:
+		default:
+		}
 	}
 }
 
 func main() {
+	devFlag := flag.Bool("dev", false, "Development mode: reload templates on each request, and serve plain "+
+		"HTTP on "+devServer)
+	flag.Parse()
+
 	// Read server configuration
 	var err error
 	if err = readConfig(); err != nil {
 		log.Fatalf("Configuration file problem\n\n%v", err)
 	}
+	if *devFlag {
+		conf.Web.Dev = true
+	}
+	if conf.Web.Dev {
+		log.Printf("*** DEVELOPMENT MODE ***\n")
+		log.Printf("*** Serving plain HTTP on %s, reloading templates on every request, and allowing "+
+			"session cookies without TLS.  Never run a public server like this. ***\n", devServer)
+	}
 
 	// Open the request log for writing
-	reqLog, err = os.OpenFile(conf.Web.RequestLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0750)
-	if err != nil {
-		log.Fatalf("Error when opening request log: %s\n", err)
+	if reqLogToFile() {
+		reqLog, err = os.OpenFile(conf.Web.RequestLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0750)
+		if err != nil {
+			log.Fatalf("Error when opening request log: %s\n", err)
+		}
+		defer reqLog.Close()
+		log.Printf("Request log opened: %s\n", conf.Web.RequestLog)
 	}
-	defer reqLog.Close()
-	log.Printf("Request log opened: %s\n", conf.Web.RequestLog)
 
 	// Setup session storage
 	session.Global.Close()
 	session.Global = session.NewCookieManagerOptions(session.NewInMemStore(),
-		&session.CookieMngrOptions{AllowHTTP: false})
+		&session.CookieMngrOptions{AllowHTTP: conf.Web.Dev})
 
-	// Parse our template files
-	tmpl = template.Must(template.New("templates").Delims("[[", "]]").ParseGlob("templates/*.html"))
+	// Parse our template files, making sure none of the pages are missing.  The templates link to the static files
+	// by their hashes, so those are worked out first
+	err = loadAssetHashes()
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	tmpl = template.Must(parseTemplates())
+	if err = checkTemplates(tmpl); err != nil {
+		log.Fatalf("Template problem: %v\n", err)
+	}
 
 	// Connect to Minio server
 	minioClient, err = minio.New(conf.Minio.Server, conf.Minio.AccessKey, conf.Minio.Secret, conf.Minio.HTTPS)
@@ -487,12 +890,26 @@ func main() {
 	// Log Minio server end point
 	log.Printf("Minio server config ok. Address: %v\n", conf.Minio.Server)
 
-	// Connect to PostgreSQL server
-	db, err = pgx.Connect(*pgConfig)
-	defer db.Close()
+	// Ensure the buckets for user avatars and data exports exist
+	for _, bucket := range []string{avatarBucket, exportBucket} {
+		err = withRetries("Minio", func() error {
+			return createBucketIfMissing(bucket)
+		})
+		if err != nil {
+			log.Fatalf("Error when checking for Minio bucket '%s': %v\n", bucket, err)
+		}
+	}
+
+	// Connect to PostgreSQL server.  The connection pool replaces connections which have died, so a PostgreSQL
+	// restart doesn't need a restart here too
+	err = withRetries("PostgreSQL", func() (err error) {
+		db, err = pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: *pgConfig, MaxConnections: conf.Pg.MaxConnections})
+		return
+	})
 	if err != nil {
 		log.Fatalf("Couldn't connect to database\n\n%v", err)
 	}
+	defer db.Close()
 
 	// Log successful connection message
 	log.Printf("Connected to PostgreSQL server: %v:%v\n", conf.Pg.Server, uint16(conf.Pg.Port))
@@ -502,7 +919,9 @@ func main() {
 
 	// Test the memcached connection
 	cacheTest := memcache.Item{Key: "connecttext", Value: []byte("1"), Expiration: 10}
-	err = memCache.Set(&cacheTest)
+	err = withRetries("Memcached", func() error {
+		return memCache.Set(&cacheTest)
+	})
 	if err != nil {
 		log.Fatalf("Memcached server seems offline: %s", err)
 	}
@@ -510,53 +929,183 @@ func main() {
 	// Log successful connection message for Memcached
 	log.Printf("Connected to Memcached: %v\n", conf.Cache.Server)
 
+	// Open the local disk cache for database files, if one is configured
+	if conf.Cache.DiskPath != "" {
+		minioCache, err = newDiskCache(conf.Cache.DiskPath, conf.Cache.DiskSize*1024*1024)
+		if err != nil {
+			log.Fatalf("Error when opening disk cache: %v\n", err)
+		}
+	}
+
+	// Start the background removal of expired data exports
+	go expireDataExports()
+
+	// Clear out the temporary files left behind by the last run
+	tempDBSlots = make(chan struct{}, conf.Web.MaxOpenDatabases)
+	sweepTempFiles()
+
+	// Start the background removal of abandoned chunked uploads
+	err = os.MkdirAll(chunkedUploadDir(), 0700)
+	if err != nil {
+		log.Fatalf("Error when creating the chunked upload directory: %v\n", err)
+	}
+	go expireChunkedUploads()
+
+	// Start the background writer for database statistics
+	go statsWriter()
+
+	// Start the background removal of audit events past their retention period
+	go expireAuditEvents()
+
+	// Start the background writer for the PostgreSQL request log
+	if reqLogToPostgres() {
+		go requestLogWriter()
+		log.Printf("Request logging to PostgreSQL enabled\n")
+	}
+
+	// Start the background job workers
+	jobCtx, stopJobs := context.WithCancel(context.Background())
+	jobWorkers := startJobWorkers(jobCtx, conf.Web.JobWorkers)
+
 	// Our pages
-	http.HandleFunc("/", logReq(mainHandler))
+	http.HandleFunc("/", logReq(rateLimit(limitPages, mainHandler)))
+	http.HandleFunc("/admin/", logReq(adminHandler))
+	http.HandleFunc(apiPrefix, logReq(apiHandler))
+	http.HandleFunc("/avatar/", logReq(avatarHandler))
+	http.HandleFunc("/contributors/", logReq(rateLimit(limitPages, contributorsHandler)))
+	http.HandleFunc("/diff/", logReq(rateLimit(limitPages, diffHandler)))
+	http.HandleFunc("/discuss/", logReq(rateLimit(limitPages, discussionsHandler)))
+	http.HandleFunc("/jobs/", logReq(jobPage))
 	http.HandleFunc("/login", logReq(loginHandler))
 	http.HandleFunc("/logout", logReq(logoutHandler))
-	http.HandleFunc("/pref", logReq(prefHandler))
+	http.HandleFunc("/merge/", logReq(rateLimit(limitPages, mergeRequestsHandler)))
+	http.HandleFunc("/pref", logReq(requireLogin(prefHandler)))
+	http.HandleFunc("/readyz", readyzHandler)
 	http.HandleFunc("/register", logReq(registerHandler))
-	http.HandleFunc("/stars/", logReq(starsHandler))
-	http.HandleFunc("/upload/", logReq(uploadFormHandler))
-	http.HandleFunc("/vis/", logReq(visualisePage))
-	http.HandleFunc("/x/download/", logReq(downloadHandler))
-	http.HandleFunc("/x/downloadcsv/", logReq(downloadCSVHandler))
+	http.HandleFunc("/robots.txt", logReq(robotsHandler))
+	http.HandleFunc("/schema/", logReq(rateLimit(limitPages, schemaHandler)))
+	http.HandleFunc("/stars/", logReq(rateLimit(limitPages, starsHandler)))
+	http.HandleFunc("/stats/", logReq(rateLimit(limitPages, statsHandler)))
+	http.HandleFunc("/upload/", logReq(requireLogin(uploadFormHandler)))
+	http.HandleFunc("/vis/", logReq(rateLimit(limitPages, visualisePage)))
+	http.HandleFunc("/x/blob/", logReq(rateLimit(limitAPI, blobHandler)))
+	http.HandleFunc("/x/cell/", logReq(rateLimit(limitAPI, cellHandler)))
+	http.HandleFunc("/x/commitedits/", logReq(commitEditsHandler))
+	http.HandleFunc("/x/defaulttable/", logReq(requireLogin(defaultTableHandler)))
+	http.HandleFunc("/x/discusscomment/", logReq(rateLimit(limitPages, requireLogin(discussionCommentHandler))))
+	http.HandleFunc("/x/discussdelete/", logReq(requireLogin(discussionDeleteHandler)))
+	http.HandleFunc("/x/discussnew/", logReq(rateLimit(limitPages, requireLogin(discussionNewHandler))))
+	http.HandleFunc("/x/download/", logReq(rateLimit(limitDownloads, downloadHandler)))
+	http.HandleFunc("/x/downloadall/", logReq(rateLimit(limitDownloads, downloadAllHandler)))
+	http.HandleFunc("/x/downloadcsv/", logReq(rateLimit(limitDownloads, downloadCSVHandler)))
+	http.HandleFunc("/x/exportdata/", logReq(exportDataHandler))
+	http.HandleFunc("/x/exportdata/download", logReq(rateLimit(limitDownloads, exportDownloadHandler)))
+	http.HandleFunc("/x/fetchdata/", logReq(fetchDataHandler))
+	http.HandleFunc("/x/jobresult/", logReq(jobResultHandler))
+	http.HandleFunc("/x/jobstatus/", logReq(rateLimit(limitAPI, jobStatusHandler)))
+	http.HandleFunc("/x/mergeaction/", logReq(requireLogin(mergeActionHandler)))
+	http.HandleFunc("/x/mergenew/", logReq(rateLimit(limitPages, requireLogin(mergeNewHandler))))
+	http.HandleFunc("/x/refetch/", logReq(refetchHandler))
+	http.HandleFunc("/x/renameuser/", logReq(renameUserHandler))
+	http.HandleFunc("/x/report/", logReq(reportHandler))
+	http.HandleFunc("/x/rowsearch/", logReq(rateLimit(limitAPI, rowSearchHandler)))
 	http.HandleFunc("/x/star/", logReq(starHandler))
-	http.HandleFunc("/x/table/", logReq(tableViewHandler))
-	http.HandleFunc("/x/uploaddata/", logReq(uploadDataHandler))
-	http.HandleFunc("/x/visdata/", logReq(visData))
-
-	// Static files
-	http.HandleFunc("/images/auth0.svg", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "images/auth0.svg")
-	}))
-	http.HandleFunc("/images/rackspace.svg", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "images/rackspace.svg")
-	}))
-	http.HandleFunc("/images/sqlitebrowser.svg", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "images/sqlitebrowser.svg")
-	}))
-	http.HandleFunc("/favicon.ico", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "favicon.ico")
-	}))
-	http.HandleFunc("/robots.txt", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "robots.txt")
-	}))
-
-	// Start server
-	log.Printf("DBHub server starting on https://%s\n", conf.Web.Server)
-	log.Fatal(http.ListenAndServeTLS(conf.Web.Server, conf.Web.Certificate, conf.Web.CertificateKey, nil))
-}
-
-func mainHandler(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/x/state/", logReq(stateHandler))
+	http.HandleFunc("/x/table/", logReq(rateLimit(limitAPI, tableViewHandler)))
+	http.HandleFunc("/x/tablefilter/", logReq(requireLogin(tableFilterHandler)))
+	http.HandleFunc("/x/upload/chunk", logReq(uploadChunkHandler))
+	http.HandleFunc("/x/upload/complete", logReq(uploadCompleteHandler))
+	http.HandleFunc("/x/upload/confirm", logReq(requireLogin(uploadConfirmHandler)))
+	http.HandleFunc("/x/upload/init", logReq(uploadInitHandler))
+	http.HandleFunc("/x/uploadavatar/", logReq(uploadAvatarHandler))
+	http.HandleFunc("/x/uploaddata/", logReq(requireLogin(uploadDataHandler)))
+	http.HandleFunc("/x/vischart.svg/", logReq(rateLimit(limitAPI, visChartHandler)))
+	http.HandleFunc("/x/visdata/", logReq(rateLimit(limitAPI, visData)))
+	http.HandleFunc("/x/visexport/", logReq(rateLimit(limitDownloads, visExportHandler)))
+	http.HandleFunc("/x/visimport/", logReq(rateLimit(limitAPI, visProfileImportHandler)))
+	http.HandleFunc("/x/visprofile/", logReq(requireLogin(visProfileExportHandler)))
+
+	// Static files, by their plain paths and by the paths including their hash which the pages use
+	for _, name := range staticAssets {
+		http.HandleFunc("/"+name, logReq(assetHandler))
+	}
+	http.HandleFunc(assetPrefix, logReq(assetHandler))
+
+	// Start server.  Development mode doesn't need certificates
+	srv := &http.Server{Addr: conf.Web.Server}
+	if conf.Web.Dev {
+		srv.Addr = devServer
+		log.Printf("DBHub server starting on http://%s\n", devServer)
+	} else {
+		log.Printf("DBHub server starting on https://%s\n", conf.Web.Server)
+	}
+	go func() {
+		var err error
+		if conf.Web.Dev {
+			err = srv.ListenAndServe()
+		} else {
+			err = srv.ListenAndServeTLS(conf.Web.Certificate, conf.Web.CertificateKey)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Shut down cleanly when asked to, letting running requests and jobs finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Printf("DBHub server shutting down\n")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Error when shutting down web server: %v\n", err)
+	}
+	stopJobs()
+	jobWorkers.Wait()
+	db.Close()
+}
+
+func mainHandler(w http.ResponseWriter, r *http.Request) {
 	pageName := "Main handler"
 
+	// Each page has one URL, without a slash on the end, so other forms are redirected to it.  This also stops the
+	// same page being cached twice under different names
+	if len(r.URL.Path) > 1 && strings.HasSuffix(r.URL.Path, "/") {
+		redirectToPath(w, r, strings.TrimRight(r.URL.Path, "/"))
+		return
+	}
+
 	// Split the request URL into path components
 	pathStrings := strings.Split(r.URL.Path, "/")
 
 	// numPieces will be 2 if the request was for the root directory (https://server/), or if
-	// the request included only a single path component (https://server/someuser/)
+	// the request included only a single path component (https://server/someuser)
 	numPieces := len(pathStrings)
+
+	// If the requested user was recently renamed, redirect to the equivalent page under their new name.  Likewise
+	// for usernames given in a different case to the one they were registered with
+	if pathStrings[1] != "" {
+		newName, err := getUsernameRedirect(pathStrings[1])
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if newName == "" {
+			newName, err = canonicalUsername(pathStrings[1])
+			if err != nil {
+				errorPage(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if newName != pathStrings[1] {
+			pathStrings[1] = newName
+			redirectToPath(w, r, strings.Join(pathStrings, "/"))
+			return
+		}
+	}
+
 	if numPieces == 2 {
 		userName := pathStrings[1]
 		// Check if the request was for the root directory
@@ -583,14 +1132,6 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// This catches the case where a "/" is on the end of a user page URL
-	// TODO: Refactor this and the above identical code.  Doing it this way is non-optimal
-	if pathStrings[2] == "" {
-		// The request was for a user page
-		userPage(w, r, userName)
-		return
-	}
-
 	// * A specific database was requested *
 
 	// Check if a table name was also requested
@@ -614,6 +1155,35 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	databasePage(w, r, userName, dbName, dbTable)
 }
 
+// Permanently redirects a request to the given path, keeping its query string
+func redirectToPath(w http.ResponseWriter, r *http.Request, path string) {
+	u := url.URL{Path: path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// Parses the page templates
+func parseTemplates() (*template.Template, error) {
+	return template.New("templates").Delims("[[", "]]").Funcs(templateFuncs).ParseGlob("templates/*.html")
+}
+
+// Re-parses the page templates, so changes to them show up without restarting the server.  Only used in
+// development mode.  If the templates don't parse, the error is logged and the previous ones are kept
+func reloadTemplates() {
+	err := loadAssetHashes()
+	if err != nil {
+		log.Printf("Error reloading static files: %v\n", err)
+	}
+	t, err := parseTemplates()
+	if err == nil {
+		err = checkTemplates(t)
+	}
+	if err != nil {
+		log.Printf("Error reloading templates: %v\n", err)
+		return
+	}
+	tmpl = t
+}
+
 // Read the server configuration file
 func readConfig() error {
 	// Reads the server configuration from disk
@@ -673,6 +1243,128 @@ func readConfig() error {
 		conf.Pg.Database = tempString
 	}
 
+	// Keep trying to reach the services we depend on for a few minutes when starting up
+	if conf.Retry.Attempts <= 0 {
+		conf.Retry.Attempts = 8
+	}
+	if conf.Retry.Interval <= 0 {
+		conf.Retry.Interval = 1
+	}
+	if conf.Pg.MaxConnections <= 0 {
+		conf.Pg.MaxConnections = 20
+	}
+
+	// Default to a 1GB disk cache
+	if conf.Cache.DiskPath != "" && conf.Cache.DiskSize <= 0 {
+		conf.Cache.DiskSize = 1024
+	}
+
+	// Use sensible timeouts if none were given
+	if conf.Timeouts.Query <= 0 {
+		conf.Timeouts.Query = 10
+	}
+	if conf.Timeouts.Minio <= 0 {
+		conf.Timeouts.Minio = 60
+	}
+	if conf.Minio.PresignExpiry <= 0 {
+		conf.Minio.PresignExpiry = 60
+	}
+	if conf.Timeouts.Fetch <= 0 {
+		conf.Timeouts.Fetch = 120
+	}
+	if conf.Timeouts.SQLite <= 0 {
+		conf.Timeouts.SQLite = 5
+	}
+
+	// Default rate limits, generous enough that people browsing the site never notice them
+	if conf.RateLimit.Pages <= 0 {
+		conf.RateLimit.Pages = 120
+	}
+	if conf.RateLimit.API <= 0 {
+		conf.RateLimit.API = 60
+	}
+	if conf.RateLimit.Downloads <= 0 {
+		conf.RateLimit.Downloads = 20
+	}
+	if conf.RateLimit.UserPages <= 0 {
+		conf.RateLimit.UserPages = 600
+	}
+	if conf.RateLimit.UserAPI <= 0 {
+		conf.RateLimit.UserAPI = 600
+	}
+	if conf.RateLimit.UserDownloads <= 0 {
+		conf.RateLimit.UserDownloads = 200
+	}
+	for _, j := range conf.Web.TrustedProxies {
+		if parseIPRange(j) == nil {
+			return fmt.Errorf("Invalid trusted proxy address: %v\n", j)
+		}
+	}
+
+	// Run background jobs with a few workers, unless told otherwise
+	if conf.Web.JobWorkers <= 0 {
+		conf.Web.JobWorkers = 4
+	}
+
+	// Show visitors a handful of rows, and let scripts ask for up to as many as users can choose in their preferences
+	if conf.Web.DefaultRows <= 0 {
+		conf.Web.DefaultRows = 10
+	}
+	if conf.Web.MaxAPIRows <= 0 {
+		conf.Web.MaxAPIRows = 500
+	}
+
+	// Keep long text values from taking over the table view
+	if conf.Web.CellLength <= 0 {
+		conf.Web.CellLength = 1024
+	}
+
+	// Forms don't need much, but databases can be big
+	if conf.Limits.Form <= 0 {
+		conf.Limits.Form = 1
+	}
+	if conf.Limits.Upload <= 0 {
+		conf.Limits.Upload = 2048
+	}
+	if conf.Limits.MultipartMemory <= 0 {
+		conf.Limits.MultipartMemory = 32
+	}
+
+	// Log people out after half an hour of inactivity, which is how long sessions lasted before this was configurable
+	if conf.Web.SessionIdleTimeout <= 0 {
+		conf.Web.SessionIdleTimeout = 30
+	}
+	if conf.Web.SessionLifetime < 0 {
+		conf.Web.SessionLifetime = 0
+	}
+
+	// Give up on chunked uploads after a day without any progress
+	if conf.Web.UploadExpiry <= 0 {
+		conf.Web.UploadExpiry = 24
+	}
+
+	// The temporary directory needs to exist already, as it's likely shared with other things
+	if conf.Web.TempDir != "" {
+		fi, err := os.Stat(conf.Web.TempDir)
+		if err != nil || !fi.IsDir() {
+			return fmt.Errorf("Temporary directory '%v' doesn't exist\n", conf.Web.TempDir)
+		}
+	}
+
+	// Allow enough open databases for a busy server, without risking the disk filling up
+	if conf.Web.MaxOpenDatabases <= 0 {
+		conf.Web.MaxOpenDatabases = 64
+	}
+
+	// The request log file remains the default, for compatibility with existing configurations
+	switch conf.Web.RequestLogBackend {
+	case "":
+		conf.Web.RequestLogBackend = reqLogFile
+	case reqLogFile, reqLogPostgres, reqLogBoth:
+	default:
+		return fmt.Errorf("Unknown request log backend: %v\n", conf.Web.RequestLogBackend)
+	}
+
 	// Verify we have the needed configuration information
 	// Note - We don't check for a valid conf.Pg.Password here, as the PostgreSQL password can also be kept
 	// in a .pgpass file as per https://www.postgresql.org/docs/current/static/libpq-pgpass.html
@@ -750,6 +1442,11 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Turn away bots
+	if !registrationAllowed(w, r) {
+		return
+	}
+
 	// Validate the user supplied username and email address
 	err = com.ValidateUserEmail(userName, email)
 	if err != nil {
@@ -757,6 +1454,11 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, r, http.StatusBadRequest, "Invalid username or email")
 		return
 	}
+	if domain, blocked := blockedEmailDomain(email); blocked {
+		logRegistrationRejected(r, fmt.Sprintf("blocked email domain '%s'", domain))
+		errorPage(w, r, http.StatusBadRequest, "Email addresses from that domain can't be used to register")
+		return
+	}
 
 	// Check the password and confirmation match
 	if len(password) != len(passConfirm) || password != passConfirm {
@@ -788,30 +1490,31 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if the username is already in our system
-	rows, err := db.Query("SELECT count(username) FROM public.users WHERE username = $1", userName)
+	userExists, err := checkUserExists(userName)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-	defer rows.Close()
-	var userCount int
-	for rows.Next() {
-		err = rows.Scan(&userCount)
-		if err != nil {
-			log.Printf("%s: Error checking if user '%s' already exists: %v\n", pageName, userName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-			return
-		}
-	}
-	if userCount > 0 {
+	if userExists {
 		log.Println("That username is already taken")
 		errorPage(w, r, http.StatusConflict, "That username is already taken")
 		return
 	}
 
+	// Names of recently renamed users stay reserved while their redirect is active
+	newName, err := getUsernameRedirect(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if newName != "" {
+		log.Printf("%s: Username '%s' is reserved by a redirect to '%s'\n", pageName, userName, newName)
+		errorPage(w, r, http.StatusConflict, "That username is already taken")
+		return
+	}
+
 	// Check if the email address is already in our system
-	rows, err = db.Query("SELECT count(username) FROM public.users WHERE email = $1", email)
+	rows, err := db.Query("SELECT count(username) FROM public.users WHERE email = $1", email)
 	if err != nil {
 		log.Printf("%s: Database query failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
@@ -843,13 +1546,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate a random string, to be used as the bucket name for the user
-	mathrand.Seed(time.Now().UnixNano())
-	const alphaNum = "abcdefghijklmnopqrstuvwxyz0123456789"
-	randomString := make([]byte, 16)
-	for i := range randomString {
-		randomString[i] = alphaNum[mathrand.Intn(len(alphaNum))]
-	}
-	bucketName := string(randomString) + ".bkt"
+	bucketName := randomString(16) + ".bkt"
 
 	// TODO: Create the users certificate
 
@@ -880,261 +1577,412 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Log the user registration
 	log.Printf("User registered: '%s' Email: '%s'\n", userName, email)
-
-	// TODO: Display a proper success page
-	// TODO: This should probably bounce the user to their logged in profile page
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprint(w, `<html><body>Account created successfully, please login: <a href="/login">Login</a></body></html>`)
+	registrationSucceeded(w)
 }
 
-// This handles incoming requests for the preferences page by logged in users
-func prefHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Preferences handler"
+// Changes the username of the logged in user.  The old name redirects to the new one for 30 days afterwards
+func renameUserHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Rename user handler"
 
 	// Ensure user is logged in
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
-	} else {
-		// Bounce to the login page
-		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
 		return
 	}
 
-	// Gather submitted form data (if any)
+	// Gather and validate the new username using the same rules as registration
 	err := r.ParseForm()
 	if err != nil {
-		log.Printf("%s: Error when parsing preference data: %s\n", pageName, err)
-		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		log.Printf("%s: Error when parsing rename data: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error when parsing rename data")
 		return
 	}
-	maxRows := r.PostFormValue("maxrows")
-
-	// If no form data was submitted, display the preferences page form
-	if maxRows == "" {
-		prefPage(w, r, fmt.Sprintf("%s", loggedInUser))
+	newName := r.PostFormValue("newname")
+	err = com.ValidateUser(newName)
+	if err != nil {
+		log.Printf("%s: Validation failed for new username: %s", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Invalid username")
 		return
 	}
-
-	// Validate submitted form data
-	err = com.Validate.Var(maxRows, "required,numeric,min=1,max=500")
+	if newName == loggedInUser {
+		http.Redirect(w, r, "/pref", http.StatusSeeOther)
+		return
+	}
+	err = com.ReservedUsernamesCheck(newName)
 	if err != nil {
-		log.Printf("%s: Preference data failed validation: %s\n", pageName, err)
-		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		log.Println(err)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Update the preference data in the database
-	dbQuery := `
-		UPDATE users
-		SET pref_max_rows = $1
-		WHERE username = $2`
-	commandTag, err := db.Exec(dbQuery, maxRows, loggedInUser)
+	userExists, err := checkUserExists(newName)
 	if err != nil {
-		log.Printf("%s: Updating user preferences failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("%s: Wrong number of rows affected when updating user preferences: %v, username: %v\n",
-			pageName, numRows, loggedInUser)
+	if userExists {
+		errorPage(w, r, http.StatusConflict, "That username is already taken")
 		return
 	}
 
-	// Bounce to the user home page
-	http.Redirect(w, r, "/"+loggedInUser, http.StatusTemporaryRedirect)
-}
-
-func starHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Star toggle Handler"
-
-	// Extract the user and database name
-	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/star/" at the start of the URL
+	// Names of recently renamed users stay reserved while their redirect is active, except for their previous owner
+	redirectTarget, err := getUsernameRedirect(newName)
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// Retrieve session data (if any)
-	var loggedInUser interface{}
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = sess.CAttr("UserName")
-	} else {
-		// No logged in username, so nothing to update
-		fmt.Fprint(w, "-1") // -1 tells the front end not to update the displayed star count
+	if redirectTarget != "" && redirectTarget != loggedInUser {
+		errorPage(w, r, http.StatusConflict, "That username is already taken")
 		return
 	}
 
-	// Retrieve the database id
-	row := db.QueryRow(`SELECT idnum FROM sqlite_databases WHERE username = $1 AND dbname = $2`, userName, dbName)
-	var dbId int
-	err = row.Scan(&dbId)
+	// Only allow one rename per month
+	var recentRename bool
+	err = db.QueryRow(`
+		SELECT coalesce(last_renamed > now() - interval '1 month', false)
+		FROM users
+		WHERE username = $1`, loggedInUser).Scan(&recentRename)
 	if err != nil {
-		log.Printf("%s: Error looking up database id. User: '%s' Error: %v\n", pageName, loggedInUser, err)
+		log.Printf("%s: Error retrieving last rename date for user '%s': %v\n", pageName, loggedInUser, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
+	if recentRename {
+		errorPage(w, r, http.StatusTooManyRequests, "Usernames can only be changed once per month")
+		return
+	}
 
-	// Check if this user has already starred this username/database
-	row = db.QueryRow(`
-		SELECT count(db)
-		FROM database_stars
-		WHERE database_stars.db = $1
-			AND database_stars.username = $2`, dbId, loggedInUser)
-	var starCount int
-	err = row.Scan(&starCount)
+	// Update the username everywhere it's referenced, in a single transaction.  Minio bucket names are random
+	// strings rather than being derived from the username, so they don't need changing
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("%s: Error looking up star count for database. User: '%s' Error: %v\n", pageName,
-			loggedInUser, err)
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
-
 	}
-
-	// Add or remove the star
-	if starCount != 0 {
-		// Unstar the database
-		deleteQuery := `DELETE FROM database_stars WHERE db = $1 AND username = $2`
-		commandTag, err := db.Exec(deleteQuery, dbId, loggedInUser)
+	defer tx.Rollback()
+	renameQueries := []string{
+		`UPDATE users SET username = $2, last_renamed = now() WHERE username = $1`,
+		`UPDATE sqlite_databases SET username = $2 WHERE username = $1`,
+		`UPDATE database_stars SET username = $2 WHERE username = $1`,
+		`UPDATE user_db_state SET username = $2 WHERE username = $1`,
+		`UPDATE database_versions SET uploaded_by = $2 WHERE uploaded_by = $1`,
+		`UPDATE discussions SET author = $2 WHERE author = $1`,
+		`UPDATE discussion_comments SET author = $2 WHERE author = $1`,
+		`UPDATE merge_requests SET author = $2 WHERE author = $1`,
+		`UPDATE merge_requests SET closed_by = $2 WHERE closed_by = $1`,
+		`UPDATE data_exports SET username = $2 WHERE username = $1`,
+		`UPDATE jobs SET username = $2 WHERE username = $1`,
+		`UPDATE abuse_reports SET reporter = $2 WHERE reporter = $1`,
+
+		// Any earlier redirects to the old name now point at the new one, and any redirect from the new name is
+		// dropped as that name is being claimed
+		`UPDATE username_redirects SET new_name = $2 WHERE new_name = $1`,
+		`DELETE FROM username_redirects WHERE old_name = $2`,
+		`INSERT INTO username_redirects (old_name, new_name, expires)
+			VALUES ($1, $2, now() + interval '30 days')
+			ON CONFLICT (old_name) DO UPDATE SET new_name = $2, expires = now() + interval '30 days'`,
+	}
+	for _, dbQuery := range renameQueries {
+		_, err = tx.Exec(dbQuery, loggedInUser, newName)
 		if err != nil {
-			log.Printf("%s: Removing star from database failed: %v\n", pageName, err)
+			log.Printf("%s: Renaming user '%s' to '%s' failed: %v\n", pageName, loggedInUser, newName, err)
 			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 			return
 		}
-		if numRows := commandTag.RowsAffected(); numRows != 1 {
-			log.Printf("%s: Wrong number of rows affected: %v, username: %v\n", pageName, numRows, userName)
+	}
+	err = auditLog(tx, r, loggedInUser, "rename user", auditTargetUser, loggedInUser,
+		map[string]interface{}{"new_name": newName})
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%s: Error committing rename of user '%s': %v\n", pageName, loggedInUser, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// The username is a constant session attribute, so replace the session with one for the new name
+	sess := session.Get(r)
+	session.Remove(sess, w)
+	session.Add(newSession(newName, sessionStarted(sess)), w)
+
+	// Log the username change
+	log.Printf("%s: User '%s' renamed to '%s'\n", pageName, loggedInUser, newName)
+
+	// Bounce to the user's renamed home page
+	http.Redirect(w, r, "/"+newName, http.StatusSeeOther)
+}
+
+// This handles incoming requests for the preferences page by logged in users
+func prefHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Preferences handler"
+	loggedInUser := currentUser(r)
+
+	// The account may have been removed while the user was still logged in, in which case the session is of no
+	// use any more
+	acct, found, err := getUserAccount(r.Context(), loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		log.Printf("%s: User '%s' no longer exists, so their session has been removed\n", pageName, loggedInUser)
+		session.Remove(session.Get(r), w)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Gather submitted form data (if any)
+	err = r.ParseForm()
+	if err != nil {
+		log.Printf("%s: Error when parsing preference data: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		return
+	}
+	// Each preference is optional, and only the ones submitted are changed
+	var prefs userPreferenceUpdate
+	submitted := false
+	if v, ok := r.PostForm["maxrows"]; ok {
+		submitted = true
+		err = com.Validate.Var(v[0], "required,numeric,min=1,max=500")
+		if err != nil {
+			log.Printf("%s: Maximum rows preference failed validation: %s\n", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "The rows per page needs to be between 1 and 500")
 			return
 		}
-
-	} else {
-		// Add a star for the database
-		insertQuery := `INSERT INTO database_stars (db, username) VALUES ($1, $2)`
-		commandTag, err := db.Exec(insertQuery, dbId, loggedInUser)
+		maxRows, _ := strconv.Atoi(v[0])
+		prefs.MaxRows = pgx.NullInt32{Int32: int32(maxRows), Valid: true}
+	}
+	if v, ok := r.PostForm["defaultpublic"]; ok {
+		submitted = true
+		public, err := strconv.ParseBool(v[0])
 		if err != nil {
-			log.Printf("%s: Adding star to database failed: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			log.Printf("%s: Default visibility preference failed validation: %s\n", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Unknown default visibility")
 			return
 		}
-		if numRows := commandTag.RowsAffected(); numRows != 1 {
-			log.Printf("%s: Wrong number of rows affected: %v, username: %v\n", pageName, numRows, userName)
+		prefs.DefaultPublic = pgx.NullBool{Bool: public, Valid: true}
+	}
+	if v, ok := r.PostForm["defaultlicence"]; ok {
+		submitted = true
+		if !isValidLicence(v[0]) {
+			log.Printf("%s: Unknown licence '%s' in preference data\n", pageName, v[0])
+			errorPage(w, r, http.StatusBadRequest, "Unknown licence")
 			return
 		}
+		prefs.DefaultLicence = pgx.NullString{String: v[0], Valid: true}
 	}
-
-	// Refresh the main database table with the updated star count
-	updateQuery := `
-		UPDATE sqlite_databases
-		SET stars = (
-			SELECT count(db)
-			FROM database_stars
-			WHERE db = $1
-		) WHERE idnum = $1`
-	commandTag, err := db.Exec(updateQuery, dbId)
-	if err != nil {
-		log.Printf("%s: Updating star count in database failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-		return
+	if v, ok := r.PostForm["dateformat"]; ok {
+		submitted = true
+		if !isValidDateFormat(v[0]) {
+			log.Printf("%s: Unknown date format '%s' in preference data\n", pageName, v[0])
+			errorPage(w, r, http.StatusBadRequest, "Unknown date format")
+			return
+		}
+		prefs.DateFormat = pgx.NullString{String: v[0], Valid: true}
+	}
+	if v, ok := r.PostForm["timezone"]; ok {
+		submitted = true
+		zone := strings.TrimSpace(v[0])
+		if !isValidTimeZone(zone) {
+			log.Printf("%s: Unknown timezone '%s' in preference data\n", pageName, zone)
+			errorPage(w, r, http.StatusBadRequest, "Unknown timezone.  Please use a name like Europe/London")
+			return
+		}
+		prefs.TimeZone = pgx.NullString{String: zone, Valid: true}
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("%s: Wrong number of rows affected: %v, username: %v\n", pageName, numRows, userName)
+
+	// If no form data was submitted, display the preferences page form
+	if !submitted {
+		prefPage(w, r, loggedInUser, acct)
 		return
 	}
 
-	// Return the updated star count to the user
-	row = db.QueryRow(`
-		SELECT stars
-		FROM sqlite_databases
-		WHERE idnum = $1`, dbId)
-	var newStarCount int
-	err = row.Scan(&newStarCount)
+	// Update the preference data in the database
+	err = setUserPreferences(loggedInUser, prefs)
 	if err != nil {
-		log.Printf("%s: Error looking up new star count for database. User: '%s' Error: %v\n", pageName,
-			loggedInUser, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-	fmt.Fprint(w, newStarCount)
+
+	// Bounce to the user home page
+	http.Redirect(w, r, "/"+loggedInUser, http.StatusTemporaryRedirect)
 }
 
-func starsHandler(w http.ResponseWriter, r *http.Request) {
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
 	// Retrieve user and database name
-	userName, dbName, err := getUD(1, r) // 2 = Ignore "/stars/" at the start of the URL
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/schema/" at the start of the URL
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Render the stars page
-	starsPage(w, r, userName, dbName)
+	// Render the schema page
+	schemaPage(w, r, userName, dbName)
 }
 
-// This passes table row data back to the main UI in JSON format
-func tableViewHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Table data handler"
+func starHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Star toggle Handler"
 
-	// TODO: Add support for database versions too
+	// Extract the user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/star/" at the start of the URL
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// Retrieve user, database, and table name
-	userName, dbName, requestedTable, err := getUDT(2, r) // 1 = Ignore "/x/table/" at the start of the URL
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		// No logged in username, so nothing to update
+		jsonError(w, http.StatusUnauthorized, "You need to be logged in to star databases")
+		return
+	}
+	changeDBStar(w, pageName, loggedInUser, userName, dbName, starToggle)
+}
+
+// Stars or unstars a database the logged in user can see, answering with its new star count and whether it's now
+// starred.  Used by both the front end and the API, so problems are returned as JSON errors
+func changeDBStar(w http.ResponseWriter, pageName string, loggedInUser string, owner string, dbName string,
+	change starChange) {
+	// Only databases the user can see can be starred
+	var dbInfo sqliteDBinfo
+	err := checkUserDBAccess(&dbInfo, loggedInUser, owner, dbName)
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+		jsonError(w, versionErrorStatus(err), err.Error())
+		return
+	}
+	dbId, err := getDatabaseID(owner, dbName)
+	if err != nil {
+		log.Printf("%s: Error looking up database id. User: '%s' Error: %v\n", pageName, loggedInUser, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
 		return
 	}
 
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
+	// Add or remove the star, returning exactly what the change left
+	starred, stars, err := setDBStar(dbId, loggedInUser, change)
+	if err != nil {
+		log.Printf("%s: Changing star for database failed. User: '%s' Error: %v\n", pageName, loggedInUser, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
+		return
 	}
+	recordQuickAccessStar(loggedInUser, owner, dbName, starred)
+	writeJSON(w, http.StatusOK, struct {
+		Stars   int
+		Starred bool
+	}{stars, starred})
+}
 
-	// Check if the user has access to the requested database
-	var dbQuery, jsonCacheKey, queryCacheKey string
-	if loggedInUser != userName {
-		// * The request is for another users database, so it needs to be a public one *
-		dbQuery = `
+func starsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 2 = Ignore "/stars/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the stars page
+	starsPage(w, r, userName, dbName)
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/stats/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the statistics page
+	statsPage(w, r, userName, dbName)
+}
+
+// This passes table row data back to the main UI in JSON format.  The same data is available from the API, as
+// /api/v1/table/
+func tableViewHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user, database, and table name
+	userName, dbName, requestedTable, err := getUDT(2, r) // 2 = Ignore "/x/table/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	tableData(w, r, userName, dbName, requestedTable)
+}
+
+// Returns a window of rows from a database table as JSON
+func tableData(w http.ResponseWriter, r *http.Request, userName string, dbName string, requestedTable string) {
+	pageName := "Table data handler"
+
+	// A specific version can be asked for, otherwise the latest one is used
+	var err error
+	dbVersion := int64(latestVersion)
+	if r.FormValue("version") != "" {
+		dbVersion, err = getVersion(r)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+
+	// Check if the user has access to the requested database
+	ctx := r.Context()
+	var dbQuery, jsonCacheKey, queryCacheKey string
+	if loggedInUser != userName {
+		// * The request is for another users database, so it needs to be a public one *
+		dbQuery = `
 			WITH requested_db AS (
-				SELECT idnum, minio_bucket
-				FROM sqlite_databases
-				WHERE username = $1
-					AND dbname = $2
+				SELECT db.idnum, db.minio_bucket
+				FROM sqlite_databases AS db, users AS u
+				WHERE db.username = u.username
+					AND u.disabled = false
+					AND db.username = $1
+					AND db.dbname = $2
 			)
-			SELECT db.minio_bucket, ver.minioid
+			SELECT db.minio_bucket, ver.minioid, ver.version
 			FROM database_versions AS ver, requested_db AS db
 			WHERE ver.db = db.idnum
 				AND ver.public = true
+				AND ($3 = 0 OR ver.version = $3)
 			ORDER BY version DESC
 			LIMIT 1`
 		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + requestedTable))
 		jsonCacheKey = "tbl-pub-" + hex.EncodeToString(tempArr[:])
-		tempArr2 := md5.Sum([]byte(fmt.Sprintf(dbQuery, userName, dbName)))
+		tempArr2 := md5.Sum([]byte(fmt.Sprintf(dbQuery, userName, dbName, dbVersion)))
 		queryCacheKey = "pub/" + hex.EncodeToString(tempArr2[:])
 
 	} else {
 		dbQuery = `
 			WITH requested_db AS (
-				SELECT idnum, minio_bucket
-				FROM sqlite_databases
-				WHERE username = $1
-					AND dbname = $2
+				SELECT db.idnum, db.minio_bucket
+				FROM sqlite_databases AS db, users AS u
+				WHERE db.username = u.username
+					AND u.disabled = false
+					AND db.username = $1
+					AND db.dbname = $2
 			)
-			SELECT db.minio_bucket, ver.minioid
+			SELECT db.minio_bucket, ver.minioid, ver.version
 			FROM database_versions AS ver, requested_db AS db
 			WHERE ver.db = db.idnum
+				AND ($3 = 0 OR ver.version = $3)
 			ORDER BY version DESC
 			LIMIT 1`
 		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + requestedTable))
 		jsonCacheKey = "tbl-" + hex.EncodeToString(tempArr[:])
-		tempArr2 := md5.Sum([]byte(fmt.Sprintf(dbQuery, userName, dbName)))
+		tempArr2 := md5.Sum([]byte(fmt.Sprintf(dbQuery, userName, dbName, dbVersion)))
 		queryCacheKey = loggedInUser + "/" + hex.EncodeToString(tempArr2[:])
 	}
 
 	var jsonResponse []byte
 	var minioInfo struct {
-		Bucket string
-		Id     string
+		Bucket  string
+		Id      string
+		Version int
 	}
 
 	// Use a cached version of the query response if it exists
@@ -1142,12 +1990,30 @@ func tableViewHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("%s: Error retrieving data from cache: %v\n", pageName, err)
 	}
+	if ok && loggedInUser != userName {
+		ok = ownerEnabled(userName)
+	}
 	if !ok {
 		// Cached version doesn't exist, so query the database
-		err = db.QueryRow(dbQuery, userName, dbName).Scan(&minioInfo.Bucket, &minioInfo.Id)
+		qctx, cancel := queryContext(ctx)
+		err = db.QueryRowEx(qctx, dbQuery, nil, userName, dbName, dbVersion).Scan(&minioInfo.Bucket, &minioInfo.Id,
+			&minioInfo.Version)
+		cancel()
+		if clientGone(ctx, pageName) {
+			return
+		}
+		if err == pgx.ErrNoRows {
+			err = versionLookupError(ctx, loggedInUser, userName, dbName, dbVersion)
+			if clientGone(ctx, pageName) {
+				return
+			}
+			jsonError(w, versionErrorStatus(err), err.Error())
+			return
+		}
 		if err != nil {
 			log.Printf("%s: Error looking up MinioID. User: '%s' Database: %v Error: %v\n", pageName,
 				userName, dbName, err)
+			jsonError(w, http.StatusInternalServerError, "Database query failed")
 			return
 		}
 
@@ -1163,82 +2029,144 @@ func tableViewHandler(w http.ResponseWriter, r *http.Request) {
 		// The requested database wasn't found
 		log.Printf("%s: Requested database not found. Username: '%s' Database: '%s'", pageName, userName,
 			dbName)
+		jsonError(w, http.StatusNotFound, errDatabaseNotFound.Error())
 		return
 	}
 
-	// Determine the number of rows to display
-	var maxRows int
+	// Determine the number of rows to display.  Scripts can ask for a different number with the rows parameter,
+	// which is kept between 1 and the API maximum.  The number used is returned with the rows, so clients can tell
+	// when their request was lowered
+	maxRows := conf.Web.DefaultRows
 	if loggedInUser != "" {
 		// Retrieve the user preference data
 		maxRows = getUserMaxRowsPref(loggedInUser)
-	} else {
-		// Not logged in, so default to 10 rows
-		maxRows = 10
+	}
+	if v := r.FormValue("rows"); v != "" {
+		maxRows, err = strconv.Atoi(v)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "Invalid row limit")
+			return
+		}
+		if maxRows < 1 {
+			maxRows = 1
+		}
+		if maxRows > conf.Web.MaxAPIRows {
+			maxRows = conf.Web.MaxAPIRows
+		}
 	}
 
-	// Use a cached version of the full json response if it exists
-	jsonCacheKey += "/" + strconv.Itoa(maxRows)
-	ok, err = getCachedData(jsonCacheKey, &jsonResponse)
+	// If a sort order was given, validate it.  The column itself is checked once the database is open.  Searches of
+	// the table go through rowSearchHandler() instead, so any search term is ignored here
+	filter, err := parseRowFilter(r)
 	if err != nil {
-		log.Printf("%s: Error retrieving data from cache: %v\n", pageName, err)
-	}
-	if ok {
-		// Serve the response from cache
-		fmt.Fprintf(w, "%s", jsonResponse)
+		jsonError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	filter.Term = ""
+	sortCol, sortDir := filter.SortCol, filter.SortDir
 
-	// Get a handle from Minio for the database object
-	userDB, err := minioClient.GetObject(minioInfo.Bucket, minioInfo.Id)
+	// Scripts can cut down the response by asking for only some of the columns, and for the rows as plain arrays
+	cols, err := requestedColumns(r)
 	if err != nil {
-		log.Printf("%s: Error retrieving DB from Minio: %v\n", pageName, err)
+		log.Printf("%s: Validation failed for column name: %s", pageName, err)
+		jsonError(w, http.StatusBadRequest, "Invalid column name")
 		return
 	}
+	compact, _ := strconv.ParseBool(r.FormValue("compact"))
 
-	// Close the object handle when this function finishes
-	defer func() {
-		err := userDB.Close()
-		if err != nil {
-			log.Printf("%s: Error closing object handle: %v\n", pageName, err)
+	// The rows are shown a window at a time, so the front end asks for the ones after the first by their offset
+	offset := 0
+	if v := r.FormValue("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			jsonError(w, http.StatusBadRequest, "Invalid row offset")
+			return
 		}
-	}()
+	}
+
+	// The owner can ask for the row keys too, for editing the table
+	editMode := r.FormValue("edit") == "1" && loggedInUser == userName
 
-	// Save the database locally to a temporary file
-	tempfileHandle, err := ioutil.TempFile("", "databaseViewHandler-")
+	// Long text values are cut short unless the full ones are asked for.  The editor always gets them in full
+	fullValues, _ := strconv.ParseBool(r.FormValue("notrunc"))
+	fullValues = fullValues || editMode
+
+	// When no table was asked for, the one the owner chose is used
+	var defaultTable string
+	if requestedTable == "" {
+		defaultTable = getDefaultTable(userName, dbName)
+	}
+
+	// The owner's default filter for the table hides rows from everyone else, unless they asked for every row.  When
+	// it isn't applied it's still described, so the page can say it's there
+	filters, err := getTableFilters(userName, dbName)
 	if err != nil {
-		log.Printf("%s: Error creating tempfile: %v\n", pageName, err)
+		jsonError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	tempfile := tempfileHandle.Name()
-	bytesWritten, err := io.Copy(tempfileHandle, userDB)
+	showAll, _ := strconv.ParseBool(r.FormValue("all"))
+	applyFilter := loggedInUser != userName && !showAll
+
+	// Use a cached version of the full json response if it exists.  The key needs everything which changes the
+	// rows returned, including the window
+	jsonCacheKey += "/" + strconv.Itoa(minioInfo.Version) + "/" + strconv.Itoa(maxRows) + "/" +
+		strconv.Itoa(offset) + "/" + sortCol + "/" + sortDir + "/" + defaultTable
+	if editMode {
+		jsonCacheKey += "/edit"
+	} else if fullValues {
+		jsonCacheKey += "/full"
+	}
+	if len(cols) > 0 {
+		tempArr := md5.Sum([]byte(strings.Join(cols, "\x00")))
+		jsonCacheKey += "/cols-" + hex.EncodeToString(tempArr[:])
+	}
+	if compact {
+		jsonCacheKey += "/compact"
+	}
+	if len(filters) > 0 {
+		jsonCacheKey += "/filters-" + filters.Key()
+		if showAll {
+			jsonCacheKey += "/all"
+		}
+	}
+	ok, err = getCachedData(jsonCacheKey, &jsonResponse)
 	if err != nil {
-		log.Printf("%s: Error writing database to temporary file: %v\n", pageName, err)
-		return
+		log.Printf("%s: Error retrieving data from cache: %v\n", pageName, err)
 	}
-	if bytesWritten == 0 {
-		log.Printf("%s: 0 bytes written to the temporary file: %v\n", pageName, dbName)
+	if ok {
+		// Serve the response from cache
+		w.Header().Set("X-DBHub-Version", strconv.Itoa(minioInfo.Version))
+		jsonOK(w, jsonResponse)
 		return
 	}
-	tempfileHandle.Close()
-	defer os.Remove(tempfile) // Delete the temporary file when this function finishes
 
-	// Open database
-	db, err := sqlite.Open(tempfile, sqlite.OpenReadOnly)
+	// Retrieve the database from Minio and open it
+	db, err := openMinioObjectCtx(ctx, minioInfo.Bucket, minioInfo.Id)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err == errTooManyOpenDBs {
+		w.Header().Set("Retry-After", strconv.Itoa(tempDBRetryAfter))
+		jsonError(w, http.StatusServiceUnavailable, "The server is busy.  Please try again in a moment.")
+		return
+	}
 	if err != nil {
-		log.Printf("Couldn't open database: %s", err)
+		log.Printf("%s: Error retrieving database '%s/%s': %v\n", pageName, userName, dbName, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer db.Close()
+	defer closeMinioObject(db)
 
 	// Retrieve the list of tables in the database
 	tables, err := db.Tables("")
 	if err != nil {
-		log.Printf("Error retrieving table names: %s", err)
+		log.Printf("%s: Error retrieving table names: %s", pageName, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
 		return
 	}
 	if len(tables) == 0 {
 		// No table names were returned, so abort
-		log.Printf("The database '%s' doesn't seem to have any tables. Aborting.", dbName)
+		jsonError(w, http.StatusNotFound, "The database doesn't have any tables")
 		return
 	}
 
@@ -1252,90 +2180,291 @@ func tableViewHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		if tablePresent == false {
 			// The requested table doesn't exist
-			errorPage(w, r, http.StatusBadRequest, "Requested table does not exist")
+			jsonError(w, http.StatusNotFound, "Requested table does not exist")
 			return
 		}
 	}
 
-	// If no specific table was requested, use the first one
+	// If no specific table was requested, use the default one
+	vt := readVirtualTables(db)
 	if requestedTable == "" {
-		requestedTable = tables[0]
+		requestedTable = landingTable(tables, vt, defaultTable)
 	}
 
 	// Read the data from the database
-	dataRows, err := readSQLiteDB(db, requestedTable, maxRows)
-	if err != nil {
+	var dataRows sqliteRecordSet
+	if err = checkRowFilter(db, requestedTable, filter); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, c := range cols {
+		if !tableHasColumn(db, requestedTable, c) {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("No such column: %s", c))
+			return
+		}
+	}
+	var where []whereClause
+	if applyFilter {
+		where = filters.Clauses(db, requestedTable)
+	}
+	sctx, cancel := sqliteContext(ctx)
+	defer cancel()
+	if editMode || (!fullValues && tableHasRowid(db, requestedTable)) {
+		// The rows are read along with their keys.  Outside of the editor that's so the values cut short can be
+		// retrieved in full using their rowid
+		dataRows, err = readSQLiteDBEditable(sctx, db, requestedTable, maxRows, offset, sortCol, sortDir, cols,
+			where)
+	} else {
+		dataRows, err = readSQLiteDBWindowCtx(sctx, db, requestedTable, maxRows, offset, sortCol, sortDir, cols,
+			where)
+	}
+	if clientGone(ctx, pageName) {
+		return
+	}
+	module := vt.Modules[requestedTable]
+	if err == errQueryTooLong {
+		jsonError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	} else if err != nil && module != "" {
+		// Some virtual table modules can't be read with a plain SELECT, so say so in place of the rows
+		log.Printf("%s: Error reading virtual table '%s' of '%s/%s': %v\n", pageName, requestedTable, userName,
+			dbName, err)
+		dataRows = sqliteRecordSet{Tablename: requestedTable, ReadError: virtualTableReadError(module)}
+		err = nil
+	} else if err != nil {
 		// Some kind of error when reading the database data
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dataRows.Module = module
+	dataRows.Limit = maxRows
+	dataRows.Version = minioInfo.Version
+	if dataRows.ReadError == "" {
+		dataRows.ColTypes = readColumnTypes(db, requestedTable, dataRows)
+	}
+	if !fullValues {
+		truncateRecords(&dataRows, conf.Web.CellLength)
+	} else if recordsSize(dataRows) > maxFullValuesSize {
+		jsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The full values of these rows come to "+
+			"more than %d MB.  Please ask for fewer rows at once", maxFullValuesSize>>20))
 		return
 	}
 
-	// Count the total number of rows in the requested table
-	dataRows.TotalRows, err = getSQLiteRowCount(db, requestedTable)
+	// Count the total number of rows in the requested table.  When the default filter was applied, the total is of
+	// the rows it leaves
+	if dataRows.ReadError == "" {
+		dataRows.TotalRows, dataRows.ApproxCount, err = getTableRowCount(sctx, db, userName, dbName,
+			minioInfo.Version, requestedTable, minioInfo.Bucket, minioInfo.Id)
+	}
+	if f, ok := filters[requestedTable]; ok && err == nil && dataRows.ReadError == "" {
+		filteredRows := dataRows.TotalRows
+		if len(where) > 0 {
+			filteredRows, err = filteredRowCount(sctx, db, requestedTable, rowFilter{Where: where})
+		}
+		describeTableFilter(&dataRows, f, len(where) > 0, filteredRows, dataRows.TotalRows)
+		if len(where) > 0 {
+			dataRows.TotalRows, dataRows.ApproxCount = filteredRows, false
+		}
+	}
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err == errQueryTooLong {
+		jsonError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	}
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		jsonError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Format the output
-	if dataRows.RowCount > 0 {
-		// Use json.MarshalIndent() for nicer looking output
-		jsonResponse, err = json.MarshalIndent(dataRows, "", " ")
+	// Format the output.  A window past the end of the table is still returned in full, so the front end gets the
+	// total row count with it
+	if dataRows.RowCount > 0 || dataRows.ReadError != "" || offset > 0 {
+		// Use json.MarshalIndent() for nicer looking output.  The compact shape is meant to be small, so isn't
+		// indented
+		dataRows.Format = recordsFormatFull
+		if compact {
+			jsonResponse, err = json.Marshal(compactRecords(dataRows))
+		} else {
+			jsonResponse, err = json.MarshalIndent(dataRows, "", " ")
+		}
 		if err != nil {
-			log.Println(err)
+			log.Printf("%s: Error encoding rows of '%s/%s': %v\n", pageName, userName, dbName, err)
+			jsonError(w, http.StatusInternalServerError, "Error encoding the table data")
 			return
 		}
 	} else {
-		// Return an empty set indicator, instead of "null"
-		jsonResponse = []byte{'{', ']'}
+		// Return an empty object as the empty set indicator, instead of "null"
+		jsonResponse = []byte("{}")
 	}
 
-	// Cache the JSON data
-	err = cacheData(jsonCacheKey, jsonResponse, cacheTime)
-	if err != nil {
-		log.Printf("%s: Error when caching JSON data: %v\n", pageName, err)
+	// Cache the JSON data, unless the row count is only an estimate
+	if !dataRows.ApproxCount {
+		err = cacheData(jsonCacheKey, jsonResponse, cacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching JSON data: %v\n", pageName, err)
+		}
 	}
 
 	//w.Header().Set("Access-Control-Allow-Origin", "*")
-	fmt.Fprintf(w, "%s", jsonResponse)
+	w.Header().Set("X-DBHub-Version", strconv.Itoa(minioInfo.Version))
+	jsonOK(w, jsonResponse)
 }
 
-// This function presents the database upload form to logged in users
-func uploadFormHandler(w http.ResponseWriter, r *http.Request) {
-	//pageName := "Upload form"
+// This function processes avatar images submitted through the preferences page
+func uploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Upload avatar handler"
 
 	// Ensure user is logged in
-	var loggedInUser interface{}
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = sess.CAttr("UserName")
-	} else {
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
 		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
 		return
 	}
 
-	// Render the upload page
-	uploadPage(w, r, fmt.Sprintf("%s", loggedInUser))
+	// Retrieve the id of any existing avatar, so it can be removed afterwards
+	var oldAvatarId pgx.NullString
+	err := db.QueryRow(`
+		SELECT avatar_minioid
+		FROM users
+		WHERE username = $1`, loggedInUser).Scan(&oldAvatarId)
+	if err != nil {
+		log.Printf("%s: Error retrieving avatar details for user '%s': %v\n", pageName, loggedInUser, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Avatars are small, so there's no need to accept large uploads
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarUpload)
+	err = r.ParseMultipartForm(maxAvatarUpload)
+	if bodyTooLarge(err) {
+		requestTooLarge(w, r, maxAvatarUpload)
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error when parsing avatar upload: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error reading the avatar upload")
+		return
+	}
+
+	var newAvatarId pgx.NullString
+	if r.PostFormValue("remove") != "true" {
+		tempFile, _, err := r.FormFile("avatar")
+		if err != nil {
+			log.Printf("%s: Uploading avatar failed: %v\n", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Avatar image missing from upload data?")
+			return
+		}
+		defer tempFile.Close()
+
+		// Check the image dimensions before decoding it, as a small file can still claim to be a huge image.  This
+		// also ensures it's really a (gif, jpeg, or png) image
+		cfg, _, err := image.DecodeConfig(tempFile)
+		if err != nil {
+			log.Printf("%s: Error decoding avatar image for user '%s': %v\n", pageName, loggedInUser, err)
+			errorPage(w, r, http.StatusBadRequest, "Avatar must be a GIF, JPEG, or PNG image")
+			return
+		}
+		if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+			errorPage(w, r, http.StatusBadRequest, "Avatar image dimensions are too large")
+			return
+		}
+		_, err = tempFile.Seek(0, io.SeekStart)
+		if err != nil {
+			log.Printf("%s: Error rewinding avatar upload: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		srcImg, _, err := image.Decode(tempFile)
+		if err != nil {
+			log.Printf("%s: Error decoding avatar image for user '%s': %v\n", pageName, loggedInUser, err)
+			errorPage(w, r, http.StatusBadRequest, "Avatar must be a GIF, JPEG, or PNG image")
+			return
+		}
+
+		// Crop the image to a centred square, then scale it to our avatar size
+		b := srcImg.Bounds()
+		side := b.Dx()
+		if b.Dy() < side {
+			side = b.Dy()
+		}
+		x0 := b.Min.X + (b.Dx()-side)/2
+		y0 := b.Min.Y + (b.Dy()-side)/2
+		dstImg := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+		draw.CatmullRom.Scale(dstImg, dstImg.Bounds(), srcImg, image.Rect(x0, y0, x0+side, y0+side), draw.Over,
+			nil)
+
+		// Store the resized avatar in Minio
+		var avatarBuf bytes.Buffer
+		err = png.Encode(&avatarBuf, dstImg)
+		if err != nil {
+			log.Printf("%s: Error encoding avatar image for user '%s': %v\n", pageName, loggedInUser, err)
+			errorPage(w, r, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		newAvatarId.String = randomString(16) + ".png"
+		newAvatarId.Valid = true
+		_, err = minioClient.PutObject(avatarBucket, newAvatarId.String, &avatarBuf, "image/png")
+		if err != nil {
+			log.Printf("%s: Storing avatar in Minio failed: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Storing in object store failed")
+			return
+		}
+	}
+
+	// Update the avatar details for the user
+	commandTag, err := db.Exec(`
+		UPDATE users
+		SET avatar_minioid = $1
+		WHERE username = $2`, newAvatarId, loggedInUser)
+	if err == nil && commandTag.RowsAffected() != 1 {
+		err = fmt.Errorf("wrong number of rows affected: %d", commandTag.RowsAffected())
+	}
+	if err != nil {
+		log.Printf("%s: Updating avatar details for user '%s' failed: %v\n", pageName, loggedInUser, err)
+
+		// Don't leave the new image behind in Minio, as nothing refers to it
+		if newAvatarId.Valid {
+			rmErr := minioClient.RemoveObject(avatarBucket, newAvatarId.String)
+			if rmErr != nil {
+				log.Printf("%s: Error removing unused avatar '%s': %v\n", pageName, newAvatarId.String, rmErr)
+			}
+		}
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Remove the previous avatar image (if any) from Minio
+	if oldAvatarId.Valid {
+		err = minioClient.RemoveObject(avatarBucket, oldAvatarId.String)
+		if err != nil {
+			log.Printf("%s: Error removing old avatar '%s': %v\n", pageName, oldAvatarId.String, err)
+		}
+	}
+
+	// Bounce back to the preferences page
+	http.Redirect(w, r, "/pref", http.StatusSeeOther)
+}
+
+// This function presents the database upload form to logged in users
+func uploadFormHandler(w http.ResponseWriter, r *http.Request) {
+	uploadPage(w, r, currentUser(r))
 }
 
 // This function processes new database data submitted through the upload form
 func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
 	pageName := "Upload DB handler"
+	loggedInUser := currentUser(r)
 
-	// Ensure user is logged in
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess == nil {
-		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
-		return
-	}
-	loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
-
-	// Prepare the form data
-	r.ParseMultipartForm(32 << 20) // 64MB of ram max
-	if err := r.ParseForm(); err != nil {
-		log.Printf("%s: ParseForm() error: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+	// Prepare the form data.  Databases over the size limit are only found to be so as they're read
+	if err := r.ParseMultipartForm(conf.Limits.MultipartMemory << 20); err != nil {
+		if bodyTooLarge(err) {
+			requestTooLarge(w, r, requestBodyLimit(r))
+			return
+		}
+		log.Printf("%s: Error parsing the upload: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error reading the upload")
 		return
 	}
 
@@ -1348,6 +2477,14 @@ func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The licence only applies to new databases.  Existing ones keep theirs
+	licence := r.PostFormValue("licence")
+	if !isValidLicence(licence) {
+		log.Printf("%s: Unknown licence '%s'\n", pageName, licence)
+		errorPage(w, r, http.StatusBadRequest, "Unknown licence")
+		return
+	}
+
 	// TODO: Add support for folders and subfolders
 	folder := "/"
 
@@ -1357,9 +2494,16 @@ func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, r, http.StatusInternalServerError, "Database file missing from upload data?")
 		return
 	}
-	dbName := handler.Filename
 	defer tempFile.Close()
 
+	// The database is named after the uploaded file, unless a name was given.  The file name is kept as well, as
+	// a record of where the database came from
+	originalName := stripControlChars(handler.Filename)
+	dbName := strings.TrimSpace(r.PostFormValue("dbname"))
+	if dbName == "" {
+		dbName = sanitiseDBName(handler.Filename)
+	}
+
 	// Validate the database name
 	err = com.ValidateDB(dbName)
 	if err != nil {
@@ -1382,370 +2526,124 @@ func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, r, http.StatusBadRequest, "Database file is 0 length?")
 		return
 	}
-	tempDB, err := ioutil.TempFile("", "dbhub-upload-")
+	tempDB, err := ioutil.TempFile(tempDir(), "dbhub-upload-")
 	if err != nil {
 		log.Printf("%s: Error creating temporary file. User: %s, Database: %s, Filename: %s, Error: %v\n",
 			pageName, loggedInUser, dbName, tempDB.Name(), err)
 		errorPage(w, r, http.StatusInternalServerError, "Internal error")
 		return
 	}
+	tempDBName := tempDB.Name()
+
+	// Delete the temporary file when this function finishes
+	defer os.Remove(tempDBName)
 	_, err = tempDB.Write(tempBuf.Bytes())
+	closeErr := tempDB.Close()
+	if err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		log.Printf("%s: Error when writing the uploaded db to a temp file. User: %s, Database: %s"+
 			"Error: %v\n", pageName, loggedInUser, dbName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Internal error")
 		return
 	}
-	tempDBName := tempDB.Name()
-
-	// Delete the temporary file when this function finishes
-	defer os.Remove(tempDBName)
 
 	// Perform a read on the database, as a basic sanity check to ensure it's really a SQLite database
-	sqliteDB, err := sqlite.Open(tempDBName, sqlite.OpenReadOnly)
-	if err != nil {
-		log.Printf("Couldn't open database when sanity checking upload: %s", err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
-		return
-	}
-	defer sqliteDB.Close()
-	tables, err := sqliteDB.Tables("")
+	err = sanityCheckSQLite(tempDBName)
 	if err != nil {
-		log.Printf("Error retrieving table names when sanity checking upload: %s", err)
-		errorPage(w, r, http.StatusInternalServerError,
-			"Error when sanity checking file.  Possibly encrypted or not a database?")
-		return
-	}
-	if len(tables) == 0 {
-		// No table names were returned, so abort
-		log.Printf("The attemped upload for '%s' failed, as it doesn't seem to have any tables.", dbName)
-		errorPage(w, r, http.StatusInternalServerError, "Database has no tables?")
+		log.Printf("%s: The attempted upload for '%s' failed the sanity check\n", pageName, dbName)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Generate sha256 of the uploaded file
+	// Uploads which would add a version to an existing database are checked with the user first, unless the form
+	// says they've agreed already.  The upload is kept on the server while they decide
 	shaSum := sha256.Sum256(tempBuf.Bytes())
-
-	// Check if the database already exists
-	var highestVersion int
-	err = db.QueryRow(`
-		SELECT version
-		FROM database_versions
-		WHERE db = (SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1
-			AND dbname = $2)
-		ORDER BY version DESC
-		LIMIT 1`, loggedInUser, dbName).Scan(&highestVersion)
-	if err != nil && err != pgx.ErrNoRows {
-		log.Printf("%s: Error when querying database: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
-		return
-	}
-	var newVersion int
-	if highestVersion > 0 {
-		// The database already exists
-		newVersion = highestVersion + 1
-	} else {
-		newVersion = 1
-	}
-
-	// Retrieve the Minio bucket to store the database in
-	var minioBucket string
-	err = db.QueryRow(`
-		SELECT minio_bucket
-		FROM users
-		WHERE username = $1`, loggedInUser).Scan(&minioBucket)
-	if err != nil && err != pgx.ErrNoRows {
-		log.Printf("%s: Error when querying database: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+	target, err := getUploadTarget(loggedInUser, dbName, hex.EncodeToString(shaSum[:]))
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// Generate random filename to store the database as
-	mathrand.Seed(time.Now().UnixNano())
-	const alphaNum = "abcdefghijklmnopqrstuvwxyz0123456789"
-	randomString := make([]byte, 8)
-	for i := range randomString {
-		randomString[i] = alphaNum[mathrand.Intn(len(alphaNum))]
-	}
-	minioId := string(randomString) + ".db"
-
-	// TODO: We should probably check if the randomly generated filename is already used for the user, just in case
-
-	// Store the database file in Minio
-	dbSize, err := minioClient.PutObject(minioBucket, minioId, &tempBuf, handler.Header["Content-Type"][0])
-	if err != nil {
-		log.Printf("%s: Storing file in Minio failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Storing in object store failed")
+	if target.Identical {
+		errorPage(w, r, http.StatusConflict, target.Message())
 		return
 	}
-
-	// TODO: Put these queries inside a single transaction
-
-	// Add the new database details to the PG database
-	var dbQuery string
-	if newVersion == 1 {
-		dbQuery = `
-			INSERT INTO sqlite_databases (username, folder, dbname, minio_bucket)
-			VALUES ($1, $2, $3, $4)`
-		commandTag, err := db.Exec(dbQuery, loggedInUser, folder, dbName, minioBucket)
+	if target.Exists && r.PostFormValue("confirm") != "true" {
+		u, err := savePendingUpload(loggedInUser, dbName, originalName, public, licence, tempBuf.Bytes())
 		if err != nil {
-			log.Printf("%s: Adding database to PostgreSQL failed: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-			return
-		}
-		if numRows := commandTag.RowsAffected(); numRows != 1 {
-			log.Printf("%s: Wrong number of rows affected: %v, user: %s, database: %v\n", pageName,
-				numRows, loggedInUser, dbName)
+			log.Printf("%s: Error keeping upload of '%s/%s' for confirmation: %v\n", pageName, loggedInUser, dbName,
+				err)
+			errorPage(w, r, http.StatusInternalServerError, "Internal error")
 			return
 		}
+		uploadConfirmPage(w, r, u, target)
+		return
 	}
 
-	// Add the database to database_versions
-	dbQuery = `
-		WITH databaseid AS (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1
-				AND dbname = $2)
-		INSERT INTO database_versions (db, size, version, sha256, public, minioid)
-		SELECT idnum, $3, $4, $5, $6, $7 FROM databaseid`
-	commandTag, err := db.Exec(dbQuery, loggedInUser, dbName, dbSize, newVersion, hex.EncodeToString(shaSum[:]),
-		public, minioId)
+	// Store the database as a new version.  The type the browser gave for the file isn't trusted, as we've checked
+	// it ourselves, so an unexpected one is only logged.  Browsers can leave it out entirely
+	claimedType := handler.Header.Get("Content-Type")
+	if claimedType != "" && claimedType != contentTypeSQLite && claimedType != "application/octet-stream" {
+		log.Printf("%s: Upload of '%s' by '%s' was sent as '%s'\n", pageName, dbName, loggedInUser, claimedType)
+	}
+	newVersion, dbSize, minioId, err := addDatabaseVersion(loggedInUser, dbName, folder, public, tempBuf.Bytes(),
+		"", loggedInUser)
 	if err != nil {
-		log.Printf("%s: Adding version info to PostgreSQL failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// Update the last_modified date for the database in sqlite_databases
-	dbQuery = `
-		UPDATE sqlite_databases
-		SET last_modified = (
-			SELECT last_modified
-			FROM database_versions
-			WHERE db = (
-				SELECT idnum
-				FROM sqlite_databases
-				WHERE username = $1
-					AND dbname = $2)
-				AND version = $3)
-		WHERE username = $1
-			AND dbname = $2`
-	commandTag, err = db.Exec(dbQuery, loggedInUser, dbName, newVersion)
-	if err != nil {
-		log.Printf("%s: Updating last_modified date in PostgreSQL failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
-		return
+	if newVersion == 1 && licence != "" {
+		// The database is stored already, so a failure here isn't worth failing the upload over
+		setDatabaseLicence(loggedInUser, dbName, licence)
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("%s: Wrong number of rows affected: %v, user: %s, database: %v\n", pageName, numRows,
-			loggedInUser, dbName)
-		return
+	if originalName != dbName {
+		setOriginalFilename(loggedInUser, dbName, newVersion, originalName)
 	}
 
 	// Log the successful database upload
 	log.Printf("%s: Username: %v, database '%v' uploaded as '%v', bytes: %v\n", pageName, loggedInUser, dbName,
 		minioId, dbSize)
 
-	// Database upload succeeded.  Tell the user then bounce back to their profile page
-	fmt.Fprintf(w, `
-	<html><head><script type="text/javascript"><!--
-		function delayer(){
-			window.location = "/%s"
-		}//-->
-	</script></head>
-	<body onLoad="setTimeout('delayer()', 5000)">
-	<body>Upload succeeded<br /><br /><a href="/%s">Continuing to profile page...</a></body></html>`,
-		loggedInUser, loggedInUser)
+	uploadSucceededPage(w, loggedInUser, dbName, newVersion, dbSize, hex.EncodeToString(shaSum[:]), tempDBName)
 }
 
-// Receives a request for specific table data from the front end, returning it as JSON
+// Receives a request for specific table data from the front end, returning it as JSON.  The same data is available
+// from the API, as /api/v1/visdata/
 func visData(w http.ResponseWriter, r *http.Request) {
-	pageName := "Visualisation data handler"
-
-	var pageData struct {
-		Meta metaInfo
-		DB   sqliteDBinfo
-		Data sqliteRecordSet
-	}
-
 	// Retrieve user, database, and table name
-	userName, dbName, requestedTable, err := getUDT(2, r) // 1 = Ignore "/x/table/" at the start of the URL
+	userName, dbName, requestedTable, err := getUDT(2, r) // 2 = Ignore "/x/visdata/" at the start of the URL
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
-		return
-	}
-
-	// Check if X and Y column names were given
-	var reqXCol, reqYCol, xCol, yCol string
-	reqXCol = r.FormValue("xcol")
-	reqYCol = r.FormValue("ycol")
-
-	// Validate column names if present
-	// FIXME: Create a proper validation function for SQLite column names
-	if reqXCol != "" {
-		err = com.ValidatePGTable(reqXCol)
-		if err != nil {
-			log.Printf("Validation failed for SQLite column name: %s", err)
-			return
-		}
-		xCol = reqXCol
-	}
-	if reqYCol != "" {
-		err = com.ValidatePGTable(reqYCol)
-		if err != nil {
-			log.Printf("Validation failed for SQLite column name: %s", err)
-			return
-		}
-		yCol = reqYCol
-	}
-
-	// Validate WHERE clause values if present
-	var reqWCol, reqWType, reqWVal, wCol, wType, wVal string
-	reqWCol = r.FormValue("wherecol")
-	reqWType = r.FormValue("wheretype")
-	reqWVal = r.FormValue("whereval")
-
-	// WHERE column
-	if reqWCol != "" {
-		err = com.ValidatePGTable(reqWCol)
-		if err != nil {
-			log.Printf("Validation failed for SQLite column name: %s", err)
-			return
-		}
-		wCol = reqWCol
-	}
-
-	// WHERE type
-	switch reqWType {
-	case "":
-		// We don't pass along empty values
-	case "LIKE", "=", "!=", "<", "<=", ">", ">=":
-		wType = reqWType
-	default:
-		// This should never be reached
-		log.Printf("%s: Validation failed on WHERE clause type. wType = '%v'\n", pageName, wType)
+		jsonError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	visDataResponse(w, r, userName, dbName, requestedTable)
+}
 
-	// TODO: Add ORDER BY clause
-	// TODO: We'll probably need some kind of optional data transformation for columns too
-	// TODO    eg column foo → DATE (type)
-
-	// WHERE value
-	var whereClauses []whereClause
-	if reqWVal != "" && wType != "" {
-		whereClauses = append(whereClauses, whereClause{Column: wCol, Type: wType, Value: reqWVal})
-
-		// TODO: Double check if we should be filtering out potentially devious characters here. I don't
-		// TODO  (at the moment) *think* we need to, as we're using parameter binding on the passed in values
-		wVal = reqWVal
-	}
-
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
-	}
+// Returns the data for a visualisation as JSON
+func visDataResponse(w http.ResponseWriter, r *http.Request, userName string, dbName string, requestedTable string) {
+	pageName := "Visualisation data handler"
 
-	// Check if the user has access to the requested database
-	err = checkUserDBAccess(&pageData.DB, loggedInUser, userName, dbName)
-	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+	data, ok := getVisData(w, r, pageName, userName, dbName, requestedTable)
+	if !ok {
 		return
 	}
+	w.Header().Set("X-DBHub-Version", strconv.Itoa(data.Version))
 
-	// * Execution can only get here if the user has access to the requested database *
-
-	// Generate a predictable cache key for the JSON data
-	var pageCacheKey string
-	if loggedInUser != userName {
-		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + requestedTable + xCol + yCol + wCol +
-			wType + wVal))
-		pageCacheKey = "visdat-pub-" + hex.EncodeToString(tempArr[:])
-	} else {
-		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + requestedTable +
-			xCol + yCol + wCol + wType + wVal))
-		pageCacheKey = "visdat-" + hex.EncodeToString(tempArr[:])
-	}
-
-	// If a cached version of the page data exists, use it
+	// Map points are returned as GeoJSON, otherwise the record set is returned as is
 	var jsonResponse []byte
-	ok, err := getCachedData(pageCacheKey, &jsonResponse)
-	if err != nil {
-		log.Printf("%s: Error retrieving page data from cache: %v\n", pageName, err)
-	}
-	if ok {
-		// Render the JSON response from cache
-		fmt.Fprintf(w, "%s", jsonResponse)
-		return
-	}
-
-	// Get a handle from Minio for the database object
-	db, err := openMinioObject(pageData.DB.MinioBkt, pageData.DB.MinioId)
-	if err != nil {
-		return
-	}
-	defer db.Close()
-
-	// Retrieve the list of tables in the database
-	tables, err := db.Tables("")
-	if err != nil {
-		log.Printf("%s: Error retrieving table names: %s", pageName, err)
-		return
-	}
-	if len(tables) == 0 {
-		// No table names were returned, so abort
-		log.Printf("%s: The database '%s' doesn't seem to have any tables. Aborting.", pageName, dbName)
-		return
-	}
-	pageData.DB.Info.Tables = tables
-
-	// If a specific table was requested, check that it's present
-	var dbTable string
-	if requestedTable != "" {
-		// Check the requested table is present
-		for _, tbl := range tables {
-			if tbl == requestedTable {
-				dbTable = requestedTable
-			}
-		}
-	}
-
-	// If a specific table wasn't requested, use the first table in the database
-	if dbTable == "" {
-		dbTable = pageData.DB.Info.Tables[0]
-	}
-
-	// Retrieve the table data requested by the user
-	maxVals := 2500 // 2500 row maximum for now
-	if xCol != "" && yCol != "" {
-		pageData.Data, err = readSQLiteDBCols(db, requestedTable, true, true, maxVals, whereClauses, xCol, yCol)
+	var err error
+	if r.FormValue("lat") != "" {
+		jsonResponse, err = json.Marshal(recordsToGeoJSON(data))
 	} else {
-		pageData.Data, err = readSQLiteDB(db, requestedTable, maxVals)
-	}
-	if err != nil {
-		// Some kind of error when reading the database data
-		errorPage(w, r, http.StatusBadRequest, err.Error())
-		return
+		// Use json.MarshalIndent() for nicer looking output
+		jsonResponse, err = json.Marshal(data)
 	}
-
-	// Use json.MarshalIndent() for nicer looking output
-	jsonResponse, err = json.Marshal(pageData.Data)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	// Cache the JSON data
-	err = cacheData(pageCacheKey, jsonResponse, cacheTime)
-	if err != nil {
-		log.Printf("%s: Error when caching JSON data: %v\n", pageName, err)
-	}
-
 	//w.Header().Set("Access-Control-Allow-Origin", "*")
-	fmt.Fprintf(w, "%s", jsonResponse)
+	jsonOK(w, jsonResponse)
 }
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	sqlite "github.com/gwenn/gosqlite"
+	"github.com/icza/session"
+	"github.com/jackc/pgx"
+	"github.com/minio/minio-go"
+)
+
+// Tests which need PostgreSQL, Minio and Memcached only run when DBHUB_TEST_BACKENDS is set, in which case they use
+// the servers from the usual configuration file.  Each test adds users with names no earlier run has used, so the
+// tests can be run again and again against the same servers, which shouldn't be ones holding real data
+const testBackendsEnv = "DBHUB_TEST_BACKENDS"
+
+var (
+	// True when the backing services are available to the tests
+	backendsReady bool
+
+	// Holds the files the tests create, and is removed once they've finished
+	testDir string
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var err error
+	testDir, err = ioutil.TempDir("", "dbhub-test-")
+	if err != nil {
+		log.Fatalf("Error creating the test directory: %v\n", err)
+	}
+
+	if os.Getenv(testBackendsEnv) != "" {
+		if err = connectTestBackends(); err != nil {
+			log.Fatalf("Error connecting to the test backends: %v\n", err)
+		}
+		backendsReady = true
+	} else {
+		setTestConfigDefaults()
+
+		// Without Memcached, caching is switched off the same way as when it stops responding
+		cacheBreaker.open = true
+		cacheBreaker.retryAt = time.Now().Add(24 * time.Hour)
+	}
+	conf.Web.TempDir = testDir
+	conf.Web.RequestLogBackend = reqLogFile
+	reqLog, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatalf("Error opening the request log: %v\n", err)
+	}
+	tempDBSlots = make(chan struct{}, conf.Web.MaxOpenDatabases)
+
+	// Sessions and pages work the same as in the server, apart from allowing session cookies without TLS
+	session.Global.Close()
+	session.Global = session.NewCookieManagerOptions(session.NewInMemStore(),
+		&session.CookieMngrOptions{AllowHTTP: true})
+	if err = loadAssetHashes(); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	tmpl, err = parseTemplates()
+	if err == nil {
+		err = checkTemplates(tmpl)
+	}
+	if err != nil {
+		log.Fatalf("Template problem: %v\n", err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// Connects to the servers named in the configuration file, the same way main() does
+func connectTestBackends() error {
+	err := readConfig()
+	if err != nil {
+		return err
+	}
+	minioClient, err = minio.New(conf.Minio.Server, conf.Minio.AccessKey, conf.Minio.Secret, conf.Minio.HTTPS)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range []string{avatarBucket, exportBucket} {
+		if err = createBucketIfMissing(bucket); err != nil {
+			return err
+		}
+	}
+	db, err = pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: *pgConfig, MaxConnections: conf.Pg.MaxConnections})
+	if err != nil {
+		return err
+	}
+	memCache = memcache.New(conf.Cache.Server)
+	return nil
+}
+
+// Fills in the configuration readConfig() would otherwise default, for tests run without a configuration file
+func setTestConfigDefaults() {
+	conf.Timeouts.Query = 10
+	conf.Timeouts.Minio = 60
+	conf.Timeouts.SQLite = 5
+	conf.Web.DefaultRows = 10
+	conf.Web.MaxAPIRows = 500
+	conf.Web.CellLength = 1024
+	conf.Web.MaxOpenDatabases = 4
+	conf.Web.SessionIdleTimeout = 30
+	conf.Limits.Form = 1
+	conf.Limits.Upload = 2048
+	conf.Limits.MultipartMemory = 32
+}
+
+// Skips a test which needs PostgreSQL, Minio and Memcached when they aren't available
+func requireBackends(t *testing.T) {
+	if !backendsReady {
+		t.Skipf("needs PostgreSQL, Minio and Memcached.  Set %s to run it", testBackendsEnv)
+	}
+}
+
+// Creates a SQLite database in the test directory by running the given statements, returning its path
+func newTestSQLite(t *testing.T, name string, stmts ...string) string {
+	path := filepath.Join(testDir, name)
+	os.Remove(path)
+	sdb, err := sqlite.Open(path)
+	if err != nil {
+		t.Fatalf("Error creating test database '%s': %v", name, err)
+	}
+	defer sdb.Close()
+	for _, s := range stmts {
+		if err = sdb.Exec(s); err != nil {
+			t.Fatalf("Error running '%s' in test database '%s': %v", s, name, err)
+		}
+	}
+	return path
+}
+
+// Creates a SQLite database with newTestSQLite(), then opens it the way databases from Minio are opened.  The
+// caller closes it
+func openTestSQLite(t *testing.T, name string, stmts ...string) *sqlite.Conn {
+	sdb, err := openImmutableSQLite(newTestSQLite(t, name, stmts...))
+	if err != nil {
+		t.Fatalf("Error opening test database '%s': %v", name, err)
+	}
+	return sdb
+}
+
+// Returns the contents of a test database, for uploading
+func readTestSQLite(t *testing.T, name string, stmts ...string) []byte {
+	data, err := ioutil.ReadFile(newTestSQLite(t, name, stmts...))
+	if err != nil {
+		t.Fatalf("Error reading test database '%s': %v", name, err)
+	}
+	return data
+}
+
+// Returns a user name which hasn't been used before, starting with the given prefix
+func testUserName(prefix string) string {
+	return prefix + randomString(8)
+}
+
+// Adds a user for a test, along with their Minio bucket
+func addTestUser(t *testing.T, userName string) {
+	bucket := randomString(16) + ".bkt"
+	_, err := db.Exec(`
+		INSERT INTO users (username, email, password_hash, client_certificate, minio_bucket)
+		VALUES ($1, $2, $3, '', $4)`, userName, userName+"@example.org", []byte("-"), bucket)
+	if err != nil {
+		t.Fatalf("Error adding test user '%s': %v", userName, err)
+	}
+	err = minioClient.MakeBucket(bucket, "us-east-1")
+	if err != nil {
+		t.Fatalf("Error creating bucket for test user '%s': %v", userName, err)
+	}
+}
+
+// Adds a version of a database for a test, made by running the given statements.  Returns the version number
+func addTestDatabase(t *testing.T, owner string, dbName string, public bool, stmts ...string) int {
+	data := readTestSQLite(t, owner+"-"+dbName, stmts...)
+	version, _, _, err := addDatabaseVersion(owner, dbName, "/", public, data, "", owner)
+	if err != nil {
+		t.Fatalf("Error adding test database '%s/%s': %v", owner, dbName, err)
+	}
+	return version
+}
+
+// Returns a request as made by the given user, carrying the cookie of a new session for them.  When userName is
+// empty the request is anonymous
+func testRequest(method string, target string, body io.Reader, userName string) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	if userName != "" {
+		w := httptest.NewRecorder()
+		session.Add(newSession(userName, time.Now()), w)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+func TestErrorContentTypes(t *testing.T) {
+	tests := []struct {
+		target      string
+		contentType string
+	}{
+		{"/someone/missing.sqlite", contentTypeHTML},
+		{apiPrefix + "databases/someone", contentTypeJSON},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		errorPage(w, httptest.NewRequest(http.MethodGet, tt.target, nil), http.StatusNotFound, "Not found")
+		if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("%s: expected Content-Type '%s', got '%s'", tt.target, tt.contentType, ct)
+		}
+	}
+}
+
+func TestHandlerContentTypes(t *testing.T) {
+	requireBackends(t)
+	owner := testUserName("ctype")
+	addTestUser(t, owner)
+	addTestDatabase(t, owner, "types.sqlite", true, "CREATE TABLE t (a INTEGER, b TEXT)",
+		"INSERT INTO t VALUES (1, 'x')")
+
+	// Downloads pass through this server, rather than going straight to Minio
+	presign := conf.Minio.PresignDownloads
+	conf.Minio.PresignDownloads = false
+	defer func() {
+		conf.Minio.PresignDownloads = presign
+	}()
+
+	// One endpoint for each kind of response
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		target      string
+		contentType string
+	}{
+		{"page", mainHandler, "/" + owner + "/types.sqlite", contentTypeHTML},
+		{"table data", tableViewHandler, "/x/table/" + owner + "/types.sqlite?table=t", contentTypeJSON},
+		{"CSV download", downloadCSVHandler, "/x/downloadcsv/" + owner + "/types.sqlite?table=t", contentTypeCSV},
+		{"database download", downloadHandler, "/x/download/" + owner + "/types.sqlite", contentTypeSQLite},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		logReq(tt.handler)(w, testRequest(http.MethodGet, tt.target, nil, ""))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, http.StatusOK, w.Code, w.Body.String())
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("%s: expected Content-Type '%s', got '%s'", tt.name, tt.contentType, ct)
+		}
+	}
+}
+
+// Returns a multipart upload of a database, for uploadDataHandler().  The part holding the file gets the given
+// headers, as browsers don't all send the same ones
+func testUploadForm(t *testing.T, fileName string, partHeader textproto.MIMEHeader, data []byte) (*bytes.Buffer,
+	string) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("public", "false")
+	partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="database"; filename="%s"`, fileName))
+	part, err := mw.CreatePart(partHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, mw.FormDataContentType()
+}
+
+func TestUploadIgnoresClaimedType(t *testing.T) {
+	requireBackends(t)
+	userName := testUserName("upload")
+	addTestUser(t, userName)
+	data := readTestSQLite(t, "upload.sqlite", "CREATE TABLE t (a INTEGER)")
+
+	// Whether the browser leaves out the type or claims something else, the database is stored as SQLite
+	tests := []struct {
+		dbName string
+		header textproto.MIMEHeader
+	}{
+		{"notype.sqlite", textproto.MIMEHeader{}},
+		{"csvtype.sqlite", textproto.MIMEHeader{"Content-Type": {"text/csv"}}},
+	}
+	for _, tt := range tests {
+		body, formType := testUploadForm(t, tt.dbName, tt.header, data)
+		r := testRequest(http.MethodPost, "/x/uploaddata/", body, userName)
+		r.Header.Set("Content-Type", formType)
+		w := httptest.NewRecorder()
+		logReq(requireLogin(uploadDataHandler))(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.dbName, http.StatusOK, w.Code, w.Body.String())
+			continue
+		}
+
+		var DB sqliteDBinfo
+		if err := checkUserDBAccess(&DB, userName, userName, tt.dbName); err != nil {
+			t.Errorf("%s: uploaded database not found: %v", tt.dbName, err)
+			continue
+		}
+		info, err := minioClient.StatObject(DB.MinioBkt, DB.MinioId)
+		if err != nil {
+			t.Errorf("%s: %v", tt.dbName, err)
+			continue
+		}
+		if info.ContentType != contentTypeSQLite {
+			t.Errorf("%s: stored with type '%s'", tt.dbName, info.ContentType)
+		}
+	}
+}
+
+func TestMissingVersionErrors(t *testing.T) {
+	requireBackends(t)
+	rateLimits, presign := conf.RateLimit.Disabled, conf.Minio.PresignDownloads
+	conf.RateLimit.Disabled, conf.Minio.PresignDownloads = true, false
+	defer func() {
+		conf.RateLimit.Disabled, conf.Minio.PresignDownloads = rateLimits, presign
+	}()
+
+	// A database with a private version between two public ones, and one which is private altogether
+	owner := testUserName("versions")
+	addTestUser(t, owner)
+	stmts := []string{"CREATE TABLE t (a INTEGER)"}
+	for i, public := range []bool{true, false, true} {
+		addTestDatabase(t, owner, "vers.sqlite", public, append(stmts, fmt.Sprintf("INSERT INTO t VALUES (%d)", i))...)
+	}
+	addTestDatabase(t, owner, "private.sqlite", false, stmts...)
+
+	// Each endpoint gets the same status for each case.  Databases nobody else can see look the same as ones which
+	// don't exist, but a private version of a public database is refused
+	endpoints := []struct {
+		name        string
+		handler     http.HandlerFunc
+		target      func(dbName string, version string) string
+		contentType string
+	}{
+		{"download", downloadHandler, func(dbName string, version string) string {
+			return "/x/download/" + owner + "/" + dbName + "/" + version
+		}, contentTypeHTML},
+		{"csv", downloadCSVHandler, func(dbName string, version string) string {
+			return "/x/downloadcsv/" + owner + "/" + dbName + "/t/" + version
+		}, contentTypeHTML},
+		{"table", tableViewHandler, func(dbName string, version string) string {
+			return "/x/table/" + owner + "/" + dbName + "?table=t&version=" + version
+		}, contentTypeJSON},
+		{"visdata", visData, func(dbName string, version string) string {
+			return "/x/visdata/" + owner + "/" + dbName + "?table=t&xcol=a&ycol=a&version=" + version
+		}, contentTypeJSON},
+	}
+	tests := []struct {
+		name    string
+		dbName  string
+		version string
+		user    string
+		status  int
+		err     error
+	}{
+		{"public version", "vers.sqlite", "3", "", http.StatusOK, nil},
+		{"own private version", "vers.sqlite", "2", owner, http.StatusOK, nil},
+		{"missing database", "missing.sqlite", "1", "", http.StatusNotFound, errDatabaseNotFound},
+		{"private database", "private.sqlite", "1", "", http.StatusNotFound, errDatabaseNotFound},
+		{"missing version", "vers.sqlite", "99", "", http.StatusNotFound, errVersionNotFound},
+		{"own missing version", "vers.sqlite", "99", owner, http.StatusNotFound, errVersionNotFound},
+		{"private version", "vers.sqlite", "2", "", http.StatusForbidden, errVersionDenied},
+	}
+	for _, e := range endpoints {
+		for _, tt := range tests {
+			w := httptest.NewRecorder()
+			logReq(e.handler)(w, testRequest(http.MethodGet, e.target(tt.dbName, tt.version), nil, tt.user))
+			if w.Code != tt.status {
+				t.Errorf("%s, %s: expected status %d, got %d: %s", e.name, tt.name, tt.status, w.Code,
+					w.Body.String())
+				continue
+			}
+			if tt.err == nil {
+				continue
+			}
+			if ct := w.Header().Get("Content-Type"); ct != e.contentType {
+				t.Errorf("%s, %s: expected Content-Type '%s', got '%s'", e.name, tt.name, e.contentType, ct)
+			}
+			msg := tt.err.Error()
+			if e.contentType == contentTypeHTML {
+				msg = template.HTMLEscapeString(msg)
+			}
+			if !strings.Contains(w.Body.String(), msg) {
+				t.Errorf("%s, %s: expected the message '%s', got: %s", e.name, tt.name, tt.err, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestDisabledOwnerHidden(t *testing.T) {
+	requireBackends(t)
+	rateLimits, presign := conf.RateLimit.Disabled, conf.Minio.PresignDownloads
+	conf.RateLimit.Disabled, conf.Minio.PresignDownloads = true, false
+	defer func() {
+		conf.RateLimit.Disabled, conf.Minio.PresignDownloads = rateLimits, presign
+	}()
+	owner := testUserName("disabled")
+	addTestUser(t, owner)
+	addTestDatabase(t, owner, "hidden.sqlite", true, "CREATE TABLE t (a INTEGER)", "INSERT INTO t VALUES (1)")
+
+	// Each request is made once before the owner is disabled, so the database details are cached
+	endpoints := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+	}{
+		{"page", func(w http.ResponseWriter, r *http.Request) {
+			databasePage(w, r, owner, "hidden.sqlite", "")
+		}, "/" + owner + "/hidden.sqlite"},
+		{"table", tableViewHandler, "/x/table/" + owner + "/hidden.sqlite?table=t"},
+		{"visdata", visData, "/x/visdata/" + owner + "/hidden.sqlite?table=t&xcol=a&ycol=a"},
+		{"clone", apiHandler, apiPrefix + "clone/" + owner + "/hidden.sqlite"},
+		{"clone file", apiHandler, apiPrefix + "clone/" + owner + "/hidden.sqlite/file?version=1"},
+	}
+	for _, e := range endpoints {
+		w := httptest.NewRecorder()
+		logReq(e.handler)(w, testRequest(http.MethodGet, e.target, nil, ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d before disabling, got %d: %s", e.name, http.StatusOK, w.Code,
+				w.Body.String())
+		}
+	}
+
+	_, err := db.Exec(`UPDATE users SET disabled = true WHERE username = $1`, owner)
+	if err != nil {
+		t.Fatalf("Error disabling test user: %v", err)
+	}
+	cacheUserDisabled(owner, true)
+	for _, e := range endpoints {
+		w := httptest.NewRecorder()
+		logReq(e.handler)(w, testRequest(http.MethodGet, e.target, nil, ""))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d once disabled, got %d: %s", e.name, http.StatusNotFound, w.Code,
+				w.Body.String())
+		}
+	}
+}
+
+func TestStarHandlerAccess(t *testing.T) {
+	requireBackends(t)
+	rateLimits := conf.RateLimit.Disabled
+	conf.RateLimit.Disabled = true
+	defer func() {
+		conf.RateLimit.Disabled = rateLimits
+	}()
+	owner := testUserName("starowner")
+	viewer := testUserName("starviewer")
+	addTestUser(t, owner)
+	addTestUser(t, viewer)
+	addTestDatabase(t, owner, "pub.sqlite", true, "CREATE TABLE t (a INTEGER)")
+	addTestDatabase(t, owner, "priv.sqlite", false, "CREATE TABLE t (a INTEGER)")
+
+	// Private databases can't be starred by other people, and look the same as missing ones
+	tests := []struct {
+		name   string
+		dbName string
+		user   string
+		status int
+	}{
+		{"public", "pub.sqlite", viewer, http.StatusOK},
+		{"anonymous", "pub.sqlite", "", http.StatusUnauthorized},
+		{"private", "priv.sqlite", viewer, http.StatusNotFound},
+		{"own private", "priv.sqlite", owner, http.StatusOK},
+		{"missing", "missing.sqlite", viewer, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		logReq(starHandler)(w, testRequest(http.MethodPost, "/x/star/"+owner+"/"+tt.dbName, nil, tt.user))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.status, w.Code, w.Body.String())
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != contentTypeJSON {
+			t.Errorf("%s: expected Content-Type '%s', got '%s'", tt.name, contentTypeJSON, ct)
+		}
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// The longest merge request title and description accepted, in characters
+const (
+	maxMergeRequestTitle       = 200
+	maxMergeRequestDescription = 5000
+)
+
+// The states a merge request can be in.  Requests start out open, and are closed by the upstream owner accepting or
+// declining them, or by their author withdrawing them.  Closed requests don't change again
+const (
+	mergeOpen      = "open"
+	mergeAccepted  = "accepted"
+	mergeDeclined  = "declined"
+	mergeWithdrawn = "withdrawn"
+)
+
+// The actions which can be taken on an open merge request, and the state each one moves it to
+var mergeActions = map[string]string{
+	"accept":   mergeAccepted,
+	"decline":  mergeDeclined,
+	"withdraw": mergeWithdrawn,
+}
+
+// A request to make a version of a fork the next version of the database it was forked from
+type mergeRequest struct {
+	ID             int64
+	Title          string
+	Description    string
+	Author         string
+	SourceOwner    string
+	SourceDatabase string
+	SourceVersion  int
+	State          string
+	Created        time.Time
+	Closed         time.Time
+	ClosedBy       string
+	CloseComment   string
+	MergedVersion  int // The upstream version the request became, once accepted
+}
+
+// Something which happened to a merge request, for the notifiers
+type mergeRequestEvent struct {
+	Owner    string // The upstream database
+	Database string
+	Request  mergeRequest
+	Action   string // "open", or one of the keys of mergeActions
+	Actor    string
+}
+
+// Functions called whenever a merge request is opened or closed.  There's no way of sending notifications to people
+// yet, so only the log is told.  Whatever does that later can be added here, and gets called after the change has
+// been committed
+var mergeRequestNotifiers = []func(mergeRequestEvent){logMergeRequestEvent}
+
+// The notifier which writes merge request events to the log
+func logMergeRequestEvent(e mergeRequestEvent) {
+	log.Printf("Merge request %d on '%s/%s' from '%s/%s' version %d: %s by '%s'\n", e.Request.ID, e.Owner,
+		e.Database, e.Request.SourceOwner, e.Request.SourceDatabase, e.Request.SourceVersion, e.Action, e.Actor)
+}
+
+// Tells the notifiers about a merge request event
+func notifyMergeRequest(e mergeRequestEvent) {
+	for _, notify := range mergeRequestNotifiers {
+		notify(e)
+	}
+}
+
+// Returns the URL of a database's merge requests, or of one of them when an id is given
+func mergeRequestURL(owner string, dbName string, id int64) string {
+	u := "/merge/" + url.PathEscape(owner) + "/" + url.PathEscape(dbName)
+	if id != 0 {
+		u += "?id=" + strconv.FormatInt(id, 10)
+	}
+	return u
+}
+
+// The columns read into a mergeRequest by scanMergeRequest(), with the merge_requests table as "mr" and the
+// database the request came from as "src"
+const mergeRequestColumns = `mr.id, mr.title, mr.description, mr.author, src.username, src.dbname, mr.source_version,
+	mr.state, mr.date_created, coalesce(mr.date_closed, mr.date_created), coalesce(mr.closed_by, ''),
+	coalesce(mr.close_comment, ''), coalesce(mr.merged_version, 0)`
+
+// Reads a merge request from a row selected with mergeRequestColumns
+func scanMergeRequest(row interface {
+	Scan(dest ...interface{}) error
+}) (mr mergeRequest, err error) {
+	err = row.Scan(&mr.ID, &mr.Title, &mr.Description, &mr.Author, &mr.SourceOwner, &mr.SourceDatabase,
+		&mr.SourceVersion, &mr.State, &mr.Created, &mr.Closed, &mr.ClosedBy, &mr.CloseComment, &mr.MergedVersion)
+	return
+}
+
+// Returns the merge requests of a database, open ones first and then the most recent.  With openOnly set, closed
+// requests are left out
+func getMergeRequests(owner string, dbName string, openOnly bool) ([]mergeRequest, error) {
+	dbQuery := `
+		SELECT ` + mergeRequestColumns + `
+		FROM merge_requests AS mr, sqlite_databases AS src, sqlite_databases AS db
+		WHERE mr.source_db = src.idnum
+			AND mr.db = db.idnum
+			AND db.username = $1
+			AND db.dbname = $2`
+	if openOnly {
+		dbQuery += `
+			AND mr.state = 'open'`
+	}
+	dbQuery += `
+		ORDER BY mr.state = 'open' DESC, mr.date_created DESC, mr.id DESC`
+	rows, err := db.Query(dbQuery, owner, dbName)
+	if err != nil {
+		log.Printf("Error retrieving merge requests of '%s/%s': %v\n", owner, dbName, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var list []mergeRequest
+	for rows.Next() {
+		mr, err := scanMergeRequest(rows)
+		if err != nil {
+			log.Printf("Error retrieving merge requests of '%s/%s': %v\n", owner, dbName, err)
+			return nil, err
+		}
+		list = append(list, mr)
+	}
+	return list, rows.Err()
+}
+
+// Returns the owner and name of the database a fork was made from.  ok is false when the database isn't a fork, or
+// the upstream database is gone
+func forkUpstream(owner string, dbName string) (upOwner string, upName string, ok bool) {
+	err := db.QueryRow(`
+		SELECT up.username, up.dbname
+		FROM sqlite_databases AS fork, sqlite_databases AS up
+		WHERE fork.username = $1
+			AND fork.dbname = $2
+			AND up.idnum = fork.forked_from`, owner, dbName).Scan(&upOwner, &upName)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("Error looking up where '%s/%s' was forked from: %v\n", owner, dbName, err)
+		}
+		return "", "", false
+	}
+	return upOwner, upName, true
+}
+
+// Recounts the open merge requests of a database from the request rows, as part of a transaction changing them
+func recountMergeRequests(tx *pgx.Tx, dbId int) error {
+	_, err := tx.Exec(`
+		UPDATE sqlite_databases
+		SET pull_requests = (
+			SELECT count(*)
+			FROM merge_requests
+			WHERE db = $1
+				AND state = 'open'
+		) WHERE idnum = $1`, dbId)
+	return err
+}
+
+// Shows the merge requests of a database, or one of them when asked for by id.  Open requests are shown with the
+// differences between the latest upstream version and the proposed one.  They're only shown to people who can see
+// the database
+func mergeRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Merge requests page"
+
+	userName, dbName, err := getUD(1, r) // 1 = Ignore "/merge/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	loggedInUser := currentUser(r)
+
+	var pageData struct {
+		Meta      metaInfo
+		Requests  []mergeRequest
+		Request   mergeRequest
+		Diff      dbDiff
+		DiffError string // Why the differences couldn't be shown, if they couldn't
+		Upstream  bool   // Whether the person looking owns the upstream database
+	}
+	pageData.Meta.Title = "Merge requests - " + userName + "/" + dbName
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+	pageData.Meta.LoggedInUser = loggedInUser
+	setUserTimePrefs(&pageData.Meta, loggedInUser)
+	pageData.Upstream = loggedInUser == userName
+
+	var dbInfo sqliteDBinfo
+	err = checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+	if !dbInfo.Info.Public {
+		noIndex(w)
+	}
+
+	// The list of requests
+	if r.FormValue("id") == "" {
+		pageData.Requests, err = getMergeRequests(userName, dbName, false)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		renderTemplate(w, "mergeRequestsPage", pageData)
+		return
+	}
+
+	// A single request
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid merge request id")
+		return
+	}
+	pageData.Request, err = scanMergeRequest(db.QueryRow(`
+		SELECT `+mergeRequestColumns+`
+		FROM merge_requests AS mr, sqlite_databases AS src, sqlite_databases AS db
+		WHERE mr.id = $1
+			AND mr.source_db = src.idnum
+			AND mr.db = db.idnum
+			AND db.username = $2
+			AND db.dbname = $3`, id, userName, dbName))
+	if err == pgx.ErrNoRows {
+		errorPage(w, r, http.StatusNotFound, "That merge request doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving merge request %d of '%s/%s': %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.Meta.Title = pageData.Request.Title + " - " + userName + "/" + dbName
+
+	// Open requests are compared with the latest upstream version, as that's what accepting them would replace.
+	// Closed requests aren't compared, as the upstream has usually moved on since
+	if pageData.Request.State == mergeOpen {
+		ctx := r.Context()
+		mr := pageData.Request
+		fromObj := versionObject{Owner: userName, Database: dbName, Bucket: dbInfo.MinioBkt,
+			MinioId: dbInfo.MinioId}
+		toObj, err := getVersionObject(ctx, loggedInUser, mr.SourceOwner, mr.SourceDatabase,
+			int64(mr.SourceVersion))
+		if clientGone(ctx, pageName) {
+			return
+		}
+		if err != nil {
+			pageData.DiffError = "The proposed version isn't available any more"
+			renderTemplate(w, "mergeRequestPage", pageData)
+			return
+		}
+		from := int64(dbInfo.Info.Version)
+		tempArr := md5.Sum([]byte(fmt.Sprintf("%s/%s/%d/%s/%s/%d", userName, dbName, from, mr.SourceOwner,
+			mr.SourceDatabase, mr.SourceVersion)))
+		cacheKey := "mergediff-" + hex.EncodeToString(tempArr[:])
+		ok, err := getCachedData(cacheKey, &pageData.Diff)
+		if err != nil {
+			log.Printf("%s: Error retrieving diff from cache: %v\n", pageName, err)
+		}
+		if !ok {
+			pageData.Diff, err = diffDatabases(ctx, from, int64(mr.SourceVersion), fromObj, toObj)
+			if clientGone(ctx, pageName) {
+				return
+			}
+			if err == errTooManyOpenDBs {
+				serverBusy(w, r)
+				return
+			}
+			if err != nil {
+				log.Printf("%s: Error comparing merge request %d with '%s/%s': %v\n", pageName, id, userName,
+					dbName, err)
+				pageData.DiffError = "The differences couldn't be worked out"
+			} else if !pageData.Diff.Incomplete {
+				err = cacheData(cacheKey, pageData.Diff, cacheTime)
+				if err != nil {
+					log.Printf("%s: Error when caching diff: %v\n", pageName, err)
+				}
+			}
+		}
+	}
+	renderTemplate(w, "mergeRequestPage", pageData)
+}
+
+// Opens a merge request from a fork to the database it was forked from.  GET shows the form for it, and POST opens
+// it.  Only the owner of the fork can do this, and only for a public version, so the upstream owner can see it
+func mergeNewHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "New merge request handler"
+
+	forkOwner, forkName, err := getUD(2, r) // 2 = Ignore "/x/mergenew/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	loggedInUser := currentUser(r)
+	if loggedInUser != forkOwner {
+		errorPage(w, r, http.StatusForbidden, "Only the owner of a fork can propose merging it")
+		return
+	}
+	upOwner, upName, ok := forkUpstream(forkOwner, forkName)
+	if !ok {
+		errorPage(w, r, http.StatusBadRequest, "This database isn't a fork of one which is still here")
+		return
+	}
+	var upInfo sqliteDBinfo
+	err = checkUserDBAccess(&upInfo, loggedInUser, upOwner, upName)
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+	var forkInfo sqliteDBinfo
+	err = checkUserDBAccess(&forkInfo, loggedInUser, forkOwner, forkName)
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		var pageData struct {
+			Meta     metaInfo
+			Upstream string
+			Latest   int
+		}
+		pageData.Meta.Title = "Propose a merge - " + forkOwner + "/" + forkName
+		pageData.Meta.Username = forkOwner
+		pageData.Meta.Database = forkName
+		pageData.Meta.LoggedInUser = loggedInUser
+		pageData.Upstream = upOwner + "/" + upName
+		pageData.Latest = forkInfo.Info.Version
+		noIndex(w)
+		renderTemplate(w, "mergeNewPage", pageData)
+		return
+	}
+
+	// Check what's being proposed
+	version, err := strconv.Atoi(r.PostFormValue("version"))
+	if err != nil || version < 1 {
+		errorPage(w, r, http.StatusBadRequest, "Invalid version number")
+		return
+	}
+	title := strings.TrimSpace(r.PostFormValue("title"))
+	if title == "" {
+		errorPage(w, r, http.StatusBadRequest, "The merge request needs a title")
+		return
+	}
+	if len([]rune(title)) > maxMergeRequestTitle {
+		errorPage(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Merge request titles can't be longer than %d characters", maxMergeRequestTitle))
+		return
+	}
+	desc := strings.TrimSpace(r.PostFormValue("description"))
+	if len([]rune(desc)) > maxMergeRequestDescription {
+		errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("Merge request descriptions can't be longer than %d "+
+			"characters", maxMergeRequestDescription))
+		return
+	}
+
+	// Checking as nobody in particular means only public versions are found
+	_, err = getVersionObject(r.Context(), "", forkOwner, forkName, int64(version))
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("Version %d isn't a public version of this database, "+
+			"so the owner of %s/%s wouldn't be able to see it", version, upOwner, upName))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	var upId, forkId int
+	err = tx.QueryRow(`
+		SELECT up.idnum, fork.idnum
+		FROM sqlite_databases AS fork, sqlite_databases AS up
+		WHERE fork.username = $1
+			AND fork.dbname = $2
+			AND up.idnum = fork.forked_from
+		FOR UPDATE OF up`, forkOwner, forkName).Scan(&upId, &forkId)
+	if err != nil {
+		log.Printf("%s: Error looking up '%s/%s' and its upstream: %v\n", pageName, forkOwner, forkName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// There's no point having the same version proposed more than once at the same time
+	var existing int64
+	err = tx.QueryRow(`
+		SELECT id
+		FROM merge_requests
+		WHERE db = $1
+			AND source_db = $2
+			AND source_version = $3
+			AND state = 'open'`, upId, forkId, version).Scan(&existing)
+	if err == nil {
+		http.Redirect(w, r, mergeRequestURL(upOwner, upName, existing), http.StatusSeeOther)
+		return
+	}
+	if err != pgx.ErrNoRows {
+		log.Printf("%s: Error checking for open merge requests: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	mr := mergeRequest{Title: title, Description: desc, Author: loggedInUser, SourceOwner: forkOwner,
+		SourceDatabase: forkName, SourceVersion: version, State: mergeOpen}
+	err = tx.QueryRow(`
+		INSERT INTO merge_requests (db, source_db, source_version, title, description, author, state)
+		VALUES ($1, $2, $3, $4, $5, $6, 'open')
+		RETURNING id, date_created`, upId, forkId, version, title, desc, loggedInUser).Scan(&mr.ID, &mr.Created)
+	if err == nil {
+		err = recountMergeRequests(tx, upId)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("%s: Error opening merge request from '%s/%s' to '%s/%s': %v\n", pageName, forkOwner,
+			forkName, upOwner, upName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	notifyMergeRequest(mergeRequestEvent{Owner: upOwner, Database: upName, Request: mr, Action: "open",
+		Actor: loggedInUser})
+	http.Redirect(w, r, mergeRequestURL(upOwner, upName, mr.ID), http.StatusSeeOther)
+}
+
+// Accepts, declines, or withdraws an open merge request.  The owner of the upstream database can accept or decline
+// it, with an optional comment, and its author can withdraw it.  Accepting stores the proposed version as the next
+// version of the upstream database, with a commit message saying where it came from
+func mergeActionHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Merge request action handler"
+
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Merge requests need to be changed with POST")
+		return
+	}
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/mergeaction/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	loggedInUser := currentUser(r)
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid merge request id")
+		return
+	}
+	action := r.PostFormValue("action")
+	newState, ok := mergeActions[action]
+	if !ok {
+		errorPage(w, r, http.StatusBadRequest, "Unknown merge request action")
+		return
+	}
+	comment := strings.TrimSpace(r.PostFormValue("comment"))
+	if len([]rune(comment)) > maxCommentLength {
+		errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("Comments can't be longer than %d characters",
+			maxCommentLength))
+		return
+	}
+
+	// The request stays locked until it's been closed, so it can't be accepted twice
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("%s: Error starting transaction: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer tx.Rollback()
+	var dbId int
+	var srcBucket string
+	var srcMinioId pgx.NullString
+	mr, err := scanMergeRequest(tx.QueryRow(`
+		SELECT `+mergeRequestColumns+`
+		FROM merge_requests AS mr, sqlite_databases AS src, sqlite_databases AS db
+		WHERE mr.id = $1
+			AND mr.source_db = src.idnum
+			AND mr.db = db.idnum
+			AND db.username = $2
+			AND db.dbname = $3
+		FOR UPDATE OF mr`, id, userName, dbName))
+	if err == pgx.ErrNoRows {
+		errorPage(w, r, http.StatusNotFound, "That merge request doesn't exist")
+		return
+	}
+	if err == nil {
+		err = tx.QueryRow(`
+			SELECT mr.db, src.minio_bucket, (
+				SELECT ver.minioid
+				FROM database_versions AS ver
+				WHERE ver.db = src.idnum
+					AND ver.version = mr.source_version
+					AND ver.public = true)
+			FROM merge_requests AS mr, sqlite_databases AS src
+			WHERE mr.id = $1
+				AND src.idnum = mr.source_db`, id).Scan(&dbId, &srcBucket, &srcMinioId)
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving merge request %d of '%s/%s': %v\n", pageName, id, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if action == "withdraw" && loggedInUser != mr.Author {
+		errorPage(w, r, http.StatusForbidden, "Only the author of a merge request can withdraw it")
+		return
+	}
+	if action != "withdraw" && loggedInUser != userName {
+		errorPage(w, r, http.StatusForbidden, "Only the owner of the database can accept or decline merge requests")
+		return
+	}
+	if mr.State != mergeOpen {
+		errorPage(w, r, http.StatusConflict, fmt.Sprintf("This merge request has already been %s", mr.State))
+		return
+	}
+
+	// Accepting copies the proposed version into the upstream database as its next version, the same way an
+	// edit does, with the same visibility as the current latest version.  It's credited to the request's author
+	// rather than the owner accepting it
+	var newVersion int
+	if action == "accept" {
+		if !srcMinioId.Valid {
+			errorPage(w, r, http.StatusConflict, "The proposed version isn't available any more")
+			return
+		}
+		var dbInfo sqliteDBinfo
+		err = checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+		if err != nil {
+			errorPage(w, r, versionErrorStatus(err), err.Error())
+			return
+		}
+		ctx := r.Context()
+		tempFile, err := copyMinioObjectToTemp(ctx, srcBucket, srcMinioId.String)
+		if clientGone(ctx, pageName) {
+			if tempFile != "" {
+				os.Remove(tempFile)
+			}
+			return
+		}
+		if err != nil {
+			log.Printf("%s: Error copying '%s/%s' version %d: %v\n", pageName, mr.SourceOwner, mr.SourceDatabase,
+				mr.SourceVersion, err)
+			errorPage(w, r, http.StatusInternalServerError, "Error retrieving the proposed version")
+			return
+		}
+		defer os.Remove(tempFile)
+		dbData, err := ioutil.ReadFile(tempFile)
+		if err != nil {
+			log.Printf("%s: Error reading proposed version: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		commitMsg := fmt.Sprintf("Merged version %d of %s/%s by %s (merge request #%d: %s)", mr.SourceVersion,
+			mr.SourceOwner, mr.SourceDatabase, mr.Author, mr.ID, mr.Title)
+		var dbSize int64
+		var minioId string
+		newVersion, dbSize, minioId, err = addDatabaseVersion(userName, dbName, "/", dbInfo.Info.Public, dbData,
+			commitMsg, mr.Author)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		recordVersionMeta(tempFile, userName, dbName, newVersion)
+		log.Printf("%s: Username: %v, database '%v' version %d merged from '%s/%s' stored as '%v', bytes: %v\n",
+			pageName, userName, dbName, newVersion, mr.SourceOwner, mr.SourceDatabase, minioId, dbSize)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE merge_requests
+		SET state = $2, date_closed = now(), closed_by = $3, close_comment = $4, merged_version = $5
+		WHERE id = $1`, id, newState, loggedInUser, pgx.NullString{String: comment, Valid: comment != ""},
+		pgx.NullInt32{Int32: int32(newVersion), Valid: newVersion != 0})
+	if err == nil {
+		err = recountMergeRequests(tx, dbId)
+	}
+	if err == nil && action != "withdraw" {
+		err = auditLog(tx, r, loggedInUser, action+" merge request", auditTargetDatabase, userName+"/"+dbName,
+			map[string]interface{}{"merge_request": id, "source": mr.SourceOwner + "/" + mr.SourceDatabase,
+				"source_version": mr.SourceVersion, "author": mr.Author, "version": newVersion})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("%s: Error closing merge request %d of '%s/%s': %v\n", pageName, id, userName, dbName, err)
+		if newVersion != 0 {
+			log.Printf("%s: Version %d of '%s/%s' was added for merge request %d, which is still open\n",
+				pageName, newVersion, userName, dbName, id)
+		}
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	mr.State = newState
+	mr.ClosedBy = loggedInUser
+	mr.CloseComment = comment
+	mr.MergedVersion = newVersion
+	notifyMergeRequest(mergeRequestEvent{Owner: userName, Database: dbName, Request: mr, Action: action,
+		Actor: loggedInUser})
+	http.Redirect(w, r, mergeRequestURL(userName, dbName, id), http.StatusSeeOther)
+}
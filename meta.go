@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// A version of a database, as described by the metadata API
+type metaVersion struct {
+	Version     int       `json:"version"`
+	SHA256      string    `json:"sha256"`
+	Size        int       `json:"size"`
+	Date        time.Time `json:"date"`
+	Public      bool      `json:"public"`
+	DownloadURL string    `json:"download_url"`
+}
+
+// A table of a database, as described by the metadata API
+type metaTable struct {
+	Name     string `json:"name"`
+	Rows     int    `json:"rows"`
+	Approx   bool   `json:"approx,omitempty"`
+	Unknown  bool   `json:"unknown,omitempty"`
+	Module   string `json:"module,omitempty"`
+	Internal bool   `json:"internal,omitempty"`
+}
+
+// The description of a database returned by the metadata API, for tools which want everything in one call
+type metaDocument struct {
+	Owner         string        `json:"owner"`
+	Database      string        `json:"database"`
+	Description   string        `json:"description"`
+	Licence       licenceInfo   `json:"licence"`
+	Stars         int           `json:"stars"`
+	Public        bool          `json:"public"`
+	LatestVersion int           `json:"latest_version"`
+	DefaultTable  string        `json:"default_table"`
+	WebURL        string        `json:"web_url"`
+	DownloadURL   string        `json:"download_url"`
+	Versions      []metaVersion `json:"versions"`
+	Tables        []metaTable   `json:"tables"`
+	Facts         dbFacts       `json:"facts"` // How the file of the latest version was made
+}
+
+// Returns the absolute URL of a path on this server
+func siteURL(path string) string {
+	scheme := "https"
+	if conf.Web.Dev {
+		scheme = "http"
+	}
+	return scheme + "://" + conf.Web.Server + path
+}
+
+// Describes a database: its versions, the tables of the latest version with their row counts, its licence and so
+// on.  Other people only see the public versions.  The response has an ETag, so clients polling for new versions
+// can do it with If-None-Match and mostly get 304s back
+func apiMetaHandler(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	pageName := "Metadata API"
+	owner, dbName := params["owner"], params["db"]
+	loggedInUser := currentUser(r)
+
+	// Check the user can see the database.  This gives the latest version they can see
+	ctx := r.Context()
+	var dbInfo sqliteDBinfo
+	err := checkUserDBAccessCtx(ctx, &dbInfo, loggedInUser, owner, dbName)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		jsonError(w, versionErrorStatus(err), err.Error())
+		return
+	}
+
+	doc := metaDocument{Owner: owner, Database: dbName, Description: dbInfo.Info.Description,
+		Stars: dbInfo.Info.Stars, LatestVersion: dbInfo.Info.Version,
+		WebURL: siteURL("/" + url.PathEscape(owner) + "/" + url.PathEscape(dbName)),
+		DownloadURL: siteURL(fmt.Sprintf("/x/download/%s/%s?version=%d", url.PathEscape(owner),
+			url.PathEscape(dbName), dbInfo.Info.Version)),
+		Versions: []metaVersion{}, Tables: []metaTable{}}
+
+	// The licence, and the versions the user can see
+	qctx, cancel := queryContext(ctx)
+	defer cancel()
+	var licence pgx.NullString
+	err = db.QueryRowEx(qctx, `
+		SELECT licence
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2`, nil, owner, dbName).Scan(&licence)
+	if err != nil {
+		log.Printf("%s: Error retrieving licence of '%s/%s': %v\n", pageName, owner, dbName, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	doc.Licence = licenceInfo{ID: licence.String}
+	for _, l := range dbLicences {
+		if l.ID == licence.String {
+			doc.Licence = l
+		}
+	}
+	rows, err := db.QueryEx(qctx, `
+		SELECT ver.version, ver.sha256, ver.size, ver.last_modified, ver.public
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND db.idnum = ver.db
+			AND (ver.public = true OR db.username = $3)
+		ORDER BY ver.version DESC`, nil, owner, dbName, loggedInUser)
+	if err != nil {
+		log.Printf("%s: Error retrieving versions of '%s/%s': %v\n", pageName, owner, dbName, err)
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	for rows.Next() {
+		var v metaVersion
+		err = rows.Scan(&v.Version, &v.SHA256, &v.Size, &v.Date, &v.Public)
+		if err != nil {
+			rows.Close()
+			log.Printf("%s: Error retrieving versions of '%s/%s': %v\n", pageName, owner, dbName, err)
+			jsonError(w, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		v.DownloadURL = siteURL(fmt.Sprintf("/x/download/%s/%s?version=%d", url.PathEscape(owner),
+			url.PathEscape(dbName), v.Version))
+		doc.Versions = append(doc.Versions, v)
+	}
+	rows.Close()
+	for _, v := range doc.Versions {
+		if v.Version == doc.LatestVersion {
+			doc.Public = v.Public
+		}
+	}
+
+	// The tables of the latest version, and the facts about its file
+	doc.Facts = getVersionFacts(ctx, owner, dbName, dbInfo)
+	tables, ok := getTableSummary(w, r, pageName, owner, dbName, dbInfo)
+	if !ok {
+		return
+	}
+	defaultTable := getDefaultTable(owner, dbName)
+	for _, t := range tables {
+		doc.Tables = append(doc.Tables, metaTable{Name: t.Name, Rows: t.Rows, Approx: t.Approx, Unknown: t.Unknown,
+			Module: t.Module, Internal: t.Internal})
+		if t.Name == defaultTable {
+			doc.DefaultTable = defaultTable
+		}
+	}
+
+	// The ETag covers the whole document rather than just the latest version, so a new star or licence shows up
+	// as a change too.  Working it out is cheap, as the table summary comes from the cache once it's been made
+	jsonResponse, err := json.Marshal(doc)
+	if err != nil {
+		log.Printf("%s: Error encoding metadata: %v\n", pageName, err)
+		jsonError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	tempArr := md5.Sum(jsonResponse)
+	etag := `"` + hex.EncodeToString(tempArr[:]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	jsonOK(w, jsonResponse)
+}
+
+// Returns the tables of a database version with the number of rows in each.  They're recorded when the version is
+// uploaded, so the database only needs opening for versions from before then.  Those summaries never change either,
+// so once every table has an exact count it's cached.  If something goes wrong, the problem has already been dealt
+// with when false is returned
+func getTableSummary(w http.ResponseWriter, r *http.Request, pageName string, owner string, dbName string,
+	dbInfo sqliteDBinfo) ([]tableRowCount, bool) {
+	if meta, ok := getVersionMeta(owner, dbName, dbInfo.Info.Version); ok {
+		return meta.Tables, true
+	}
+	tempArr := md5.Sum([]byte(fmt.Sprintf("%s/%s/%d", owner, dbName, dbInfo.Info.Version)))
+	cacheKey := "tablesummary-" + hex.EncodeToString(tempArr[:])
+	var summary []tableRowCount
+	ok, err := getCachedData(cacheKey, &summary)
+	if err != nil {
+		log.Printf("%s: Error retrieving table summary from cache: %v\n", pageName, err)
+	}
+	if ok {
+		return summary, true
+	}
+
+	// Get a handle from Minio for the database object
+	ctx := r.Context()
+	sdb, err := openMinioObjectCtx(ctx, dbInfo.MinioBkt, dbInfo.MinioId)
+	if clientGone(ctx, pageName) {
+		return nil, false
+	}
+	if err == errTooManyOpenDBs {
+		serverBusy(w, r)
+		return nil, false
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	defer closeMinioObject(sdb)
+	tables, err := sdb.Tables("")
+	if err != nil {
+		log.Printf("%s: Error retrieving table names of '%s/%s': %v\n", pageName, owner, dbName, err)
+		jsonError(w, http.StatusInternalServerError, "Error reading from the database")
+		return nil, false
+	}
+
+	// The row counts are cached individually too, so this is only slow for versions nobody has looked at yet
+	sctx, cancel := sqliteContext(ctx)
+	defer cancel()
+	summary, err = getTableRowCounts(sctx, sdb, owner, dbName, dbInfo.Info.Version, tables, readVirtualTables(sdb),
+		dbInfo.MinioBkt, dbInfo.MinioId)
+	if clientGone(ctx, pageName) {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("%s: Error counting table rows of '%s/%s': %v\n", pageName, owner, dbName, err)
+		jsonError(w, http.StatusInternalServerError, "Error reading from the database")
+		return nil, false
+	}
+
+	// Approximate counts are still being worked out, so the summary is left uncached until they're done.  So are
+	// summaries where counting ran out of time, as those tables are marked unknown only for now
+	if sctx.Err() != nil {
+		return summary, true
+	}
+	for _, t := range summary {
+		if t.Approx {
+			return summary, true
+		}
+	}
+	err = cacheData(cacheKey, summary, rowCountCacheTime)
+	if err != nil {
+		log.Printf("%s: Error when caching table summary: %v\n", pageName, err)
+	}
+	return summary, true
+}
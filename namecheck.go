@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Names which work in SQLite but are awkward to use, along with other parts of a schema which make a table harder to
+// work with on the site, are pointed out when a database is uploaded.  They're only warnings, as the database is
+// still stored as it is
+
+// The kinds of problem found with a table or column
+const (
+	nameNeedsQuoting  = "quoting"    // The name has to be quoted to be used in SQL
+	nameUntypedColumn = "untyped"    // The column has no declared type
+	nameNoPrimaryKey  = "primarykey" // The table has no primary key
+)
+
+// The words SQLite reserves for its SQL syntax, which need quoting to be used as names.  From
+// https://sqlite.org/lang_keywords.html
+var sqliteKeywords = map[string]bool{
+	"ABORT": true, "ACTION": true, "ADD": true, "AFTER": true, "ALL": true, "ALTER": true, "ALWAYS": true,
+	"ANALYZE": true, "AND": true, "AS": true, "ASC": true, "ATTACH": true, "AUTOINCREMENT": true, "BEFORE": true,
+	"BEGIN": true, "BETWEEN": true, "BY": true, "CASCADE": true, "CASE": true, "CAST": true, "CHECK": true,
+	"COLLATE": true, "COLUMN": true, "COMMIT": true, "CONFLICT": true, "CONSTRAINT": true, "CREATE": true,
+	"CROSS": true, "CURRENT": true, "CURRENT_DATE": true, "CURRENT_TIME": true, "CURRENT_TIMESTAMP": true,
+	"DATABASE": true, "DEFAULT": true, "DEFERRABLE": true, "DEFERRED": true, "DELETE": true, "DESC": true,
+	"DETACH": true, "DISTINCT": true, "DO": true, "DROP": true, "EACH": true, "ELSE": true, "END": true,
+	"ESCAPE": true, "EXCEPT": true, "EXCLUDE": true, "EXCLUSIVE": true, "EXISTS": true, "EXPLAIN": true,
+	"FAIL": true, "FILTER": true, "FIRST": true, "FOLLOWING": true, "FOR": true, "FOREIGN": true, "FROM": true,
+	"FULL": true, "GENERATED": true, "GLOB": true, "GROUP": true, "GROUPS": true, "HAVING": true, "IF": true,
+	"IGNORE": true, "IMMEDIATE": true, "IN": true, "INDEX": true, "INDEXED": true, "INITIALLY": true,
+	"INNER": true, "INSERT": true, "INSTEAD": true, "INTERSECT": true, "INTO": true, "IS": true, "ISNULL": true,
+	"JOIN": true, "KEY": true, "LAST": true, "LEFT": true, "LIKE": true, "LIMIT": true, "MATCH": true,
+	"MATERIALIZED": true, "NATURAL": true, "NO": true, "NOT": true, "NOTHING": true, "NOTNULL": true,
+	"NULL": true, "NULLS": true, "OF": true, "OFFSET": true, "ON": true, "OR": true, "ORDER": true,
+	"OTHERS": true, "OUTER": true, "OVER": true, "PARTITION": true, "PLAN": true, "PRAGMA": true,
+	"PRECEDING": true, "PRIMARY": true, "QUERY": true, "RAISE": true, "RANGE": true, "RECURSIVE": true,
+	"REFERENCES": true, "REGEXP": true, "REINDEX": true, "RELEASE": true, "RENAME": true, "REPLACE": true,
+	"RESTRICT": true, "RETURNING": true, "RIGHT": true, "ROLLBACK": true, "ROW": true, "ROWS": true,
+	"SAVEPOINT": true, "SELECT": true, "SET": true, "TABLE": true, "TEMP": true, "TEMPORARY": true,
+	"THEN": true, "TIES": true, "TO": true, "TRANSACTION": true, "TRIGGER": true, "UNBOUNDED": true,
+	"UNION": true, "UNIQUE": true, "UPDATE": true, "USING": true, "VACUUM": true, "VALUES": true, "VIEW": true,
+	"VIRTUAL": true, "WHEN": true, "WHERE": true, "WINDOW": true, "WITH": true, "WITHOUT": true,
+}
+
+// A problem found with the name of a table or column, or with the table itself.  Column is empty for problems with
+// a table
+type nameWarning struct {
+	Kind   string
+	Table  string
+	Column string
+	Reason string `json:",omitempty"` // Why the name needs quoting
+}
+
+// Describes the problem for showing to the owner of the database
+func (n nameWarning) Message() string {
+	what := fmt.Sprintf("Table %s", quoteIdentifier(n.Table))
+	if n.Column != "" {
+		what = fmt.Sprintf("Column %s of table %s", quoteIdentifier(n.Column), quoteIdentifier(n.Table))
+	}
+	switch n.Kind {
+	case nameNeedsQuoting:
+		return fmt.Sprintf("%s needs quoting in SQL, as %s", what, n.Reason)
+	case nameUntypedColumn:
+		return fmt.Sprintf("%s has no declared type, so its values aren't converted to any type", what)
+	case nameNoPrimaryKey:
+		return fmt.Sprintf("%s has no primary key, so edits find its rows by rowid, which can change when the "+
+			"database is vacuumed", what)
+	}
+	return what
+}
+
+// Returns why a name needs quoting to be used in SQL, or an empty string if it can be used as it is
+func nameQuotingReason(name string) string {
+	if name == "" {
+		return "it's empty"
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		return "it starts with a digit"
+	}
+	if strings.ContainsAny(name, "\"'`[]") {
+		return "it contains quote characters"
+	}
+	for _, c := range name {
+		// SQLite allows any character outside of ASCII in names
+		if c != '_' && c < 0x80 && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			return "it contains spaces or punctuation"
+		}
+	}
+	if sqliteKeywords[strings.ToUpper(name)] {
+		return "it's an SQLite keyword"
+	}
+	return ""
+}
+
+// Looks through the tables of a database for names and definitions which will be awkward to use.  Virtual tables and
+// SQLite's own tables are left out, as their definitions aren't up to the owner
+func checkNames(sdb *sqlite.Conn, tables []string, vt vtableInfo) (warnings []nameWarning) {
+	for _, t := range tables {
+		if vt.Modules[t] != "" || vt.IsInternal(t) || strings.HasPrefix(strings.ToLower(t), "sqlite_") {
+			continue
+		}
+		if reason := nameQuotingReason(t); reason != "" {
+			warnings = append(warnings, nameWarning{Kind: nameNeedsQuoting, Table: t, Reason: reason})
+		}
+		cols, err := tableColumns(sdb, t)
+		if err != nil {
+			log.Printf("Error retrieving columns of table '%s' when checking names: %v\n", t, err)
+			continue
+		}
+		hasPk := false
+		for _, c := range cols {
+			if reason := nameQuotingReason(c.Name); reason != "" {
+				warnings = append(warnings, nameWarning{Kind: nameNeedsQuoting, Table: t, Column: c.Name,
+					Reason: reason})
+			}
+			if strings.TrimSpace(c.DataType) == "" {
+				warnings = append(warnings, nameWarning{Kind: nameUntypedColumn, Table: t, Column: c.Name})
+			}
+			if c.Pk > 0 {
+				hasPk = true
+			}
+		}
+		if !hasPk {
+			warnings = append(warnings, nameWarning{Kind: nameNoPrimaryKey, Table: t})
+		}
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
@@ -11,7 +12,6 @@ import (
 	"strings"
 	"time"
 
-	sqlite "github.com/gwenn/gosqlite"
 	"github.com/icza/session"
 	"github.com/jackc/pgx"
 )
@@ -20,35 +20,126 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 	pageName := "Render database page"
 
 	var pageData struct {
-		Meta metaInfo
-		DB   sqliteDBinfo
-		Data sqliteRecordSet
-	}
-
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
-		pageData.Meta.LoggedInUser = loggedInUser
+		Meta          metaInfo
+		DB            sqliteDBinfo
+		Data          sqliteRecordSet
+		Starred       bool           // Whether the logged in user has starred the database
+		DefaultTable  string         // The table the owner chose to have shown first, if any
+		MergeRequests []mergeRequest // The open merge requests, only filled in for the owner
+		Upstream      string         // The database this one was forked from, only filled in for the owner
+		CloneURL      string         // The dbhub:// URL desktop clients can open the database with
+		NameWarnings  []nameWarning  // Awkward names found when the version was uploaded, only filled in for the owner
+		Facts         dbFacts        // How the database file was made
+		ShowAll       bool           // Whether every row was asked for, rather than those left by the default filter
+	}
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+	pageData.Meta.LoggedInUser = loggedInUser
+
+	// A specific version can be asked for, so links to the page keep showing the same data after newer versions
+	// are added.  Otherwise the latest one is used
+	version := int64(latestVersion)
+	var err error
+	if r.FormValue("version") != "" {
+		version, err = getVersion(r)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
 	}
 
 	// Check if the user has access to the requested database
-	err := checkUserDBAccess(&pageData.DB, loggedInUser, userName, dbName)
+	ctx := r.Context()
+	err = checkUserDBVersionAccessCtx(ctx, &pageData.DB, loggedInUser, userName, dbName, version)
+	if clientGone(ctx, pageName) {
+		return
+	}
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+		errorPage(w, r, versionErrorStatus(err), err.Error())
 		return
 	}
+	latest := pageData.DB.Info.Latest
+	if !pageData.DB.Info.Public {
+		noIndex(w)
+	}
 
 	// * Execution can only get here if the user has access to the requested database *
+	recordStat(r, userName, dbName, statView, loggedInUser)
+	recordQuickAccessView(loggedInUser, userName, dbName)
+
+	// Versions uploaded before the facts about their file were recorded have them read now, so they're filled in
+	// whether or not the page comes from the cache
+	facts := getVersionFacts(ctx, userName, dbName, pageData.DB)
+
+	// The page data is shared between everyone but the owner, so whether this person has starred the database is
+	// filled in when the page is rendered rather than cached with it
+	starred, err := checkDBStarred(loggedInUser, userName, dbName)
+	if err != nil {
+		log.Printf("%s: Error checking if '%s' starred '%s/%s': %v\n", pageName, loggedInUser, userName, dbName,
+			err)
+	}
+
+	// The owner is shown the open merge requests for the database, where to propose merging it if it's a fork, and
+	// any warnings about the names in the version.  These are filled in when the page is rendered too, so they're
+	// never out of date
+	var openRequests []mergeRequest
+	var upstream string
+	var nameWarnings []nameWarning
+	if loggedInUser == userName {
+		if meta, ok := getVersionMeta(userName, dbName, pageData.DB.Info.Version); ok {
+			nameWarnings = meta.NameWarnings
+		}
+		openRequests, err = getMergeRequests(userName, dbName, true)
+		if err != nil {
+			log.Printf("%s: Error retrieving open merge requests of '%s/%s': %v\n", pageName, userName, dbName, err)
+		}
+		if upOwner, upName, ok := forkUpstream(userName, dbName); ok {
+			upstream = upOwner + "/" + upName
+		}
+	}
+
+	// Logged in users are shown the table and sort order they last used, unless a table was asked for
+	var sortCol, sortDir string
+	savedTable := false
+	if loggedInUser != "" {
+		state := getDBState(loggedInUser, userName, dbName)
+		if dbTable == "" && state.Table != "" {
+			dbTable = state.Table
+			savedTable = true
+		}
+		if dbTable == state.Table && state.SortCol != "" {
+			sortCol = state.SortCol
+			sortDir = sortDirection(state.SortDir)
+			if sortDir == "" {
+				sortDir = "ASC"
+			}
+		}
+	}
+
+	// Otherwise the table the owner chose is shown, if there is one
+	defaultTable := getDefaultTable(userName, dbName)
 
-	// Generate a predictable cache key for the whole page data
+	// Everyone but the owner is shown the rows left by the owner's default filter for the table, unless they asked
+	// for every row
+	filters, err := getTableFilters(userName, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	pageData.ShowAll, _ = strconv.ParseBool(r.FormValue("all"))
+	applyFilter := loggedInUser != userName && !pageData.ShowAll
+
+	// Generate a predictable cache key for the whole page data.  It includes the version shown, whether that was
+	// asked for or is the latest one, and the default table and filters so changing them takes effect straight away
 	var pageCacheKey string
+	pageParams := fmt.Sprintf("/%s/%d/%s/%s/%s/%s/%s/%t", dbName, pageData.DB.Info.Version, dbTable, defaultTable,
+		sortCol, sortDir, filters.Key(), pageData.ShowAll)
 	if loggedInUser != userName {
-		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + dbTable))
+		tempArr := md5.Sum([]byte(userName + pageParams))
 		pageCacheKey = "dwndb-pub-" + hex.EncodeToString(tempArr[:])
 	} else {
-		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + dbTable))
+		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + pageParams))
 		pageCacheKey = "dwndb-" + hex.EncodeToString(tempArr[:])
 	}
 
@@ -56,8 +147,8 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 	if loggedInUser != "" {
 		pageData.DB.MaxRows = getUserMaxRowsPref(loggedInUser)
 	} else {
-		// Not logged in, so default to 10 rows
-		pageData.DB.MaxRows = 10
+		// Not logged in, so use the default number of rows
+		pageData.DB.MaxRows = conf.Web.DefaultRows
 	}
 
 	// If a cached version of the page data exists, use it
@@ -67,29 +158,40 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 		log.Printf("%s: Error retrieving page data from cache: %v\n", pageName, err)
 	}
 	if ok {
-		// Render the page from cache
-		t := tmpl.Lookup("databasePage")
-		err = t.Execute(w, pageData)
-		if err != nil {
-			log.Printf("Error: %s", err)
-		}
+		// Render the page from cache.  The timestamps are shown in the timezone of whoever is looking, and the
+		// latest version may have changed since the page was cached
+		setUserTimePrefs(&pageData.Meta, loggedInUser)
+		pageData.DB.Info.Latest = latest
+		pageData.Starred = starred
+		pageData.MergeRequests = openRequests
+		pageData.Upstream = upstream
+		pageData.NameWarnings = nameWarnings
+		pageData.Facts = facts
+		pageData.CloneURL = cloneURL(userName, dbName)
+		renderTemplate(w, "databasePage", pageData)
 		return
 	}
 
 	// Get a handle from Minio for the database object
-	db, err := openMinioObject(pageData.DB.MinioBkt, pageData.DB.MinioId)
+	db, err := openMinioObjectCtx(ctx, pageData.DB.MinioBkt, pageData.DB.MinioId)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err == errTooManyOpenDBs {
+		serverBusy(w, r)
+		return
+	}
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-	defer db.Close()
+	defer closeMinioObject(db)
 
 	// Retrieve the list of tables in the database
 	tables, err := db.Tables("")
 	if err != nil {
+		// Without the table list there's nothing to show, unlike when just one table can't be read
 		log.Printf("Error retrieving table names: %s", err)
-		// TODO: Add proper error handing here.  Maybe display the page, but show the error where
-		// TODO  the table data would otherwise be?
 		errorPage(w, r, http.StatusInternalServerError,
 			fmt.Sprintf("Error reading from '%s'.  Possibly encrypted or not a database?", dbName))
 		return
@@ -101,6 +203,7 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 		return
 	}
 	pageData.DB.Info.Tables = tables
+	vt := readVirtualTables(db)
 
 	// If a specific table was requested, check that it's present
 	if dbTable != "" {
@@ -111,7 +214,19 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 				tablePresent = true
 			}
 		}
-		if tablePresent == false {
+		if tablePresent == false && !savedTable {
+			// Links typed in by hand often get the case of the name wrong, so use the table that matches apart from
+			// case, as long as there's only one of them
+			if match, ok := matchTableName(tables, dbTable); ok {
+				dbTable = match
+				tablePresent = true
+			}
+		}
+		if tablePresent == false && savedTable {
+			// The table last used has gone from the database since, so fall back to the defaults
+			dbTable = ""
+			sortCol, sortDir = "", ""
+		} else if tablePresent == false {
 			// The requested table doesn't exist in the database
 			log.Printf("%s: Requested table not present in database. DB: '%s/%s', Table: '%s'\n", pageName,
 				userName, dbName, dbTable)
@@ -120,152 +235,257 @@ func databasePage(w http.ResponseWriter, r *http.Request, userName string, dbNam
 		}
 	}
 
-	// If a specific table wasn't requested, use the first table in the database
+	// If a specific table wasn't requested, use the default one
 	if dbTable == "" {
-		dbTable = pageData.DB.Info.Tables[0]
+		dbTable = landingTable(tables, vt, defaultTable)
+	}
+	pageData.Data.Module = vt.Modules[dbTable]
+
+	// Likewise, a saved sort column may not be there any more
+	var orderBy string
+	if sortCol != "" && tableHasColumn(db, dbTable, sortCol) {
+		orderBy = " ORDER BY " + quoteIdentifier(sortCol) + " " + sortDir
+		pageData.Data.SortCol = sortCol
+		pageData.Data.SortDir = sortDir
 	}
 
+	// Stop reading from the database if it takes too long, such as for a view defined by an expensive query
+	sctx, cancelSQLite := sqliteContext(ctx)
+	defer cancelSQLite()
+
 	// Retrieve (up to) x rows from the selected database
 	// Ugh, have to use string smashing for this, even though the SQL spec doesn't seem to say table names
 	// shouldn't be parameterised.  Limitation from SQLite's implementation? :(
-	stmt, err := db.Prepare("SELECT * FROM "+dbTable+" LIMIT ?", pageData.DB.MaxRows)
-	if err != nil {
-		log.Printf("Error when preparing statement for database: %s\v", err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
-		return
-	}
-
-	// Retrieve the field names
-	pageData.Data.ColNames = stmt.ColumnNames()
-	pageData.Data.ColCount = len(pageData.Data.ColNames)
-
-	// Process each row
-	fieldCount := -1
-	err = stmt.Select(func(s *sqlite.Stmt) error {
-
-		// Get the number of fields in the result
-		if fieldCount == -1 {
-			fieldCount = stmt.DataCount()
-		}
-
-		// Retrieve the data for each row
-		var row []dataValue
-		for i := 0; i < fieldCount; i++ {
-			// Retrieve the data type for the field
-			fieldType := stmt.ColumnType(i)
-
-			isNull := false
-			switch fieldType {
-			case sqlite.Integer:
-				var val int
-				val, isNull, err = s.ScanInt(i)
-				if err != nil {
-					log.Printf("Something went wrong with ScanInt(): %v\n", err)
-					break
-				}
-				if !isNull {
-					stringVal := fmt.Sprintf("%d", val)
-					row = append(row, dataValue{Name: pageData.Data.ColNames[i], Type: Integer,
-						Value: stringVal})
-				}
-			case sqlite.Float:
-				var val float64
-				val, isNull, err = s.ScanDouble(i)
-				if err != nil {
-					log.Printf("Something went wrong with ScanDouble(): %v\n", err)
-					break
-				}
-				if !isNull {
-					stringVal := strconv.FormatFloat(val, 'f', 4, 64)
-					row = append(row, dataValue{Name: pageData.Data.ColNames[i], Type: Float,
-						Value: stringVal})
-				}
-			case sqlite.Text:
-				var val string
-				val, isNull = s.ScanText(i)
-				if !isNull {
-					row = append(row, dataValue{Name: pageData.Data.ColNames[i], Type: Text,
-						Value: val})
-				}
-			case sqlite.Blob:
-				_, isNull = s.ScanBlob(i)
-				if !isNull {
-					row = append(row, dataValue{Name: pageData.Data.ColNames[i], Type: Binary,
-						Value: "<i>BINARY DATA</i>"})
-				}
-			case sqlite.Null:
-				isNull = true
-			}
-			if isNull {
-				row = append(row, dataValue{Name: pageData.Data.ColNames[i], Type: Null,
-					Value: "<i>NULL</i>"})
-			}
-		}
-		pageData.Data.Records = append(pageData.Data.Records, row)
-
-		return nil
-	})
-	if err != nil {
-		log.Printf("Error when retrieving select data from database: %s\v", err)
-		errorPage(w, r, http.StatusInternalServerError,
-			fmt.Sprintf("Error reading data from '%s'.  Possibly malformed?", dbName))
+	// Tables with a rowid have it read too, so the values cut short can be retrieved in full
+	var keyCols []string
+	if tableHasRowid(db, dbTable) {
+		keyCols = []string{"rowid"}
+	}
+	var where []whereClause
+	if applyFilter {
+		where = filters.Clauses(db, dbTable)
+	}
+	dbQuery := "SELECT " + strings.Join(append(keyCols, "*"), ", ") + " FROM " + quoteIdentifier(dbTable)
+	conds, args := whereConditions(where)
+	if len(conds) > 0 {
+		dbQuery += " WHERE " + strings.Join(conds, " AND ")
+	}
+	dbQuery += orderBy + " LIMIT ? OFFSET ?"
+	stop := interruptWhenDone(sctx, db)
+	dataRows, err := readSQLiteRows(db, dbQuery, append(args, pageData.DB.MaxRows, 0), false, false, 1)
+	stop()
+	if clientGone(ctx, pageName) {
 		return
 	}
-	defer stmt.Finalize()
+	if sctx.Err() == context.DeadlineExceeded {
+		err = errQueryTooLong
+	}
+
+	// When the table can't be read, the reason is shown in place of its rows so the other tables can still be
+	// chosen.  Those pages aren't cached, in case the problem goes away
+	readFailed := false
+	if err != nil && pageData.Data.Module != "" {
+		// Some virtual table modules can't be read with a plain SELECT, so say so in place of the rows
+		log.Printf("%s: Error reading virtual table '%s' of '%s/%s': %v\n", pageName, dbTable, userName, dbName,
+			err)
+		pageData.Data.ReadError = virtualTableReadError(pageData.Data.Module)
+	} else if err != nil {
+		log.Printf("%s: Error reading table '%s' of '%s/%s': %v\n", pageName, dbTable, userName, dbName, err)
+		pageData.Data.ReadError = tableReadError(dbTable, err)
+		readFailed = true
+	} else {
+		splitRowKeys(&dataRows, keyCols)
+		truncateRecords(&dataRows, conf.Web.CellLength)
+		pageData.Data.ColNames = dataRows.ColNames
+		pageData.Data.ColCount = dataRows.ColCount
+		pageData.Data.KeyCols = dataRows.KeyCols
+		pageData.Data.RowKeys = dataRows.RowKeys
+		pageData.Data.Records = dataRows.Records
+		pageData.Data.ColTypes = readColumnTypes(db, dbTable, dataRows)
+	}
 
 	// Count the total number of rows in the selected table
-	dbQuery := "SELECT count(*) FROM " + dbTable
-	err = db.OneValue(dbQuery, &pageData.Data.RowCount)
+	if pageData.Data.ReadError == "" {
+		pageData.Data.RowCount, pageData.Data.ApproxCount, err = getTableRowCount(sctx, db, userName, dbName,
+			pageData.DB.Info.Version, dbTable, pageData.DB.MinioBkt, pageData.DB.MinioId)
+	}
+	if f, ok := filters[dbTable]; ok && err == nil && pageData.Data.ReadError == "" {
+		// When the default filter was applied, the count is of the rows it leaves
+		filteredRows := pageData.Data.RowCount
+		if len(where) > 0 {
+			filteredRows, err = filteredRowCount(sctx, db, dbTable, rowFilter{Where: where})
+		}
+		describeTableFilter(&pageData.Data, f, len(where) > 0, filteredRows, pageData.Data.RowCount)
+		if len(where) > 0 {
+			pageData.Data.RowCount, pageData.Data.ApproxCount = filteredRows, false
+		}
+	}
+	if clientGone(ctx, pageName) {
+		return
+	}
 	if err != nil {
+		// The rows were read fine, so show them along with the number there are
 		log.Printf("%s: Error occurred when counting total table rows: %s\n", pageName, err)
+		pageData.Data.RowCount = len(pageData.Data.Records)
+		readFailed = true
+	}
+
+	// Count the rows in every table too, for the table list
+	pageData.DB.Info.TableRows, err = getTableRowCounts(sctx, db, userName, dbName, pageData.DB.Info.Version,
+		tables, vt, pageData.DB.MinioBkt, pageData.DB.MinioId)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error occurred when counting table rows: %s\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
 		return
 	}
+	approxCounts := pageData.Data.ApproxCount
+	for _, t := range pageData.DB.Info.TableRows {
+		approxCounts = approxCounts || t.Approx
+	}
 
 	pageData.Data.Tablename = dbTable
+	pageData.Data.Version = pageData.DB.Info.Version
+	pageData.DefaultTable = defaultTable
 	pageData.Meta.Username = userName
 	pageData.Meta.Database = dbName
+	pageData.Meta.Version = pageData.DB.Info.Version
 	pageData.Meta.Server = conf.Web.Server
 	pageData.Meta.Title = fmt.Sprintf("%s / %s", userName, dbName)
 
-	// Cache the page data
-	err = cacheData(pageCacheKey, pageData, cacheTime)
-	if err != nil {
-		log.Printf("%s: Error when caching page data: %v\n", pageName, err)
+	// Cache the page data.  Pages with an approximate row count aren't cached, so the exact count shows up once
+	// it's ready
+	if !approxCounts && !readFailed {
+		err = cacheData(pageCacheKey, pageData, cacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching page data: %v\n", pageName, err)
+		}
 	}
 
 	// TODO: Should we cache the rendered page too?
 
 	// Render the page
-	t := tmpl.Lookup("databasePage")
-	err = t.Execute(w, pageData)
+	setUserTimePrefs(&pageData.Meta, loggedInUser)
+	pageData.Starred = starred
+	pageData.MergeRequests = openRequests
+	pageData.Upstream = upstream
+	pageData.NameWarnings = nameWarnings
+	pageData.Facts = facts
+	pageData.CloneURL = cloneURL(userName, dbName)
+	renderTemplate(w, "databasePage", pageData)
+}
+
+// Shows the differences in structure and row counts between two versions of a database
+func diffPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Diff page"
+
+	var pageData struct {
+		Meta metaInfo
+		Diff dbDiff
+	}
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve the versions to compare
+	from, err := strconv.ParseInt(r.FormValue("from"), 10, 0)
+	if err != nil || from < 1 {
+		errorPage(w, r, http.StatusBadRequest, "Invalid 'from' version number")
+		return
+	}
+	to, err := strconv.ParseInt(r.FormValue("to"), 10, 0)
+	if err != nil || to < 1 {
+		errorPage(w, r, http.StatusBadRequest, "Invalid 'to' version number")
+		return
+	}
+	pageData.Meta.Title = fmt.Sprintf("Changes from version %d to %d", from, to)
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+	pageData.Meta.LoggedInUser = loggedInUser
+
+	// Both versions need to be available to the user
+	ctx := r.Context()
+	fromObj, err := getVersionObject(ctx, loggedInUser, userName, dbName, from)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	toObj, err := getVersionObject(ctx, loggedInUser, userName, dbName, to)
+	if clientGone(ctx, pageName) {
+		return
+	}
 	if err != nil {
-		log.Printf("Error: %s", err)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Versions never change once uploaded, so the comparison is cached for the version pair
+	tempArr := md5.Sum([]byte(fmt.Sprintf("%s/%s/%d/%d", userName, dbName, from, to)))
+	cacheKey := "diff-" + hex.EncodeToString(tempArr[:])
+	ok, err := getCachedData(cacheKey, &pageData.Diff)
+	if err != nil {
+		log.Printf("%s: Error retrieving diff from cache: %v\n", pageName, err)
+	}
+	if !ok {
+		pageData.Diff, err = diffDatabases(ctx, from, to, fromObj, toObj)
+		if clientGone(ctx, pageName) {
+			return
+		}
+		if err == errTooManyOpenDBs {
+			serverBusy(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("%s: Error comparing versions %d and %d of '%s/%s': %v\n", pageName, from, to, userName,
+				dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Comparisons missing some row counts aren't cached, so the counts can be tried again
+		if !pageData.Diff.Incomplete {
+			err = cacheData(cacheKey, pageData.Diff, cacheTime)
+			if err != nil {
+				log.Printf("%s: Error when caching diff: %v\n", pageName, err)
+			}
+		}
 	}
+
+	// Render the page
+	renderTemplate(w, "diffPage", pageData)
 }
 
 // General error display page
 func errorPage(w http.ResponseWriter, r *http.Request, httpcode int, msg string) {
+	// Requests made through the API get their errors as JSON
+	if isAPIRequest(r) {
+		w.Header().Del("X-DBHub-Version")
+		jsonError(w, httpcode, msg)
+		return
+	}
+
 	var pageData struct {
 		Meta    metaInfo
 		Message string
 	}
 	pageData.Message = msg
 
-	// Retrieve session data (if any)
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser := sess.CAttr("UserName")
-		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
-	}
+	// Retrieve the logged in user (if any)
+	pageData.Meta.LoggedInUser = currentUser(r)
+
+	// Headers meant for the response which failed, such as a download's file name, don't apply to the error page.
+	// Error pages aren't worth having in search results either
+	w.Header().Del("Content-Disposition")
+	w.Header().Del("X-DBHub-Version")
+	noIndex(w)
 
 	// Render the page
-	w.WriteHeader(httpcode)
-	t := tmpl.Lookup("errorPage")
-	err := t.Execute(w, pageData)
-	if err != nil {
-		log.Printf("Error: %s", err)
-	}
+	renderTemplateStatus(w, httpcode, "errorPage", pageData)
 }
 
 // Renders the front page of the website
@@ -276,17 +496,36 @@ func frontPage(w http.ResponseWriter, r *http.Request) {
 	type userInfo struct {
 		Username     string
 		LastModified time.Time
+		Avatar       string
 	}
 	var pageData struct {
-		Meta metaInfo
-		List []userInfo
+		Meta  metaInfo
+		List  []userInfo
+		Pager pageInfo
+	}
+
+	// Retrieve the logged in user (if any)
+	pageData.Meta.LoggedInUser = currentUser(r)
+	setUserTimePrefs(&pageData.Meta, pageData.Meta.LoggedInUser)
+
+	// Work out which page of the user list to show
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	var total int
+	err := db.QueryRowEx(ctx, `
+		SELECT count(DISTINCT db.username)
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.idnum = ver.db
+			AND ver.public = true`, nil).Scan(&total)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
 	}
-
-	// Retrieve session data (if any)
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser := sess.CAttr("UserName")
-		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	pageData.Pager, err = getListPage(r, "page", total)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	// Retrieve list of users with public databases
@@ -302,9 +541,12 @@ func frontPage(w http.ResponseWriter, r *http.Request) {
 			WHERE db.idnum = pub.db
 			ORDER BY db.username, last_modified DESC
 		)
-		SELECT username, last_modified FROM public_users
-		ORDER BY last_modified DESC`
-	rows, err := db.Query(dbQuery)
+		SELECT pu.username, pu.last_modified, u.email, u.avatar_minioid
+		FROM public_users AS pu, users AS u
+		WHERE u.username = pu.username
+		ORDER BY last_modified DESC, pu.username
+		LIMIT $1 OFFSET $2`
+	rows, err := db.QueryEx(ctx, dbQuery, nil, listPageSize, pageData.Pager.Offset)
 	if err != nil {
 		log.Printf("%s: Database query failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
@@ -313,41 +555,41 @@ func frontPage(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 	for rows.Next() {
 		var oneRow userInfo
-		err = rows.Scan(&oneRow.Username, &oneRow.LastModified)
+		var email string
+		var avatarId pgx.NullString
+		err = rows.Scan(&oneRow.Username, &oneRow.LastModified, &email, &avatarId)
 		if err != nil {
 			log.Printf("%s: Error retrieving database list for user: %v\n", pageName, err)
 			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list for user")
 			return
 		}
+		oneRow.Avatar = avatarURL(oneRow.Username, email, avatarId.Valid)
 		pageData.List = append(pageData.List, oneRow)
 	}
 	pageData.Meta.Title = `SQLite storage "in the cloud"`
 
 	// Render the page
-	t := tmpl.Lookup("rootPage")
-	err = t.Execute(w, pageData)
-	if err != nil {
-		log.Printf("Error: %s", err)
-	}
+	renderTemplate(w, "rootPage", pageData)
 }
 
 func loginPage(w http.ResponseWriter, r *http.Request) {
 	var pageData struct {
 		Meta      metaInfo
 		SourceRef string
+		Expired   bool // Whether the visitor was sent here because their session ran out
 	}
 	pageData.Meta.Title = "Login"
+	pageData.Expired = r.FormValue("expired") != ""
 
-	// Retrieve session data (if any)
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser := sess.CAttr("UserName")
-		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
-	}
+	// Retrieve the logged in user (if any)
+	pageData.Meta.LoggedInUser = currentUser(r)
 
-	// If the referrer is a page from our website, pass that to the login page
+	// The page to go back to can be given by requireLogin().  Otherwise, if the referrer is a page from our website,
+	// pass that to the login page
 	referrer := r.Referer()
-	if referrer != "" {
+	if next := localBounceURL(r.FormValue("next")); next != "" {
+		pageData.SourceRef = next
+	} else if referrer != "" {
 		ref, err := url.Parse(referrer)
 		if err != nil {
 			log.Printf("Error when parsing referrer URL for login page: %s\n", err)
@@ -360,42 +602,47 @@ func loginPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Render the page
-	t := tmpl.Lookup("loginPage")
-	err := t.Execute(w, pageData)
-	if err != nil {
-		log.Printf("Error: %s", err)
-	}
+	noIndex(w)
+	renderTemplate(w, "loginPage", pageData)
 }
 
 // Renders the user Preferences page
-func prefPage(w http.ResponseWriter, r *http.Request, userName string) {
-	pageName := "Preference page form"
-
+func prefPage(w http.ResponseWriter, r *http.Request, userName string, acct userAccount) {
 	var pageData struct {
-		Meta    metaInfo
-		MaxRows int
+		Meta        metaInfo
+		Prefs       userPreferences
+		Licences    []licenceInfo
+		DateFormats []dateFormatInfo
+		LocalAvatar bool
+		Export      dataExport
+		HasExport   bool
+		SessionEnds time.Time
 	}
 	pageData.Meta.Title = "Preferences"
+	if sess := session.Get(r); sess != nil {
+		pageData.SessionEnds = sessionExpiry(sess)
+	}
 	pageData.Meta.LoggedInUser = userName
-
-	// Retrieve the user preference data
-	dbQuery := `
-		SELECT pref_max_rows
-		FROM users
-		WHERE username = $1`
-	err := db.QueryRow(dbQuery, userName).Scan(&pageData.MaxRows)
+	pageData.Licences = dbLicences
+	pageData.DateFormats = dateFormats
+
+	// The user preference data is retrieved by prefHandler, which checks the user still exists
+	pageData.Prefs = acct.Prefs
+	pageData.Meta.DateFormat = pageData.Prefs.DateFormat
+	pageData.Meta.TimeZone = pageData.Prefs.TimeZone
+	pageData.LocalAvatar = acct.LocalAvatar
+	pageData.Meta.Avatar = avatarURL(userName, acct.Email, acct.LocalAvatar)
+
+	// Retrieve the status of any data export
+	var err error
+	pageData.Export, pageData.HasExport, err = getDataExport(userName)
 	if err != nil {
-		log.Printf("%s: Error retrieving User preference data: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Error retrieving preference data")
 		return
 	}
 
 	// Render the page
-	t := tmpl.Lookup("prefPage")
-	err = t.Execute(w, pageData)
-	if err != nil {
-		log.Printf("Error: %s", err)
-	}
+	renderTemplate(w, "prefPage", pageData)
 }
 
 func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
@@ -408,117 +655,59 @@ func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
 		DateStarred time.Time
 	}
 	var pageData struct {
-		Meta       metaInfo
-		PrivateDBs []dbInfo
-		PublicDBs  []dbInfo
-		Stars      []starRow
+		Meta        metaInfo
+		ListOptions dbListOptions
+		Databases   dbSection
+		Stars       []starRow
 	}
 	pageData.Meta.Username = userName
 	pageData.Meta.Title = userName
 	pageData.Meta.Server = conf.Web.Server
 	pageData.Meta.LoggedInUser = userName
+	pageData.Meta.Avatar = getUserAvatar(userName)
+	setUserTimePrefs(&pageData.Meta, userName)
 
 	// Check if the desired user exists
-	row := db.QueryRow("SELECT count(username) FROM public.users WHERE username = $1", userName)
-	var userCount int
-	err := row.Scan(&userCount)
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	userExists, err := checkUserExistsCtx(ctx, userName)
 	if err != nil {
-		log.Printf("%s: Error looking up user details failed. User: '%s' Error: %v\n", pageName, userName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// If the user doesn't exist, display an error page
-	if userCount == 0 {
+	if !userExists {
 		errorPage(w, r, http.StatusNotFound, fmt.Sprintf("Unknown user: %s", userName))
 		return
 	}
 
-	var dbQuery string
-	// Retrieve list of public databases for the user
-	dbQuery = `
-		WITH public_dbs AS (
-			SELECT db.dbname, db.last_modified, ver.size, ver.version, db.watchers, db.stars,
-				db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
-				db.releases, db.contributors, db.description
-			FROM sqlite_databases AS db, database_versions AS ver
-			WHERE db.idnum = ver.db
-				AND db.username = $1
-				AND ver.public = true
-			ORDER BY dbname, version DESC
-		), unique_dbs AS (
-			SELECT DISTINCT ON (dbname) * FROM public_dbs ORDER BY dbname
-		)
-		SELECT * FROM unique_dbs ORDER BY last_modified DESC`
-	rows, err := db.Query(dbQuery, userName)
+	// The listings can be ordered and filtered.  The choices are kept in the page links, as getListPage() only
+	// changes the page number
+	pageData.ListOptions = parseDBListOptions(r)
+
+	// Retrieve the page of the user's databases asked for
+	total, err := countUserDBSection(ctx, userName, false, pageData.ListOptions)
 	if err != nil {
 		log.Printf("%s: Database query failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var desc pgx.NullString
-		var oneRow dbInfo
-		err = rows.Scan(&oneRow.Database, &oneRow.LastModified, &oneRow.Size, &oneRow.Version,
-			&oneRow.Watchers, &oneRow.Stars, &oneRow.Forks, &oneRow.Discussions, &oneRow.MRs,
-			&oneRow.Updates, &oneRow.Branches, &oneRow.Releases, &oneRow.Contributors, &desc)
-		if err != nil {
-			log.Printf("%s: Error retrieving public database list for user: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
-			return
-		}
-		if !desc.Valid {
-			oneRow.Description = ""
-		} else {
-			oneRow.Description = fmt.Sprintf(": %s", desc.String)
-		}
-		pageData.PublicDBs = append(pageData.PublicDBs, oneRow)
-	}
-
-	// Retrieve list of private databases for the user
-	dbQuery = `
-		WITH public_dbs AS (
-			SELECT db.dbname, db.last_modified, ver.size, ver.version, db.watchers, db.stars,
-				db.forks, db.discussions, db.pull_requests, db.updates, db.branches,
-				db.releases, db.contributors, db.description
-			FROM sqlite_databases AS db, database_versions AS ver
-			WHERE db.idnum = ver.db
-				AND db.username = $1
-				AND ver.public = false
-			ORDER BY dbname, version DESC
-		), unique_dbs AS (
-			SELECT DISTINCT ON (dbname) * FROM public_dbs ORDER BY dbname
-		)
-		SELECT * FROM unique_dbs ORDER BY last_modified DESC`
-	rows2, err := db.Query(dbQuery, userName)
+	pageData.Databases.Pager, err = getListPage(r, "page", total)
 	if err != nil {
-		log.Printf("%s: Database query failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows2.Close()
-	for rows2.Next() {
-		var desc pgx.NullString
-		var oneRow dbInfo
-		err = rows2.Scan(&oneRow.Database, &oneRow.LastModified, &oneRow.Size, &oneRow.Version,
-			&oneRow.Watchers, &oneRow.Stars, &oneRow.Forks, &oneRow.Discussions, &oneRow.MRs,
-			&oneRow.Updates, &oneRow.Branches, &oneRow.Releases, &oneRow.Contributors, &desc)
-		if err != nil {
-			log.Printf("%s: Error retrieving private database list for user: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
-			return
-		}
-		if !desc.Valid {
-			oneRow.Description = ""
-		} else {
-			oneRow.Description = fmt.Sprintf(": %s", desc.String)
-		}
-		pageData.PrivateDBs = append(pageData.PrivateDBs, oneRow)
+	pageData.Databases.DBs, err = getUserDBSection(ctx, userName, false, pageData.ListOptions,
+		pageData.Databases.Pager.Offset, userName)
+	if err != nil {
+		log.Printf("%s: Error retrieving database list for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list")
+		return
 	}
 
 	// Retrieve the list of starred databases for the user
-	dbQuery = `
+	dbQuery := `
 		WITH stars AS (
 			SELECT db, date_starred
 			FROM database_stars
@@ -528,16 +717,16 @@ func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
 		FROM sqlite_databases AS dbs, stars
 		WHERE dbs.idnum = stars.db
 		ORDER BY date_starred DESC`
-	rows3, err := db.Query(dbQuery, userName)
+	rows, err := db.QueryEx(ctx, dbQuery, nil, userName)
 	if err != nil {
 		log.Printf("%s: Database query failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows3.Close()
-	for rows3.Next() {
+	defer rows.Close()
+	for rows.Next() {
 		var oneRow starRow
-		err = rows3.Scan(&oneRow.Username, &oneRow.Database, &oneRow.DateStarred)
+		err = rows.Scan(&oneRow.Username, &oneRow.Database, &oneRow.DateStarred)
 		if err != nil {
 			log.Printf("%s: Error retrieving stars list for user: %v\n", pageName, err)
 			errorPage(w, r, http.StatusInternalServerError, "Error retrieving stars list")
@@ -547,32 +736,132 @@ func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
 	}
 
 	// Render the page
-	t := tmpl.Lookup("profilePage")
-	err = t.Execute(w, pageData)
-	if err != nil {
-		log.Printf("Error: %s", err)
-	}
+	renderTemplate(w, "profilePage", pageData)
 }
 
 func registerPage(w http.ResponseWriter, r *http.Request) {
 	var pageData struct {
-		Meta metaInfo
+		Meta      metaInfo
+		Challenge registrationChallenge // The question to ask, if there is one
+		Honeypot  bool
 	}
 	pageData.Meta.Title = "Register"
-
-	// Retrieve session data (if any)
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser := sess.CAttr("UserName")
-		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
+	if conf.Registration.Challenge {
+		pageData.Challenge = newRegistrationChallenge()
 	}
+	pageData.Honeypot = conf.Registration.Honeypot
+
+	// Retrieve the logged in user (if any)
+	pageData.Meta.LoggedInUser = currentUser(r)
 
 	// Render the page
-	t := tmpl.Lookup("registerPage")
-	err := t.Execute(w, pageData)
+	noIndex(w)
+	renderTemplate(w, "registerPage", pageData)
+}
+
+// Shows the tables and views of a database version with their CREATE statements, and the indexes on each table.
+// With format=json the schema is returned as JSON instead, along with the columns of each table, for the pickers on
+// the database page
+func schemaPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Schema page"
+
+	asJSON := r.FormValue("format") == "json"
+	fail := func(status int, msg string) {
+		if asJSON {
+			jsonError(w, status, msg)
+			return
+		}
+		errorPage(w, r, status, msg)
+	}
+
+	var pageData struct {
+		Meta   metaInfo
+		Schema dbSchema
+	}
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+	pageData.Meta.Title = fmt.Sprintf("%s / %s schema", userName, dbName)
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+	pageData.Meta.LoggedInUser = loggedInUser
+
+	// Use the requested version if one was given, otherwise the latest one the user can see
+	ctx := r.Context()
+	var obj versionObject
+	var version int64
+	if r.FormValue("version") != "" {
+		var err error
+		version, err = getVersion(r)
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		obj, err = getVersionObject(ctx, loggedInUser, userName, dbName, version)
+		if clientGone(ctx, pageName) {
+			return
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		var dbDetails sqliteDBinfo
+		err := checkUserDBAccessCtx(ctx, &dbDetails, loggedInUser, userName, dbName)
+		if clientGone(ctx, pageName) {
+			return
+		}
+		if err != nil {
+			fail(versionErrorStatus(err), err.Error())
+			return
+		}
+		version = int64(dbDetails.Info.Version)
+		obj = versionObject{Owner: userName, Database: dbName, Bucket: dbDetails.MinioBkt,
+			MinioId: dbDetails.MinioId}
+	}
+
+	// Versions never change once uploaded, so the schema is cached per version.  The columns were added to the
+	// cached schema later, hence the key
+	tempArr := md5.Sum([]byte(fmt.Sprintf("%s/%s/%d", userName, dbName, version)))
+	cacheKey := "schema-cols-" + hex.EncodeToString(tempArr[:])
+	ok, err := getCachedData(cacheKey, &pageData.Schema)
 	if err != nil {
-		log.Printf("Error: %s", err)
+		log.Printf("%s: Error retrieving schema from cache: %v\n", pageName, err)
 	}
+	if !ok {
+		sdb, err := openMinioObjectCtx(ctx, obj.Bucket, obj.MinioId)
+		if clientGone(ctx, pageName) {
+			return
+		}
+		if err == errTooManyOpenDBs {
+			w.Header().Set("Retry-After", strconv.Itoa(tempDBRetryAfter))
+			fail(http.StatusServiceUnavailable, "The server is busy.  Please try again in a moment.")
+			return
+		}
+		if err != nil {
+			fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		pageData.Schema, err = readSchema(sdb)
+		closeMinioObject(sdb)
+		if err != nil {
+			fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		pageData.Schema.Version = int(version)
+		err = cacheData(cacheKey, pageData.Schema, cacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching schema: %v\n", pageName, err)
+		}
+	}
+
+	if asJSON {
+		writeJSON(w, http.StatusOK, pageData.Schema)
+		return
+	}
+
+	// Render the page
+	renderTemplate(w, "schemaPage", pageData)
 }
 
 func starsPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
@@ -581,6 +870,7 @@ func starsPage(w http.ResponseWriter, r *http.Request, userName string, dbName s
 	type userInfo struct {
 		Username    string
 		DateStarred time.Time
+		Avatar      string
 	}
 	var pageData struct {
 		Meta  metaInfo
@@ -590,12 +880,9 @@ func starsPage(w http.ResponseWriter, r *http.Request, userName string, dbName s
 	pageData.Meta.Username = userName
 	pageData.Meta.Database = dbName
 
-	// Retrieve session data (if any)
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser := sess.CAttr("UserName")
-		pageData.Meta.LoggedInUser = fmt.Sprintf("%s", loggedInUser)
-	}
+	// Retrieve the logged in user (if any)
+	pageData.Meta.LoggedInUser = currentUser(r)
+	setUserTimePrefs(&pageData.Meta, pageData.Meta.LoggedInUser)
 
 	// Retrieve list of users who starred the database
 	dbQuery := `
@@ -610,10 +897,13 @@ func starsPage(w http.ResponseWriter, r *http.Request, userName string, dbName s
 				)
 			ORDER BY username DESC
 		)
-		SELECT username, date_starred
-		FROM star_users
+		SELECT su.username, su.date_starred, u.email, u.avatar_minioid
+		FROM star_users AS su, users AS u
+		WHERE u.username = su.username
 		ORDER BY date_starred DESC`
-	rows, err := db.Query(dbQuery, userName, dbName)
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	rows, err := db.QueryEx(ctx, dbQuery, nil, userName, dbName)
 	if err != nil {
 		log.Printf("%s: Database query failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
@@ -622,37 +912,232 @@ func starsPage(w http.ResponseWriter, r *http.Request, userName string, dbName s
 	defer rows.Close()
 	for rows.Next() {
 		var oneRow userInfo
-		err = rows.Scan(&oneRow.Username, &oneRow.DateStarred)
+		var email string
+		var avatarId pgx.NullString
+		err = rows.Scan(&oneRow.Username, &oneRow.DateStarred, &email, &avatarId)
 		if err != nil {
 			log.Printf("%s: Error retrieving list of stars for %s/%s: %v\n", pageName, userName, dbName,
 				err)
 			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 			return
 		}
+		oneRow.Avatar = avatarURL(oneRow.Username, email, avatarId.Valid)
 		pageData.Stars = append(pageData.Stars, oneRow)
 	}
 
 	// Render the page
-	t := tmpl.Lookup("starsPage")
-	err = t.Execute(w, pageData)
+	renderTemplate(w, "starsPage", pageData)
+}
+
+// Renders the list of people who have contributed versions of a database, with how many each.  People other than
+// the owner only see the public versions counted
+func contributorsPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Contributors page"
+
+	type contributorInfo struct {
+		Username     string
+		Versions     int
+		LatestUpload time.Time
+		Avatar       string
+	}
+	var pageData struct {
+		Meta         metaInfo
+		Contributors []contributorInfo
+	}
+	pageData.Meta.Title = "Contributors - " + userName + "/" + dbName
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+	loggedInUser := currentUser(r)
+	pageData.Meta.LoggedInUser = loggedInUser
+	setUserTimePrefs(&pageData.Meta, loggedInUser)
+
+	var dbInfo sqliteDBinfo
+	err := checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+	if !dbInfo.Info.Public {
+		noIndex(w)
+	}
+
+	// Versions from before uploaders were recorded were all uploaded by the owner
+	dbQuery := `
+		WITH contributions AS (
+			SELECT coalesce(ver.uploaded_by, db.username) AS contributor, count(*) AS versions,
+				max(ver.last_modified) AS latest
+			FROM database_versions AS ver, sqlite_databases AS db
+			WHERE db.username = $1
+				AND db.dbname = $2
+				AND ver.db = db.idnum
+				AND ($3 OR ver.public = true)
+			GROUP BY contributor
+		)
+		SELECT c.contributor, c.versions, c.latest, coalesce(u.email, ''), u.avatar_minioid
+		FROM contributions AS c
+			LEFT JOIN users AS u ON u.username = c.contributor
+		ORDER BY c.versions DESC, c.contributor`
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	rows, err := db.QueryEx(ctx, dbQuery, nil, userName, dbName, loggedInUser == userName)
 	if err != nil {
-		log.Printf("Error: %s", err)
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow contributorInfo
+		var email string
+		var avatarId pgx.NullString
+		err = rows.Scan(&oneRow.Username, &oneRow.Versions, &oneRow.LatestUpload, &email, &avatarId)
+		if err != nil {
+			log.Printf("%s: Error retrieving contributors of %s/%s: %v\n", pageName, userName, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		oneRow.Avatar = avatarURL(oneRow.Username, email, avatarId.Valid)
+		pageData.Contributors = append(pageData.Contributors, oneRow)
 	}
+
+	// Render the page
+	renderTemplate(w, "contributorsPage", pageData)
+}
+
+// Renders the view and download statistics for a database.  Only the owner of the database can see these
+func statsPage(w http.ResponseWriter, r *http.Request, userName string, dbName string) {
+	pageName := "Stats page"
+
+	type dayStats struct {
+		Date         time.Time
+		Views        int
+		AnonViews    int
+		BotViews     int
+		Downloads    int
+		CSVDownloads int
+	}
+	var pageData struct {
+		Meta   metaInfo
+		Days   int
+		Stats  []dayStats
+		Totals dayStats
+	}
+	pageData.Meta.Title = "Statistics"
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+	pageData.Meta.LoggedInUser = loggedInUser
+	if loggedInUser != userName {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+
+	// Only the last 30 or 90 days can be displayed
+	pageData.Days = 30
+	if r.FormValue("days") == "90" {
+		pageData.Days = 90
+	}
+
+	dbQuery := `
+		SELECT date, views, anon_views, bot_views, downloads, csv_downloads
+		FROM database_stats
+		WHERE db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND dbname = $2
+				)
+			AND date > current_date - $3::integer
+		ORDER BY date DESC`
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	rows, err := db.QueryEx(ctx, dbQuery, nil, userName, dbName, pageData.Days)
+	if err != nil {
+		log.Printf("%s: Database query failed: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow dayStats
+		err = rows.Scan(&oneRow.Date, &oneRow.Views, &oneRow.AnonViews, &oneRow.BotViews, &oneRow.Downloads,
+			&oneRow.CSVDownloads)
+		if err != nil {
+			log.Printf("%s: Error retrieving statistics for %s/%s: %v\n", pageName, userName, dbName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		pageData.Totals.Views += oneRow.Views
+		pageData.Totals.AnonViews += oneRow.AnonViews
+		pageData.Totals.BotViews += oneRow.BotViews
+		pageData.Totals.Downloads += oneRow.Downloads
+		pageData.Totals.CSVDownloads += oneRow.CSVDownloads
+		pageData.Stats = append(pageData.Stats, oneRow)
+	}
+
+	// Render the page
+	renderTemplate(w, "statsPage", pageData)
 }
 
 func uploadPage(w http.ResponseWriter, r *http.Request, userName string) {
 	var pageData struct {
-		Meta metaInfo
+		Meta     metaInfo
+		Prefs    userPreferences
+		Licences []licenceInfo
 	}
 	pageData.Meta.Title = "Upload database"
 	pageData.Meta.LoggedInUser = userName
+	pageData.Licences = dbLicences
+
+	// Pre-fill the form with the user's defaults.  If they can't be retrieved, the form falls back to private with
+	// no licence
+	pageData.Prefs, _ = getUserPreferences(userName)
 
 	// Render the page
-	t := tmpl.Lookup("uploadPage")
-	err := t.Execute(w, pageData)
-	if err != nil {
-		log.Printf("Error: %s", err)
-	}
+	renderTemplate(w, "uploadPage", pageData)
+}
+
+// Asks the user to confirm an upload is meant to be a new version of one of their existing databases
+func uploadConfirmPage(w http.ResponseWriter, r *http.Request, u chunkedUpload, target uploadTarget) {
+	var pageData struct {
+		Meta     metaInfo
+		UploadID string
+		Filename string
+		Target   uploadTarget
+	}
+	pageData.Meta.Title = "Confirm upload"
+	pageData.Meta.LoggedInUser = u.Owner
+	pageData.UploadID = u.ID
+	pageData.Filename = u.Filename
+	pageData.Target = target
+	renderTemplate(w, "uploadConfirmPage", pageData)
+}
+
+// Shows the user what was stored by an upload.  The details of the new version are recorded first, so this needs
+// to be called while the uploaded file is still around
+func uploadSucceededPage(w http.ResponseWriter, userName string, dbName string, version int, size int64,
+	shaSum string, dbPath string) {
+	var pageData struct {
+		Meta     metaInfo
+		Database string
+		Version  int
+		Size     int
+		SHA256   string
+		Tables   []tableRowCount
+		Warnings []nameWarning
+	}
+	pageData.Meta.Title = "Upload succeeded"
+	pageData.Meta.LoggedInUser = userName
+	pageData.Database = dbName
+	pageData.Version = version
+	pageData.Size = int(size)
+	pageData.SHA256 = shaSum
+	meta := recordVersionMeta(dbPath, userName, dbName, version)
+	pageData.Tables = meta.Tables
+	pageData.Warnings = meta.NameWarnings
+	renderTemplate(w, "uploadSucceededPage", pageData)
 }
 
 func userPage(w http.ResponseWriter, r *http.Request, userName string) {
@@ -660,99 +1145,78 @@ func userPage(w http.ResponseWriter, r *http.Request, userName string) {
 
 	// Structure to hold page data
 	var pageData struct {
-		Meta   metaInfo
-		DBRows []dbInfo
+		Meta        metaInfo
+		ListOptions dbListOptions
+		Databases   dbSection
 	}
 	pageData.Meta.Username = userName
 	pageData.Meta.Title = userName
 	pageData.Meta.Server = conf.Web.Server
 
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
-		if loggedInUser == userName {
-			// The logged in user is looking at their own user page
-			profilePage(w, r, loggedInUser)
-			return
-		}
-		pageData.Meta.LoggedInUser = loggedInUser
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+	if loggedInUser != "" && loggedInUser == userName {
+		// The logged in user is looking at their own user page
+		profilePage(w, r, loggedInUser)
+		return
 	}
+	pageData.Meta.LoggedInUser = loggedInUser
+	setUserTimePrefs(&pageData.Meta, loggedInUser)
 
 	// Check if the desired user exists
-	row := db.QueryRow("SELECT count(username) FROM public.users WHERE username = $1", userName)
-	var userCount int
-	err := row.Scan(&userCount)
+	ctx, cancel := queryContext(r.Context())
+	defer cancel()
+	userExists, err := checkUserExistsCtx(ctx, userName)
 	if err != nil {
-		log.Printf("%s: Error looking up user details failed. User: '%s' Error: %v\n", pageName, userName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// If the user doesn't exist, display an error page
-	if userCount == 0 {
+	if !userExists {
 		errorPage(w, r, http.StatusNotFound, fmt.Sprintf("Unknown user: %s", userName))
 		return
 	}
+	pageData.Meta.Avatar = getUserAvatar(userName)
 
-	var dbQuery string
-	// Retrieve list of public databases for the user
-	dbQuery = `
-		WITH public_dbs AS (
-			SELECT db.dbname, db.last_modified, ver.size, ver.version, db.watchers, db.stars, db.forks,
-				db.discussions, db.pull_requests, db.updates, db.branches, db.releases,
-				db.contributors, db.description
-			FROM sqlite_databases AS db, database_versions AS ver
-			WHERE db.idnum = ver.db
-				AND db.username = $1
-				AND ver.public = true
-			ORDER BY dbname, version DESC
-		), unique_dbs AS (
-			SELECT DISTINCT ON (dbname) * FROM public_dbs ORDER BY dbname
-		)
-		SELECT * FROM unique_dbs ORDER BY last_modified DESC`
-	rows, err := db.Query(dbQuery, userName)
+	// The listings can be ordered and filtered.  The choices are kept in the page links, as getListPage() only
+	// changes the page number
+	pageData.ListOptions = parseDBListOptions(r)
+
+	// Retrieve the page of the user's public databases asked for
+	total, err := countUserDBSection(ctx, userName, true, pageData.ListOptions)
 	if err != nil {
 		log.Printf("%s: Database query failed: %v\n", pageName, err)
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var desc pgx.NullString
-		var oneRow dbInfo
-		err = rows.Scan(&oneRow.Database, &oneRow.LastModified, &oneRow.Size, &oneRow.Version,
-			&oneRow.Watchers, &oneRow.Stars, &oneRow.Forks, &oneRow.Discussions, &oneRow.MRs,
-			&oneRow.Updates, &oneRow.Branches, &oneRow.Releases, &oneRow.Contributors, &desc)
-		if err != nil {
-			log.Printf("%s: Error retrieving database list for user: %v\n", pageName, err)
-			errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list for user")
-			return
-		}
-		if !desc.Valid {
-			oneRow.Description = ""
-		} else {
-			oneRow.Description = fmt.Sprintf(": %s", desc.String)
-		}
-		pageData.DBRows = append(pageData.DBRows, oneRow)
+	pageData.Databases.Pager, err = getListPage(r, "page", total)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
-
-	// Render the page
-	t := tmpl.Lookup("userPage")
-	err = t.Execute(w, pageData)
+	pageData.Databases.DBs, err = getUserDBSection(ctx, userName, true, pageData.ListOptions,
+		pageData.Databases.Pager.Offset, loggedInUser)
 	if err != nil {
-		log.Printf("Error: %s", err)
+		log.Printf("%s: Error retrieving database list for user: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error retrieving database list for user")
+		return
 	}
+
+	// Render the page
+	renderTemplate(w, "userPage", pageData)
 }
 
 func visualisePage(w http.ResponseWriter, r *http.Request) {
+	pageName := "Visualise page"
+
 	// Structure to hold page data
 	var pageData struct {
 		Meta     metaInfo
 		DB       sqliteDBinfo
 		Data     sqliteRecordSet
 		ColNames []string
+		State    visState
 	}
 	pageData.Meta.Title = "Visualise data"
 
@@ -765,35 +1229,45 @@ func visualisePage(w http.ResponseWriter, r *http.Request) {
 	pageData.Meta.Username = userName
 	pageData.Meta.Database = dbName
 
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		loggedInUser = fmt.Sprintf("%s", sess.CAttr("UserName"))
-		pageData.Meta.LoggedInUser = loggedInUser
-	}
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+	pageData.Meta.LoggedInUser = loggedInUser
 
 	// Check if the user has access to the requested database
-	err = checkUserDBAccess(&pageData.DB, loggedInUser, pageData.Meta.Username, dbName)
+	ctx := r.Context()
+	err = checkUserDBAccessCtx(ctx, &pageData.DB, loggedInUser, pageData.Meta.Username, dbName)
+	if clientGone(ctx, pageName) {
+		return
+	}
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+		errorPage(w, r, versionErrorStatus(err), err.Error())
 		return
 	}
+	pageData.Meta.Version = pageData.DB.Info.Version
+	if !pageData.DB.Info.Public {
+		noIndex(w)
+	}
 
 	// Get a handle from Minio for the database object
-	db, err := openMinioObject(pageData.DB.MinioBkt, pageData.DB.MinioId)
+	db, err := openMinioObjectCtx(ctx, pageData.DB.MinioBkt, pageData.DB.MinioId)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err == errTooManyOpenDBs {
+		serverBusy(w, r)
+		return
+	}
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-	defer db.Close()
+	defer closeMinioObject(db)
 
 	// Retrieve the list of tables in the database
 	tables, err := db.Tables("")
 	if err != nil {
+		// Without the table list there's nothing to show, unlike when just one table can't be read
 		log.Printf("Error retrieving table names: %s", err)
-		// TODO: Add proper error handing here.  Maybe display the page, but show the error where
-		// TODO  the table data would otherwise be?
 		errorPage(w, r, http.StatusInternalServerError,
 			fmt.Sprintf("Error reading from '%s'.  Possibly encrypted or not a database?", dbName))
 		return
@@ -821,37 +1295,61 @@ func visualisePage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// If no specific table was requested, just choose the first one given to us in the list from the database
+	// Logged in users start with the visualisation settings they last used, if they're for this table.  When no
+	// table was requested, the one they last used is chosen if it's still there
+	var state visState
+	if loggedInUser != "" {
+		state = getDBState(loggedInUser, userName, dbName).Vis
+	}
+	if requestedTable == "" && state.Table != "" {
+		for _, tableName := range tables {
+			if state.Table == tableName {
+				requestedTable = tableName
+			}
+		}
+	}
+
+	// If no specific table was requested, use the default one
 	if requestedTable == "" {
-		requestedTable = tables[0]
+		requestedTable = landingTable(tables, readVirtualTables(db), getDefaultTable(userName, dbName))
 	}
 	pageData.Data.Tablename = requestedTable
+	if state.Table == requestedTable {
+		pageData.State = state
+	}
 
-	// Retrieve a list of all column names in the specified table
-	var tempStruct sqliteRecordSet
-	tempStruct, err = readSQLiteDB(db, requestedTable, 1)
-	if err != nil {
-		// Some kind of error when reading the database data
-		errorPage(w, r, http.StatusBadRequest, err.Error())
-		return
+	// Retrieve a list of all column names in the specified table.  The rows themselves are retrieved by the front end
+	// from /x/visdata/ once it knows what to draw, so big tables don't slow down loading the page
+	var names []string
+	cols, err := tableColumns(db, requestedTable)
+	for _, c := range cols {
+		names = append(names, c.Name)
 	}
-	pageData.ColNames = tempStruct.ColNames
+	pageData.ColNames = names
+	pageData.Data = sqliteRecordSet{Tablename: requestedTable, ColNames: names, ColCount: len(names),
+		Records: []dataRow{}}
 
 	// TODO: If a full visualisation profile was specified, we should gather the data for it and provide it to the
 	// TODO  render function
 
-	// Read all of the data from the requested (or default) table, add it to the page data
-	pageData.Data, err = readSQLiteDB(db, requestedTable, 1000) // 1000 row maximum for now
-	if err != nil {
-		// Some kind of error when reading the database data
-		errorPage(w, r, http.StatusBadRequest, err.Error())
-		return
+	// The rows can still be included in the page when asked for, for reading without running the front end
+	if err == nil && r.FormValue("embed") == "1" {
+		sctx, cancel := sqliteContext(ctx)
+		defer cancel()
+		pageData.Data, err = readSQLiteDBColsSampled(sctx, db, requestedTable, false, false, 1000, "", nil, "*")
+		if clientGone(ctx, pageName) {
+			return
+		}
 	}
 
-	// Render the page
-	t := tmpl.Lookup("visualisePage")
-	err = t.Execute(w, pageData)
+	// When the table can't be read, the reason is shown in place of the chart so the other tables can still be chosen
 	if err != nil {
-		log.Printf("Error: %s", err)
+		log.Printf("%s: Error reading table '%s' of '%s/%s': %v\n", pageName, requestedTable, userName, dbName, err)
+		pageData.ColNames = []string{}
+		pageData.Data = sqliteRecordSet{Tablename: requestedTable, ColNames: []string{}, Records: []dataRow{},
+			ReadError: tableReadError(requestedTable, err)}
 	}
+
+	// Render the page
+	renderTemplate(w, "visualisePage", pageData)
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// The header of every page has a menu of the databases a logged in user has recently viewed, along with the ones
+// they've starred.  The menu is kept in one cache entry per user, so showing it costs a single cache get.  When the
+// cache can't be reached the menu is just left empty
+
+// How many databases are kept in each part of the menu
+const (
+	quickAccessRecent  = 10
+	quickAccessStarred = 10
+)
+
+// How long the menu is kept after the user last viewed a database, in seconds
+const quickAccessCacheTime = 2592000
+
+// How long the user's access to the databases in the menu is trusted before being checked again.  Databases which
+// have been deleted, or made private by someone else, drop out of the menu when it's checked
+const quickAccessCheckInterval = 2 * time.Minute
+
+// A database listed in the menu
+type quickAccessDB struct {
+	Owner string
+	Name  string
+}
+
+// The databases in a user's menu, newest first
+type quickAccessMenu struct {
+	Recent      []quickAccessDB
+	Starred     []quickAccessDB
+	StarsLoaded bool      // Whether Starred has been filled in from the database yet
+	Checked     time.Time // When the user's access to the databases was last checked
+}
+
+// Returns true if there's nothing to show in the menu
+func (m quickAccessMenu) Empty() bool {
+	return len(m.Recent) == 0 && len(m.Starred) == 0
+}
+
+// Returns the cache key for a user's menu
+func quickAccessCacheKey(userName string) string {
+	return "quickaccess/" + userName
+}
+
+// Returns the menu for a user.  Nothing is returned for people who aren't logged in, or if anything goes wrong
+func getQuickAccess(loggedInUser string) (menu quickAccessMenu) {
+	if loggedInUser == "" {
+		return
+	}
+	ok, err := getCachedData(quickAccessCacheKey(loggedInUser), &menu)
+	if err != nil {
+		log.Printf("Error retrieving quick access menu for user '%s': %v\n", loggedInUser, err)
+		return quickAccessMenu{}
+	}
+	if !ok {
+		return quickAccessMenu{}
+	}
+	if time.Since(menu.Checked) < quickAccessCheckInterval {
+		return
+	}
+
+	// Drop any databases the user can't see any more
+	visible, err := visibleDatabases(loggedInUser, append(menu.Recent, menu.Starred...))
+	if err != nil {
+		log.Printf("Error checking quick access menu for user '%s': %v\n", loggedInUser, err)
+		return quickAccessMenu{}
+	}
+	menu.Recent = filterQuickAccess(menu.Recent, visible)
+	menu.Starred = filterQuickAccess(menu.Starred, visible)
+	menu.Checked = time.Now()
+	saveQuickAccess(loggedInUser, menu)
+	return
+}
+
+// Returns the databases in a list which are also in the given set
+func filterQuickAccess(dbs []quickAccessDB, keep map[quickAccessDB]bool) (kept []quickAccessDB) {
+	for _, d := range dbs {
+		if keep[d] {
+			kept = append(kept, d)
+		}
+	}
+	return
+}
+
+// Returns which of the given databases the user can see.  These are their own, and other people's which have at
+// least one public version
+func visibleDatabases(loggedInUser string, dbs []quickAccessDB) (map[quickAccessDB]bool, error) {
+	visible := make(map[quickAccessDB]bool)
+	if len(dbs) == 0 {
+		return visible, nil
+	}
+	owners := make([]string, 0, len(dbs))
+	names := make([]string, 0, len(dbs))
+	for _, d := range dbs {
+		owners = append(owners, d.Owner)
+		names = append(names, d.Name)
+	}
+	rows, err := db.Query(`
+		SELECT db.username, db.dbname
+		FROM sqlite_databases AS db, unnest($1::text[], $2::text[]) AS req (owner, name)
+		WHERE db.username = req.owner
+			AND db.dbname = req.name
+			AND (db.username = $3
+				OR EXISTS (
+					SELECT 1
+					FROM database_versions AS ver
+					WHERE ver.db = db.idnum
+						AND ver.public = true))`, owners, names, loggedInUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d quickAccessDB
+		err = rows.Scan(&d.Owner, &d.Name)
+		if err != nil {
+			return nil, err
+		}
+		visible[d] = true
+	}
+	return visible, rows.Err()
+}
+
+// Returns the databases a user has starred which they can still see, most recently starred first
+func starredDatabases(loggedInUser string) (dbs []quickAccessDB, err error) {
+	rows, err := db.Query(`
+		SELECT db.username, db.dbname
+		FROM database_stars AS stars, sqlite_databases AS db
+		WHERE stars.db = db.idnum
+			AND stars.username = $1
+			AND (db.username = $1
+				OR EXISTS (
+					SELECT 1
+					FROM database_versions AS ver
+					WHERE ver.db = db.idnum
+						AND ver.public = true))
+		ORDER BY stars.date_starred DESC
+		LIMIT $2`, loggedInUser, quickAccessStarred)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d quickAccessDB
+		err = rows.Scan(&d.Owner, &d.Name)
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, d)
+	}
+	return dbs, rows.Err()
+}
+
+// Saves a user's menu to the cache
+func saveQuickAccess(loggedInUser string, menu quickAccessMenu) {
+	err := cacheData(quickAccessCacheKey(loggedInUser), menu, quickAccessCacheTime)
+	if err != nil {
+		log.Printf("Error saving quick access menu for user '%s': %v\n", loggedInUser, err)
+	}
+}
+
+// Moves a database to the front of a list, adding it if it's not there already, and keeps the list to its limit
+func pushQuickAccess(dbs []quickAccessDB, d quickAccessDB, limit int) []quickAccessDB {
+	list := []quickAccessDB{d}
+	for _, old := range dbs {
+		if old != d && len(list) < limit {
+			list = append(list, old)
+		}
+	}
+	return list
+}
+
+// Removes a database from a list
+func dropQuickAccess(dbs []quickAccessDB, d quickAccessDB) (list []quickAccessDB) {
+	for _, old := range dbs {
+		if old != d {
+			list = append(list, old)
+		}
+	}
+	return
+}
+
+// Adds a database the user has just viewed to their menu.  The user has just been checked as able to see it, so
+// this is only called after that
+func recordQuickAccessView(loggedInUser string, owner string, dbName string) {
+	if loggedInUser == "" {
+		return
+	}
+	var menu quickAccessMenu
+	ok, err := getCachedData(quickAccessCacheKey(loggedInUser), &menu)
+	if err != nil {
+		log.Printf("Error retrieving quick access menu for user '%s': %v\n", loggedInUser, err)
+		return
+	}
+	if !ok {
+		menu.Checked = time.Now()
+	}
+	if !menu.StarsLoaded {
+		menu.Starred, err = starredDatabases(loggedInUser)
+		if err != nil {
+			log.Printf("Error retrieving starred databases for user '%s': %v\n", loggedInUser, err)
+		} else {
+			menu.StarsLoaded = true
+		}
+	}
+	menu.Recent = pushQuickAccess(menu.Recent, quickAccessDB{owner, dbName}, quickAccessRecent)
+	saveQuickAccess(loggedInUser, menu)
+}
+
+// Updates the starred part of a user's menu after they star or unstar a database.  If the user doesn't have a menu
+// yet, their stars are read when they next view a database
+func recordQuickAccessStar(loggedInUser string, owner string, dbName string, starred bool) {
+	var menu quickAccessMenu
+	ok, err := getCachedData(quickAccessCacheKey(loggedInUser), &menu)
+	if err != nil {
+		log.Printf("Error retrieving quick access menu for user '%s': %v\n", loggedInUser, err)
+		return
+	}
+	if !ok || !menu.StarsLoaded {
+		return
+	}
+	d := quickAccessDB{owner, dbName}
+	if starred {
+		menu.Starred = pushQuickAccess(menu.Starred, d, quickAccessStarred)
+	} else {
+		menu.Starred = dropQuickAccess(menu.Starred, d)
+	}
+	saveQuickAccess(loggedInUser, menu)
+}
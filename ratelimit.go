@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// The kinds of traffic which are rate limited separately
+type limitClass int
+
+const (
+	limitPages limitClass = iota
+	limitAPI
+	limitDownloads
+)
+
+// The number of requests turned away for each kind of traffic since startup.  Updated atomically
+var rateLimitedCount [3]uint64
+
+// The number of times the rate limit couldn't be checked, so the request was let through
+var rateLimitErrors uint64
+
+// Returns the name of a kind of traffic, as used in the rate limit keys and logging
+func (c limitClass) String() string {
+	switch c {
+	case limitAPI:
+		return "api"
+	case limitDownloads:
+		return "downloads"
+	}
+	return "pages"
+}
+
+// Returns the requests per minute allowed for a kind of traffic from anonymous visitors
+func (l rateLimitInfo) anonLimit(class limitClass) int {
+	switch class {
+	case limitAPI:
+		return l.API
+	case limitDownloads:
+		return l.Downloads
+	}
+	return l.Pages
+}
+
+// Returns the requests per minute allowed for a kind of traffic from logged in users
+func (l rateLimitInfo) userLimit(class limitClass) int {
+	switch class {
+	case limitAPI:
+		return l.UserAPI
+	case limitDownloads:
+		return l.UserDownloads
+	}
+	return l.UserPages
+}
+
+// Wraps a handler with a rate limit for the given kind of traffic
+func rateLimit(class limitClass, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowRequest(w, r, class) {
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// Counts a request against the rate limit of the client making it.  Logged in users are limited by their username,
+// everyone else by IP address.  When the request is over the limit, a 429 response has already been sent and false
+// is returned
+func allowRequest(w http.ResponseWriter, r *http.Request, class limitClass) bool {
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+
+	// Work out which limit applies
+	var key string
+	var limit int
+	if loggedInUser != "" {
+		key = "rl-" + class.String() + "-u-" + loggedInUser
+		limit = conf.RateLimit.userLimit(class)
+	} else {
+		key = "rl-" + class.String() + "-ip-" + clientIP(r)
+		limit = conf.RateLimit.anonLimit(class)
+	}
+	if conf.RateLimit.Disabled || limit <= 0 {
+		return true
+	}
+
+	ok, wait, err := takeToken(key, limit)
+	if err != nil {
+		atomic.AddUint64(&rateLimitErrors, 1)
+		log.Printf("Error checking %s rate limit for '%s': %v\n", class, key, err)
+	}
+	if ok {
+		return true
+	}
+	atomic.AddUint64(&rateLimitedCount[class], 1)
+
+	// Tell the client how long until a request will be let through again, rounded up to the next second
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	msg := "Too many requests.  Please wait a moment and try again."
+	if class == limitAPI {
+		jsonError(w, http.StatusTooManyRequests, msg)
+		return false
+	}
+	errorPage(w, r, http.StatusTooManyRequests, msg)
+	return false
+}
+
+// Returns the number of requests turned away by the rate limits since startup, for each kind of traffic, and the
+// number of times the limit couldn't be checked
+func rateLimitStats() (pages uint64, api uint64, downloads uint64, errors uint64) {
+	return atomic.LoadUint64(&rateLimitedCount[limitPages]), atomic.LoadUint64(&rateLimitedCount[limitAPI]),
+		atomic.LoadUint64(&rateLimitedCount[limitDownloads]), atomic.LoadUint64(&rateLimitErrors)
+}
+
+// Counts an attempt at something limited to a number of attempts per hour, such as abuse reports from an IP address,
+// and returns whether this one is within the limit.  The counter is kept in Memcached, so the limit holds across all
+// of the web servers.  While the cache is known to be down the attempt is allowed
+func hourlyLimitAllows(cacheKey string, limit int) (bool, error) {
+	if !cacheAvailable() {
+		return true, nil
+	}
+	count, err := memCache.Increment(cacheKey, 1)
+	defer func() { cacheResult(err) }()
+	if err == memcache.ErrCacheMiss {
+		// First attempt in the current window
+		err = memCache.Add(&memcache.Item{Key: cacheKey, Value: []byte("1"), Expiration: 3600})
+		if err == memcache.ErrNotStored {
+			// Another request created the counter first, so count against that instead
+			count, err = memCache.Increment(cacheKey, 1)
+			if err != nil {
+				return false, err
+			}
+			return count <= uint64(limit), nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	return count <= uint64(limit), nil
+}
+
+// Takes a token from a token bucket kept in Memcached, so the limits hold across all of the web servers.  The bucket
+// holds a minute's worth of requests, and refills continuously.  When the bucket is empty, the time until the next
+// token is available is returned.  If the cache can't be used, requests are let through rather than the site being
+// taken down with it
+func takeToken(key string, perMinute int) (bool, time.Duration, error) {
+	if !cacheAvailable() {
+		return true, 0, nil
+	}
+	capacity := float64(perMinute)
+	rate := capacity / 60 // Tokens per second
+
+	// Another server can update the bucket between reading and writing it, in which case try again a few times
+	for i := 0; i < 3; i++ {
+		now := time.Now()
+		item, err := memCache.Get(key)
+		if err == memcache.ErrCacheMiss {
+			// Buckets expire once they would have refilled, so a missing one is full
+			err = memCache.Add(&memcache.Item{Key: key, Value: encodeBucket(capacity-1, now), Expiration: 60})
+			if err == memcache.ErrNotStored {
+				continue
+			}
+			cacheResult(err)
+			return true, 0, err
+		}
+		if err != nil {
+			cacheResult(err)
+			return true, 0, err
+		}
+
+		// Refill the bucket for the time since it was last used
+		tokens, last, ok := decodeBucket(item.Value)
+		if !ok {
+			tokens, last = capacity, now
+		}
+		tokens = math.Min(capacity, tokens+now.Sub(last).Seconds()*rate)
+		allowed := tokens >= 1
+		if allowed {
+			tokens--
+		}
+		item.Value = encodeBucket(tokens, now)
+		item.Expiration = 60
+		err = memCache.CompareAndSwap(item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		cacheResult(err)
+		if err != nil {
+			return true, 0, err
+		}
+		if allowed {
+			return true, 0, nil
+		}
+		return false, time.Duration((1 - tokens) / rate * float64(time.Second)), nil
+	}
+
+	// The bucket is too busy to update, which only happens with lots of requests for the same client at once
+	return false, time.Second, nil
+}
+
+// Token buckets are stored as the number of tokens left, and when that was worked out
+func encodeBucket(tokens float64, when time.Time) []byte {
+	return []byte(strconv.FormatFloat(tokens, 'f', 3, 64) + ":" + strconv.FormatInt(when.UnixNano(), 10))
+}
+
+func decodeBucket(b []byte) (float64, time.Time, bool) {
+	s := strings.SplitN(string(b), ":", 2)
+	if len(s) != 2 {
+		return 0, time.Time{}, false
+	}
+	tokens, err := strconv.ParseFloat(s[0], 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	when, err := strconv.ParseInt(s[1], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return tokens, time.Unix(0, when), true
+}
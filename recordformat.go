@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	com "github.com/dbhubio/common"
+)
+
+// The shapes the table data endpoint returns rows in.  The full one gives each value as an object with its column
+// name and type.  The compact one gives each row as an array of values in the same order as ColNames, which is much
+// smaller for wide tables.  The Format field of the response says which one was used
+const (
+	recordsFormatFull    = "full"
+	recordsFormatCompact = "compact"
+)
+
+// A record set in the compact shape.  Values are strings, or null for NULL.  The types of the columns are in
+// ColTypes, and any values cut short for display are listed in Truncated
+type compactRecordSet struct {
+	sqliteRecordSet
+	Records   [][]interface{}
+	Truncated [][2]int `json:",omitempty"` // The row and column of each value cut short
+}
+
+// Converts a record set to the compact shape
+func compactRecords(rs sqliteRecordSet) compactRecordSet {
+	c := compactRecordSet{sqliteRecordSet: rs, Records: make([][]interface{}, 0, len(rs.Records))}
+	c.Format = recordsFormatCompact
+	for i, row := range rs.Records {
+		vals := make([]interface{}, len(row))
+		for j, v := range row {
+			if v.Type != Null {
+				vals[j] = v.Value
+			}
+			if v.Truncated {
+				c.Truncated = append(c.Truncated, [2]int{i, j})
+			}
+		}
+		c.Records = append(c.Records, vals)
+	}
+	return c
+}
+
+// Returns the columns asked for with the cols parameter, which can be given more than once and can hold several
+// names separated by commas.  The names are checked for being reasonable here, and against the table once it's open
+func requestedColumns(r *http.Request) ([]string, error) {
+	var cols []string
+	for _, v := range r.Form["cols"] {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.TrimSpace(c)
+			if c == "" {
+				continue
+			}
+			if err := com.ValidatePGTable(c); err != nil {
+				return nil, err
+			}
+			cols = append(cols, c)
+		}
+	}
+	return cols, nil
+}
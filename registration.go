@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// The protections against bots signing up are set in the [registration] section of the config.  Rejected attempts
+// are logged with a hash of the IP address rather than the address itself, which is enough to tell whether the
+// attempts are coming from one place when tuning the settings
+
+// The name of the hidden registration form field which only bots fill in.  It's named like something a form filler
+// would expect to complete
+const registrationHoneypotField = "website"
+
+// Number of seconds a registration challenge can be answered in
+const registrationChallengeExpiry = 1800
+
+// Salted into the IP address hashes written to the log, so they can't be reversed by hashing every address.  It's
+// different each time the server starts, so hashes can only be compared within a run
+var ipLogSalt = randomToken()
+
+// A question asked on the registration form.  The answer is kept in the cache, found with the token
+type registrationChallenge struct {
+	Token    string
+	Question string
+}
+
+// Returns a random hex string, for tokens which need to be hard to guess
+func randomToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Printf("Error generating random token: %v\n", err)
+		return randomString(32)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Returns a short hash of the IP address a request came from, for logging
+func hashedIP(r *http.Request) string {
+	sum := sha256.Sum256([]byte(ipLogSalt + clientIP(r)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Logs why a registration attempt was turned away
+func logRegistrationRejected(r *http.Request, reason string) {
+	log.Printf("Registration rejected: %s.  IP hash: %s, user agent: %q\n", reason, hashedIP(r), r.UserAgent())
+}
+
+// Makes a new arithmetic question for the registration form.  Without the cache there's nowhere to keep the
+// answer, so no question is asked then and checkRegistrationChallenge() lets the registration through
+func newRegistrationChallenge() registrationChallenge {
+	if !cacheAvailable() {
+		return registrationChallenge{}
+	}
+	a, b := mathrand.Intn(10)+1, mathrand.Intn(10)+1
+	c := registrationChallenge{Token: randomToken(), Question: fmt.Sprintf("What is %d plus %d?", a, b)}
+	err := cacheData("regchallenge-"+c.Token, a+b, registrationChallengeExpiry)
+	if err != nil {
+		log.Printf("Error storing registration challenge: %v\n", err)
+		return registrationChallenge{}
+	}
+	return c
+}
+
+// Checks the answer to a registration challenge.  Each challenge can only be answered once
+func checkRegistrationChallenge(token string, answer string) bool {
+	if !cacheAvailable() {
+		return true
+	}
+	if token == "" {
+		return false
+	}
+	var want int
+	ok, err := getCachedData("regchallenge-"+token, &want)
+	if err != nil {
+		log.Printf("Error retrieving registration challenge: %v\n", err)
+		return true
+	}
+	if !ok {
+		return false
+	}
+	err = memCache.Delete(cacheKeyPrefix + "regchallenge-" + token)
+	if err != nil && err != memcache.ErrCacheMiss {
+		cacheResult(err)
+		log.Printf("Error removing registration challenge: %v\n", err)
+	}
+	got, err := strconv.Atoi(strings.TrimSpace(answer))
+	return err == nil && got == want
+}
+
+// Returns the domain of an email address if it's one registrations aren't allowed from
+func blockedEmailDomain(email string) (string, bool) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(email[at+1:], "."))
+	for _, j := range conf.Registration.BlockedDomains {
+		blocked := strings.ToLower(strings.TrimSpace(j))
+		if blocked != "" && (domain == blocked || strings.HasSuffix(domain, "."+blocked)) {
+			return domain, true
+		}
+	}
+	return "", false
+}
+
+// Runs the checks for bots which happen before the registration details are looked at.  If the attempt is turned
+// away, the response has already been sent and false is returned
+func registrationAllowed(w http.ResponseWriter, r *http.Request) bool {
+	// Bots filling in the hidden field are told the account was made, so they don't learn to leave it alone
+	if conf.Registration.Honeypot && r.PostFormValue(registrationHoneypotField) != "" {
+		logRegistrationRejected(r, "hidden field filled in")
+		registrationSucceeded(w)
+		return false
+	}
+
+	if conf.Registration.PerIPLimit > 0 {
+		ok, err := hourlyLimitAllows("reg-ip-"+clientIP(r), conf.Registration.PerIPLimit)
+		if err != nil {
+			log.Printf("Error checking registration rate limit: %v\n", err)
+		} else if !ok {
+			logRegistrationRejected(r, "too many attempts from the address")
+			errorPage(w, r, http.StatusTooManyRequests, "Too many accounts have been registered from your "+
+				"address.  Please try again later.")
+			return false
+		}
+	}
+
+	if conf.Registration.Challenge && !checkRegistrationChallenge(r.PostFormValue("challenge_token"),
+		r.PostFormValue("challenge_answer")) {
+		logRegistrationRejected(r, "wrong or expired challenge answer")
+		errorPage(w, r, http.StatusBadRequest, "The answer to the question wasn't right.  Please go back, reload "+
+			"the page, and try again.")
+		return false
+	}
+	return true
+}
+
+// Tells the person registering their account was created
+func registrationSucceeded(w http.ResponseWriter) {
+	// TODO: Display a proper success page
+	// TODO: This should probably bounce the user to their logged in profile page
+	w.Header().Set("Content-Type", contentTypeHTML)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, `<html><body>Account created successfully, please login: <a href="/login">Login</a></body></html>`)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+// The number of abuse reports a single IP address can submit per hour
+const reportRateLimit = 5
+
+// The reasons a database can be reported for
+var reportReasons = []string{
+	"Copyright infringement",
+	"Personal or private information",
+	"Malware or exploit",
+	"Spam",
+	"Other",
+}
+
+// Checks whether the given IP address is allowed to submit another abuse report, counting this attempt if so.
+// Without the cache there's nothing to count with, so people aren't stopped from reporting abuse
+func reportAllowed(ip string) (bool, error) {
+	return hourlyLimitAllows("report-ip-"+ip, reportRateLimit)
+}
+
+// Displays the abuse report form for a public database, and stores the report when the form is submitted
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Report handler"
+
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/report/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+
+	// Only public databases can be reported, so check it's available to anonymous users
+	var dbInfo sqliteDBinfo
+	err = checkUserDBAccess(&dbInfo, "", userName, dbName)
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+
+	var pageData struct {
+		Meta      metaInfo
+		Reasons   []string
+		Submitted bool
+	}
+	pageData.Meta.Title = "Report " + userName + "/" + dbName
+	pageData.Meta.Username = userName
+	pageData.Meta.Database = dbName
+	pageData.Meta.LoggedInUser = loggedInUser
+	pageData.Reasons = reportReasons
+
+	// Render the report form
+	if r.Method != http.MethodPost {
+		renderTemplate(w, "reportPage", pageData)
+		return
+	}
+
+	// Validate the submitted report
+	reason := r.PostFormValue("reason")
+	validReason := false
+	for _, j := range reportReasons {
+		if reason == j {
+			validReason = true
+			break
+		}
+	}
+	if !validReason {
+		errorPage(w, r, http.StatusBadRequest, "Unknown report reason")
+		return
+	}
+	details := strings.TrimSpace(r.PostFormValue("details"))
+	if len(details) > 2000 {
+		errorPage(w, r, http.StatusBadRequest, "Report details can't be longer than 2000 characters")
+		return
+	}
+
+	// Limit the number of reports which can be submitted from one place
+	ip := clientIP(r)
+	ok, err := reportAllowed(ip)
+	if err != nil {
+		log.Printf("%s: Error checking report rate limit for '%s': %v\n", pageName, ip, err)
+		errorPage(w, r, http.StatusInternalServerError, "Something went wrong when submitting the report")
+		return
+	}
+	if !ok {
+		errorPage(w, r, http.StatusTooManyRequests, "Too many reports have been submitted.  Please try again later.")
+		return
+	}
+
+	// Anonymous reports are stored with only the IP address of the reporter
+	reporter := pgx.NullString{String: loggedInUser, Valid: loggedInUser != ""}
+	commandTag, err := db.Exec(`
+		INSERT INTO abuse_reports (db, reason, details, reporter, reporter_ip)
+		SELECT idnum, $3, $4, $5, $6
+		FROM sqlite_databases
+		WHERE username = $1
+			AND dbname = $2`, userName, dbName, reason, details, reporter, ip)
+	if err != nil {
+		log.Printf("%s: Storing report for '%s/%s' failed: %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("%s: Wrong number of rows affected: %v, database: %v/%v\n", pageName, numRows, userName,
+			dbName)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	log.Printf("%s: Database '%s/%s' reported for '%s'\n", pageName, userName, dbName, reason)
+
+	// Let the reporter know it was received
+	pageData.Submitted = true
+	renderTemplate(w, "reportPage", pageData)
+}
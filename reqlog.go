@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// The places incoming requests can be logged to
+const (
+	reqLogFile     = "file"
+	reqLogPostgres = "postgres"
+	reqLogBoth     = "both"
+)
+
+// The maximum number of request records written to PostgreSQL in one go
+const reqLogBatchSize = 500
+
+// How long queued request records can wait before being written, when the batch isn't yet full
+const reqLogFlushInterval = 5 * time.Second
+
+// The details of a single request, as written to PostgreSQL
+type requestRecord struct {
+	Timestamp time.Time
+	User      string
+	Method    string
+	Path      string
+	Status    int
+	Duration  time.Duration
+	Bytes     int64
+	UserAgent string
+}
+
+// Wraps a ResponseWriter, keeping track of the status code and number of bytes sent
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+
+	// Attempts to set the status after it was already sent.  These point to a handler which wrote part of a response
+	// before deciding it failed
+	extraStatus []int
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status != 0 {
+		// The status has gone out already, so passing this on would only get a "superfluous WriteHeader" warning
+		s.extraStatus = append(s.extraStatus, code)
+		return
+	}
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Passes flushes on to the wrapped ResponseWriter, so responses which are streamed reach the client as they're
+// written rather than when the handler finishes
+func (s *statusRecorder) Flush() {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Request records waiting to be written to PostgreSQL.  When the writer can't keep up, new records are dropped
+// instead of holding up requests
+var reqLogQueue = make(chan requestRecord, 10000)
+
+// Returns true if request records should be written to the request log file
+func reqLogToFile() bool {
+	return conf.Web.RequestLogBackend == reqLogFile || conf.Web.RequestLogBackend == reqLogBoth
+}
+
+// Returns true if request records should be written to PostgreSQL
+func reqLogToPostgres() bool {
+	return conf.Web.RequestLogBackend == reqLogPostgres || conf.Web.RequestLogBackend == reqLogBoth
+}
+
+// Ensures the daily request_log partitions for today and tomorrow exist, and drops any older than the retention
+// period
+func maintainReqLogPartitions(conn *pgx.Conn) error {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for _, day := range []time.Time{today, today.AddDate(0, 0, 1)} {
+		_, err := conn.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS request_log_%s
+			PARTITION OF request_log
+			FOR VALUES FROM ('%s') TO ('%s')`, day.Format("20060102"), day.Format("2006-01-02"),
+			day.AddDate(0, 0, 1).Format("2006-01-02")))
+		if err != nil {
+			return err
+		}
+	}
+
+	// A retention period of 0 keeps everything
+	if conf.Web.RequestLogRetention <= 0 {
+		return nil
+	}
+	rows, err := conn.Query(`
+		SELECT child.relname
+		FROM pg_inherits AS inh, pg_class AS parent, pg_class AS child
+		WHERE inh.inhparent = parent.oid
+			AND inh.inhrelid = child.oid
+			AND parent.relname = 'request_log'`)
+	if err != nil {
+		return err
+	}
+	var expired []string
+	cutoff := today.AddDate(0, 0, -conf.Web.RequestLogRetention)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		day, err := time.Parse("20060102", strings.TrimPrefix(name, "request_log_"))
+		if err != nil {
+			// Not one of our partitions
+			continue
+		}
+		if day.Before(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	for _, name := range expired {
+		_, err = conn.Exec(fmt.Sprintf(`DROP TABLE %s`, name))
+		if err != nil {
+			return err
+		}
+		log.Printf("Dropped expired request log partition: %s\n", name)
+	}
+	return nil
+}
+
+// Writes queued request records to PostgreSQL in batches.  This uses its own connection, so a slow request log
+// doesn't hold up the queries for serving pages
+func requestLogWriter() {
+	var conn *pgx.Conn
+	err := withRetries("PostgreSQL request log", func() (err error) {
+		conn, err = pgx.Connect(*pgConfig)
+		return
+	})
+	if err != nil {
+		log.Fatalf("Couldn't connect to database for request logging\n\n%v", err)
+	}
+	defer func() { conn.Close() }()
+
+	err = maintainReqLogPartitions(conn)
+	if err != nil {
+		log.Fatalf("Error when setting up request log partitions: %v\n", err)
+	}
+	lastMaintenance := time.Now()
+
+	var batch []requestRecord
+	ticker := time.NewTicker(reqLogFlushInterval)
+	for {
+		select {
+		case rec := <-reqLogQueue:
+			batch = append(batch, rec)
+			if len(batch) < reqLogBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		// Check the partitions once an hour, so new days and expired days are taken care of
+		if time.Since(lastMaintenance) > time.Hour {
+			err = maintainReqLogPartitions(conn)
+			if err != nil {
+				log.Printf("Error maintaining request log partitions: %v\n", err)
+			}
+			lastMaintenance = time.Now()
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+		err = writeRequestRecords(conn, batch)
+		if err != nil {
+			log.Printf("Error writing %d request log records: %v\n", len(batch), err)
+
+			// Reconnect if the connection has died.  If that fails too, the next batch tries again
+			if !conn.IsAlive() {
+				newConn, err := pgx.Connect(*pgConfig)
+				if err != nil {
+					log.Printf("Error reconnecting to database for request logging: %v\n", err)
+				} else {
+					conn.Close()
+					conn = newConn
+				}
+			}
+		}
+		batch = batch[:0]
+	}
+}
+
+// Writes a batch of request records to PostgreSQL, in a single transaction
+func writeRequestRecords(conn *pgx.Conn, batch []requestRecord) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, rec := range batch {
+		_, err = tx.Exec(`
+			INSERT INTO request_log (timestamp, username, method, path, status, duration_ms, bytes, user_agent)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, rec.Timestamp, rec.User, rec.Method, rec.Path, rec.Status,
+			rec.Duration.Seconds()*1000, rec.Bytes, rec.UserAgent)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
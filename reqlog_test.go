@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatusRecorderNotesExtraStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := &statusRecorder{ResponseWriter: w}
+	rec.WriteHeader(http.StatusOK)
+	rec.WriteHeader(http.StatusInternalServerError)
+	if w.Code != http.StatusOK || rec.status != http.StatusOK {
+		t.Errorf("Expected the first status to be sent, got %d (recorded %d)", w.Code, rec.status)
+	}
+	if !reflect.DeepEqual(rec.extraStatus, []int{http.StatusInternalServerError}) {
+		t.Errorf("Unexpected extra status codes: %v", rec.extraStatus)
+	}
+
+	// Writing the body sends a 200 straight away, so a status set afterwards is one too many as well
+	w = httptest.NewRecorder()
+	rec = &statusRecorder{ResponseWriter: w}
+	rec.Write([]byte("partial"))
+	rec.WriteHeader(http.StatusNotFound)
+	if rec.status != http.StatusOK || !reflect.DeepEqual(rec.extraStatus, []int{http.StatusNotFound}) {
+		t.Errorf("Unexpected status %d and extra status codes %v", rec.status, rec.extraStatus)
+	}
+}
+
+// Swaps in a set of templates for a test, returning a function which puts the real ones back
+func useTestTemplates(text string) func() {
+	orig := tmpl
+	tmpl = template.Must(template.New("test").Delims("[[", "]]").Funcs(templateFuncs).Parse(text))
+	return func() {
+		tmpl = orig
+	}
+}
+
+func TestRenderTemplateSetsStatusOnce(t *testing.T) {
+	defer useTestTemplates(`[[ define "good" ]]Hello [[ .Name ]][[ end ]]` +
+		`[[ define "failing" ]]The start of the page [[ .Missing.Field ]][[ end ]]`)()
+
+	w := httptest.NewRecorder()
+	rec := &statusRecorder{ResponseWriter: w}
+	renderTemplateStatus(rec, http.StatusNotFound, "good", struct{ Name string }{"there"})
+	if rec.status != http.StatusNotFound || len(rec.extraStatus) != 0 || w.Body.String() != "Hello there" {
+		t.Errorf("Unexpected response: status %d, extra %v, body '%s'", rec.status, rec.extraStatus, w.Body)
+	}
+	if w.Header().Get("Content-Type") != contentTypeHTML {
+		t.Errorf("Unexpected Content-Type: %s", w.Header().Get("Content-Type"))
+	}
+
+	// A template which fails part way through gives an error, without any of the page being sent first
+	w = httptest.NewRecorder()
+	rec = &statusRecorder{ResponseWriter: w}
+	renderTemplateStatus(rec, http.StatusOK, "failing", struct{ Name string }{"there"})
+	if rec.status != http.StatusInternalServerError || len(rec.extraStatus) != 0 {
+		t.Errorf("Unexpected status %d and extra status codes %v", rec.status, rec.extraStatus)
+	}
+	if strings.Contains(w.Body.String(), "The start of the page") {
+		t.Errorf("Part of the failed page was sent")
+	}
+}
+
+// Runs a handler through logReq(), returning what it logged
+func logReqOutput(fn http.HandlerFunc) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	logReq(fn)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+	return buf.String()
+}
+
+func TestLogReqNotesExtraStatus(t *testing.T) {
+	out := logReqOutput(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		errorPage(w, r, http.StatusInternalServerError, "Something failed")
+	})
+	if !strings.Contains(out, "Response status for '/test' was set again after 200 was sent: [500]") {
+		t.Errorf("Handler setting the status twice wasn't logged.  Log output: %s", out)
+	}
+
+	out = logReqOutput(func(w http.ResponseWriter, r *http.Request) {
+		errorPage(w, r, http.StatusNotFound, "Not here")
+	})
+	if strings.Contains(out, "was set again") {
+		t.Errorf("Handler setting the status once was logged.  Log output: %s", out)
+	}
+}
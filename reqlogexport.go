@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formats the request log can be exported in
+const (
+	reqExportCSV       = "csv"
+	reqExportJSONLines = "jsonl"
+)
+
+// How many records are written between flushes of an export, so it reaches the browser as it goes instead of
+// building up in buffers
+const reqExportFlushRows = 1000
+
+// Matches a line of the request log file, as written by logReq()
+var reqLogLineRE = regexp.MustCompile(`^(\S+) - (\S+) \[([^\]]+)\] "(\S+) (\S+) [^"]*" "-" "-" "(.*)" "(.*)"$`)
+
+// The filters for exporting the request log.  Empty ones match everything
+type reqLogFilter struct {
+	From        time.Time // The start of the first day included
+	To          time.Time // The start of the day after the last one included
+	PathPrefix  string
+	StatusClass int // 2 for 2xx responses, 4 for 4xx, and so on
+	User        string
+}
+
+// Returns true if a request record matches the filter
+func (f reqLogFilter) Matches(rec requestRecord) bool {
+	if rec.Timestamp.Before(f.From) || !rec.Timestamp.Before(f.To) {
+		return false
+	}
+	if !strings.HasPrefix(rec.Path, f.PathPrefix) {
+		return false
+	}
+	if f.StatusClass != 0 && rec.Status/100 != f.StatusClass {
+		return false
+	}
+	return f.User == "" || rec.User == f.User
+}
+
+// Reads the export filter from a request.  The dates are whole days in UTC, and default to today
+func parseReqLogFilter(r *http.Request) (f reqLogFilter, err error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	f.From, f.To = today, today
+	if v := r.FormValue("from"); v != "" {
+		f.From, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return f, errors.New("Invalid start date")
+		}
+	}
+	if v := r.FormValue("to"); v != "" {
+		f.To, err = time.Parse("2006-01-02", v)
+		if err != nil {
+			return f, errors.New("Invalid end date")
+		}
+	}
+	if f.To.Before(f.From) {
+		return f, errors.New("The end date is before the start date")
+	}
+	f.To = f.To.AddDate(0, 0, 1)
+	if v := r.FormValue("status"); v != "" {
+		f.StatusClass, err = strconv.Atoi(v)
+		if err != nil || f.StatusClass < 1 || f.StatusClass > 5 {
+			return f, errors.New("Invalid status class")
+		}
+	}
+	f.PathPrefix = r.FormValue("path")
+	f.User = r.FormValue("username")
+	return f, nil
+}
+
+// A request record as exported.  Records read from the request log file don't include the status, duration or size
+// of the response, so those are left empty
+type reqExportRecord struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"username"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     *int      `json:"status"`
+	DurationMs *float64  `json:"duration_ms"`
+	Bytes      *int64    `json:"bytes"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+// Writes exported request records to the browser as CSV or JSON Lines
+type reqExporter struct {
+	w    http.ResponseWriter
+	csv  *csv.Writer
+	enc  *json.Encoder
+	rows int
+}
+
+// Writes a record, flushing every so often
+func (e *reqExporter) Write(rec reqExportRecord) (err error) {
+	if e.csv != nil {
+		var status, duration, size string
+		if rec.Status != nil {
+			status = strconv.Itoa(*rec.Status)
+		}
+		if rec.DurationMs != nil {
+			duration = strconv.FormatFloat(*rec.DurationMs, 'f', 3, 64)
+		}
+		if rec.Bytes != nil {
+			size = strconv.FormatInt(*rec.Bytes, 10)
+		}
+		err = e.csv.Write([]string{rec.Time.UTC().Format(time.RFC3339Nano), rec.User, rec.Method, rec.Path,
+			status, duration, size, rec.UserAgent})
+	} else {
+		err = e.enc.Encode(rec)
+	}
+	if err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%reqExportFlushRows == 0 {
+		return e.Flush()
+	}
+	return nil
+}
+
+// Sends anything buffered on to the browser
+func (e *reqExporter) Flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Sends the request records matching a filter from PostgreSQL to an exporter, oldest first.  The rows are read as
+// they're written out, so large ranges aren't held in memory
+func exportReqLogPostgres(ctx context.Context, f reqLogFilter, e *reqExporter) error {
+	rows, err := db.QueryEx(ctx, `
+		SELECT timestamp, username, method, path, status, duration_ms::float8, bytes::int8, user_agent
+		FROM request_log
+		WHERE timestamp >= $1
+			AND timestamp < $2
+			AND left(path, length($3)) = $3
+			AND ($4 = 0 OR status / 100 = $4)
+			AND ($5 = '' OR username = $5)
+		ORDER BY timestamp`, nil, f.From, f.To, f.PathPrefix, f.StatusClass, f.User)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec reqExportRecord
+		var status int
+		var duration float64
+		var size int64
+		err = rows.Scan(&rec.Time, &rec.User, &rec.Method, &rec.Path, &status, &duration, &size, &rec.UserAgent)
+		if err != nil {
+			return err
+		}
+		rec.Status, rec.DurationMs, rec.Bytes = &status, &duration, &size
+		err = e.Write(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Reads a line of the request log file.  Returns false for lines which aren't request records
+func parseReqLogLine(line string) (rec requestRecord, ok bool) {
+	m := reqLogLineRE.FindStringSubmatch(line)
+	if m == nil {
+		return rec, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, m[3])
+	if err != nil {
+		return rec, false
+	}
+	return requestRecord{Timestamp: ts, User: m[2], Method: m[4], Path: m[5], UserAgent: m[7]}, true
+}
+
+// Sends the request records matching a filter from the request log file to an exporter.  The file is read a line at
+// a time, so large files aren't held in memory.  Records in the file don't have a status, so none match a filter on
+// the status class
+func exportReqLogFile(ctx context.Context, f reqLogFilter, e *reqExporter) error {
+	file, err := os.Open(conf.Web.RequestLog)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rec, ok := parseReqLogLine(scanner.Text())
+		if !ok || !f.Matches(rec) {
+			continue
+		}
+		err = e.Write(reqExportRecord{Time: rec.Timestamp, User: rec.User, Method: rec.Method, Path: rec.Path,
+			UserAgent: rec.UserAgent})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Displays the form for exporting the request log.  When a format is given, the matching records are downloaded
+// instead
+func adminRequestsPage(w http.ResponseWriter, r *http.Request, adminUser string) {
+	var pageData struct {
+		Meta     metaInfo
+		From     string
+		To       string
+		Path     string
+		Status   int
+		Username string
+		Postgres bool // Whether records come from PostgreSQL rather than the request log file
+	}
+	pageData.Meta.Title = "Admin - Request log"
+	pageData.Meta.LoggedInUser = adminUser
+
+	filter, err := parseReqLogFilter(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch format := r.FormValue("format"); format {
+	case "":
+	case reqExportCSV, reqExportJSONLines:
+		adminRequestsExport(w, r, adminUser, filter, format)
+		return
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown export format")
+		return
+	}
+
+	pageData.From = filter.From.Format("2006-01-02")
+	pageData.To = filter.To.AddDate(0, 0, -1).Format("2006-01-02")
+	pageData.Path = filter.PathPrefix
+	pageData.Status = filter.StatusClass
+	pageData.Username = filter.User
+	pageData.Postgres = reqLogToPostgres()
+
+	// Render the page
+	renderTemplate(w, "adminRequestsPage", pageData)
+}
+
+// Streams the request records matching a filter to the browser.  Exports are audited, as the records say who went
+// where
+func adminRequestsExport(w http.ResponseWriter, r *http.Request, adminUser string, filter reqLogFilter,
+	format string) {
+	pageName := "Admin request log export"
+
+	source := reqLogFile
+	if reqLogToPostgres() {
+		source = reqLogPostgres
+	}
+	from, to := filter.From.Format("2006-01-02"), filter.To.AddDate(0, 0, -1).Format("2006-01-02")
+	err := auditLog(nil, r, adminUser, "export request log", auditTargetSite, "",
+		map[string]interface{}{"from": from, "to": to, "format": format, "path": filter.PathPrefix,
+			"status": filter.StatusClass, "username": filter.User, "source": source})
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", contentDisposition("attachment",
+		fmt.Sprintf("requests-%s-%s.%s", from, to, format)))
+	e := &reqExporter{w: w}
+	if format == reqExportCSV {
+		w.Header().Set("Content-Type", contentTypeCSV)
+		e.csv = csv.NewWriter(w)
+		err = e.csv.Write([]string{"time", "username", "method", "path", "status", "duration_ms", "bytes",
+			"user_agent"})
+	} else {
+		w.Header().Set("Content-Type", contentTypeJSONLines)
+		e.enc = json.NewEncoder(w)
+	}
+
+	if err == nil {
+		if source == reqLogPostgres {
+			err = exportReqLogPostgres(r.Context(), filter, e)
+		} else {
+			err = exportReqLogFile(r.Context(), filter, e)
+		}
+	}
+	if err != nil && e.rows == 0 && r.Context().Err() == nil {
+		// Nothing has gone to the browser yet, so it can still be told
+		log.Printf("%s: Error reading the request log: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "The request log couldn't be read")
+		return
+	}
+
+	// Once records have been sent, an error can't be shown to the browser, so it's only logged
+	if err == nil {
+		err = e.Flush()
+	}
+	if err != nil {
+		log.Printf("%s: Error writing request log export: %v\n", pageName, err)
+		return
+	}
+	log.Printf("%s: Admin '%s' exported %d request records from %s to %s\n", pageName, adminUser, e.rows, from,
+		to)
+}
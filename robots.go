@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The paths crawlers are asked to keep out of.  These are the routes registered in main() which either need a
+// logged in user or are only used by the pages themselves, so there's nothing in them worth indexing.  New routes
+// like that need adding here too.  Rules are prefixes, so the single pages end in $ to keep them from matching the
+// pages of users whose names start the same way
+var robotsDisallowed = []string{
+	"/admin/",
+	apiPrefix,
+	"/jobs/",
+	"/login$",
+	"/logout$",
+	"/pref$",
+	"/register$",
+	"/upload/",
+	"/x/",
+}
+
+// Returns robots.txt, built from the routes crawlers should stay out of and the robots settings in the config
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	buf.WriteString("User-agent: *\n")
+	for _, path := range robotsDisallowed {
+		fmt.Fprintf(&buf, "Disallow: %s\n", path)
+	}
+	buf.WriteString("Allow: /\n")
+	if conf.Web.RobotsCrawlDelay > 0 {
+		fmt.Fprintf(&buf, "Crawl-delay: %d\n", conf.Web.RobotsCrawlDelay)
+	}
+	if conf.Web.RobotsSitemap != "" {
+		fmt.Fprintf(&buf, "\nSitemap: %s\n", conf.Web.RobotsSitemap)
+	}
+	if extra := strings.TrimSpace(conf.Web.RobotsExtra); extra != "" {
+		buf.WriteString("\n" + extra + "\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", assetCachePlain))
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		log.Printf("Error returning robots.txt: %v\n", err)
+	}
+}
+
+// Asks search engines not to index or keep a copy of the page being returned, for pages which are only useful to the
+// person looking at them or which show private databases
+func noIndex(w http.ResponseWriter) {
+	w.Header().Set("X-Robots-Tag", "noindex, noarchive")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Tables whose largest rowid is above this are given an approximate row count at first, with the exact count
+// done in the background
+const approxRowCountThreshold = 1000000
+
+// Row counts never change for a given database version, so they're kept for as long as Memcached allows
+const rowCountCacheTime = 2592000
+
+// Tables currently being counted in the background, so each is only counted once at a time
+var (
+	rowCountsPending   = make(map[string]bool)
+	rowCountsPendingMu sync.Mutex
+)
+
+// Counts the rows in a table in the background, caching the result
+func countRowsInBackground(cacheKey string, bucket string, id string, dbTable string) {
+	rowCountsPendingMu.Lock()
+	if rowCountsPending[cacheKey] {
+		rowCountsPendingMu.Unlock()
+		return
+	}
+	rowCountsPending[cacheKey] = true
+	rowCountsPendingMu.Unlock()
+
+	go func() {
+		defer func() {
+			rowCountsPendingMu.Lock()
+			delete(rowCountsPending, cacheKey)
+			rowCountsPendingMu.Unlock()
+		}()
+
+		// This needs its own connection, as the one used by the request will be closed by now
+		sdb, err := openMinioObject(bucket, id)
+		if err != nil {
+			log.Printf("Error opening database for background row count: %v\n", err)
+			return
+		}
+		defer closeMinioObject(sdb)
+		rowCount, err := getSQLiteRowCount(sdb, quoteIdentifier(dbTable))
+		if err != nil {
+			return
+		}
+		err = cacheData(cacheKey, rowCount, rowCountCacheTime)
+		if err != nil {
+			log.Printf("Error when caching row count: %v\n", err)
+		}
+	}()
+}
+
+// Returns the number of rows in each of the given tables, in a single pass over them.  Versions uploaded since the
+// counts were recorded at upload time have them in PostgreSQL.  For older ones, counts are cached per database
+// version in the same way as countTableRows(), so this is only slow the first time a version is viewed.  Virtual
+// tables are labelled with their module, and tables which can't be counted are marked as unknown rather than
+// failing the lot
+func getTableRowCounts(ctx context.Context, sdb *sqlite.Conn, owner string, dbName string, version int,
+	tables []string, vt vtableInfo, bucket string, id string) ([]tableRowCount, error) {
+	if meta, ok := getVersionMeta(owner, dbName, version); ok && len(meta.Tables) == len(tables) {
+		return meta.Tables, nil
+	}
+	var counts []tableRowCount
+	for _, t := range tables {
+		c := tableRowCount{Name: t, Module: vt.Modules[t], Internal: vt.IsInternal(t)}
+		var err error
+		c.Rows, c.Approx, err = countTableRows(ctx, sdb, owner, dbName, version, t, bucket, id)
+		if ctx.Err() == context.Canceled {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Couldn't count the rows of table '%s' in '%s/%s': %v\n", t, owner, dbName, err)
+			c.Unknown = true
+		}
+		counts = append(counts, c)
+	}
+	return counts, nil
+}
+
+// Returns the number of rows in a table, using the count recorded when the version was uploaded if there is one
+func getTableRowCount(ctx context.Context, sdb *sqlite.Conn, owner string, dbName string, version int,
+	dbTable string, bucket string, id string) (rowCount int, approx bool, err error) {
+	if meta, ok := getVersionMeta(owner, dbName, version); ok {
+		for _, t := range meta.Tables {
+			if t.Name == dbTable && !t.Unknown {
+				return t.Rows, false, nil
+			}
+		}
+	}
+	return countTableRows(ctx, sdb, owner, dbName, version, dbTable, bucket, id)
+}
+
+// Returns the number of rows in a table, using the cached count for the database version if there is one.  For
+// very large tables which haven't been counted yet, an approximate count is returned straight away and the exact
+// count is done in the background
+func countTableRows(ctx context.Context, sdb *sqlite.Conn, owner string, dbName string, version int,
+	dbTable string, bucket string, id string) (rowCount int, approx bool, err error) {
+	tempArr := md5.Sum([]byte(fmt.Sprintf("%s/%s/%d/%s", owner, dbName, version, dbTable)))
+	cacheKey := "rowcount-" + hex.EncodeToString(tempArr[:])
+	ok, err := getCachedData(cacheKey, &rowCount)
+	if err != nil {
+		log.Printf("Error retrieving row count from cache: %v\n", err)
+	}
+	if ok {
+		return rowCount, false, nil
+	}
+
+	// If a count is already running, or the table looks huge, give the approximate count from the largest rowid.
+	// Tables created WITHOUT ROWID don't have one, so they're always counted directly
+	rowCountsPendingMu.Lock()
+	pending := rowCountsPending[cacheKey]
+	rowCountsPendingMu.Unlock()
+	var maxRowid int
+	if sdb.OneValue("SELECT max(rowid) FROM "+quoteIdentifier(dbTable), &maxRowid) == nil &&
+		(pending || maxRowid > approxRowCountThreshold) {
+		countRowsInBackground(cacheKey, bucket, id, dbTable)
+		return maxRowid, true, nil
+	}
+
+	// Count the rows now, interrupting the count if the request goes away or runs out of time.  Counts which take
+	// too long are finished in the background instead, with the approximate count given for now
+	if ctx.Err() == context.DeadlineExceeded {
+		return approxRowCount(cacheKey, bucket, id, dbTable, maxRowid)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sdb.Interrupt()
+		case <-done:
+		}
+	}()
+	rowCount, err = getSQLiteRowCount(sdb, quoteIdentifier(dbTable))
+	if ctx.Err() == context.DeadlineExceeded {
+		return approxRowCount(cacheKey, bucket, id, dbTable, maxRowid)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	err = cacheData(cacheKey, rowCount, rowCountCacheTime)
+	if err != nil {
+		log.Printf("Error when caching row count: %v\n", err)
+	}
+	return rowCount, false, nil
+}
+
+// Starts counting the rows of a table in the background, after counting them for a request took too long.  The
+// largest rowid is given as the count in the meantime, which isn't available for tables created WITHOUT ROWID
+func approxRowCount(cacheKey string, bucket string, id string, dbTable string, maxRowid int) (int, bool, error) {
+	countRowsInBackground(cacheKey, bucket, id, dbTable)
+	if maxRowid == 0 {
+		return 0, false, errQueryTooLong
+	}
+	return maxRowid, true, nil
+}
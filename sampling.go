@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// The ways large result sets can be reduced to fit in a visualisation
+const (
+	sampleEveryNth = "every_nth" // Every Nth matching row is returned
+	sampleBuckets  = "buckets"   // Rows are grouped into ranges of X, with the average, min, and max of Y
+)
+
+// Returns a SQL identifier quoted for SQLite
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Like readSQLiteDBColsCtx(), but when more than maxRows rows match, the data is downsampled rather than cut off.
+// If the X and Y columns hold only numbers, the rows are grouped into maxRows ranges of X.  Otherwise, or when
+// method is sampleEveryNth, every Nth row is returned
+func readSQLiteDBColsSampled(ctx context.Context, db *sqlite.Conn, dbTable string, ignoreBinary bool,
+	ignoreNull bool, maxRows int, method string, filters []whereClause, cols ...string) (sqliteRecordSet, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.Interrupt()
+		case <-done:
+		}
+	}()
+
+	// Construct the WHERE clause, leaving out rows which would be skipped anyway
+	var conditions []string
+	var args []interface{}
+	for _, f := range filters {
+		conditions = append(conditions, fmt.Sprintf("%s %s ?", quoteIdentifier(f.Column), f.Type))
+		args = append(args, f.Value)
+	}
+	var colString []string
+	for _, c := range cols {
+		if c == "*" {
+			colString = append(colString, c)
+			continue
+		}
+		colString = append(colString, quoteIdentifier(c))
+		if ignoreNull {
+			conditions = append(conditions, quoteIdentifier(c)+" IS NOT NULL")
+		}
+		if ignoreBinary {
+			conditions = append(conditions, "typeof("+quoteIdentifier(c)+") != 'blob'")
+		}
+	}
+	var where string
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	from := " FROM " + quoteIdentifier(dbTable) + where
+
+	// Count the matching rows.  If they all fit, there's nothing to do
+	var matching int
+	err := db.OneValue("SELECT count(*)"+from, &matching, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return sqliteRecordSet{}, sqliteCtxErr(ctx)
+		}
+		log.Printf("Error counting rows for downsampling: %v\n", err)
+		return sqliteRecordSet{}, errors.New("Error when reading data from the SQLite database")
+	}
+	if matching <= maxRows {
+		dataRows, err := readSQLiteDBCols(db, dbTable, ignoreBinary, ignoreNull, maxRows, filters, cols...)
+		dataRows.TotalRows = matching
+		if ctx.Err() != nil {
+			return dataRows, sqliteCtxErr(ctx)
+		}
+		return dataRows, err
+	}
+
+	// When X and the Y columns are all numeric, group the rows into ranges of X.  For a single Y column the minimum
+	// and maximum of each range are included too
+	if method != sampleEveryNth && len(cols) >= 2 && cols[0] != "*" {
+		x := quoteIdentifier(cols[0])
+		var typeChecks []string
+		for _, c := range cols {
+			typeChecks = append(typeChecks, "typeof("+quoteIdentifier(c)+") NOT IN ('integer', 'real')")
+		}
+		var minX, maxX float64
+		var nonNumeric int
+		err = db.OneValue("SELECT sum("+strings.Join(typeChecks, " OR ")+")"+from, &nonNumeric, args...)
+		if err == nil && nonNumeric == 0 {
+			err = db.OneValue("SELECT min("+x+")"+from, &minX, args...)
+		}
+		if err == nil && nonNumeric == 0 {
+			err = db.OneValue("SELECT max("+x+")"+from, &maxX, args...)
+		}
+		if err == nil && nonNumeric == 0 && maxX > minX {
+			aggCols := []string{fmt.Sprintf("avg(%[1]s) AS %[1]s", x)}
+			for _, c := range cols[1:] {
+				aggCols = append(aggCols, fmt.Sprintf("avg(%[1]s) AS %[1]s", quoteIdentifier(c)))
+			}
+			if len(cols) == 2 {
+				y := quoteIdentifier(cols[1])
+				aggCols = append(aggCols, fmt.Sprintf("min(%s) AS %s", y, quoteIdentifier("min_"+cols[1])),
+					fmt.Sprintf("max(%s) AS %s", y, quoteIdentifier("max_"+cols[1])))
+			}
+			width := (maxX - minX) / float64(maxRows)
+			dbQuery := fmt.Sprintf(`SELECT %s%s
+				GROUP BY min(CAST((%s - ?) / ? AS INTEGER), ?)
+				ORDER BY 1`, strings.Join(aggCols, ", "), from, x)
+			bucketArgs := append(append([]interface{}{}, args...), minX, width, maxRows-1)
+			dataRows, err := readSQLiteRows(db, dbQuery, bucketArgs, ignoreBinary, ignoreNull, 1)
+			dataRows.Tablename = dbTable
+			dataRows.TotalRows = matching
+			dataRows.Downsampled = true
+			dataRows.SampleMethod = sampleBuckets
+			if ctx.Err() != nil {
+				return dataRows, sqliteCtxErr(ctx)
+			}
+			return dataRows, err
+		}
+		if ctx.Err() != nil {
+			return sqliteRecordSet{}, sqliteCtxErr(ctx)
+		}
+	}
+
+	// Otherwise return every Nth row
+	step := (matching + maxRows - 1) / maxRows
+	dbQuery := "SELECT " + strings.Join(colString, ", ") + from
+	dataRows, err := readSQLiteRows(db, dbQuery, args, ignoreBinary, ignoreNull, step)
+	dataRows.Tablename = dbTable
+	dataRows.TotalRows = matching
+	dataRows.Downsampled = true
+	dataRows.SampleMethod = sampleEveryNth
+	if len(dataRows.Records) > maxRows {
+		dataRows.Records = dataRows.Records[:maxRows]
+		dataRows.RowCount = maxRows
+	}
+	if ctx.Err() != nil {
+		return dataRows, sqliteCtxErr(ctx)
+	}
+	return dataRows, err
+}
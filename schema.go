@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// The structure of a database version, as shown on the schema page
+type dbSchema struct {
+	Version    int
+	Tables     []schemaTable
+	FileSize   int64
+	IndexSizes bool // True when the SQLite build has the dbstat table, so index sizes are known
+}
+
+// A table or view, along with its indexes
+type schemaTable struct {
+	Name    string
+	Type    string
+	SQL     string
+	Columns []columnInfo
+	Indexes []schemaIndex
+}
+
+// An index on a table.  Automatic indexes are the ones SQLite creates for UNIQUE and PRIMARY KEY constraints, and
+// don't have a CREATE statement of their own
+type schemaIndex struct {
+	Name      string
+	Columns   []string
+	Unique    bool
+	Automatic bool
+	Origin    string // "c" for CREATE INDEX, "u" for a UNIQUE constraint, and "pk" for a PRIMARY KEY
+	SQL       string
+	Size      int64
+}
+
+// Returns a short description of where the index comes from
+func (i schemaIndex) Source() string {
+	switch i.Origin {
+	case "u":
+		return "UNIQUE constraint"
+	case "pk":
+		return "PRIMARY KEY"
+	case "c":
+		return "CREATE INDEX"
+	}
+	if i.Automatic {
+		return "automatic"
+	}
+	return "CREATE INDEX"
+}
+
+// Returns the share of the database file used by the index, as a percentage
+func (i schemaIndex) SizeShare(fileSize int64) string {
+	if fileSize <= 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(i.Size)*100/float64(fileSize))
+}
+
+// Returns the columns an index covers.  Indexes on expressions have no column name, so they're described instead
+func readIndexColumns(db *sqlite.Conn, index string) ([]string, error) {
+	stmt, err := db.Prepare("PRAGMA index_info(" + quoteIdentifier(index) + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	var cols []string
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		name, isNull := s.ScanText(2)
+		if isNull {
+			name = "<expression>"
+		}
+		cols = append(cols, name)
+		return nil
+	})
+	return cols, err
+}
+
+// Returns the indexes of a table, from PRAGMA index_list.  Older SQLite versions don't give the origin of an index,
+// in which case automatic indexes are told apart by their name
+func readIndexes(db *sqlite.Conn, dbTable string) ([]schemaIndex, error) {
+	stmt, err := db.Prepare("PRAGMA index_list(" + quoteIdentifier(dbTable) + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	var indexes []schemaIndex
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		var idx schemaIndex
+		idx.Name, _ = s.ScanText(1)
+		unique, _, err := s.ScanInt(2)
+		if err != nil {
+			return err
+		}
+		idx.Unique = unique != 0
+		if s.ColumnCount() > 3 {
+			idx.Origin, _ = s.ScanText(3)
+		}
+		idx.Automatic = strings.HasPrefix(idx.Name, "sqlite_autoindex_") || idx.Origin == "u" ||
+			idx.Origin == "pk"
+		indexes = append(indexes, idx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range indexes {
+		indexes[i].Columns, err = readIndexColumns(db, indexes[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		if !indexes[i].Automatic {
+			var def string
+			if db.OneValue("SELECT sql FROM sqlite_master WHERE type = 'index' AND name = ?", &def,
+				indexes[i].Name) == nil {
+				indexes[i].SQL = def
+			}
+		}
+	}
+	return indexes, nil
+}
+
+// Reads the tables and views of a database, with their CREATE statements and indexes
+func readSchema(db *sqlite.Conn) (schema dbSchema, err error) {
+	stmt, err := db.Prepare(`
+		SELECT type, name, sql
+		FROM sqlite_master
+		WHERE type IN ('table', 'view')
+			AND name NOT LIKE 'sqlite_%'
+		ORDER BY name`)
+	if err != nil {
+		log.Printf("Error reading the schema: %v\n", err)
+		return schema, fmt.Errorf("Error reading the database schema")
+	}
+	defer stmt.Finalize()
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		var t schemaTable
+		t.Type, _ = s.ScanText(0)
+		t.Name, _ = s.ScanText(1)
+		t.SQL, _ = s.ScanText(2)
+		schema.Tables = append(schema.Tables, t)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error reading the schema: %v\n", err)
+		return schema, fmt.Errorf("Error reading the database schema")
+	}
+
+	for i, t := range schema.Tables {
+		schema.Tables[i].Columns, err = tableColumns(db, t.Name)
+		if err != nil {
+			log.Printf("Error reading the columns of '%s': %v\n", t.Name, err)
+			return schema, fmt.Errorf("Error reading the columns of '%s'", t.Name)
+		}
+		if t.Type != "table" {
+			continue
+		}
+		schema.Tables[i].Indexes, err = readIndexes(db, t.Name)
+		if err != nil {
+			log.Printf("Error reading the indexes of table '%s': %v\n", t.Name, err)
+			return schema, fmt.Errorf("Error reading the indexes of table '%s'", t.Name)
+		}
+	}
+
+	// The size of each index can only be worked out when SQLite was built with the dbstat table
+	var pageCount, pageSize int64
+	if db.OneValue("PRAGMA page_count", &pageCount) == nil && db.OneValue("PRAGMA page_size", &pageSize) == nil {
+		schema.FileSize = pageCount * pageSize
+	}
+	var probe int64
+	if db.OneValue("SELECT count(*) FROM dbstat WHERE name = 'sqlite_master'", &probe) != nil {
+		return schema, nil
+	}
+	schema.IndexSizes = true
+	for i := range schema.Tables {
+		for j := range schema.Tables[i].Indexes {
+			idx := &schema.Tables[i].Indexes[j]
+			var size int64
+			if db.OneValue("SELECT coalesce(sum(pgsize), 0) FROM dbstat WHERE name = ?", &size, idx.Name) == nil {
+				idx.Size = size
+			}
+		}
+	}
+	return schema, nil
+}
+
+// Works out the type of each column of the rows read from a table.  The storage class is the one the values read
+// have, when they all have the same one.  Otherwise it comes from the declared type, using SQLite's rules for type
+// affinity
+func readColumnTypes(db *sqlite.Conn, dbTable string, rs sqliteRecordSet) []columnType {
+	declared := make(map[string]string)
+	cols, err := tableColumns(db, dbTable)
+	if err != nil {
+		log.Printf("Error reading the column types of table '%s': %v\n", dbTable, err)
+	}
+	for _, c := range cols {
+		declared[c.Name] = c.DataType
+	}
+
+	types := make([]columnType, len(rs.ColNames))
+	for i, name := range rs.ColNames {
+		class, mixed := "", false
+		for _, row := range rs.Records {
+			if i >= len(row) || row[i].Type == Null {
+				continue
+			}
+			c := storageClass(row[i].Type)
+			if class != "" && c != class {
+				mixed = true
+				break
+			}
+			class = c
+		}
+		if class == "" || mixed {
+			class = affinityClass(declared[name])
+		}
+		types[i] = columnType{Declared: declared[name], Class: class}
+	}
+	return types
+}
+
+// Returns the storage class of a value read from a table
+func storageClass(t ValType) string {
+	switch t {
+	case Integer:
+		return "integer"
+	case Float:
+		return "real"
+	case Text:
+		return "text"
+	case Binary, Image:
+		return "blob"
+	}
+	return "null"
+}
+
+// Returns the storage class values of a declared column type are most likely to have, following the rules SQLite
+// uses for type affinity.  Columns without a declared type can hold anything, so "null" is returned for them
+func affinityClass(declared string) string {
+	t := strings.ToUpper(declared)
+	switch {
+	case t == "":
+		return "null"
+	case strings.Contains(t, "INT"):
+		return "integer"
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return "text"
+	case strings.Contains(t, "BLOB"):
+		return "blob"
+	}
+	return "real"
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	com "github.com/dbhubio/common"
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Limits for row searches, so a single search can't tie up a database
+const (
+	maxSearchLength  = 100 // Characters in the search term
+	maxSearchResults = 100 // Rows returned
+)
+
+// Matches the content= option of an FTS5 table definition, which names the table it indexes
+var ftsContentRE = regexp.MustCompile(`(?i)content\s*=\s*['"\x60\[]?([^'"\x60\],)\s]+)`)
+
+// Escapes the LIKE wildcards in a search term so they're matched literally.  Used with ESCAPE '\'
+func escapeLike(term string) string {
+	term = strings.Replace(term, `\`, `\\`, -1)
+	term = strings.Replace(term, "%", `\%`, -1)
+	return strings.Replace(term, "_", `\_`, -1)
+}
+
+// Returns the name of the FTS5 table indexing the given table, or an empty string if the database doesn't have one
+func findFTSTable(db *sqlite.Conn, dbTable string) string {
+	stmt, err := db.Prepare(`SELECT name, sql FROM sqlite_master WHERE type = 'table' AND sql LIKE '%USING fts5%'`)
+	if err != nil {
+		log.Printf("Error when looking for FTS5 tables: %v\n", err)
+		return ""
+	}
+	defer stmt.Finalize()
+	var ftsTable string
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		var name, def string
+		if err := s.Scan(&name, &def); err != nil {
+			return err
+		}
+		m := ftsContentRE.FindStringSubmatch(def)
+		if m != nil && strings.EqualFold(m[1], dbTable) && ftsTable == "" {
+			ftsTable = name
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error when looking for FTS5 tables: %v\n", err)
+		return ""
+	}
+	return ftsTable
+}
+
+// Reads the row filter parameters of a request, which are "sort" and "dir" for the ordering and "q" for a search
+// term.  The error returned is fit for showing to the user
+func parseRowFilter(r *http.Request) (rowFilter, error) {
+	f := rowFilter{SortCol: r.FormValue("sort"), Term: strings.TrimSpace(r.FormValue("q"))}
+	if f.SortCol != "" {
+		err := com.ValidatePGTable(f.SortCol)
+		if err != nil {
+			log.Printf("Validation failed for sort column: %s", err)
+			return f, errors.New("Invalid sort column")
+		}
+		f.SortDir = sortDirection(r.FormValue("dir"))
+		if f.SortDir == "" {
+			f.SortDir = "ASC"
+		}
+	}
+	if len([]rune(f.Term)) > maxSearchLength {
+		return f, fmt.Errorf("Search terms can't be longer than %d characters", maxSearchLength)
+	}
+	return f, nil
+}
+
+// Checks the columns a row filter needs are in the table.  The error returned is fit for showing to the user
+func checkRowFilter(db *sqlite.Conn, dbTable string, f rowFilter) error {
+	for _, w := range f.Where {
+		if !tableHasColumn(db, dbTable, w.Column) {
+			return errors.New("Default filter column does not exist")
+		}
+	}
+	if f.SortCol != "" && !tableHasColumn(db, dbTable, f.SortCol) {
+		return errors.New("Requested sort column does not exist")
+	}
+	if f.Term != "" {
+		cols, err := textColumns(db, dbTable)
+		if err != nil {
+			log.Printf("Error retrieving columns of table '%s': %v\n", dbTable, err)
+			return errors.New("Error reading the table columns")
+		}
+		if len(cols) == 0 {
+			return errors.New("The table doesn't have any text columns to search")
+		}
+	}
+	return nil
+}
+
+// Describes a row filter for people, eg: rows matching "smith", ordered by "surname" descending
+func (f rowFilter) String() string {
+	var parts []string
+	for _, w := range f.Where {
+		parts = append(parts, "rows where "+w.String())
+	}
+	if f.Term != "" {
+		parts = append(parts, fmt.Sprintf("rows matching %q", f.Term))
+	}
+	if f.SortCol != "" {
+		dir := "ascending"
+		if f.SortDir == "DESC" {
+			dir = "descending"
+		}
+		parts = append(parts, fmt.Sprintf("ordered by %q %s", f.SortCol, dir))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Returns the WHERE and ORDER BY clauses for a row filter, along with the values to bind to them.  The search uses
+// all of the text columns, and the FTS5 index for the table if there is one, just as the table view's search does
+func rowFilterClauses(db *sqlite.Conn, dbTable string, f rowFilter) (string, []interface{}, error) {
+	var clauses string
+	conds, args := whereConditions(f.Where)
+	if f.Term != "" {
+		cols, err := textColumns(db, dbTable)
+		if err != nil {
+			return "", nil, err
+		}
+		cond, termArgs := searchCondition(dbTable, findFTSTable(db, dbTable), f.Term, cols)
+		conds = append(conds, cond)
+		args = append(args, termArgs...)
+	}
+	if len(conds) > 0 {
+		clauses = " WHERE " + strings.Join(conds, " AND ")
+	}
+	if f.SortCol != "" {
+		clauses += " ORDER BY " + quoteIdentifier(f.SortCol) + " " + sortDirection(f.SortDir)
+	}
+	return clauses, args, nil
+}
+
+// Counts the rows of a table which a row filter keeps.  The count is interrupted if the context is done
+func filteredRowCount(ctx context.Context, db *sqlite.Conn, dbTable string, f rowFilter) (int, error) {
+	stop := interruptWhenDone(ctx, db)
+	defer stop()
+	if f.Term == "" && len(f.Where) == 0 {
+		rowCount, err := getSQLiteRowCount(db, quoteIdentifier(dbTable))
+		if ctx.Err() != nil {
+			return 0, sqliteCtxErr(ctx)
+		}
+		return rowCount, err
+	}
+	clauses, args, err := rowFilterClauses(db, dbTable, rowFilter{Term: f.Term, Where: f.Where})
+	if err != nil {
+		return 0, err
+	}
+	var rowCount int
+	err = db.OneValue("SELECT count(*) FROM "+quoteIdentifier(dbTable)+clauses, &rowCount, args...)
+	if ctx.Err() != nil {
+		return 0, sqliteCtxErr(ctx)
+	}
+	if err != nil {
+		log.Printf("Error occurred when counting filtered table rows: %s\n", err)
+		return 0, errors.New("Database query failure")
+	}
+	return rowCount, nil
+}
+
+// Returns the conditions for a set of WHERE clauses, along with the values to bind to them.  The columns and
+// comparisons need to have been checked already
+func whereConditions(clauses []whereClause) ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, w := range clauses {
+		conds = append(conds, quoteIdentifier(w.Column)+" "+w.Type+" ?")
+		args = append(args, w.Value)
+	}
+	return conds, args
+}
+
+// Returns the condition matching the rows of a table which contain a search term in one of the given columns.  If
+// ftsTable is given, that FTS5 index is used rather than scanning the table
+func searchCondition(dbTable string, ftsTable string, term string, cols []string) (string, []interface{}) {
+	if ftsTable != "" {
+		// The term is given to FTS5 as a phrase, so none of it is treated as query syntax
+		return fmt.Sprintf("rowid IN (SELECT rowid FROM %[1]s WHERE %[1]s MATCH ?)", quoteIdentifier(ftsTable)),
+			[]interface{}{`"` + strings.Replace(term, `"`, `""`, -1) + `"`}
+	}
+	var conditions []string
+	var args []interface{}
+	for _, c := range cols {
+		conditions = append(conditions, quoteIdentifier(c)+` LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(term)+"%")
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// Searches the given columns of a table for a term, returning the matching rows along with the column each matched
+// in.  If ftsTable is given, that FTS5 index is used rather than scanning the table.  Only rows matching the where
+// clauses are searched
+func searchSQLiteTable(db *sqlite.Conn, dbTable string, ftsTable string, term string, cols []string,
+	where []whereClause) (sqliteRecordSet, error) {
+	conds, args := whereConditions(where)
+	cond, termArgs := searchCondition(dbTable, ftsTable, term, cols)
+	conds = append(conds, cond)
+	args = append(args, termArgs...)
+	dbQuery := fmt.Sprintf("SELECT * FROM %s WHERE %s LIMIT ?", quoteIdentifier(dbTable),
+		strings.Join(conds, " AND "))
+	args = append(args, maxSearchResults)
+	dataRows, err := readSQLiteRows(db, dbQuery, args, false, false, 1)
+	if err != nil {
+		return dataRows, err
+	}
+	dataRows.Tablename = dbTable
+
+	// Work out which column each row matched in.  LIKE ignores case for ASCII, so this does too
+	searched := make(map[string]bool)
+	for _, c := range cols {
+		searched[c] = true
+	}
+	lowerTerm := strings.ToLower(term)
+	for _, row := range dataRows.Records {
+		var matched string
+		for _, val := range row {
+			if (val.Type != Text && val.Type != Integer && val.Type != Float) || !searched[val.Name] {
+				continue
+			}
+			if strings.Contains(strings.ToLower(val.Value), lowerTerm) {
+				matched = val.Name
+				break
+			}
+		}
+		dataRows.MatchedCols = append(dataRows.MatchedCols, matched)
+	}
+
+	// The long values are only cut short once they've been matched against
+	truncateRecords(&dataRows, conf.Web.CellLength)
+	return dataRows, nil
+}
+
+// Returns the names of the columns in a table which can hold text.  Columns without a declared type can hold
+// anything, so they're included too
+func textColumns(db *sqlite.Conn, dbTable string) ([]string, error) {
+	tableCols, err := tableColumns(db, dbTable)
+	if err != nil {
+		return nil, err
+	}
+	var cols []string
+	for _, c := range tableCols {
+		dataType := strings.ToUpper(c.DataType)
+		if dataType == "" || strings.Contains(dataType, "CHAR") || strings.Contains(dataType, "CLOB") ||
+			strings.Contains(dataType, "TEXT") {
+			cols = append(cols, c.Name)
+		}
+	}
+	return cols, nil
+}
+
+// Searches the rows of a database table, returning the matches as JSON
+func rowSearchHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Row search handler"
+
+	// Retrieve user, database, and table name
+	userName, dbName, requestedTable, err := getUDT(2, r) // 2 = Ignore "/x/rowsearch/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Validate the search term
+	filter, err := parseRowFilter(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	term := filter.Term
+	if term == "" {
+		errorPage(w, r, http.StatusBadRequest, "No search term given")
+		return
+	}
+
+	// Validate the column names if any were given
+	reqCols := r.Form["col"]
+	for _, c := range reqCols {
+		err = com.ValidatePGTable(c)
+		if err != nil {
+			log.Printf("%s: Validation failed for SQLite column name: %s", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Invalid column name")
+			return
+		}
+	}
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+
+	// Check if the user has access to the requested database.  A specific version can be searched, otherwise the
+	// latest one is used
+	version := int64(latestVersion)
+	if r.FormValue("version") != "" {
+		version, err = getVersion(r)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	ctx := r.Context()
+	var dbInfo sqliteDBinfo
+	err = checkUserDBVersionAccessCtx(ctx, &dbInfo, loggedInUser, userName, dbName, version)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+
+	// Other people only search the rows the owner's default filter leaves, unless they asked for every row
+	filters, _, err := viewerTableFilters(r, loggedInUser, userName, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Use a cached version of the results if they exist
+	var cacheKey string
+	searchParams := fmt.Sprintf("/%d/%s/%s/%s/%s", dbInfo.Info.Version, requestedTable, strings.Join(reqCols, ","),
+		term, filters.Key())
+	if loggedInUser != userName {
+		tempArr := md5.Sum([]byte(userName + "/" + dbName + searchParams))
+		cacheKey = "rowsearch-pub-" + hex.EncodeToString(tempArr[:])
+	} else {
+		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + searchParams))
+		cacheKey = "rowsearch-" + hex.EncodeToString(tempArr[:])
+	}
+	w.Header().Set("X-DBHub-Version", strconv.Itoa(dbInfo.Info.Version))
+	var jsonResponse []byte
+	ok, err := getCachedData(cacheKey, &jsonResponse)
+	if err != nil {
+		log.Printf("%s: Error retrieving data from cache: %v\n", pageName, err)
+	}
+	if ok {
+		jsonOK(w, jsonResponse)
+		return
+	}
+
+	// Retrieve the database from Minio and open it
+	db, err := openMinioObjectCtx(ctx, dbInfo.MinioBkt, dbInfo.MinioId)
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if err == errTooManyOpenDBs {
+		serverBusy(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving database '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error opening database")
+		return
+	}
+	defer closeMinioObject(db)
+
+	// Check the requested table exists, using the first one if none was given
+	tables, err := db.Tables("")
+	if err != nil || len(tables) == 0 {
+		log.Printf("%s: Error retrieving table names from '%s/%s': %v\n", pageName, userName, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error reading the database tables")
+		return
+	}
+	if requestedTable != "" {
+		tablePresent := false
+		for _, tableName := range tables {
+			if requestedTable == tableName {
+				tablePresent = true
+			}
+		}
+		if tablePresent == false {
+			errorPage(w, r, http.StatusBadRequest, "Requested table does not exist")
+			return
+		}
+	}
+	if requestedTable == "" {
+		requestedTable = tables[0]
+	}
+
+	// Search the requested columns, or all of the text ones
+	searchCols := reqCols
+	for _, c := range reqCols {
+		if !tableHasColumn(db, requestedTable, c) {
+			errorPage(w, r, http.StatusBadRequest, "Requested column does not exist")
+			return
+		}
+	}
+	if len(searchCols) == 0 {
+		searchCols, err = textColumns(db, requestedTable)
+		if err != nil {
+			log.Printf("%s: Error retrieving columns of table '%s': %v\n", pageName, requestedTable, err)
+			errorPage(w, r, http.StatusInternalServerError, "Error reading the table columns")
+			return
+		}
+		if len(searchCols) == 0 {
+			errorPage(w, r, http.StatusBadRequest, "The table doesn't have any text columns to search")
+			return
+		}
+	}
+
+	// Run the search, interrupting it if the client goes away or it takes too long
+	sctx, cancel := sqliteContext(ctx)
+	defer cancel()
+	stop := interruptWhenDone(sctx, db)
+	var ftsTable string
+	if len(reqCols) == 0 {
+		// Only searches across the whole table can use an FTS5 index
+		ftsTable = findFTSTable(db, requestedTable)
+	}
+	dataRows, err := searchSQLiteTable(db, requestedTable, ftsTable, term, searchCols,
+		filters.Clauses(db, requestedTable))
+	stop()
+	if clientGone(ctx, pageName) {
+		return
+	}
+	if sctx.Err() == context.DeadlineExceeded {
+		errorPage(w, r, http.StatusGatewayTimeout, errQueryTooLong.Error())
+		return
+	}
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	dataRows.Version = dbInfo.Info.Version
+	jsonResponse, err = json.MarshalIndent(dataRows, "", " ")
+	if err != nil {
+		log.Printf("%s: Error when JSON marshalling returned data: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error encoding the search results")
+		return
+	}
+	err = cacheData(cacheKey, jsonResponse, cacheTime)
+	if err != nil {
+		log.Printf("%s: Error when caching search results: %v\n", pageName, err)
+	}
+	jsonOK(w, jsonResponse)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	com "github.com/dbhubio/common"
+	"github.com/icza/session"
+	"github.com/jackc/pgx"
+)
+
+// The key the logged in user is stored under in the request context
+type sessionUserKey struct{}
+
+// Session attributes.  When the session was started is kept as a constant attribute rather than using the session's
+// creation time, so it carries over when the session is replaced after a username change
+const (
+	sessionStartedAttr    = "Started"
+	sessionLastActiveAttr = "LastActive"
+)
+
+// How long whether an account is disabled is cached for, in seconds.  Disabling or enabling an account updates the
+// cached value straight away, so this only matters if the cache loses it
+const userDisabledCacheTime = 300
+
+// How long sessions are kept in the store after they've expired, so people coming back soon after are told their
+// session ran out rather than just finding themselves logged out
+const sessionExpiredGrace = time.Hour
+
+// Creates a session for a user who has logged in.  started is when they logged in, which is the current time
+// unless an existing session is being replaced
+func newSession(userName string, started time.Time) session.Session {
+	timeout := time.Duration(conf.Web.SessionIdleTimeout) * time.Minute
+	if life := time.Duration(conf.Web.SessionLifetime) * time.Hour; life > timeout {
+		timeout = life
+	}
+	return session.NewSessionOptions(&session.SessOptions{
+		CAttrs:  map[string]interface{}{"UserName": userName, sessionStartedAttr: started},
+		Attrs:   map[string]interface{}{sessionLastActiveAttr: time.Now()},
+		Timeout: timeout + sessionExpiredGrace,
+	})
+}
+
+// Returns when a session was started, falling back to its creation time for sessions made before this was recorded
+func sessionStarted(sess session.Session) time.Time {
+	if started, ok := sess.CAttr(sessionStartedAttr).(time.Time); ok {
+		return started
+	}
+	return sess.Created()
+}
+
+// Returns when a session will expire if nothing more is done with it.  The idle timeout is counted from the last
+// request, but the session can't outlive the absolute lifetime however busy it is
+func sessionExpiry(sess session.Session) time.Time {
+	lastActive, ok := sess.Attr(sessionLastActiveAttr).(time.Time)
+	if !ok {
+		lastActive = sess.Accessed()
+	}
+	expires := lastActive.Add(time.Duration(conf.Web.SessionIdleTimeout) * time.Minute)
+	life := time.Duration(conf.Web.SessionLifetime) * time.Hour
+	if capped := sessionStarted(sess).Add(life); life > 0 && capped.Before(expires) {
+		expires = capped
+	}
+	return expires
+}
+
+// Checks whether the session a request belongs to has expired, and if not, notes the request as activity on it.
+// Expired sessions are removed, then visitors asking for a page are sent to the login page, which brings them back
+// to the page afterwards, while API requests are given an error.  Returns false if the request was answered here
+func checkSessionExpiry(w http.ResponseWriter, r *http.Request) bool {
+	sess := session.Get(r)
+	if sess == nil {
+		return true
+	}
+	if time.Now().Before(sessionExpiry(sess)) {
+		sess.SetAttr(sessionLastActiveAttr, time.Now())
+		return true
+	}
+	session.Remove(sess, w)
+	if isAPIRequest(r) {
+		jsonError(w, http.StatusUnauthorized, "Your session has expired.  Please log in again")
+		return false
+	}
+
+	// Form submissions can't be replayed, so they bounce back to the page the form was on
+	next := r.URL.RequestURI()
+	if r.Method != http.MethodGet {
+		next = localBounceURL(r.Referer())
+	}
+	http.Redirect(w, r, "/login?expired=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+	return false
+}
+
+// Returns the cache key for whether a user's account is disabled
+func userDisabledCacheKey(userName string) string {
+	return "userdisabled/" + userName
+}
+
+// Notes whether a user's account is disabled in the cache, so their sessions are checked against it
+func cacheUserDisabled(userName string, disabled bool) {
+	err := cacheData(userDisabledCacheKey(userName), disabled, userDisabledCacheTime)
+	if err != nil {
+		log.Printf("Error caching the status of user '%s': %v\n", userName, err)
+	}
+}
+
+// Returns true if a user's account has been disabled, or doesn't exist any more
+func userDisabled(userName string) (bool, error) {
+	var disabled bool
+	ok, err := getCachedData(userDisabledCacheKey(userName), &disabled)
+	if err != nil {
+		log.Printf("Error retrieving the status of user '%s' from cache: %v\n", userName, err)
+	}
+	if ok {
+		return disabled, nil
+	}
+	err = db.QueryRow(`
+		SELECT disabled
+		FROM users
+		WHERE username = $1`, userName).Scan(&disabled)
+	if err == pgx.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	cacheUserDisabled(userName, disabled)
+	return disabled, nil
+}
+
+// Returns true if the owner of a database still has an enabled account.  Cached database details are only used when
+// this is the case, so databases of a newly disabled user disappear straight away rather than when the cache expires
+func ownerEnabled(owner string) bool {
+	disabled, err := userDisabled(owner)
+	if err != nil {
+		log.Printf("Error checking the status of user '%s': %v\n", owner, err)
+		return false
+	}
+	return !disabled
+}
+
+// Checks the account a request's session belongs to is still allowed to log in.  Sessions of accounts which have
+// been disabled since they logged in are removed, with the visitor told why.  When the account can't be checked the
+// session is kept, but the request is refused.  Returns false if the request was answered here
+func checkSessionAccount(w http.ResponseWriter, r *http.Request) bool {
+	userName := sessionUser(r)
+	if userName == "" {
+		return true
+	}
+	disabled, err := userDisabled(userName)
+	if err != nil {
+		log.Printf("Error checking the status of user '%s': %v\n", userName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return false
+	}
+	if !disabled {
+		return true
+	}
+	log.Printf("Removed a session of disabled user '%s'\n", userName)
+	session.Remove(session.Get(r), w)
+	errorPage(w, r, http.StatusForbidden, "This account has been disabled")
+	return false
+}
+
+// Returns the user a request's session belongs to, or an empty string for anonymous visitors.  Sessions without a
+// valid username, such as ones missing the attribute, are treated as anonymous rather than as a user named "<nil>"
+func sessionUser(r *http.Request) string {
+	sess := session.Get(r)
+	if sess == nil {
+		return ""
+	}
+	userName, ok := sess.CAttr("UserName").(string)
+	if !ok || com.ValidateUser(userName) != nil {
+		return ""
+	}
+	return userName
+}
+
+// Resolves the logged in user for a request once, storing it in the request context for currentUser()
+func withSessionUser(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, sessionUser(r)))
+}
+
+// Returns the logged in user for a request, or an empty string for anonymous visitors.  Requests which didn't come
+// through logReq() have their session read here instead
+func currentUser(r *http.Request) string {
+	if userName, ok := r.Context().Value(sessionUserKey{}).(string); ok {
+		return userName
+	}
+	return sessionUser(r)
+}
+
+// Wraps a handler which needs a logged in user.  Anonymous visitors asking for a page are sent to the login page,
+// which brings them back to the page afterwards.  Anything else, such as a form submission, is refused
+func requireLogin(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) != "" {
+			fn(w, r)
+			return
+		}
+		if r.Method != http.MethodGet || isAPIRequest(r) {
+			errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+			return
+		}
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	}
+}
+
+// Returns the page to go back to after logging in, if it's a page on this site.  Anything pointing elsewhere, or
+// which a browser could treat as pointing elsewhere, gives an empty string
+func localBounceURL(rawURL string) string {
+	ref, err := url.Parse(rawURL)
+	if err != nil || ref.Scheme != "" || ref.Host != "" || !strings.HasPrefix(ref.Path, "/") ||
+		strings.HasPrefix(ref.Path, "//") || strings.Contains(rawURL, "\\") {
+		return ""
+	}
+	return ref.RequestURI()
+}
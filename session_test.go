@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/icza/session"
+)
+
+// Sets the session timeouts for a test, returning a function which puts the previous ones back
+func useSessionTimeouts(idleMinutes int, lifetimeHours int) func() {
+	idle, life := conf.Web.SessionIdleTimeout, conf.Web.SessionLifetime
+	conf.Web.SessionIdleTimeout, conf.Web.SessionLifetime = idleMinutes, lifetimeHours
+	return func() {
+		conf.Web.SessionIdleTimeout, conf.Web.SessionLifetime = idle, life
+	}
+}
+
+// Stores a session for a user who logged in at started and was last active at lastActive, returning a request
+// carrying its cookie
+func sessionRequest(method string, target string, started time.Time, lastActive time.Time) (*http.Request,
+	session.Session) {
+	sess := newSession("someone", started)
+	sess.SetAttr(sessionLastActiveAttr, lastActive)
+	w := httptest.NewRecorder()
+	session.Add(sess, w)
+	r := httptest.NewRequest(method, target, nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r, sess
+}
+
+// Reports whether two times are within a few seconds of each other
+func closeTo(a time.Time, b time.Time) bool {
+	d := a.Sub(b)
+	return d > -5*time.Second && d < 5*time.Second
+}
+
+func TestSessionExpiry(t *testing.T) {
+	defer useSessionTimeouts(30, 0)()
+	now := time.Now()
+
+	// Without a lifetime, only the idle timeout applies
+	_, sess := sessionRequest(http.MethodGet, "/", now.Add(-48*time.Hour), now.Add(-10*time.Minute))
+	if exp := sessionExpiry(sess); !closeTo(exp, now.Add(20*time.Minute)) {
+		t.Errorf("Expected the session to expire 20 minutes from now, got %v", exp.Sub(now))
+	}
+
+	// The lifetime caps the idle timeout, however recently the session was used
+	conf.Web.SessionLifetime = 1
+	_, sess = sessionRequest(http.MethodGet, "/", now.Add(-50*time.Minute), now)
+	if exp := sessionExpiry(sess); !closeTo(exp, now.Add(10*time.Minute)) {
+		t.Errorf("Expected the session to expire 10 minutes from now, got %v", exp.Sub(now))
+	}
+
+	// Until the cap is near, the idle timeout is what counts
+	_, sess = sessionRequest(http.MethodGet, "/", now.Add(-10*time.Minute), now)
+	if exp := sessionExpiry(sess); !closeTo(exp, now.Add(30*time.Minute)) {
+		t.Errorf("Expected the session to expire 30 minutes from now, got %v", exp.Sub(now))
+	}
+}
+
+func TestSessionSlidingRenewal(t *testing.T) {
+	defer useSessionTimeouts(30, 24)()
+	now := time.Now()
+
+	// Each request pushes the expiry back to a full idle timeout from now
+	r, sess := sessionRequest(http.MethodGet, "/someone/db.sqlite", now.Add(-time.Hour), now.Add(-25*time.Minute))
+	w := httptest.NewRecorder()
+	if !checkSessionExpiry(w, r) {
+		t.Fatalf("Session was expired early, with status %d", w.Code)
+	}
+	if exp := sessionExpiry(sess); !closeTo(exp, now.Add(30*time.Minute)) {
+		t.Errorf("Expected the session to be renewed for 30 minutes, got %v", exp.Sub(now))
+	}
+	if session.Get(r) == nil {
+		t.Errorf("Renewed session was removed")
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	defer useSessionTimeouts(30, 1)()
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		referer    string
+		started    time.Time
+		lastActive time.Time
+		status     int
+		location   string
+	}{
+		// Idle for too long
+		{"idle page", http.MethodGet, "/someone/db.sqlite?table=t", "", now.Add(-40 * time.Minute),
+			now.Add(-31 * time.Minute), http.StatusSeeOther, "/login?expired=1&next=%2Fsomeone%2Fdb.sqlite%3Ftable%3Dt"},
+
+		// Busy right up to the end of its lifetime
+		{"lifetime page", http.MethodGet, "/pref", "", now.Add(-61 * time.Minute), now.Add(-time.Second),
+			http.StatusSeeOther, "/login?expired=1&next=%2Fpref"},
+
+		// Forms bounce back to the page they were on, rather than to where they were sent
+		{"form", http.MethodPost, "/x/star/someone/db.sqlite", "/someone/db.sqlite", now.Add(-2 * time.Hour),
+			now.Add(-time.Minute), http.StatusSeeOther, "/login?expired=1&next=%2Fsomeone%2Fdb.sqlite"},
+
+		// API clients can't follow the redirect, so get an error
+		{"API", http.MethodGet, apiPrefix + "meta/someone/db.sqlite", "", now.Add(-2 * time.Hour), now,
+			http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		r, _ := sessionRequest(tt.method, tt.target, tt.started, tt.lastActive)
+		if tt.referer != "" {
+			r.Header.Set("Referer", tt.referer)
+		}
+
+		// The session is dealt with before the handler is reached
+		handled := false
+		w := httptest.NewRecorder()
+		logReq(func(w http.ResponseWriter, r *http.Request) {
+			handled = true
+		})(w, r)
+		if handled || w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d (handler run: %v)", tt.name, tt.status, w.Code, handled)
+			continue
+		}
+		if loc := w.Header().Get("Location"); loc != tt.location {
+			t.Errorf("%s: expected to be sent to '%s', got '%s'", tt.name, tt.location, loc)
+		}
+		if tt.status == http.StatusUnauthorized && w.Header().Get("Content-Type") != contentTypeJSON {
+			t.Errorf("%s: expected a JSON error, got '%s'", tt.name, w.Body.String())
+		}
+
+		// The session is gone from the store, and the browser is told to forget its cookie
+		if session.Get(r) != nil {
+			t.Errorf("%s: expired session is still in the store", tt.name)
+		}
+		cleared := false
+		for _, c := range w.Result().Cookies() {
+			cleared = cleared || c.MaxAge < 0
+		}
+		if !cleared {
+			t.Errorf("%s: session cookie wasn't cleared", tt.name)
+		}
+	}
+}
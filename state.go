@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	com "github.com/dbhubio/common"
+)
+
+// The number of databases each user has their settings remembered for.  The least recently used are removed first
+const maxSavedStates = 100
+
+// The settings a user last used when viewing a database
+type dbState struct {
+	Table   string
+	SortCol string
+	SortDir string
+	Vis     visState
+}
+
+// The settings a user last used on the visualise page for a database
+type visState struct {
+	Table     string
+	XCol      string
+	YCols     []string
+	Aggregate string
+	Lat       string
+	Lon       string
+	Label     string
+}
+
+// Retrieves the settings a user last used for a database.  If there aren't any, the zero value is returned
+func getDBState(loggedInUser string, owner string, dbName string) (state dbState) {
+	var stateJSON string
+	err := db.QueryRow(`
+		SELECT st.state::text
+		FROM user_db_state AS st, sqlite_databases AS db
+		WHERE st.db = db.idnum
+			AND st.username = $1
+			AND db.username = $2
+			AND db.dbname = $3`, loggedInUser, owner, dbName).Scan(&stateJSON)
+	if err != nil {
+		// No saved state is the common case, so isn't worth logging
+		return
+	}
+	err = json.Unmarshal([]byte(stateJSON), &state)
+	if err != nil {
+		log.Printf("Error decoding saved state for '%s' on '%s/%s': %v\n", loggedInUser, owner, dbName, err)
+		return dbState{}
+	}
+	return
+}
+
+// Returns a sort direction for SQL, or an empty string if it isn't a valid one
+func sortDirection(dir string) string {
+	switch strings.ToUpper(dir) {
+	case "ASC":
+		return "ASC"
+	case "DESC":
+		return "DESC"
+	}
+	return ""
+}
+
+// Saves the settings the logged in user is using for a database, so they're restored on their next visit.  Only
+// the values given in the request are changed
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Save state handler"
+
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Settings need to be sent with POST")
+		return
+	}
+
+	// Anonymous users don't have saved settings
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Retrieve user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/state/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Check the user can see the database
+	var dbInfo sqliteDBinfo
+	err = checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+	if err != nil {
+		errorPage(w, r, versionErrorStatus(err), err.Error())
+		return
+	}
+
+	// Validate the given values
+	err = r.ParseForm()
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	var names []string
+	for _, field := range []string{"table", "sortcol", "vistable", "xcol", "groupby", "lat", "lon", "label"} {
+		if val := r.PostForm.Get(field); val != "" {
+			names = append(names, val)
+		}
+	}
+	if len(r.PostForm["ycol"]) > maxYCols {
+		errorPage(w, r, http.StatusBadRequest, "Too many Y columns")
+		return
+	}
+	names = append(names, r.PostForm["ycol"]...)
+	for _, name := range names {
+		err = com.ValidatePGTable(name)
+		if err != nil {
+			log.Printf("%s: Validation failed for name: %s", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Invalid table or column name")
+			return
+		}
+	}
+	sortDir := r.PostForm.Get("sortdir")
+	if sortDir != "" && sortDirection(sortDir) == "" {
+		errorPage(w, r, http.StatusBadRequest, "Invalid sort direction")
+		return
+	}
+	switch r.PostForm.Get("aggregate") {
+	case "", "count", "sum", "avg", "min", "max":
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Invalid aggregate")
+		return
+	}
+
+	// Update the saved state with the values given
+	state := getDBState(loggedInUser, userName, dbName)
+	if _, ok := r.PostForm["table"]; ok {
+		state.Table = r.PostForm.Get("table")
+		state.SortCol = r.PostForm.Get("sortcol")
+		state.SortDir = sortDirection(sortDir)
+	}
+	if _, ok := r.PostForm["vistable"]; ok {
+		state.Vis = visState{
+			Table:     r.PostForm.Get("vistable"),
+			XCol:      r.PostForm.Get("xcol"),
+			YCols:     r.PostForm["ycol"],
+			Aggregate: r.PostForm.Get("aggregate"),
+			Lat:       r.PostForm.Get("lat"),
+			Lon:       r.PostForm.Get("lon"),
+			Label:     r.PostForm.Get("label"),
+		}
+	}
+	err = saveDBState(loggedInUser, userName, dbName, state)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Saves the settings a user is using for a database, keeping only the ones for their most recently used databases
+func saveDBState(loggedInUser string, owner string, dbName string, state dbState) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Error encoding state for '%s' on '%s/%s': %v\n", loggedInUser, owner, dbName, err)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v\n", err)
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		INSERT INTO user_db_state (username, db, state, last_used)
+		SELECT $1, idnum, $4::jsonb, now()
+		FROM sqlite_databases
+		WHERE username = $2
+			AND dbname = $3
+		ON CONFLICT (username, db) DO UPDATE
+		SET state = EXCLUDED.state, last_used = EXCLUDED.last_used`, loggedInUser, owner, dbName,
+		string(stateJSON))
+	if err != nil {
+		log.Printf("Error saving state for '%s' on '%s/%s': %v\n", loggedInUser, owner, dbName, err)
+		return err
+	}
+
+	// Only keep the most recently used settings for each user
+	_, err = tx.Exec(`
+		DELETE FROM user_db_state
+		WHERE username = $1
+			AND db NOT IN (
+				SELECT db
+				FROM user_db_state
+				WHERE username = $1
+				ORDER BY last_used DESC
+				LIMIT $2)`, loggedInUser, maxSavedStates)
+	if err != nil {
+		log.Printf("Error removing old states for '%s': %v\n", loggedInUser, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Error committing state for '%s' on '%s/%s': %v\n", loggedInUser, owner, dbName, err)
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The kinds of event recorded in the database statistics
+const (
+	statView = iota
+	statDownload
+	statCSVDownload
+)
+
+// How often the aggregated statistics are written to PostgreSQL
+const statsFlushInterval = time.Minute
+
+// Substrings of user agents which identify crawlers.  Matching requests are counted separately from real views
+var botAgents = []string{"bot", "crawler", "spider", "slurp", "curl", "wget", "python-requests"}
+
+// A single view or download of a database
+type statEvent struct {
+	Owner    string
+	Database string
+	Kind     int
+	LoggedIn bool
+	Bot      bool
+}
+
+// Daily totals for a database, accumulated between flushes
+type statCounts struct {
+	Views        int
+	AnonViews    int
+	BotViews     int
+	Downloads    int
+	CSVDownloads int
+}
+
+type statKey struct {
+	Owner    string
+	Database string
+	Date     time.Time
+}
+
+// Events are passed to the background writer through this channel, so recording them never waits on PostgreSQL
+var statsQueue = make(chan statEvent, 1000)
+
+// Returns true if the user agent of the request looks like a crawler
+func isBot(r *http.Request) bool {
+	agent := strings.ToLower(r.UserAgent())
+	if agent == "" {
+		return true
+	}
+	for _, j := range botAgents {
+		if strings.Contains(agent, j) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues a view or download of a database for the statistics.  If the queue is full the event is dropped, rather
+// than slowing down the request
+func recordStat(r *http.Request, owner string, dbName string, kind int, loggedInUser string) {
+	// Owners looking at their own databases aren't interesting
+	if loggedInUser == owner {
+		return
+	}
+	select {
+	case statsQueue <- statEvent{Owner: owner, Database: dbName, Kind: kind, LoggedIn: loggedInUser != "",
+		Bot: isBot(r)}:
+	default:
+	}
+}
+
+// Aggregates queued statistics events in memory, periodically adding the totals to the database_stats table
+func statsWriter() {
+	counts := make(map[statKey]*statCounts)
+	ticker := time.NewTicker(statsFlushInterval)
+	for {
+		select {
+		case ev := <-statsQueue:
+			key := statKey{Owner: ev.Owner, Database: ev.Database, Date: time.Now().UTC().Truncate(24 * time.Hour)}
+			c, ok := counts[key]
+			if !ok {
+				c = &statCounts{}
+				counts[key] = c
+			}
+			// Anything a bot does is only counted as a bot view, so it doesn't inflate the download counts either
+			switch {
+			case ev.Bot:
+				c.BotViews++
+			case ev.Kind == statDownload:
+				c.Downloads++
+			case ev.Kind == statCSVDownload:
+				c.CSVDownloads++
+			case ev.LoggedIn:
+				c.Views++
+			default:
+				c.Views++
+				c.AnonViews++
+			}
+		case <-ticker.C:
+			for key, c := range counts {
+				_, err := db.Exec(`
+					INSERT INTO database_stats (db, date, views, anon_views, bot_views, downloads, csv_downloads)
+					SELECT idnum, $3, $4, $5, $6, $7, $8
+					FROM sqlite_databases
+					WHERE username = $1
+						AND dbname = $2
+					ON CONFLICT (db, date) DO UPDATE
+					SET views = database_stats.views + EXCLUDED.views,
+						anon_views = database_stats.anon_views + EXCLUDED.anon_views,
+						bot_views = database_stats.bot_views + EXCLUDED.bot_views,
+						downloads = database_stats.downloads + EXCLUDED.downloads,
+						csv_downloads = database_stats.csv_downloads + EXCLUDED.csv_downloads`,
+					key.Owner, key.Database, key.Date, c.Views, c.AnonViews, c.BotViews, c.Downloads,
+					c.CSVDownloads)
+				if err != nil {
+					// Keep the counts, so they're retried on the next flush
+					log.Printf("Error saving statistics for '%s/%s': %v\n", key.Owner, key.Database, err)
+					continue
+				}
+				delete(counts, key)
+			}
+		}
+	}
+}
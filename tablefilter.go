@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	com "github.com/dbhubio/common"
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Owners can give each table a default filter, such as only showing rows whose "status" column is "published".
+// Everyone but the owner sees the table filtered, on the database page, in the table data, searches, single cells,
+// visualisations and exports, unless they ask for every row with all=true.  The filters are stored in PostgreSQL:
+//
+//	CREATE TABLE table_filters (
+//		db bigint NOT NULL REFERENCES sqlite_databases (idnum) ON DELETE CASCADE,
+//		table_name text NOT NULL,
+//		column_name text NOT NULL,
+//		operator text NOT NULL,
+//		value text NOT NULL,
+//		PRIMARY KEY (db, table_name)
+//	);
+
+// The comparisons a default filter can use, which are the ones visualisations can filter on
+var filterOperators = []string{"=", "!=", "<", "<=", ">", ">=", "LIKE"}
+
+// Returns true if a comparison can be used in a filter
+func validFilterOperator(op string) bool {
+	for _, o := range filterOperators {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Describes a filter condition for people, eg: "status" = 'published'
+func (w whereClause) String() string {
+	return fmt.Sprintf("%s %s '%v'", quoteIdentifier(w.Column), w.Type, w.Value)
+}
+
+// The default filters of a database's tables, by table name
+type tableFilters map[string]whereClause
+
+// Returns a string which changes whenever any of the filters do, for the cache keys of filtered data.  It's empty
+// when there are no filters
+func (t tableFilters) Key() string {
+	if len(t) == 0 {
+		return ""
+	}
+	var tables []string
+	for name := range t {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+	var s string
+	for _, name := range tables {
+		s += name + "\x00" + t[name].String() + "\x00"
+	}
+	tempArr := md5.Sum([]byte(s))
+	return hex.EncodeToString(tempArr[:])
+}
+
+// Returns the default filter for a table as WHERE clauses for one version of the database.  The filter's column may
+// not be in every version, and its value is converted to suit the column's type, so the clauses are worked out
+// against the open database.  A filter which doesn't fit the version is left out
+func (t tableFilters) Clauses(sdb *sqlite.Conn, dbTable string) []whereClause {
+	w, ok := t[dbTable]
+	if !ok {
+		return nil
+	}
+	cols, err := tableColumns(sdb, dbTable)
+	if err != nil {
+		log.Printf("Error retrieving columns of table '%s' for its default filter: %v\n", dbTable, err)
+		return nil
+	}
+	found := false
+	for _, c := range cols {
+		if c.Name == w.Column {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	clauses := []whereClause{w}
+	if err = typeWhereClauses(cols, clauses); err != nil {
+		log.Printf("Default filter of table '%s' doesn't fit this version: %v\n", dbTable, err)
+		return nil
+	}
+	return clauses
+}
+
+// Returns the default filters for the tables of a database
+func getTableFilters(owner string, dbName string) (tableFilters, error) {
+	rows, err := db.Query(`
+		SELECT f.table_name, f.column_name, f.operator, f.value
+		FROM table_filters AS f, sqlite_databases AS db
+		WHERE f.db = db.idnum
+			AND db.username = $1
+			AND db.dbname = $2`, owner, dbName)
+	if err != nil {
+		log.Printf("Error retrieving the default filters of '%s/%s': %v\n", owner, dbName, err)
+		return nil, errors.New("Database query failed")
+	}
+	defer rows.Close()
+	filters := make(tableFilters)
+	for rows.Next() {
+		var table, value string
+		var w whereClause
+		err = rows.Scan(&table, &w.Column, &w.Type, &value)
+		if err != nil {
+			log.Printf("Error retrieving the default filters of '%s/%s': %v\n", owner, dbName, err)
+			return nil, errors.New("Database query failed")
+		}
+		if !validFilterOperator(w.Type) {
+			log.Printf("Ignoring default filter of '%s/%s' table '%s' with unknown operator '%s'\n", owner, dbName,
+				table, w.Type)
+			continue
+		}
+		w.Value = value
+		filters[table] = w
+	}
+	return filters, rows.Err()
+}
+
+// Returns the default filters which apply to the person making a request.  Owners see every row of their own
+// databases, and everyone else can ask for every row with all=true.  The second value returned is whether every row
+// was asked for
+func viewerTableFilters(r *http.Request, loggedInUser string, owner string, dbName string) (tableFilters, bool,
+	error) {
+	if loggedInUser == owner {
+		return nil, false, nil
+	}
+	showAll, _ := strconv.ParseBool(r.FormValue("all"))
+	if showAll {
+		return nil, true, nil
+	}
+	filters, err := getTableFilters(owner, dbName)
+	return filters, false, err
+}
+
+// Fills in the details of a table's default filter for showing with its rows.  When the filter was applied, the
+// number of rows it hid is worked out from the total number of rows in the table
+func describeTableFilter(rs *sqliteRecordSet, filter whereClause, applied bool, filteredRows int, totalRows int) {
+	rs.DefaultFilter = filter.String()
+	rs.FilterApplied = applied
+	if applied && totalRows > filteredRows {
+		rs.HiddenRows = totalRows - filteredRows
+	}
+}
+
+// Sets the default filter of a table.  A nil filter removes it
+func setTableFilter(owner string, dbName string, dbTable string, w *whereClause) error {
+	var err error
+	if w == nil {
+		_, err = db.Exec(`
+			DELETE FROM table_filters
+			WHERE db = (
+					SELECT idnum
+					FROM sqlite_databases
+					WHERE username = $1
+						AND dbname = $2)
+				AND table_name = $3`, owner, dbName, dbTable)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO table_filters (db, table_name, column_name, operator, value)
+			SELECT idnum, $3, $4, $5, $6
+			FROM sqlite_databases
+			WHERE username = $1
+				AND dbname = $2
+			ON CONFLICT (db, table_name) DO UPDATE
+			SET column_name = excluded.column_name, operator = excluded.operator, value = excluded.value`,
+			owner, dbName, dbTable, w.Column, w.Type, fmt.Sprintf("%v", w.Value))
+	}
+	if err != nil {
+		log.Printf("Error setting the default filter of '%s/%s' table '%s': %v\n", owner, dbName, dbTable, err)
+		return errors.New("Database query failed")
+	}
+	return nil
+}
+
+// Sets the default filter of a table, which hides rows from everyone but the owner unless they ask to see them all.
+// Only the owner can change it, and the column needs to be in the table in the latest version.  An empty column
+// clears the filter
+func tableFilterHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Table filter handler"
+
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "The default filter needs to be sent with POST")
+		return
+	}
+	loggedInUser := currentUser(r)
+
+	// Retrieve user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/tablefilter/" at the start of the URL
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if loggedInUser != userName {
+		jsonError(w, http.StatusForbidden, "Only the owner of a database can change its default filters")
+		return
+	}
+	dbTable := r.PostFormValue("table")
+	err = com.ValidatePGTable(dbTable)
+	if err != nil {
+		log.Printf("%s: Validation failed for table name: %s", pageName, err)
+		jsonError(w, http.StatusBadRequest, "Invalid table name")
+		return
+	}
+	var filter *whereClause
+	if col := r.PostFormValue("col"); col != "" {
+		err = com.ValidatePGTable(col)
+		if err != nil {
+			log.Printf("%s: Validation failed for column name: %s", pageName, err)
+			jsonError(w, http.StatusBadRequest, "Invalid column name")
+			return
+		}
+		op := r.PostFormValue("op")
+		if !validFilterOperator(op) {
+			jsonError(w, http.StatusBadRequest, "Unknown comparison")
+			return
+		}
+		filter = &whereClause{Column: col, Type: op, Value: r.PostFormValue("value")}
+	}
+
+	// Check the column is in the table in the latest version, and the value can be compared with it
+	if filter != nil {
+		var dbInfo sqliteDBinfo
+		err = checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+		if err != nil {
+			jsonError(w, versionErrorStatus(err), err.Error())
+			return
+		}
+		sdb, err := openMinioObject(dbInfo.MinioBkt, dbInfo.MinioId)
+		if err == errTooManyOpenDBs {
+			serverBusy(w, r)
+			return
+		}
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		clauses := tableFilters{dbTable: *filter}.Clauses(sdb, dbTable)
+		if clauses == nil {
+			// Say why, as Clauses() only logs it
+			cols, _ := tableColumns(sdb, dbTable)
+			closeMinioObject(sdb)
+			if typeWhereClauses(cols, []whereClause{*filter}) != nil {
+				jsonError(w, http.StatusBadRequest, fmt.Sprintf("The value to compare column '%s' with needs to "+
+					"be a number", filter.Column))
+				return
+			}
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("The latest version doesn't have a column called "+
+				"'%s' in table '%s'", filter.Column, dbTable))
+			return
+		}
+		closeMinioObject(sdb)
+	}
+
+	err = setTableFilter(userName, dbName, dbTable, filter)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var desc string
+	if filter != nil {
+		desc = filter.String()
+	}
+	writeJSON(w, http.StatusOK, struct {
+		DefaultFilter string
+	}{desc})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// The formats a table can be exported in, besides CSV.  These are meant for pasting into documents, so they're
+// limited to a reasonable number of rows
+const (
+	tableFormatHTML     = "html"
+	tableFormatMarkdown = "md"
+	tableFormatMaxRows  = 10000
+)
+
+// Escapes a value for use in a GitHub flavoured Markdown table cell.  Pipes would end the cell, angle brackets
+// would be taken as HTML, and line breaks would end the row
+var markdownCellReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	"|", `\|`,
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"\r\n", "<br>",
+	"\n", "<br>",
+	"\r", "<br>",
+)
+
+// Writes rows out as a minimal HTML table, with the column names as its header.  If a note is given, such as the
+// filter applied to the rows, it's shown below the table
+func writeHTMLTable(w io.Writer, title string, colNames []string, rows [][]string, note string) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n",
+		html.EscapeString(title))
+	fmt.Fprintf(b, "<table>\n<caption>%s</caption>\n<thead>\n<tr>", html.EscapeString(title))
+	for _, c := range colNames {
+		fmt.Fprintf(b, "<th scope=\"col\">%s</th>", html.EscapeString(c))
+	}
+	fmt.Fprint(b, "</tr>\n</thead>\n<tbody>\n")
+	for _, row := range rows {
+		fmt.Fprint(b, "<tr>")
+		for _, val := range row {
+			fmt.Fprintf(b, "<td>%s</td>", html.EscapeString(val))
+		}
+		fmt.Fprint(b, "</tr>\n")
+	}
+	fmt.Fprint(b, "</tbody>\n</table>\n")
+	if note != "" {
+		fmt.Fprintf(b, "<p><em>%s</em></p>\n", html.EscapeString(note))
+	}
+	fmt.Fprint(b, "</body>\n</html>\n")
+	return b.Flush()
+}
+
+// Writes rows out as a GitHub flavoured Markdown table, with the column names as its header.  If a note is given,
+// such as the filter applied to the rows, it's added as a paragraph after the table
+func writeMarkdownTable(w io.Writer, colNames []string, rows [][]string, note string) error {
+	b := bufio.NewWriter(w)
+	writeRow := func(vals []string) {
+		fmt.Fprint(b, "|")
+		for _, val := range vals {
+			fmt.Fprintf(b, " %s |", markdownCellReplacer.Replace(val))
+		}
+		fmt.Fprint(b, "\n")
+	}
+	writeRow(colNames)
+	fmt.Fprint(b, "|")
+	for range colNames {
+		fmt.Fprint(b, " --- |")
+	}
+	fmt.Fprint(b, "\n")
+	for _, row := range rows {
+		writeRow(row)
+	}
+	if note != "" {
+		fmt.Fprintf(b, "\n_%s_\n", markdownCellReplacer.Replace(note))
+	}
+	return b.Flush()
+}
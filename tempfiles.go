@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+const (
+	// How long a request waits for one of the other requests to finish with its database, when the most databases
+	// allowed are already open
+	tempDBQueueWait = 5 * time.Second
+
+	// How long clients turned away are told to wait before trying again, in seconds
+	tempDBRetryAfter = 10
+
+	// Temporary files older than this are left over from a previous run, so are removed at startup
+	staleTempFileAge = time.Hour
+)
+
+// Returned when a database can't be opened because too many others are already open
+var errTooManyOpenDBs = errors.New("Too many databases are open.  Please try again in a moment")
+
+var (
+	// Slots for the databases retrieved from Minio into temporary files.  Each one open holds a slot until it's
+	// closed, so the number open at once can't fill the disk
+	tempDBSlots chan struct{}
+
+	// The SQLite connections holding a slot, so closeMinioObject() knows to release it
+	tempDBs   = make(map[*sqlite.Conn]bool)
+	tempDBsMu sync.Mutex
+
+	// The number of times a database couldn't be opened because too many were open.  Updated atomically
+	tempDBRejected uint64
+)
+
+// Returns the directory temporary files are written to
+func tempDir() string {
+	if conf.Web.TempDir != "" {
+		return conf.Web.TempDir
+	}
+	return os.TempDir()
+}
+
+// Removes temporary files left behind by a previous run, such as when the server crashed part way through a
+// request.  Only our own files are touched, as the directory may be shared with other programs
+func sweepTempFiles() {
+	files, err := ioutil.ReadDir(tempDir())
+	if err != nil {
+		log.Printf("Error looking for stale temporary files: %v\n", err)
+		return
+	}
+	cutoff := time.Now().Add(-staleTempFileAge)
+	removed := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "dbhub-") || f.ModTime().After(cutoff) {
+			continue
+		}
+		err = os.Remove(filepath.Join(tempDir(), f.Name()))
+		if err != nil {
+			log.Printf("Error removing stale temporary file '%s': %v\n", f.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d stale temporary files\n", removed)
+	}
+}
+
+// Waits for a slot to open a database in, giving up after a short time or when the context is cancelled
+func acquireTempDBSlot(ctx context.Context) error {
+	select {
+	case tempDBSlots <- struct{}{}:
+		return nil
+	default:
+	}
+	t := time.NewTimer(tempDBQueueWait)
+	defer t.Stop()
+	select {
+	case tempDBSlots <- struct{}{}:
+		return nil
+	case <-t.C:
+		atomic.AddUint64(&tempDBRejected, 1)
+		return errTooManyOpenDBs
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseTempDBSlot() {
+	<-tempDBSlots
+}
+
+// Returns the number of databases currently open from temporary files, and the number of times one couldn't be
+// opened since startup because too many were
+func tempDBStats() (open int, rejected uint64) {
+	return len(tempDBSlots), atomic.LoadUint64(&tempDBRejected)
+}
+
+// Tells the client the server is too busy to open the database they asked for, and to try again shortly
+func serverBusy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(tempDBRetryAfter))
+	errorPage(w, r, http.StatusServiceUnavailable, "The server is busy.  Please try again in a moment.")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The functions available to the page templates.  These need to be registered before the templates are parsed
+var templateFuncs = template.FuncMap{
+	"assetURL":    assetURL,
+	"formatCount": formatCount,
+	"formatSize":  formatSize,
+	"formatTime":  formatTime,
+	"plural":      plural,
+	"quickAccess": getQuickAccess,
+	"timeAgo": func(t time.Time) string {
+		return relativeTime(t, time.Now())
+	},
+	"truncate": truncateText,
+}
+
+// Formats a size in bytes for display, eg "512 bytes", "12.5 KB" or "3.4 MB"
+func formatSize(size int) string {
+	if size < 1024 {
+		return plural(size, "byte", "bytes")
+	}
+
+	// Sizes which would round up to 1024.0 of one unit are given as 1.0 of the next
+	units := []string{"KB", "MB", "GB"}
+	val := float64(size) / 1024
+	i := 0
+	for val >= 1023.95 && i < len(units)-1 {
+		val /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", val, units[i])
+}
+
+// Returns the count along with the singular or plural form of a word to go with it, eg "1 row" or "1,234 rows"
+func plural(n int, singular string, pluralForm string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", singular)
+	}
+	return fmt.Sprintf("%s %s", formatCount(n), pluralForm)
+}
+
+// Formats a count for display with thousands separators, eg "1,234,567"
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	if neg {
+		return "-" + s
+	}
+	return s
+}
+
+// Shortens text to at most the given number of characters, ending it with an ellipsis when something was cut off
+func truncateText(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	if length < 1 {
+		return ""
+	}
+	return string(runes[:length-1]) + "…"
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Renders a page template, failing the test if it doesn't render
+func renderTestPage(t *testing.T, name string, data interface{}) string {
+	w := httptest.NewRecorder()
+	renderTemplate(w, name, data)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Rendering '%s' gave status %d: %s", name, w.Code, w.Body.String())
+	}
+	return w.Body.String()
+}
+
+func TestUserPageDescriptions(t *testing.T) {
+	var pageData struct {
+		Meta        metaInfo
+		ListOptions dbListOptions
+		Databases   dbSection
+	}
+	pageData.Meta.Username = "someone"
+	pageData.Databases.DBs = []dbInfo{
+		{Owner: "someone", Database: "markup.sqlite", Description: `<b>"bold"</b> & co`, Size: 2048, Stars: 1234},
+		{Owner: "someone", Database: "plain.sqlite"},
+		{Owner: "someone", Database: "long.sqlite", Description: strings.Repeat("a", 250)},
+	}
+	pageData.Databases.Pager.Total = 3
+	page := renderTestPage(t, "userPage", pageData)
+
+	// Descriptions are escaped by the template, which adds the separator in front of them
+	if !strings.Contains(page, `markup.sqlite</a> : &lt;b&gt;&#34;bold&#34;&lt;/b&gt; &amp; co</h4>`) {
+		t.Errorf("Description wasn't escaped as expected")
+	}
+	if strings.Contains(page, `<b>"bold"</b>`) {
+		t.Errorf("Description markup was passed through to the page")
+	}
+
+	// Databases without a description don't get a separator
+	if !strings.Contains(page, `plain.sqlite</a> </h4>`) {
+		t.Errorf("Database without a description was shown with one")
+	}
+
+	// Long descriptions are cut short
+	if !strings.Contains(page, ": "+strings.Repeat("a", 199)+"…</h4>") {
+		t.Errorf("Long description wasn't truncated")
+	}
+
+	// Numbers are formatted by the template rather than the handler
+	if !strings.Contains(page, "<b>Size:</b> 2.0 KB") || !strings.Contains(page, "<b>Stars:</b> 1,234") {
+		t.Errorf("Size and counts weren't formatted")
+	}
+}
+
+func TestErrorPageEscapesMessage(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/someone/missing.sqlite", nil)
+	errorPage(w, r, http.StatusNotFound, `Unknown database: <script>alert("x")</script>`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `<h2>Unknown database: &lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</h2>`) {
+		t.Errorf("Error message wasn't escaped as expected")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size int
+		want string
+	}{
+		{0, "0 bytes"},
+		{1, "1 byte"},
+		{999, "999 bytes"},
+		{1000, "1,000 bytes"},
+		{1023, "1,023 bytes"},
+		{1024, "1.0 KB"},
+		{1075, "1.0 KB"},
+		{1076, "1.1 KB"},
+		{1536, "1.5 KB"},
+		{1024*1024 - 52, "1023.9 KB"},
+		{1024*1024 - 51, "1.0 MB"},
+		{1024 * 1024, "1.0 MB"},
+		{4404019, "4.2 MB"},
+		{1024*1024*1024 - 1, "1.0 GB"},
+		{1024 * 1024 * 1024, "1.0 GB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GB"},
+		{2048 * 1024 * 1024 * 1024, "2048.0 GB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.size); got != tt.want {
+			t.Errorf("formatSize(%d): expected '%s', got '%s'", tt.size, tt.want, got)
+		}
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "0"},
+		{7, "7"},
+		{999, "999"},
+		{1000, "1,000"},
+		{12345, "12,345"},
+		{999999, "999,999"},
+		{1000000, "1,000,000"},
+		{1234567, "1,234,567"},
+		{-1, "-1"},
+		{-1000, "-1,000"},
+		{-123456, "-123,456"},
+	}
+	for _, tt := range tests {
+		if got := formatCount(tt.n); got != tt.want {
+			t.Errorf("formatCount(%d): expected '%s', got '%s'", tt.n, tt.want, got)
+		}
+	}
+}
+
+func TestPlural(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "0 rows"},
+		{1, "1 row"},
+		{2, "2 rows"},
+		{1000, "1,000 rows"},
+		{-1, "-1 rows"},
+	}
+	for _, tt := range tests {
+		if got := plural(tt.n, "row", "rows"); got != tt.want {
+			t.Errorf("plural(%d): expected '%s', got '%s'", tt.n, tt.want, got)
+		}
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		s      string
+		length int
+		want   string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"eleven chars", 10, "eleven ch…"},
+		{"données à voir", 8, "données…"},
+		{"anything", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateText(tt.s, tt.length); got != tt.want {
+			t.Errorf("truncateText('%s', %d): expected '%s', got '%s'", tt.s, tt.length, tt.want, got)
+		}
+	}
+}
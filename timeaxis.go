@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The ways X axis values can be interpreted as timestamps
+const (
+	xTypeAuto  = "auto"  // Numbers are treated as epoch values, text as ISO-8601
+	xTypeDate  = "date"  // ISO-8601 text
+	xTypeEpoch = "epoch" // Unix epoch seconds or milliseconds
+)
+
+// Epoch values larger than this are taken to be in milliseconds.  In seconds it's over 3000 years away
+const epochMillisThreshold = 1e11
+
+// The ISO-8601 layouts SQLite date and time functions produce, plus the common variations
+var isoDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Converts a Unix epoch value to a timestamp, guessing whether it's in seconds or milliseconds
+func parseEpoch(val string) (time.Time, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if math.Abs(f) > epochMillisThreshold {
+		f /= 1000
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+}
+
+// Converts ISO-8601 text to a timestamp.  Values without a time zone are taken to be UTC, as SQLite does
+func parseISODate(val string) (time.Time, error) {
+	val = strings.TrimSpace(val)
+	for _, layout := range isoDateLayouts {
+		t, err := time.Parse(layout, val)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.New("not an ISO-8601 date")
+}
+
+// Interprets the X values (the first column) of a record set as timestamps, replacing them with RFC3339 strings
+// and sorting the rows by time.  Rows whose X value can't be understood are dropped, and counted in SkippedRows
+func convertTimeAxis(dataRows *sqliteRecordSet, xType string) {
+	type timedRow struct {
+		ts  time.Time
+		row dataRow
+	}
+	var rows []timedRow
+	for _, row := range dataRows.Records {
+		if len(row) == 0 {
+			continue
+		}
+		var ts time.Time
+		var err error
+		switch {
+		case xType == xTypeEpoch:
+			ts, err = parseEpoch(row[0].Value)
+		case xType == xTypeDate:
+			ts, err = parseISODate(row[0].Value)
+		case row[0].Type == Integer || row[0].Type == Float:
+			ts, err = parseEpoch(row[0].Value)
+		default:
+			// Text holding just a number is treated as an epoch value too
+			ts, err = parseISODate(row[0].Value)
+			if err != nil {
+				ts, err = parseEpoch(row[0].Value)
+			}
+		}
+		if err != nil || row[0].Type == Null {
+			dataRows.SkippedRows++
+			continue
+		}
+		row[0].Type = Text
+		row[0].Value = ts.Format(time.RFC3339Nano)
+		rows = append(rows, timedRow{ts: ts, row: row})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].ts.Before(rows[j].ts)
+	})
+
+	dataRows.Records = dataRows.Records[:0]
+	for _, r := range rows {
+		dataRows.Records = append(dataRows.Records, r.row)
+	}
+	dataRows.RowCount = len(dataRows.Records)
+	dataRows.TemporalX = true
+}
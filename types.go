@@ -2,19 +2,40 @@ package main
 
 import (
 	"time"
+
+	"github.com/jackc/pgx"
 )
 
 // Configuration file
 type tomlConfig struct {
-	Cache cacheInfo
-	Minio minioInfo
-	Pg    pgInfo
-	Web   webInfo
+	Cache        cacheInfo
+	Limits       limitsInfo
+	Minio        minioInfo
+	Pg           pgInfo
+	RateLimit    rateLimitInfo `toml:"ratelimit"`
+	Registration registrationInfo
+	Retry        retryInfo
+	Timeouts     timeoutInfo
+	Web          webInfo
+}
+
+// The most data accepted in request bodies, in MB
+type limitsInfo struct {
+	// Forms and JSON requests, which is everything not covered by the upload limit
+	Form int64
+
+	// Requests sending databases or images, and saving edits
+	Upload int64
+
+	// How much of a multipart upload is held in memory before the rest is written to a temporary file
+	MultipartMemory int64 `toml:"multipart_memory"`
 }
 
-// Memcached connection parameters
+// Memcached connection parameters, and the local disk cache for database files
 type cacheInfo struct {
-	Server string
+	Server   string
+	DiskPath string `toml:"disk_path"` // Leave empty to disable the disk cache
+	DiskSize int64  `toml:"disk_size"` // In MB
 }
 
 // Minio connection parameters
@@ -23,15 +44,75 @@ type minioInfo struct {
 	AccessKey string `toml:"access_key"`
 	Secret    string
 	HTTPS     bool
+
+	// Database downloads are redirected to a presigned Minio URL instead of being sent through this server.  Only
+	// for deployments where visitors can reach Minio at the address above
+	PresignDownloads bool `toml:"presign_downloads"`
+
+	// Number of seconds the presigned download URLs work for
+	PresignExpiry int `toml:"presign_expiry"`
 }
 
 // PostgreSQL connection parameters
 type pgInfo struct {
-	Server   string
-	Port     int
-	Username string
-	Password string
-	Database string
+	Server         string
+	Port           int
+	Username       string
+	Password       string
+	Database       string
+	MaxConnections int `toml:"max_connections"`
+}
+
+// The number of requests per minute allowed for each kind of traffic, from anonymous visitors (by IP address) and
+// from logged in users (by username).  Short bursts of up to a minute's worth of requests are allowed
+type rateLimitInfo struct {
+	Pages         int
+	API           int
+	Downloads     int
+	UserPages     int `toml:"user_pages"`
+	UserAPI       int `toml:"user_api"`
+	UserDownloads int `toml:"user_downloads"`
+	Disabled      bool
+}
+
+// Protections against bots signing up.  Each one is off unless it's set
+type registrationInfo struct {
+	// Number of registration attempts allowed from each IP address per hour.  0 means no limit
+	PerIPLimit int `toml:"per_ip_limit"`
+
+	// Ask a simple arithmetic question on the registration form
+	Challenge bool
+
+	// Add a hidden field to the registration form, which people never see but form filling bots do
+	Honeypot bool
+
+	// Email domains which can't be used to register, such as those of disposable email services.  Subdomains of
+	// them are blocked too
+	BlockedDomains []string `toml:"blocked_domains"`
+}
+
+// How often to try connecting to the services we depend on when starting up.  The interval (in seconds) doubles
+// after each failed attempt
+type retryInfo struct {
+	Attempts int
+	Interval int
+}
+
+type tableRowCount struct {
+	Name     string
+	Rows     int
+	Approx   bool   // True when the count is an estimate, as the table is still being counted
+	Unknown  bool   // True when the table couldn't be counted, which happens with some virtual tables
+	Module   string // The module used by a virtual table
+	Internal bool   // True for the shadow tables holding the data of a virtual table
+}
+
+// Per-operation timeouts, in seconds
+type timeoutInfo struct {
+	Query  int
+	Minio  int
+	Fetch  int // For downloading databases from remote URLs
+	SQLite int // For the reads from SQLite databases done by each request
 }
 
 type webInfo struct {
@@ -39,15 +120,102 @@ type webInfo struct {
 	Certificate    string
 	CertificateKey string `toml:"certificate_key"`
 	RequestLog     string `toml:"request_log"`
+
+	// Where requests are logged to: "file" (the default), "postgres", or "both"
+	RequestLogBackend string `toml:"request_log_backend"`
+
+	// Number of days of requests kept in PostgreSQL.  0 means they're never removed
+	RequestLogRetention int `toml:"request_log_retention"`
+
+	// Number of days audit events are kept for.  0 means they're never removed
+	AuditRetention int `toml:"audit_retention"`
+
+	// Addresses of the reverse proxies in front of the server, as IP addresses or CIDR ranges.  Requests from these
+	// are taken to be from the address they give in X-Forwarded-For
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// Number of workers running background jobs
+	JobWorkers int `toml:"job_workers"`
+
+	// Text values longer than this many bytes are cut short when shown in tables
+	CellLength int `toml:"cell_length"`
+
+	// Number of rows shown from a table for visitors, and users who haven't chosen their own
+	DefaultRows int `toml:"default_rows"`
+
+	// The most rows the JSON table endpoints return at once, when asked for a number with the rows parameter
+	MaxAPIRows int `toml:"max_api_rows"`
+
+	// Seconds crawlers are asked to wait between requests in robots.txt.  0 leaves it out
+	RobotsCrawlDelay int `toml:"robots_crawl_delay"`
+
+	// The sitemap URL given in robots.txt, if there is one
+	RobotsSitemap string `toml:"robots_sitemap"`
+
+	// Extra rules added to the end of robots.txt as they are, for anything the generated rules don't cover
+	RobotsExtra string `toml:"robots_extra"`
+
+	// Number of minutes a login session lasts without any requests being made with it
+	SessionIdleTimeout int `toml:"session_idle_timeout"`
+
+	// Number of hours a login session lasts however active it is.  0 means there's no limit
+	SessionLifetime int `toml:"session_lifetime"`
+
+	// Number of hours a chunked upload can go without any data being sent before it's removed
+	UploadExpiry int `toml:"upload_expiry"`
+
+	// Where temporary files are written.  Defaults to the system temporary directory
+	TempDir string `toml:"temp_dir"`
+
+	// The most databases retrieved from Minio into temporary files which can be open at once.  Requests beyond this
+	// wait briefly for one to be closed, then are turned away.  Not used when the disk cache is enabled
+	MaxOpenDatabases int `toml:"max_open_databases"`
+
+	// Development mode.  Templates are re-parsed for every request, and the server listens on plain HTTP at
+	// localhost:8080.  Can also be turned on with the -dev command line flag
+	Dev bool
+}
+
+// A column of a SQLite table.  Generated columns are shown like any other, but can't be written to
+type columnInfo struct {
+	Name      string
+	DataType  string
+	NotNull   bool
+	Pk        int // Position in the primary key, starting from 1.  0 when the column isn't part of it
+	Generated bool
+}
+
+// A date format users can choose, along with how a date looks in it
+type dateFormatInfo struct {
+	Format  string
+	Example string
 }
 
+// The type of a column.  Declared is the type given in the table's definition, exactly as written, and Class is the
+// storage class of its values: "integer", "real", "text", "blob" or "null"
+type columnType struct {
+	Declared string
+	Class    string
+}
+
+// A value from a SQLite table.  NULLs and BLOBs have an empty Value, with Type saying which they are, so it's up to
+// whatever displays them to decide how they look
 type dataValue struct {
 	Name  string
 	Type  ValType
-	Value interface{}
+	Value string
+
+	// Set when a long text value was cut short for display, along with its full length in bytes.  The whole value
+	// can be retrieved from /x/cell/.  Blobs always have their length given
+	Truncated bool `json:",omitempty"`
+	Length    int  `json:",omitempty"`
+
+	// Set for blobs holding an image, which can be shown using /x/blob/
+	Image bool `json:",omitempty"`
 }
 type dataRow []dataValue
 type dbInfo struct {
+	Owner        string
 	Database     string
 	Tables       []string
 	Watchers     int
@@ -64,17 +232,51 @@ type dbInfo struct {
 	DateCreated  time.Time
 	LastModified time.Time
 	Public       bool
-	Size         int
+	Starred      bool // Whether the person looking has starred the database
+	Size         int  // In bytes.  Pages show it with formatSize(), and the JSON API gives the number
 	Version      int
+	Latest       int    // The newest version the person looking can see, when older versions are shown
+	SourceURL    string // Where the database is fetched from, if it was added from a URL.  Only set for the owner
+	SHA256       string
+	VersionDate  time.Time       // When the displayed version was uploaded
+	OriginalName string          // The name of the file the displayed version was uploaded from, if it differs
+	TableRows    []tableRowCount // The row count of each table, in the same order as Tables
 }
 
 type metaInfo struct {
+	Avatar       string
 	Protocol     string
 	Server       string
 	Title        string
 	Username     string
 	Database     string
+	Version      int // On pages about a database, the version being shown
 	LoggedInUser string
+	DateFormat   string // The date format and timezone of the logged in user, for formatTime()
+	TimeZone     string
+}
+
+// One page of a listing, along with links to the pages either side of it
+// The ordering and filtering chosen for the database listings on the profile and user pages
+type dbListOptions struct {
+	Sort   string // One of the keys of dbListSorts
+	Dir    string // ASC or DESC
+	Filter string // Only databases with this in their name or description are listed
+}
+
+// One page of a group of a user's databases, as shown on their profile and user pages
+type dbSection struct {
+	DBs   []dbInfo
+	Pager pageInfo
+}
+
+type pageInfo struct {
+	Page       int
+	TotalPages int
+	Total      int
+	Offset     int
+	PrevLink   string
+	NextLink   string
 }
 
 type sqliteDBinfo struct {
@@ -84,17 +286,108 @@ type sqliteDBinfo struct {
 	MinioId  string
 }
 
+// The ordering and search applied to the rows of a table in the table view.  Downloads accept the same parameters,
+// so they can give exactly the rows being looked at
+type rowFilter struct {
+	SortCol string
+	SortDir string
+	Term    string // Rows are kept when one of their text columns contains this
+
+	// The owner's default filter for the table, when it applies to the person looking.  It isn't read from the
+	// request, but added once the table is known
+	Where []whereClause `json:",omitempty"`
+}
+
 type sqliteRecordSet struct {
-	Tablename string
-	ColNames  []string
-	ColCount  int
-	RowCount  int
-	TotalRows int
-	Records   []dataRow
+	Tablename   string
+	ColNames    []string
+	ColCount    int
+	RowCount    int
+	TotalRows   int
+	ApproxCount bool // True when the total row count is an estimate
+	Records     []dataRow
+
+	// The type of each column, in the same order as ColNames
+	ColTypes []columnType `json:",omitempty"`
+
+	// Set when the rows were downsampled to fit a visualisation, with the method used
+	Downsampled  bool
+	SampleMethod string
+
+	// The names of the Y series in each record, which follow the X value
+	Series []string
+
+	// Set when the X values are timestamps.  Rows whose X value couldn't be understood are counted in SkippedRows
+	TemporalX   bool
+	SkippedRows int
+
+	// The column the rows are ordered by, if any, and the direction
+	SortCol string
+	SortDir string
+
+	// When only a window of the table's rows was read, the position of the first one, and the most rows the window
+	// could have held
+	Offset int
+	Limit  int `json:",omitempty"`
+
+	// For virtual tables, the module they use.  Some modules can't be read with a plain SELECT, in which case
+	// ReadError says why instead of the whole page failing
+	Module    string
+	ReadError string
+
+	// For search results, the column each record matched in
+	MatchedCols []string `json:",omitempty"`
+
+	// For the web editor, the columns identifying each row and their values for each record
+	KeyCols []string            `json:",omitempty"`
+	RowKeys []map[string]string `json:",omitempty"`
+
+	// The version of the database the rows were read from
+	Version int
+
+	// The owner's default filter for the table, described for people, and whether it was applied to the rows.  When
+	// it was, HiddenRows is how many rows it hid
+	DefaultFilter string `json:",omitempty"`
+	FilterApplied bool   `json:",omitempty"`
+	HiddenRows    int    `json:",omitempty"`
+
+	// The shape of the response from the table data endpoint, which can return Records in a compact form instead
+	Format string `json:",omitempty"`
+}
+
+// A licence which can be chosen for a database
+type licenceInfo struct {
+	ID   string
+	Name string
+}
+
+// The preferences of a user
+type userPreferences struct {
+	MaxRows        int
+	DefaultPublic  bool
+	DefaultLicence string
+	DateFormat     string
+	TimeZone       string // An IANA timezone name.  Empty means UTC
+}
+
+// The preferences of a user, along with the account details shown on the preferences page
+type userAccount struct {
+	Prefs       userPreferences
+	Email       string
+	LocalAvatar bool // Whether the user uploaded their own avatar, rather than using Gravatar
+}
+
+// Changes to the preferences of a user.  Only the fields which are Valid are updated
+type userPreferenceUpdate struct {
+	MaxRows        pgx.NullInt32
+	DefaultPublic  pgx.NullBool
+	DefaultLicence pgx.NullString
+	DateFormat     pgx.NullString
+	TimeZone       pgx.NullString
 }
 
 type whereClause struct {
 	Column string
 	Type   string
-	Value  string
+	Value  interface{} // A string, or for comparisons with numeric columns an int64 or float64
 }
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	com "github.com/dbhubio/common"
+	"github.com/jackc/pgx"
+)
+
+// Very large databases can be uploaded in chunks, so a dropped connection only loses the chunk being sent.  An
+// upload is started with /x/upload/init, which returns an upload ID.  The chunks are then sent in order to
+// /x/upload/chunk, and /x/upload/complete stores the result as a new database version once its sha256 matches.
+// The chunks are written to a temporary file on the web server, so all of the requests for an upload need to reach
+// the same server
+const (
+	// The largest database which can be uploaded in chunks
+	maxChunkedUploadSize = 16 << 30
+
+	// The largest chunk accepted in one request, and the size clients are told to use
+	maxChunkSize = 32 << 20
+)
+
+// The details given when starting a chunked upload, kept alongside the uploaded data
+type chunkedUpload struct {
+	ID       string
+	Owner    string
+	Database string
+	Public   bool
+	Licence  string
+	Size     int64
+	SHA256   string
+	Started  time.Time
+
+	// Set for uploads from the upload form which are waiting for the user to confirm they're a new version of an
+	// existing database.  Filename is the name of the file they were uploaded from
+	Confirming bool
+	Filename   string
+}
+
+// What storing an upload under a database name would do.  An upload with the name of an existing database adds a
+// new version to it, which isn't what people expect if the file only shares the name by chance, so they're asked to
+// confirm it first
+type uploadTarget struct {
+	Database     string
+	Exists       bool      // Whether there's a database with the name already
+	Latest       int       // The latest version of the existing database
+	LastModified time.Time // When the existing database last changed
+	Identical    bool      // Whether the upload is the same as the latest version, in which case nothing is stored
+}
+
+// The version storing the upload would create
+func (t uploadTarget) NextVersion() int {
+	return t.Latest + 1
+}
+
+// Describes what storing the upload would do, for uploads which need confirming or are turned away
+func (t uploadTarget) Message() string {
+	if t.Identical {
+		return fmt.Sprintf("This is the same as version %d of your existing database '%s', so nothing was stored",
+			t.Latest, t.Database)
+	}
+	return fmt.Sprintf("This will create version %d of your existing database '%s', last modified %s",
+		t.NextVersion(), t.Database, formatTime(t.LastModified, metaInfo{}))
+}
+
+// The response to a chunked upload which needs confirming or was turned away, so clients can show the details
+type uploadConflictResponse struct {
+	Error         string
+	Database      string
+	LatestVersion int
+	LastModified  time.Time
+	Identical     bool
+}
+
+func (t uploadTarget) conflictResponse() uploadConflictResponse {
+	return uploadConflictResponse{t.Message(), t.Database, t.Latest, t.LastModified, t.Identical}
+}
+
+// Works out what storing an upload with the given sha256 as the named database would do
+func getUploadTarget(owner string, dbName string, shaSum string) (t uploadTarget, err error) {
+	t.Database = dbName
+	var latestSha string
+	err = db.QueryRow(`
+		SELECT ver.version, ver.sha256, db.last_modified
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.idnum = ver.db
+			AND db.username = $1
+			AND db.dbname = $2
+		ORDER BY ver.version DESC
+		LIMIT 1`, owner, dbName).Scan(&t.Latest, &latestSha, &t.LastModified)
+	if err == pgx.ErrNoRows {
+		return t, nil
+	}
+	if err != nil {
+		log.Printf("Error checking for an existing database '%s/%s': %v\n", owner, dbName, err)
+		return t, errors.New("Database query failed")
+	}
+	t.Exists = true
+	t.Identical = strings.EqualFold(latestSha, shaSum)
+	return t, nil
+}
+
+// Keeps a database from the upload form on the server while the user confirms it's a new version of an existing
+// database, so they don't need to send it again.  It's kept in the same way as a chunked upload which has finished
+// arriving, so it expires in the same way if they never answer
+func savePendingUpload(owner string, dbName string, filename string, public bool, licence string,
+	data []byte) (chunkedUpload, error) {
+	shaSum := sha256.Sum256(data)
+	u := chunkedUpload{
+		ID:         randomString(16),
+		Owner:      owner,
+		Database:   dbName,
+		Public:     public,
+		Licence:    licence,
+		Size:       int64(len(data)),
+		SHA256:     hex.EncodeToString(shaSum[:]),
+		Started:    time.Now(),
+		Confirming: true,
+		Filename:   filename,
+	}
+	info, err := json.Marshal(u)
+	if err == nil {
+		err = ioutil.WriteFile(u.dataPath(), data, 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(chunkedUploadInfoPath(u.ID), info, 0600)
+	}
+	if err != nil {
+		removeChunkedUpload(u)
+		return u, err
+	}
+	return u, nil
+}
+
+// Chunked uploads being written to by a request right now, so two requests can't write to the same one at once
+var chunkedUploadsBusy = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// Returns the directory the chunked uploads are written to
+func chunkedUploadDir() string {
+	return filepath.Join(tempDir(), "dbhub-uploads")
+}
+
+// Returns the path of the file holding the data received so far for a chunked upload
+func (u chunkedUpload) dataPath() string {
+	return filepath.Join(chunkedUploadDir(), u.ID+".part")
+}
+
+// Returns the path of the file holding the details of a chunked upload
+func chunkedUploadInfoPath(id string) string {
+	return filepath.Join(chunkedUploadDir(), id+".json")
+}
+
+// Returns the number of bytes received so far for a chunked upload
+func (u chunkedUpload) received() (int64, error) {
+	fi, err := os.Stat(u.dataPath())
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Retrieves the details of a chunked upload belonging to the given user.  The returned errors are suitable for
+// showing to the user
+func getChunkedUpload(id string, loggedInUser string) (chunkedUpload, int, error) {
+	var u chunkedUpload
+
+	// Upload IDs are generated by randomString(), so anything else can't be one
+	if len(id) != 16 || strings.Trim(id, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		return u, http.StatusBadRequest, errors.New("Invalid upload ID")
+	}
+	b, err := ioutil.ReadFile(chunkedUploadInfoPath(id))
+	if os.IsNotExist(err) {
+		return u, http.StatusNotFound, errors.New("Unknown upload ID.  The upload may have expired")
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &u)
+	}
+	if err != nil {
+		log.Printf("Error reading the details of chunked upload '%s': %v\n", id, err)
+		return u, http.StatusInternalServerError, errors.New("Internal error")
+	}
+	if u.Owner != loggedInUser {
+		return u, http.StatusNotFound, errors.New("Unknown upload ID.  The upload may have expired")
+	}
+	return u, http.StatusOK, nil
+}
+
+// Marks a chunked upload as in use by the current request, returning false if another request is using it already
+func lockChunkedUpload(id string) bool {
+	chunkedUploadsBusy.Lock()
+	defer chunkedUploadsBusy.Unlock()
+	if chunkedUploadsBusy.ids[id] {
+		return false
+	}
+	chunkedUploadsBusy.ids[id] = true
+	return true
+}
+
+func unlockChunkedUpload(id string) {
+	chunkedUploadsBusy.Lock()
+	delete(chunkedUploadsBusy.ids, id)
+	chunkedUploadsBusy.Unlock()
+}
+
+// Removes the files of a chunked upload
+func removeChunkedUpload(u chunkedUpload) {
+	for _, j := range []string{u.dataPath(), chunkedUploadInfoPath(u.ID)} {
+		err := os.Remove(j)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing chunked upload file '%s': %v\n", j, err)
+		}
+	}
+}
+
+// Starts a chunked upload.  Takes the same form fields as the upload form, with the name, total size, and sha256
+// of the database given instead of the file itself
+func uploadInitHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Chunked upload init handler"
+
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "Uploads need to be started with POST")
+		return
+	}
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		jsonError(w, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Grab and validate the supplied "public" form field
+	public, err := strconv.ParseBool(r.PostFormValue("public"))
+	if err != nil {
+		log.Printf("%s: Error when converting public value to boolean: %v\n", pageName, err)
+		jsonError(w, http.StatusBadRequest, "Public value incorrect")
+		return
+	}
+
+	// The licence only applies to new databases.  Existing ones keep theirs
+	licence := r.PostFormValue("licence")
+	if !isValidLicence(licence) {
+		log.Printf("%s: Unknown licence '%s'\n", pageName, licence)
+		jsonError(w, http.StatusBadRequest, "Unknown licence")
+		return
+	}
+
+	// Validate the database name
+	dbName := r.PostFormValue("name")
+	err = com.ValidateDB(dbName)
+	if err != nil {
+		log.Printf("%s: Validation failed for database name: %s", pageName, err)
+		jsonError(w, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+
+	// The total size and sha256 are checked once all of the chunks have arrived
+	size, err := strconv.ParseInt(r.PostFormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		jsonError(w, http.StatusBadRequest, "Invalid database size")
+		return
+	}
+	if size > maxChunkedUploadSize {
+		jsonError(w, http.StatusBadRequest, fmt.Sprintf("The database is larger than the %d GB limit",
+			maxChunkedUploadSize>>30))
+		return
+	}
+	shaSum := strings.ToLower(r.PostFormValue("sha256"))
+	if b, err := hex.DecodeString(shaSum); err != nil || len(b) != sha256.Size {
+		jsonError(w, http.StatusBadRequest, "Invalid sha256")
+		return
+	}
+
+	// Save the details of the upload, and create the empty file the chunks are added to
+	u := chunkedUpload{
+		ID:       randomString(16),
+		Owner:    loggedInUser,
+		Database: dbName,
+		Public:   public,
+		Licence:  licence,
+		Size:     size,
+		SHA256:   shaSum,
+		Started:  time.Now(),
+	}
+	info, err := json.Marshal(u)
+	if err == nil {
+		err = ioutil.WriteFile(chunkedUploadInfoPath(u.ID), info, 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(u.dataPath(), nil, 0600)
+	}
+	if err != nil {
+		log.Printf("%s: Error creating chunked upload for '%s/%s': %v\n", pageName, loggedInUser, dbName, err)
+		removeChunkedUpload(u)
+		jsonError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	log.Printf("%s: Username: %v, started chunked upload '%v' of database '%v', bytes: %v\n", pageName,
+		loggedInUser, u.ID, dbName, size)
+	writeJSON(w, http.StatusOK, struct {
+		UploadID  string
+		ChunkSize int
+	}{u.ID, maxChunkSize})
+}
+
+// Receives the next chunk of a chunked upload, as the body of a POST request.  The upload ID and offset are given in
+// the query string, as the body is the chunk itself.  The offset gives where the chunk starts, which needs to be
+// where the data received so far ends.  A GET request returns how much has been received, for resuming an upload
+// which was interrupted
+func uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Chunked upload chunk handler"
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		jsonError(w, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	u, httpcode, err := getChunkedUpload(r.URL.Query().Get("id"), loggedInUser)
+	if err != nil {
+		jsonError(w, httpcode, err.Error())
+		return
+	}
+	if !lockChunkedUpload(u.ID) {
+		jsonError(w, http.StatusConflict, "Another chunk of this upload is still being received")
+		return
+	}
+	defer unlockChunkedUpload(u.ID)
+	received, err := u.received()
+	if err != nil {
+		log.Printf("%s: Error checking chunked upload '%s': %v\n", pageName, u.ID, err)
+		jsonError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	type chunkStatus struct {
+		Error    string `json:",omitempty"`
+		Received int64
+		Size     int64
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(w, http.StatusOK, chunkStatus{Received: received, Size: u.Size})
+		return
+	case http.MethodPost:
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "Chunks need to be sent with POST")
+		return
+	}
+
+	// Chunks need to arrive in order.  When they don't, the client is told where to carry on from
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		jsonError(w, http.StatusBadRequest, "Invalid chunk offset")
+		return
+	}
+	if offset != received {
+		writeJSON(w, http.StatusConflict, chunkStatus{
+			Error:    fmt.Sprintf("Expected the chunk starting at byte %d", received),
+			Received: received,
+			Size:     u.Size,
+		})
+		return
+	}
+	if r.ContentLength > maxChunkSize {
+		jsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Chunks can't be larger than %d MB",
+			maxChunkSize>>20))
+		return
+	}
+
+	// Append the chunk to the data received so far.  If the connection drops part way through, the partial chunk is
+	// cut off again so the client can resend it whole
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("%s: Error opening chunked upload '%s': %v\n", pageName, u.ID, err)
+		jsonError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	limit := u.Size - received
+	if limit > maxChunkSize {
+		limit = maxChunkSize
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, limit+1))
+	if err != nil || n > limit {
+		truncErr := f.Truncate(received)
+		f.Close()
+		if truncErr != nil {
+			log.Printf("%s: Error discarding partial chunk of upload '%s': %v\n", pageName, u.ID, truncErr)
+		}
+		if bodyTooLarge(err) {
+			requestTooLarge(w, r, requestBodyLimit(r))
+			return
+		}
+		if err != nil {
+			log.Printf("%s: Error receiving chunk of upload '%s': %v\n", pageName, u.ID, err)
+			jsonError(w, http.StatusBadRequest, "Receiving the chunk failed.  Please send it again")
+			return
+		}
+		jsonError(w, http.StatusRequestEntityTooLarge, "The chunk goes past the end of the database")
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		log.Printf("%s: Error writing chunk of upload '%s': %v\n", pageName, u.ID, err)
+		jsonError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, chunkStatus{Received: received + n, Size: u.Size})
+}
+
+// Finishes a chunked upload.  Once the data received matches the size and sha256 given at the start, it goes
+// through the same checks as a database from the upload form and is stored as a new version
+func uploadCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Chunked upload complete handler"
+
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "Uploads need to be completed with POST")
+		return
+	}
+
+	// Ensure user is logged in
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		jsonError(w, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	u, httpcode, err := getChunkedUpload(r.FormValue("id"), loggedInUser)
+	if err != nil {
+		jsonError(w, httpcode, err.Error())
+		return
+	}
+	if !lockChunkedUpload(u.ID) {
+		jsonError(w, http.StatusConflict, "A chunk of this upload is still being received")
+		return
+	}
+	defer unlockChunkedUpload(u.ID)
+
+	// Make sure everything arrived intact
+	received, err := u.received()
+	if err != nil {
+		log.Printf("%s: Error checking chunked upload '%s': %v\n", pageName, u.ID, err)
+		jsonError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if received != u.Size {
+		jsonError(w, http.StatusBadRequest, fmt.Sprintf("Only %d of %d bytes have been received", received,
+			u.Size))
+		return
+	}
+	shaSum, err := fileSha256(u.dataPath())
+	if err != nil {
+		log.Printf("%s: Error generating sha256 of chunked upload '%s': %v\n", pageName, u.ID, err)
+		jsonError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if shaSum != u.SHA256 {
+		// Something was corrupted along the way.  There's no way to tell which chunk, so it all needs sending again
+		log.Printf("%s: The sha256 of chunked upload '%s' doesn't match.  Expected %s, got %s\n", pageName, u.ID,
+			u.SHA256, shaSum)
+		removeChunkedUpload(u)
+		jsonError(w, http.StatusBadRequest, "The uploaded data doesn't match its sha256.  Please upload it again")
+		return
+	}
+
+	// From here on it's the same as an upload from the form
+	err = sanityCheckSQLite(u.dataPath())
+	if err != nil {
+		log.Printf("%s: The chunked upload for '%s' failed the sanity check\n", pageName, u.Database)
+		removeChunkedUpload(u)
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Adding a version to an existing database needs confirming, by completing the upload again with confirm=true.
+	// The data is kept until then
+	target, err := getUploadTarget(u.Owner, u.Database, shaSum)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if target.Identical {
+		removeChunkedUpload(u)
+		writeJSON(w, http.StatusConflict, target.conflictResponse())
+		return
+	}
+	if target.Exists && r.FormValue("confirm") != "true" {
+		writeJSON(w, http.StatusConflict, target.conflictResponse())
+		return
+	}
+	newVersion, dbSize, minioId, err := addDatabaseVersionFile(u.Owner, u.Database, "/", u.Public, u.dataPath(),
+		u.SHA256, "", u.Owner)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if newVersion == 1 && u.Licence != "" {
+		// The database is stored already, so a failure here isn't worth failing the upload over
+		setDatabaseLicence(u.Owner, u.Database, u.Licence)
+	}
+	meta := recordVersionMeta(u.dataPath(), u.Owner, u.Database, newVersion)
+	removeChunkedUpload(u)
+
+	// Log the successful database upload
+	log.Printf("%s: Username: %v, database '%v' uploaded in chunks as '%v', bytes: %v\n", pageName, u.Owner,
+		u.Database, minioId, dbSize)
+
+	writeJSON(w, http.StatusOK, struct {
+		Database string
+		Version  int
+		Size     int64
+		SHA256   string
+		Tables   []tableRowCount
+		Warnings []nameWarning
+	}{u.Database, newVersion, dbSize, u.SHA256, meta.Tables, meta.NameWarnings})
+}
+
+// Stores, or throws away, an upload from the upload form which was waiting for the user to confirm it's a new
+// version of an existing database
+func uploadConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Upload confirm handler"
+	loggedInUser := currentUser(r)
+
+	if r.Method != http.MethodPost {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Uploads need to be confirmed with POST")
+		return
+	}
+	u, httpcode, err := getChunkedUpload(r.PostFormValue("id"), loggedInUser)
+	if err == nil && !u.Confirming {
+		httpcode, err = http.StatusNotFound, errors.New("Unknown upload ID.  The upload may have expired")
+	}
+	if err != nil {
+		errorPage(w, r, httpcode, err.Error())
+		return
+	}
+	if !lockChunkedUpload(u.ID) {
+		errorPage(w, r, http.StatusConflict, "This upload is already being stored")
+		return
+	}
+	defer unlockChunkedUpload(u.ID)
+
+	if r.PostFormValue("action") != "confirm" {
+		removeChunkedUpload(u)
+		http.Redirect(w, r, "/upload/", http.StatusSeeOther)
+		return
+	}
+
+	// The database may have changed while the user was deciding
+	target, err := getUploadTarget(u.Owner, u.Database, u.SHA256)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if target.Identical {
+		removeChunkedUpload(u)
+		errorPage(w, r, http.StatusConflict, target.Message())
+		return
+	}
+	// The file has been waiting on disk for the user, so it's checked again before being stored
+	err = sanityCheckSQLite(u.dataPath())
+	if err != nil {
+		log.Printf("%s: The pending upload '%s' failed the sanity check: %v\n", pageName, u.ID, err)
+		removeChunkedUpload(u)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	newVersion, dbSize, minioId, err := addDatabaseVersionFile(u.Owner, u.Database, "/", u.Public, u.dataPath(),
+		u.SHA256, "", u.Owner)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if newVersion == 1 && u.Licence != "" {
+		// The database was removed in the meantime, so this is a new one
+		setDatabaseLicence(u.Owner, u.Database, u.Licence)
+	}
+	if u.Filename != u.Database {
+		setOriginalFilename(u.Owner, u.Database, newVersion, u.Filename)
+	}
+
+	// Log the successful database upload
+	log.Printf("%s: Username: %v, database '%v' uploaded after confirmation as '%v', bytes: %v\n", pageName,
+		u.Owner, u.Database, minioId, dbSize)
+	uploadSucceededPage(w, u.Owner, u.Database, newVersion, dbSize, u.SHA256, u.dataPath())
+	removeChunkedUpload(u)
+}
+
+// Periodically removes chunked uploads which haven't had any data sent to them for a while
+func expireChunkedUploads() {
+	for {
+		files, err := ioutil.ReadDir(chunkedUploadDir())
+		if err != nil {
+			log.Printf("Error looking for expired chunked uploads: %v\n", err)
+		}
+
+		// Each upload has two files, so it's only expired once neither has changed for long enough
+		lastChange := make(map[string]time.Time)
+		for _, f := range files {
+			id := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+			if f.ModTime().After(lastChange[id]) {
+				lastChange[id] = f.ModTime()
+			}
+		}
+		cutoff := time.Now().Add(-time.Duration(conf.Web.UploadExpiry) * time.Hour)
+		for id, changed := range lastChange {
+			if changed.After(cutoff) {
+				continue
+			}
+			chunkedUploadsBusy.Lock()
+			busy := chunkedUploadsBusy.ids[id]
+			chunkedUploadsBusy.Unlock()
+			if busy {
+				continue
+			}
+			removeChunkedUpload(chunkedUpload{ID: id})
+			log.Printf("Removed expired chunked upload '%s'\n", id)
+		}
+		time.Sleep(time.Hour)
+	}
+}
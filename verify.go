@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Number of corrupted database objects detected while serving downloads.  Updated atomically
+var corruptObjects uint64
+
+// Progress and results of the most recent "verify all objects" job
+type objectVerification struct {
+	Running    bool
+	Started    time.Time
+	Finished   time.Time
+	Total      int
+	Checked    int
+	Mismatches []string
+}
+
+var (
+	verifyStatus   objectVerification
+	verifyStatusMu sync.Mutex
+)
+
+// Returns a copy of the status of the most recent verification job
+func getVerifyStatus() objectVerification {
+	verifyStatusMu.Lock()
+	defer verifyStatusMu.Unlock()
+	status := verifyStatus
+	status.Mismatches = append([]string(nil), verifyStatus.Mismatches...)
+	return status
+}
+
+// Starts a background job checking the sha256 of every stored database version.  Returns false if a job is already
+// running
+func startObjectVerification() bool {
+	verifyStatusMu.Lock()
+	defer verifyStatusMu.Unlock()
+	if verifyStatus.Running {
+		return false
+	}
+	verifyStatus = objectVerification{Running: true, Started: time.Now()}
+	go verifyAllObjects()
+	return true
+}
+
+// Walks every database version, comparing the sha256 of the object in Minio against the stored value
+func verifyAllObjects() {
+	pageName := "Verify objects"
+
+	type version struct {
+		name   string
+		bucket string
+		id     string
+		sha    string
+	}
+	var versions []version
+	rows, err := db.Query(`
+		SELECT db.username, db.dbname, ver.version, db.minio_bucket, ver.minioid, ver.sha256
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.idnum = ver.db
+		ORDER BY db.username, db.dbname, ver.version`)
+	if err == nil {
+		for rows.Next() {
+			var userName, dbName string
+			var ver int
+			var oneRow version
+			err = rows.Scan(&userName, &dbName, &ver, &oneRow.bucket, &oneRow.id, &oneRow.sha)
+			if err != nil {
+				break
+			}
+			oneRow.name = fmt.Sprintf("%s/%s version %d", userName, dbName, ver)
+			versions = append(versions, oneRow)
+		}
+		rows.Close()
+	}
+	if err != nil {
+		log.Printf("%s: Error retrieving version list: %v\n", pageName, err)
+		verifyStatusMu.Lock()
+		verifyStatus.Running = false
+		verifyStatus.Finished = time.Now()
+		verifyStatus.Mismatches = append(verifyStatus.Mismatches, "Job failed: "+err.Error())
+		verifyStatusMu.Unlock()
+		return
+	}
+	verifyStatusMu.Lock()
+	verifyStatus.Total = len(versions)
+	verifyStatusMu.Unlock()
+
+	for _, ver := range versions {
+		var problem string
+		obj, err := minioClient.GetObject(ver.bucket, ver.id)
+		if err == nil {
+			hasher := sha256.New()
+			_, err = io.Copy(hasher, obj)
+			obj.Close()
+			if err == nil {
+				if sum := hex.EncodeToString(hasher.Sum(nil)); sum != ver.sha {
+					problem = fmt.Sprintf("%s: sha256 mismatch (stored %s, calculated %s)", ver.name, ver.sha,
+						sum)
+				}
+			}
+		}
+		if err != nil {
+			problem = fmt.Sprintf("%s: couldn't be read from Minio: %v", ver.name, err)
+		}
+		if problem != "" {
+			log.Printf("%s: %s\n", pageName, problem)
+		}
+
+		verifyStatusMu.Lock()
+		verifyStatus.Checked++
+		if problem != "" {
+			verifyStatus.Mismatches = append(verifyStatus.Mismatches, problem)
+		}
+		verifyStatusMu.Unlock()
+	}
+
+	verifyStatusMu.Lock()
+	verifyStatus.Running = false
+	verifyStatus.Finished = time.Now()
+	log.Printf("%s: Checked %d objects, %d problems found\n", pageName, verifyStatus.Checked,
+		len(verifyStatus.Mismatches))
+	verifyStatusMu.Unlock()
+}
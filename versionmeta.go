@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+
+	sqlite "github.com/gwenn/gosqlite"
+	"github.com/jackc/pgx"
+)
+
+// Details of a database version which never change, read from the file when it's uploaded so pages can show them
+// without retrieving it from Minio.  Versions uploaded before these were recorded don't have them
+type versionMeta struct {
+	Tables     []tableRowCount
+	SchemaHash string // The sha256 of the schema, for telling whether two versions have the same tables
+
+	// Versions recorded before these were collected don't have them, so they're read when first needed
+	Facts *dbFacts `json:",omitempty"`
+
+	// Names and tables which will be awkward to use on the site, shown to the owner
+	NameWarnings []nameWarning `json:",omitempty"`
+}
+
+// Reads the details of a SQLite database file to record with a new version
+func readVersionMeta(path string) (versionMeta, error) {
+	sdb, err := openImmutableSQLite(path)
+	if err != nil {
+		return versionMeta{}, err
+	}
+	defer sdb.Close()
+	return summariseVersion(sdb)
+}
+
+// Reads the details of an open SQLite database to record with its version.  Virtual tables and their shadow tables
+// are marked as such, and tables which can't be counted, as happens with some virtual tables, are marked Unknown
+// rather than failing the whole lot
+func summariseVersion(sdb *sqlite.Conn) (meta versionMeta, err error) {
+	tables, err := sdb.Tables("")
+	if err != nil {
+		return
+	}
+	vt := readVirtualTables(sdb)
+	for _, t := range tables {
+		count := tableRowCount{Name: t, Module: vt.Modules[t], Internal: vt.IsInternal(t)}
+		count.Rows, err = getSQLiteRowCount(sdb, quoteIdentifier(t))
+		if err != nil {
+			count.Unknown = true
+		}
+		meta.Tables = append(meta.Tables, count)
+	}
+	meta.NameWarnings = checkNames(sdb, tables, vt)
+	facts := readDBFacts(sdb)
+	meta.Facts = &facts
+	meta.SchemaHash, err = schemaHash(sdb)
+	return
+}
+
+// Returns the sha256 of the definitions in a database's schema, in a set order so the same schema always gives the
+// same hash
+func schemaHash(sdb *sqlite.Conn) (string, error) {
+	stmt, err := sdb.Prepare("SELECT type, name, tbl_name, coalesce(sql, '') FROM sqlite_master ORDER BY type, name")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Finalize()
+	h := sha256.New()
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		for i := 0; i < 4; i++ {
+			val, _ := s.ScanText(i)
+			h.Write([]byte(val))
+			h.Write([]byte{0})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Records the details of a database version
+func saveVersionMeta(userName string, dbName string, version int, meta versionMeta) error {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		log.Printf("Error encoding details of '%s/%s' version %d: %v\n", userName, dbName, version, err)
+		return err
+	}
+	_, err = db.Exec(`
+		UPDATE database_versions
+		SET table_meta = $4::jsonb
+		WHERE db = (SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+				AND dbname = $2)
+			AND version = $3`, userName, dbName, version, string(metaJSON))
+	if err != nil {
+		log.Printf("Error saving details of '%s/%s' version %d: %v\n", userName, dbName, version, err)
+	}
+	return err
+}
+
+// Reads the details of a newly uploaded database version from its file, and records them.  The upload has already
+// succeeded by now, so failures are only logged, and the details are read live from the file when needed instead
+func recordVersionMeta(path string, userName string, dbName string, version int) versionMeta {
+	meta, err := readVersionMeta(path)
+	if err != nil {
+		log.Printf("Error reading details of '%s/%s' version %d: %v\n", userName, dbName, version, err)
+		return meta
+	}
+	saveVersionMeta(userName, dbName, version, meta)
+	return meta
+}
+
+// Returns the recorded details of a database version.  False is returned for versions which don't have them, such as
+// those uploaded before they were recorded
+func getVersionMeta(userName string, dbName string, version int) (meta versionMeta, ok bool) {
+	var metaJSON pgx.NullString
+	err := db.QueryRow(`
+		SELECT ver.table_meta::text
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.dbname = $2
+			AND db.idnum = ver.db
+			AND ver.version = $3`, userName, dbName, version).Scan(&metaJSON)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("Error retrieving details of '%s/%s' version %d: %v\n", userName, dbName, version, err)
+		}
+		return
+	}
+	if !metaJSON.Valid {
+		return
+	}
+	err = json.Unmarshal([]byte(metaJSON.String), &meta)
+	if err != nil {
+		log.Printf("Error decoding details of '%s/%s' version %d: %v\n", userName, dbName, version, err)
+		return versionMeta{}, false
+	}
+	return meta, true
+}
@@ -0,0 +1,747 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	com "github.com/dbhubio/common"
+)
+
+// Default size (in pixels) of server side rendered charts
+const (
+	chartWidth  = 800
+	chartHeight = 400
+)
+
+// Colours used for each series in server side rendered charts.  These match the d3 category 10 scheme used by the
+// visualise page
+var chartColours = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f",
+	"#bcbd22", "#17becf"}
+
+// A visualisation series, in the form returned by the JSON export
+type visExportSeries struct {
+	Name   string     `json:"name"`
+	Values []*float64 `json:"values"`
+}
+
+// Returns the names of the Y series in a record set.  When none were named, the second column is used
+func chartSeries(data sqliteRecordSet) []string {
+	if len(data.Series) > 0 {
+		return data.Series
+	}
+	if len(data.ColNames) > 1 {
+		return data.ColNames[1:2]
+	}
+	return nil
+}
+
+// Escapes text for including in an SVG document
+func escapeSVG(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// Formats an axis label, keeping it short
+func formatTick(val float64, temporal bool) string {
+	if temporal {
+		return time.Unix(int64(val), 0).UTC().Format("2006-01-02")
+	}
+	return strconv.FormatFloat(val, 'g', 4, 64)
+}
+
+// Retrieves the visualisation data described by the request parameters, for the handlers which return it in
+// various forms.  If something goes wrong, a JSON error has already been sent when false is returned
+func getVisData(w http.ResponseWriter, r *http.Request, pageName string, userName string, dbName string,
+	requestedTable string) (sqliteRecordSet, bool) {
+	var pageData struct {
+		Meta metaInfo
+		DB   sqliteDBinfo
+		Data sqliteRecordSet
+	}
+	var err error
+
+	// The data is returned in various forms, but problems are always reported as JSON
+	fail := func(status int, msg string) (sqliteRecordSet, bool) {
+		jsonError(w, status, msg)
+		return pageData.Data, false
+	}
+
+	// Check if X and Y column names were given.  There can be several Y columns, each plotted as its own series
+	var reqXCol, xCol string
+	var yCols []string
+	reqXCol = r.FormValue("xcol")
+	reqYCols := r.Form["ycol"]
+	if len(reqYCols) > maxYCols {
+		return fail(http.StatusBadRequest, fmt.Sprintf("No more than %d Y columns can be requested", maxYCols))
+	}
+
+	// Validate column names if present
+	// FIXME: Create a proper validation function for SQLite column names
+	if reqXCol != "" {
+		err = com.ValidatePGTable(reqXCol)
+		if err != nil {
+			return fail(http.StatusBadRequest, "Invalid column name")
+		}
+		xCol = reqXCol
+	}
+	for _, reqYCol := range reqYCols {
+		if reqYCol == "" {
+			continue
+		}
+		err = com.ValidatePGTable(reqYCol)
+		if err != nil {
+			return fail(http.StatusBadRequest, "Invalid column name")
+		}
+		yCols = append(yCols, reqYCol)
+	}
+
+	// Latitude and longitude columns give map points instead, optionally with a label for each
+	geoCols := []string{r.FormValue("lat"), r.FormValue("lon")}
+	if label := r.FormValue("label"); label != "" {
+		geoCols = append(geoCols, label)
+	}
+	if geoCols[0] != "" || geoCols[1] != "" {
+		for _, c := range geoCols {
+			err = com.ValidatePGTable(c)
+			if err != nil {
+				return fail(http.StatusBadRequest, "Invalid column name")
+			}
+		}
+	} else {
+		geoCols = nil
+	}
+
+	// Validate the aggregation values if present.  Rows are grouped by the X column, unless another column was given
+	aggregate := r.FormValue("aggregate")
+	switch aggregate {
+	case "", "count", "sum", "avg", "min", "max":
+	default:
+		return fail(http.StatusBadRequest, "Unknown aggregate function")
+	}
+	groupBy := r.FormValue("groupby")
+	if groupBy != "" {
+		err = com.ValidatePGTable(groupBy)
+		if err != nil {
+			return fail(http.StatusBadRequest, "Invalid column name")
+		}
+	}
+	if aggregate != "" && groupBy == "" {
+		groupBy = xCol
+	}
+	if aggregate != "" && (groupBy == "" || (aggregate != "count" && len(yCols) == 0)) {
+		return fail(http.StatusBadRequest, "The aggregate needs a column to group by, and a Y column to work on")
+	}
+
+	// X values can optionally be interpreted as dates and times
+	xType := r.FormValue("xtype")
+	switch xType {
+	case "", xTypeAuto, xTypeDate, xTypeEpoch:
+	default:
+		return fail(http.StatusBadRequest, "Unknown X axis type")
+	}
+
+	// Large results are downsampled unless raw data was asked for, in which case they're cut off at the limit
+	sampling := r.FormValue("sampling")
+	switch sampling {
+	case "", "raw":
+	default:
+		return fail(http.StatusBadRequest, "Unknown sampling mode")
+	}
+
+	// Validate WHERE clause values if present
+	var reqWCol, reqWType, reqWVal, wCol, wType, wVal string
+	reqWCol = r.FormValue("wherecol")
+	reqWType = r.FormValue("wheretype")
+	reqWVal = r.FormValue("whereval")
+
+	// WHERE column
+	if reqWCol != "" {
+		err = com.ValidatePGTable(reqWCol)
+		if err != nil {
+			return fail(http.StatusBadRequest, "Invalid column name")
+		}
+		wCol = reqWCol
+	}
+
+	// WHERE type
+	switch reqWType {
+	case "":
+		// We don't pass along empty values
+	case "LIKE", "=", "!=", "<", "<=", ">", ">=":
+		wType = reqWType
+	default:
+		return fail(http.StatusBadRequest, "Unknown WHERE clause type")
+	}
+
+	// TODO: Add ORDER BY clause
+	// TODO: We'll probably need some kind of optional data transformation for columns too
+	// TODO    eg column foo → DATE (type)
+
+	// WHERE value
+	var whereClauses []whereClause
+	if reqWVal != "" && wType != "" {
+		whereClauses = append(whereClauses, whereClause{Column: wCol, Type: wType, Value: reqWVal})
+
+		// TODO: Double check if we should be filtering out potentially devious characters here. I don't
+		// TODO  (at the moment) *think* we need to, as we're using parameter binding on the passed in values
+		wVal = reqWVal
+	}
+
+	// Retrieve the logged in user (if any)
+	loggedInUser := currentUser(r)
+
+	// A specific version can be asked for, otherwise the latest one is used
+	version := int64(latestVersion)
+	if r.FormValue("version") != "" {
+		version, err = getVersion(r)
+		if err != nil {
+			return fail(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	// Check if the user has access to the requested database
+	ctx := r.Context()
+	err = checkUserDBVersionAccessCtx(ctx, &pageData.DB, loggedInUser, userName, dbName, version)
+	if clientGone(ctx, pageName) {
+		return pageData.Data, false
+	}
+	if err != nil {
+		return fail(versionErrorStatus(err), err.Error())
+	}
+
+	// * Execution can only get here if the user has access to the requested database *
+
+	// Other people only see the rows the owner's default filter leaves, unless they asked for every row
+	filters, _, err := viewerTableFilters(r, loggedInUser, userName, dbName)
+	if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+
+	// Generate a predictable cache key for the data.  The Y columns are kept in order, as that's the order of
+	// the series.  The version is included so a new upload isn't answered with the data of the one before
+	visParams := "/" + strconv.Itoa(pageData.DB.Info.Version) + "/" + xCol + "/" + strings.Join(yCols, ",") + "/" +
+		wCol + wType + wVal + "/" + sampling + "/" + aggregate + "/" + groupBy + "/" + xType + "/" +
+		strings.Join(geoCols, ",") + "/" + filters.Key()
+	var pageCacheKey string
+	if loggedInUser != userName {
+		tempArr := md5.Sum([]byte(userName + "/" + dbName + "/" + requestedTable + visParams))
+		pageCacheKey = "visrec-pub-" + hex.EncodeToString(tempArr[:])
+	} else {
+		tempArr := md5.Sum([]byte(loggedInUser + "-" + userName + "/" + dbName + "/" + requestedTable + visParams))
+		pageCacheKey = "visrec-" + hex.EncodeToString(tempArr[:])
+	}
+
+	// If a cached version of the data exists, use it
+	ok, err := getCachedData(pageCacheKey, &pageData.Data)
+	if err != nil {
+		log.Printf("%s: Error retrieving page data from cache: %v\n", pageName, err)
+	}
+	if ok {
+		return pageData.Data, true
+	}
+
+	// Get a handle from Minio for the database object
+	db, err := openMinioObjectCtx(ctx, pageData.DB.MinioBkt, pageData.DB.MinioId)
+	if err == errTooManyOpenDBs {
+		w.Header().Set("Retry-After", strconv.Itoa(tempDBRetryAfter))
+		return fail(http.StatusServiceUnavailable, "The server is busy.  Please try again in a moment.")
+	}
+	if err != nil {
+		if clientGone(ctx, pageName) {
+			return pageData.Data, false
+		}
+		return fail(http.StatusInternalServerError, "Database query failed")
+	}
+	defer closeMinioObject(db)
+
+	// Retrieve the list of tables in the database
+	tables, err := db.Tables("")
+	if err != nil {
+		log.Printf("%s: Error retrieving table names: %s", pageName, err)
+		return fail(http.StatusInternalServerError, "Database query failed")
+	}
+	if len(tables) == 0 {
+		// No table names were returned, so abort
+		return fail(http.StatusBadRequest, "The database doesn't have any tables")
+	}
+	pageData.DB.Info.Tables = tables
+
+	// If a specific table was requested, check that it's present
+	var dbTable string
+	if requestedTable != "" {
+		// Check the requested table is present
+		for _, tbl := range tables {
+			if tbl == requestedTable {
+				dbTable = requestedTable
+			}
+		}
+	}
+
+	// If a specific table wasn't requested, use the first table in the database
+	if dbTable == "" {
+		dbTable = pageData.DB.Info.Tables[0]
+	}
+
+	// Check the requested Y and map columns are in the table, and compare numeric columns with numbers
+	if len(yCols) > 0 || len(geoCols) > 0 || len(whereClauses) > 0 {
+		tableCols, err := tableColumns(db, dbTable)
+		if err != nil {
+			log.Printf("%s: Error retrieving columns of table '%s': %v\n", pageName, dbTable, err)
+			return fail(http.StatusInternalServerError, "Database query failed")
+		}
+		err = typeWhereClauses(tableCols, whereClauses)
+		if err != nil {
+			return fail(http.StatusBadRequest, err.Error())
+		}
+		for _, y := range append(append([]string{}, yCols...), geoCols...) {
+			found := false
+			for _, c := range tableCols {
+				if c.Name == y {
+					found = true
+				}
+			}
+			if !found {
+				return fail(http.StatusBadRequest, "Requested column not present in table")
+			}
+		}
+	}
+
+	// The default filter is added after the user's clauses are checked, as its value already suits the column
+	defaultWhere := filters.Clauses(db, dbTable)
+	whereClauses = append(whereClauses, defaultWhere...)
+
+	// Retrieve the table data requested by the user
+	maxVals := 2500 // 2500 row maximum for now
+	xyCols := append([]string{xCol}, yCols...)
+	sctx, cancel := sqliteContext(ctx)
+	defer cancel()
+	switch {
+	case geoCols != nil && sampling == "raw":
+		pageData.Data, err = readSQLiteDBColsCtx(sctx, db, requestedTable, true, false, maxVals, whereClauses,
+			geoCols...)
+	case geoCols != nil:
+		// Map points are never averaged together, as that would put them in places which aren't in the data
+		pageData.Data, err = readSQLiteDBColsSampled(sctx, db, requestedTable, true, false, maxVals, sampleEveryNth,
+			whereClauses, geoCols...)
+	case aggregate != "":
+		pageData.Data, err = readSQLiteAggregate(sctx, db, requestedTable, aggregate, groupBy, yCols, whereClauses,
+			maxVals)
+	case sampling == "raw" && xCol != "" && len(yCols) > 0:
+		pageData.Data, err = readSQLiteDBColsCtx(sctx, db, requestedTable, true, true, maxVals, whereClauses,
+			xyCols...)
+	case sampling == "raw":
+		pageData.Data, err = readSQLiteDBColsCtx(sctx, db, requestedTable, false, false, maxVals, defaultWhere, "*")
+	case xCol != "" && len(yCols) > 0:
+		pageData.Data, err = readSQLiteDBColsSampled(sctx, db, requestedTable, true, true, maxVals, "",
+			whereClauses, xyCols...)
+	default:
+		pageData.Data, err = readSQLiteDBColsSampled(sctx, db, requestedTable, false, false, maxVals, "",
+			defaultWhere, "*")
+	}
+	if clientGone(ctx, pageName) {
+		return pageData.Data, false
+	}
+	if err == errNonNumericColumn {
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	if err == errQueryTooLong {
+		return fail(http.StatusGatewayTimeout, err.Error())
+	}
+	if err != nil {
+		// Some kind of error when reading the database data
+		return fail(http.StatusBadRequest, err.Error())
+	}
+
+	// Name each of the series being returned
+	if aggregate != "" && len(pageData.Data.ColNames) > 1 {
+		pageData.Data.Series = pageData.Data.ColNames[1:]
+	} else {
+		pageData.Data.Series = yCols
+	}
+
+	// Convert the X values to timestamps if asked
+	if xType != "" && geoCols == nil {
+		convertTimeAxis(&pageData.Data, xType)
+	}
+
+	// Cache the data
+	pageData.Data.Version = pageData.DB.Info.Version
+	err = cacheData(pageCacheKey, pageData.Data, cacheTime)
+	if err != nil {
+		log.Printf("%s: Error when caching visualisation data: %v\n", pageName, err)
+	}
+	return pageData.Data, true
+}
+
+// Renders a simple line or bar chart of a record set as SVG.  The first column is the X axis, and each series is
+// drawn in its own colour.  When the X values aren't numbers or timestamps, a bar chart is always drawn
+func renderChartSVG(data sqliteRecordSet, chartType string, width int, height int) []byte {
+	series := chartSeries(data)
+	marginLeft, marginRight, marginTop, marginBottom := 60.0, 20.0, 20.0, 40.0
+	if len(series) > 1 {
+		marginTop = 40
+	}
+	plotWidth := float64(width) - marginLeft - marginRight
+	plotHeight := float64(height) - marginTop - marginBottom
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" `+
+		`font-family="sans-serif" font-size="11">`+"\n", width, height, width, height)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="white"/>`+"\n", width, height)
+	if len(data.Records) == 0 || len(series) == 0 {
+		fmt.Fprintf(&buf, `<text x="%d" y="%d" text-anchor="middle">No data</text>`+"\n", width/2, height/2)
+		buf.WriteString("</svg>\n")
+		return buf.Bytes()
+	}
+
+	// Work out the X values, falling back to categories when they aren't numeric
+	numeric := true
+	xVals := make([]float64, len(data.Records))
+	for i, row := range data.Records {
+		var err error
+		if data.TemporalX {
+			var ts time.Time
+			ts, err = time.Parse(time.RFC3339Nano, row[0].Value)
+			xVals[i] = float64(ts.Unix())
+		} else {
+			xVals[i], err = strconv.ParseFloat(row[0].Value, 64)
+		}
+		if err != nil {
+			numeric = false
+			break
+		}
+	}
+	if !numeric {
+		chartType = "bar"
+	}
+
+	// Gather the Y values, and the range they cover.  Missing or non numeric values leave gaps
+	yVals := make([][]*float64, len(series))
+	yMin, yMax := math.Inf(1), math.Inf(-1)
+	for s := range series {
+		yVals[s] = make([]*float64, len(data.Records))
+		for i, row := range data.Records {
+			if s+1 >= len(row) {
+				continue
+			}
+			v, err := strconv.ParseFloat(row[s+1].Value, 64)
+			if err != nil {
+				continue
+			}
+			yVals[s][i] = &v
+			yMin = math.Min(yMin, v)
+			yMax = math.Max(yMax, v)
+		}
+	}
+	if math.IsInf(yMin, 1) {
+		yMin, yMax = 0, 1
+	}
+	if chartType == "bar" && yMin > 0 {
+		yMin = 0
+	}
+	if yMax == yMin {
+		yMin--
+		yMax++
+	}
+	yPos := func(v float64) float64 {
+		return marginTop + plotHeight - (v-yMin)/(yMax-yMin)*plotHeight
+	}
+
+	// Axes, with evenly spaced ticks on the Y axis
+	fmt.Fprintf(&buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="black"/>`+"\n", marginLeft,
+		marginTop, marginLeft, marginTop+plotHeight)
+	fmt.Fprintf(&buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="black"/>`+"\n", marginLeft,
+		marginTop+plotHeight, marginLeft+plotWidth, marginTop+plotHeight)
+	for i := 0; i <= 5; i++ {
+		v := yMin + (yMax-yMin)*float64(i)/5
+		fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" text-anchor="end" dominant-baseline="middle">%s</text>`+"\n",
+			marginLeft-5, yPos(v), escapeSVG(formatTick(v, false)))
+	}
+
+	if chartType == "bar" {
+		// Each X value gets a band, shared between the series
+		band := plotWidth / float64(len(data.Records))
+		barWidth := band * 0.8 / float64(len(series))
+		labelEvery := (len(data.Records) + 9) / 10
+		base := yPos(math.Max(yMin, 0))
+		for i, row := range data.Records {
+			for s := range series {
+				if yVals[s][i] == nil {
+					continue
+				}
+				y := yPos(*yVals[s][i])
+				top, h := math.Min(y, base), math.Abs(base-y)
+				fmt.Fprintf(&buf, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n",
+					marginLeft+band*float64(i)+band*0.1+barWidth*float64(s), top, barWidth, h,
+					chartColours[s%len(chartColours)])
+			}
+			if i%labelEvery == 0 {
+				label := row[0].Value
+				if data.TemporalX && numeric {
+					label = formatTick(xVals[i], true)
+				}
+				fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n",
+					marginLeft+band*(float64(i)+0.5), marginTop+plotHeight+15, escapeSVG(label))
+			}
+		}
+	} else {
+		// Scale the X axis to the data, with evenly spaced ticks
+		xMin, xMax := xVals[0], xVals[0]
+		for _, x := range xVals {
+			xMin = math.Min(xMin, x)
+			xMax = math.Max(xMax, x)
+		}
+		if xMax == xMin {
+			xMin--
+			xMax++
+		}
+		xPos := func(v float64) float64 {
+			return marginLeft + (v-xMin)/(xMax-xMin)*plotWidth
+		}
+		for i := 0; i <= 5; i++ {
+			v := xMin + (xMax-xMin)*float64(i)/5
+			fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n", xPos(v),
+				marginTop+plotHeight+15, escapeSVG(formatTick(v, data.TemporalX)))
+		}
+
+		// The points are joined in order of X
+		order := make([]int, len(xVals))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return xVals[order[a]] < xVals[order[b]]
+		})
+		for s := range series {
+			var points []string
+			for _, i := range order {
+				if yVals[s][i] != nil {
+					points = append(points, fmt.Sprintf("%.1f,%.1f", xPos(xVals[i]), yPos(*yVals[s][i])))
+				}
+			}
+			fmt.Fprintf(&buf, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`+"\n",
+				strings.Join(points, " "), chartColours[s%len(chartColours)])
+		}
+	}
+
+	// Name the series when there's more than one
+	if len(series) > 1 {
+		x := marginLeft
+		for s, name := range series {
+			fmt.Fprintf(&buf, `<rect x="%.1f" y="10" width="10" height="10" fill="%s"/>`+"\n", x,
+				chartColours[s%len(chartColours)])
+			fmt.Fprintf(&buf, `<text x="%.1f" y="19">%s</text>`+"\n", x+14, escapeSVG(name))
+			x += 14 + float64(len(name))*7 + 20
+		}
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
+
+// Returns a visualisation as an SVG chart, for embedding in places without JavaScript.  This accepts the same
+// parameters as visData(), plus "type" (line or bar) and optional "width" and "height"
+func visChartHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Visualisation chart handler"
+
+	// Retrieve user, database, and table name
+	userName, dbName, requestedTable, err := getUDT(2, r) // 2 = Ignore "/x/vischart.svg/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Validate the chart options
+	chartType := r.FormValue("type")
+	switch chartType {
+	case "":
+		chartType = "line"
+	case "line", "bar":
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown chart type")
+		return
+	}
+	width, height := chartWidth, chartHeight
+	if r.FormValue("width") != "" {
+		val, err := strconv.Atoi(r.FormValue("width"))
+		if err != nil || val < 100 || val > 4000 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid chart width")
+			return
+		}
+		width = val
+	}
+	if r.FormValue("height") != "" {
+		val, err := strconv.Atoi(r.FormValue("height"))
+		if err != nil || val < 100 || val > 4000 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid chart height")
+			return
+		}
+		height = val
+	}
+
+	data, ok := getVisData(w, r, pageName, userName, dbName, requestedTable)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	_, err = w.Write(renderChartSVG(data, chartType, width, height))
+	if err != nil {
+		log.Printf("%s: Error returning chart: %v\n", pageName, err)
+	}
+}
+
+// Returns the data behind a visualisation as a file, after any aggregation or downsampling.  This accepts the same
+// parameters as visData(), plus "format" which is csv (the default), json, or geojson for map points
+func visExportHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Visualisation export handler"
+
+	// Retrieve user, database, and table name
+	userName, dbName, requestedTable, err := getUDT(2, r) // 2 = Ignore "/x/visexport/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "json", "geojson":
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown export format")
+		return
+	}
+
+	if format == "geojson" && (r.FormValue("lat") == "" || r.FormValue("lon") == "") {
+		errorPage(w, r, http.StatusBadRequest, "GeoJSON exports need latitude and longitude columns")
+		return
+	}
+
+	data, ok := getVisData(w, r, pageName, userName, dbName, requestedTable)
+	if !ok {
+		return
+	}
+	fileName := strings.TrimSuffix(dbName, ".sqlite") + "-" + data.Tablename + "." + format
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fileName))
+
+	// Map points are in GeoJSON, for loading into GIS tools
+	if format == "geojson" {
+		w.Header().Set("Content-Type", "application/geo+json")
+		err = json.NewEncoder(w).Encode(recordsToGeoJSON(data))
+		if err != nil {
+			log.Printf("%s: Error returning GeoJSON data: %v\n", pageName, err)
+		}
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", contentTypeCSV)
+		csvFile := csv.NewWriter(w)
+		err = csvFile.Write(data.ColNames)
+		for _, row := range data.Records {
+			if err != nil {
+				break
+			}
+			var vals []string
+			for _, v := range row {
+				vals = append(vals, v.Value)
+			}
+			err = csvFile.Write(vals)
+		}
+		csvFile.Flush()
+		if err == nil {
+			err = csvFile.Error()
+		}
+		if err != nil {
+			log.Printf("%s: Error returning CSV data: %v\n", pageName, err)
+		}
+		return
+	}
+
+	// The JSON export has the X values and each series as separate arrays, as most plotting tools expect
+	var export struct {
+		Table        string            `json:"table"`
+		XColumn      string            `json:"x_column"`
+		TemporalX    bool              `json:"temporal_x"`
+		Downsampled  bool              `json:"downsampled"`
+		SampleMethod string            `json:"sample_method,omitempty"`
+		TotalRows    int               `json:"total_rows"`
+		SkippedRows  int               `json:"skipped_rows"`
+		X            []string          `json:"x"`
+		Series       []visExportSeries `json:"series"`
+	}
+	export.Table = data.Tablename
+	if len(data.ColNames) > 0 {
+		export.XColumn = data.ColNames[0]
+	}
+	export.TemporalX = data.TemporalX
+	export.Downsampled = data.Downsampled
+	export.SampleMethod = data.SampleMethod
+	export.TotalRows = data.TotalRows
+	export.SkippedRows = data.SkippedRows
+	export.X = []string{}
+	export.Series = []visExportSeries{}
+	for s, name := range chartSeries(data) {
+		series := visExportSeries{Name: name, Values: []*float64{}}
+		for _, row := range data.Records {
+			var val *float64
+			if s+1 < len(row) {
+				if v, err := strconv.ParseFloat(row[s+1].Value, 64); err == nil {
+					val = &v
+				}
+			}
+			series.Values = append(series.Values, val)
+		}
+		export.Series = append(export.Series, series)
+	}
+	for _, row := range data.Records {
+		if len(row) > 0 {
+			export.X = append(export.X, row[0].Value)
+		} else {
+			export.X = append(export.X, "")
+		}
+	}
+	writeJSON(w, http.StatusOK, export)
+}
+
+// Converts the values of WHERE clauses on numeric columns into numbers, so they're compared as numbers rather than
+// as text ("9" sorts after "10") and the column's indexes can be used.  Columns without a declared type can hold
+// anything, so their values are only converted when they look like numbers.  LIKE always compares text, so its
+// values are left alone
+func typeWhereClauses(cols []columnInfo, clauses []whereClause) error {
+	affinity := make(map[string]string)
+	for _, c := range cols {
+		affinity[c.Name] = affinityClass(c.DataType)
+	}
+	for i, w := range clauses {
+		val, ok := w.Value.(string)
+		class, found := affinity[w.Column]
+		if !ok || !found || w.Type == "LIKE" {
+			continue
+		}
+		switch class {
+		case "integer", "real", "null":
+			s := strings.TrimSpace(val)
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil && class != "real" {
+				clauses[i].Value = n
+			} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+				clauses[i].Value = f
+			} else if class != "null" {
+				return fmt.Errorf("The value to compare column '%s' with needs to be a number", w.Column)
+			}
+		}
+	}
+	return nil
+}
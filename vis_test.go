@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// A table with a column of each affinity, along with one without a declared type which can hold anything
+var affinityFixture = []string{
+	"CREATE TABLE m (i INTEGER, r REAL, d DECIMAL(10,2), s TEXT, v VARCHAR(20), b BLOB, x)",
+	"INSERT INTO m VALUES (9, 9.5, 9, '9', '9', x'09', 9)",
+	"INSERT INTO m VALUES (10, 10.5, 10, '10', '10', x'10', 10)",
+	"INSERT INTO m VALUES (11, 11.5, 11, '11', '11', x'11', 'eleven')",
+}
+
+func TestTypeWhereClauses(t *testing.T) {
+	sdb := openTestSQLite(t, "affinity.sqlite", affinityFixture...)
+	defer sdb.Close()
+	cols, err := tableColumns(sdb, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		column string
+		op     string
+		value  string
+		want   interface{} // The value to bind, or nil when the clause is refused
+	}{
+		{"i", ">", "10", int64(10)},
+		{"i", "=", " 7 ", int64(7)},
+		{"i", ">", "2.5", 2.5},
+		{"i", ">", "ten", nil},
+		{"i", "LIKE", "1%", "1%"},
+		{"r", ">", "3", 3.0},
+		{"r", "<", "x", nil},
+		{"d", ">=", "1.5", 1.5},
+		{"s", ">", "10", "10"},
+		{"v", "=", "9", "9"},
+		{"b", "=", "9", "9"},
+		{"x", ">", "10", int64(10)},
+		{"x", "=", "eleven", "eleven"},
+		{"missing", ">", "10", "10"},
+	}
+	for _, tt := range tests {
+		clauses := []whereClause{{Column: tt.column, Type: tt.op, Value: tt.value}}
+		err := typeWhereClauses(cols, clauses)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s %s '%s': expected an error, got the value %#v", tt.column, tt.op, tt.value,
+					clauses[0].Value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s '%s': %v", tt.column, tt.op, tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(clauses[0].Value, tt.want) {
+			t.Errorf("%s %s '%s': expected %#v, got %#v", tt.column, tt.op, tt.value, tt.want, clauses[0].Value)
+		}
+	}
+}
+
+func TestTypedWhereClauseRows(t *testing.T) {
+	sdb := openTestSQLite(t, "affinityrows.sqlite", affinityFixture...)
+	defer sdb.Close()
+	cols, err := tableColumns(sdb, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compared as text, "9" sorts after "10".  Without a declared type, text would only match the rows holding text
+	tests := []struct {
+		column string
+		value  string
+		rows   []string // The values of i in the matching rows
+	}{
+		{"i", "9", []string{"10", "11"}},
+		{"r", "9.5", []string{"10", "11"}},
+		{"s", "9", nil},
+		{"x", "9", []string{"10", "11"}},
+	}
+	for _, tt := range tests {
+		clauses := []whereClause{{Column: tt.column, Type: ">", Value: tt.value}}
+		if err = typeWhereClauses(cols, clauses); err != nil {
+			t.Fatal(err)
+		}
+		data, err := readSQLiteDBWindowCtx(context.Background(), sdb, "m", 10, 0, "i", "ASC", []string{"i"}, clauses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows []string
+		for _, r := range data.Records {
+			rows = append(rows, r[0].Value)
+		}
+		if !reflect.DeepEqual(rows, tt.rows) {
+			t.Errorf("%s > %s: expected rows %v, got %v", tt.column, tt.value, tt.rows, rows)
+		}
+	}
+}
+
+func TestVisDataRejectsNonNumericValue(t *testing.T) {
+	requireBackends(t)
+	owner := testUserName("visowner")
+	addTestUser(t, owner)
+	addTestDatabase(t, owner, "affinity.sqlite", true, affinityFixture...)
+
+	tests := []struct {
+		value  string
+		status int
+	}{
+		{"10", http.StatusOK},
+		{"ten", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		q := url.Values{"table": {"m"}, "xcol": {"i"}, "ycol": {"r"}, "wherecol": {"i"}, "wheretype": {">"},
+			"whereval": {tt.value}}
+		w := apiRequest(http.MethodGet, "visdata/"+owner+"/affinity.sqlite?"+q.Encode(), nil, "")
+		if w.Code != tt.status {
+			t.Errorf("'%s': expected status %d, got %d: %s", tt.value, tt.status, w.Code, w.Body.String())
+			continue
+		}
+		if tt.status == http.StatusBadRequest {
+			if msg := apiErrorMessage(t, w); msg != "The value to compare column 'i' with needs to be a number" {
+				t.Errorf("Unexpected error message: %s", msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	com "github.com/dbhubio/common"
+)
+
+// The version of the visualisation profile format written by exports.  It only needs increasing when a change would
+// make older servers read a profile wrongly, as fields they don't know about are ignored anyway
+const visProfileSchema = 1
+
+// The largest visualisation profile accepted for importing
+const maxVisProfileSize = 64 << 10
+
+// A user's visualisation settings for a database, in the form they're exported and imported as
+type visProfile struct {
+	Schema    int      `json:"schema"`
+	Table     string   `json:"table"`
+	XCol      string   `json:"x_column"`
+	YCols     []string `json:"y_columns"`
+	Aggregate string   `json:"aggregate,omitempty"`
+	Lat       string   `json:"latitude_column,omitempty"`
+	Lon       string   `json:"longitude_column,omitempty"`
+	Label     string   `json:"label_column,omitempty"`
+}
+
+// Returns the visualisation settings the logged in user last used for a database, as a JSON document for importing
+// into another database with visProfileImportHandler()
+func visProfileExportHandler(w http.ResponseWriter, r *http.Request) {
+	loggedInUser := currentUser(r)
+
+	// Retrieve user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/visprofile/" at the start of the URL
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Check the user can still see the database
+	var dbInfo sqliteDBinfo
+	err = checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+	if err != nil {
+		jsonError(w, versionErrorStatus(err), err.Error())
+		return
+	}
+
+	vis := getDBState(loggedInUser, userName, dbName).Vis
+	if vis.Table == "" || vis.XCol == "" {
+		jsonError(w, http.StatusNotFound, "There are no saved visualisation settings for this database")
+		return
+	}
+	profile := visProfile{Schema: visProfileSchema, Table: vis.Table, XCol: vis.XCol, YCols: vis.YCols,
+		Aggregate: vis.Aggregate, Lat: vis.Lat, Lon: vis.Lon, Label: vis.Label}
+	if profile.YCols == nil {
+		profile.YCols = []string{}
+	}
+	fileName := strings.TrimSuffix(dbName, ".sqlite") + "-visualisation.json"
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fileName))
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// Imports a visualisation profile from visProfileExportHandler() as the logged in user's settings for a database.
+// The table and columns it names are checked against the latest version of the database.  Columns which can't be
+// found are left out and listed in the response, so the user knows what to fix up by hand.  If the table itself
+// can't be found, nothing is saved
+func visProfileImportHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Visualisation profile import"
+
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "Profiles need to be sent with POST")
+		return
+	}
+
+	// The settings are saved for the user doing the import, so anonymous visitors have nowhere to put them
+	loggedInUser := currentUser(r)
+	if loggedInUser == "" {
+		jsonError(w, http.StatusUnauthorized, "You need to be logged in to import visualisation settings")
+		return
+	}
+
+	// Retrieve user and database name
+	userName, dbName, err := getUD(2, r) // 2 = Ignore "/x/visimport/" at the start of the URL
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Settings can only be saved on databases the user can see
+	var dbInfo sqliteDBinfo
+	err = checkUserDBAccess(&dbInfo, loggedInUser, userName, dbName)
+	if err != nil {
+		jsonError(w, http.StatusForbidden,
+			fmt.Sprintf("You can't save visualisation settings on '%s/%s'", userName, dbName))
+		return
+	}
+
+	// Decode and validate the profile
+	var profile visProfile
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVisProfileSize)).Decode(&profile)
+	if bodyTooLarge(err) {
+		jsonError(w, http.StatusRequestEntityTooLarge, tooLargeMessage(maxVisProfileSize))
+		return
+	}
+	if err != nil {
+		log.Printf("%s: Error decoding profile: %v\n", pageName, err)
+		jsonError(w, http.StatusBadRequest, "The file isn't a visualisation profile")
+		return
+	}
+	if profile.Schema < 1 {
+		jsonError(w, http.StatusBadRequest, "The file isn't a visualisation profile")
+		return
+	}
+	if profile.Schema > visProfileSchema {
+		jsonError(w, http.StatusBadRequest, fmt.Sprintf(
+			"The profile is in a newer format (version %d) than this server understands", profile.Schema))
+		return
+	}
+	if len(profile.YCols) > maxYCols {
+		jsonError(w, http.StatusBadRequest, "Too many Y columns")
+		return
+	}
+	switch profile.Aggregate {
+	case "", "count", "sum", "avg", "min", "max":
+	default:
+		jsonError(w, http.StatusBadRequest, "Invalid aggregate")
+		return
+	}
+	names := []string{profile.Table, profile.XCol}
+	for _, name := range append([]string{profile.Lat, profile.Lon, profile.Label}, profile.YCols...) {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		err = com.ValidatePGTable(name)
+		if err != nil {
+			log.Printf("%s: Validation failed for name: %s", pageName, err)
+			jsonError(w, http.StatusBadRequest, "Invalid table or column name")
+			return
+		}
+	}
+
+	// Check the names against the database
+	sdb, err := openMinioObject(dbInfo.MinioBkt, dbInfo.MinioId)
+	if err == errTooManyOpenDBs {
+		serverBusy(w, r)
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer closeMinioObject(sdb)
+	tables, err := sdb.Tables("")
+	if err != nil {
+		log.Printf("%s: Error retrieving table names: %v\n", pageName, err)
+		jsonError(w, http.StatusInternalServerError, "Error reading from the database")
+		return
+	}
+	var response struct {
+		Profile    visProfile
+		Unresolved []string
+	}
+	table, ok := matchTableName(tables, profile.Table)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, struct {
+			Error      string
+			Unresolved []string
+		}{fmt.Sprintf("The database doesn't have a table called '%s'", profile.Table),
+			[]string{fmt.Sprintf("table '%s'", profile.Table)}})
+		return
+	}
+	cols, err := tableColumns(sdb, table)
+	if err != nil {
+		log.Printf("%s: Error retrieving columns of '%s': %v\n", pageName, table, err)
+		jsonError(w, http.StatusInternalServerError, tableReadError(table, err))
+		return
+	}
+	var colNames []string
+	for _, c := range cols {
+		colNames = append(colNames, c.Name)
+	}
+
+	// Column names are matched the same way as table names, so a profile from a database which differs only in
+	// the case of its names still imports cleanly
+	resolve := func(kind string, name string) string {
+		if name == "" {
+			return ""
+		}
+		match, ok := matchTableName(colNames, name)
+		if !ok {
+			response.Unresolved = append(response.Unresolved, fmt.Sprintf("%s column '%s'", kind, name))
+			return ""
+		}
+		return match
+	}
+	vis := visState{
+		Table:     table,
+		XCol:      resolve("X", profile.XCol),
+		Aggregate: profile.Aggregate,
+		Lat:       resolve("latitude", profile.Lat),
+		Lon:       resolve("longitude", profile.Lon),
+		Label:     resolve("label", profile.Label),
+	}
+	for _, y := range profile.YCols {
+		if col := resolve("Y", y); col != "" {
+			vis.YCols = append(vis.YCols, col)
+		}
+	}
+
+	// A map needs both of its coordinates
+	if vis.Lat == "" || vis.Lon == "" {
+		vis.Lat, vis.Lon, vis.Label = "", "", ""
+	}
+
+	state := getDBState(loggedInUser, userName, dbName)
+	state.Vis = vis
+	err = saveDBState(loggedInUser, userName, dbName, state)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	response.Profile = visProfile{Schema: visProfileSchema, Table: vis.Table, XCol: vis.XCol, YCols: vis.YCols,
+		Aggregate: vis.Aggregate, Lat: vis.Lat, Lon: vis.Lon, Label: vis.Label}
+	if response.Unresolved == nil {
+		response.Unresolved = []string{}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Matches the module name in a CREATE VIRTUAL TABLE statement
+var vtableModuleRE = regexp.MustCompile(`(?i)\bUSING\s+["\x60\[]?(\w+)`)
+
+// The suffixes of the shadow tables which virtual table modules keep their data in.  eg an FTS5 table "docs" stores
+// its index in "docs_data", "docs_idx", and so on
+var shadowTableSuffixes = map[string][]string{
+	"fts3":      {"content", "segments", "segdir", "docsize", "stat"},
+	"fts4":      {"content", "segments", "segdir", "docsize", "stat"},
+	"fts5":      {"data", "idx", "content", "docsize", "config"},
+	"rtree":     {"node", "parent", "rowid"},
+	"geopoly":   {"node", "parent", "rowid"},
+	"rtree_i32": {"node", "parent", "rowid"},
+}
+
+// The virtual tables in a database, and the shadow tables which belong to them
+type vtableInfo struct {
+	Modules map[string]string // Virtual table name to the module it uses
+	Shadow  map[string]bool
+}
+
+// Returns true if the table is only there to hold the data of a virtual table
+func (v vtableInfo) IsInternal(dbTable string) bool {
+	return v.Shadow[dbTable]
+}
+
+// Returns the names of the tables which aren't internal to a virtual table, keeping their order
+func (v vtableInfo) VisibleTables(tables []string) []string {
+	var visible []string
+	for _, t := range tables {
+		if !v.Shadow[t] {
+			visible = append(visible, t)
+		}
+	}
+	return visible
+}
+
+// Finds the virtual tables in a database from sqlite_master, along with their shadow tables.  On error an empty
+// set is returned, so everything is treated as a normal table
+func readVirtualTables(db *sqlite.Conn) (v vtableInfo) {
+	v.Modules = make(map[string]string)
+	v.Shadow = make(map[string]bool)
+	stmt, err := db.Prepare(`SELECT name, sql FROM sqlite_master WHERE type = 'table' AND sql LIKE 'CREATE VIRTUAL%'`)
+	if err != nil {
+		log.Printf("Error when looking for virtual tables: %v\n", err)
+		return
+	}
+	defer stmt.Finalize()
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		var name, def string
+		if err := s.Scan(&name, &def); err != nil {
+			return err
+		}
+		module := "unknown"
+		if m := vtableModuleRE.FindStringSubmatch(def); m != nil {
+			module = strings.ToLower(m[1])
+		}
+		v.Modules[name] = module
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error when looking for virtual tables: %v\n", err)
+		return
+	}
+	for name, module := range v.Modules {
+		for _, suffix := range shadowTableSuffixes[module] {
+			v.Shadow[name+"_"+suffix] = true
+		}
+	}
+	return
+}
+
+// The message shown in place of the rows of a virtual table which can't be read
+func virtualTableReadError(module string) string {
+	return fmt.Sprintf("This is a virtual table using the '%s' module, which can't be displayed", module)
+}
+
+// Returns the message shown in place of a table's rows when reading it fails, such as when it's malformed or is a
+// view of a table which isn't there
+func tableReadError(dbTable string, err error) string {
+	if err == errQueryTooLong {
+		return err.Error()
+	}
+	return fmt.Sprintf("Error reading data from table '%s'.  Possibly malformed?", dbTable)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+const (
+	// The most rows an Excel worksheet can have, including the header row
+	xlsxMaxRows = 1048576
+
+	// Excel doesn't allow sheet names longer than this
+	xlsxMaxSheetName = 31
+
+	xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// Namespaces and content types used in the workbook parts
+const (
+	xlsxPackageNS   = "http://schemas.openxmlformats.org/package/2006/"
+	xlsxRelNS       = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	xlsxSpreadsheet = "application/vnd.openxmlformats-officedocument.spreadsheetml."
+	xlsxXMLHeader   = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+)
+
+// The fixed parts of a workbook holding a single worksheet
+var xlsxStaticParts = []struct {
+	Name    string
+	Content string
+}{
+	{"[Content_Types].xml", xlsxXMLHeader +
+		`<Types xmlns="` + xlsxPackageNS + `content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="` + xlsxSpreadsheet + `sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="` + xlsxSpreadsheet + `worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xlsxXMLHeader +
+		`<Relationships xmlns="` + xlsxPackageNS + `relationships">` +
+		`<Relationship Id="rId1" Type="` + xlsxRelNS + `/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", xlsxXMLHeader +
+		`<Relationships xmlns="` + xlsxPackageNS + `relationships">` +
+		`<Relationship Id="rId1" Type="` + xlsxRelNS + `/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// A single cell value for a worksheet.  Empty cells are left out of the sheet
+type xlsxCell struct {
+	Value   string
+	Numeric bool
+	Empty   bool
+}
+
+// Writes a single sheet Excel workbook, streaming the rows out as they're given rather than holding the whole
+// sheet in memory
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	row   int
+}
+
+// Starts a new workbook, with a sheet of the given name
+func newXLSXWriter(w io.Writer, sheetName string) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxStaticParts {
+		f, err := zw.Create(part.Name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(f, part.Content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := zw.Create("xl/workbook.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(f, xlsxXMLHeader+
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="%s">`+
+		`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`, xlsxRelNS,
+		xmlEscape(xlsxSheetName(sheetName)))
+	if err != nil {
+		return nil, err
+	}
+
+	// The worksheet is written last, so its rows can be streamed straight into the zip file
+	f, err = zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x := &xlsxWriter{zw: zw, sheet: bufio.NewWriter(f)}
+	_, err = x.sheet.WriteString(xlsxXMLHeader +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Adds a row to the end of the sheet
+func (x *xlsxWriter) WriteRow(cells []xlsxCell) error {
+	if x.row >= xlsxMaxRows {
+		return fmt.Errorf("Excel sheets can't have more than %d rows", xlsxMaxRows)
+	}
+	x.row++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.row)
+	for i, c := range cells {
+		if c.Empty {
+			continue
+		}
+		ref := xlsxColumnName(i) + strconv.Itoa(x.row)
+		if c.Numeric {
+			fmt.Fprintf(x.sheet, `<c r="%s"><v>%s</v></c>`, ref, c.Value)
+		} else {
+			fmt.Fprintf(x.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref,
+				xmlEscape(c.Value))
+		}
+	}
+	_, err := x.sheet.WriteString("</row>")
+	return err
+}
+
+// Finishes the sheet and the workbook.  The underlying writer isn't closed
+func (x *xlsxWriter) Close() error {
+	_, err := x.sheet.WriteString("</sheetData></worksheet>")
+	if err != nil {
+		return err
+	}
+	err = x.sheet.Flush()
+	if err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+// Returns the letters Excel uses for a (zero based) column number.  eg 0 is A, 26 is AA
+func xlsxColumnName(n int) string {
+	name := ""
+	for n++; n > 0; n = (n - 1) / 26 {
+		name = string(rune('A'+(n-1)%26)) + name
+	}
+	return name
+}
+
+// Returns a table name changed to suit Excel's rules for sheet names
+func xlsxSheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`:\/?*[]`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, "'")
+	if r := []rune(name); len(r) > xlsxMaxSheetName {
+		name = string(r[:xlsxMaxSheetName])
+	}
+	if name == "" {
+		name = "Sheet1"
+	}
+	return name
+}
+
+// Escapes text for use in XML.  Characters XML doesn't allow are replaced
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Writes the rows of a SQLite table out as an Excel workbook, with the column names as the first row.  Integers and
+// floating point values are written as numbers, so Excel doesn't treat them as text.  If columns are given only
+// those are written, and if maxRows is above zero no more than that many rows are written
+func writeSQLiteTableXLSX(w io.Writer, db *sqlite.Conn, dbTable string, cols []string, filter rowFilter,
+	maxRows int) error {
+	dbQuery, args, err := tableExportQuery(db, dbTable, cols, filter, maxRows)
+	if err != nil {
+		return err
+	}
+	stmt, err := db.Prepare(dbQuery, args...)
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+
+	x, err := newXLSXWriter(w, dbTable)
+	if err != nil {
+		return err
+	}
+	var header []xlsxCell
+	for _, name := range stmt.ColumnNames() {
+		header = append(header, xlsxCell{Value: name})
+	}
+	err = x.WriteRow(header)
+	if err != nil {
+		return err
+	}
+
+	fieldCount := -1
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		if fieldCount == -1 {
+			fieldCount = stmt.DataCount()
+		}
+		row := make([]xlsxCell, fieldCount)
+		for i := 0; i < fieldCount; i++ {
+			switch stmt.ColumnType(i) {
+			case sqlite.Integer:
+				val, isNull, err := s.ScanInt64(i)
+				if err != nil {
+					return err
+				}
+				row[i] = xlsxCell{Value: strconv.FormatInt(val, 10), Numeric: true, Empty: isNull}
+			case sqlite.Float:
+				val, isNull, err := s.ScanDouble(i)
+				if err != nil {
+					return err
+				}
+				// Excel has no way to store infinity or NaN as numbers
+				numeric := !math.IsInf(val, 0) && !math.IsNaN(val)
+				row[i] = xlsxCell{Value: strconv.FormatFloat(val, 'g', -1, 64), Numeric: numeric, Empty: isNull}
+			case sqlite.Text:
+				val, isNull := s.ScanText(i)
+				row[i] = xlsxCell{Value: val, Empty: isNull}
+			case sqlite.Blob:
+				val, isNull := s.ScanBlob(i)
+				row[i] = xlsxCell{Value: base64.StdEncoding.EncodeToString(val), Empty: isNull}
+			default:
+				row[i] = xlsxCell{Empty: true}
+			}
+		}
+		return x.WriteRow(row)
+	})
+	if err != nil {
+		return err
+	}
+	return x.Close()
+}